@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const acksFile = "acks.json"
+
+// Acknowledgement marks an error message of an integration as seen, with a
+// free-text note for teammates. Acks are kept as history and listed in the
+// next digest of the integration.
+type Acknowledgement struct {
+	Fingerprint   string    `json:"fingerprint"`
+	IntegrationID int       `json:"integrationId"`
+	Error         string    `json:"error"`
+	Note          string    `json:"note"`
+	By            string    `json:"by"`
+	At            time.Time `json:"at"`
+}
+
+type ackStore struct {
+	mu   sync.Mutex
+	acks []Acknowledgement
+}
+
+var acks = loadAcks()
+
+// errorFingerprint identifies an error message of an integration across
+// occurrences.
+func errorFingerprint(integrationID int, message string) string {
+	sum := sha1.Sum([]byte(strconv.Itoa(integrationID) + "\x00" + message))
+	return hex.EncodeToString(sum[:6])
+}
+
+func loadAcks() *ackStore {
+	a := &ackStore{}
+	if _, err := loadState(acksFile, &a.acks); err != nil {
+		log.Printf("Error loading acknowledgements: %v\n", err)
+	}
+	return a
+}
+
+func (a *ackStore) reload() {
+	var acks []Acknowledgement
+	if _, err := loadState(acksFile, &acks); err != nil {
+		log.Printf("Error reloading acknowledgements: %v\n", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks = acks
+}
+
+func (a *ackStore) add(ack Acknowledgement) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.acks = append(a.acks, ack)
+	if err := saveState(acksFile, a.acks); err != nil {
+		log.Printf("Error saving acknowledgements: %v\n", err)
+	}
+}
+
+// latest returns the most recent acknowledgement for fingerprint.
+func (a *ackStore) latest(fingerprint string) (Acknowledgement, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := len(a.acks) - 1; i >= 0; i-- {
+		if a.acks[i].Fingerprint == fingerprint {
+			return a.acks[i], true
+		}
+	}
+	return Acknowledgement{}, false
+}
+
+// since returns the acknowledgements for integrationID made after t, oldest
+// first.
+func (a *ackStore) since(integrationID int, t time.Time) []Acknowledgement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var out []Acknowledgement
+	for _, ack := range a.acks {
+		if ack.IntegrationID == integrationID && ack.At.After(t) {
+			out = append(out, ack)
+		}
+	}
+	return out
+}
+
+func (a *ackStore) all() []Acknowledgement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := append([]Acknowledgement(nil), a.acks...)
+	sort.Slice(out, func(i, j int) bool { return out[i].At.After(out[j].At) })
+	return out
+}
+
+// recentError is an alerted error as shown on the dashboard.
+type recentError struct {
+	Fingerprint   string
+	IntegrationID int
+	Error         string
+	Timestamp     string
+}
+
+// recentErrorLog keeps the last alerted errors in memory for the dashboard.
+type recentErrorLog struct {
+	mu      sync.Mutex
+	limit   int
+	entries []recentError
+}
+
+var alertedErrors = &recentErrorLog{limit: 200}
+
+func (r *recentErrorLog) add(integrationID int, errors []ErrorLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range errors {
+		r.entries = append(r.entries, recentError{
+			Fingerprint:   errorFingerprint(integrationID, e.Error),
+			IntegrationID: integrationID,
+			Error:         e.Error,
+			Timestamp:     e.Timestamp,
+		})
+	}
+	if over := len(r.entries) - r.limit; over > 0 {
+		r.entries = append([]recentError(nil), r.entries[over:]...)
+	}
+}
+
+// list returns the recent errors, newest first.
+func (r *recentErrorLog) list() []recentError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]recentError, len(r.entries))
+	for i, e := range r.entries {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
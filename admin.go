@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// shutdownRequests asks main for the same graceful shutdown as SIGTERM.
+var shutdownRequests = make(chan struct{}, 1)
+
+// reloadableKeys are the settings a reload applies. Everything else is read
+// once at startup, so changing it is reported as needing a restart.
+var reloadableKeys = map[string]bool{
+	"messageTemplate":     true,
+	"messageTemplateFile": true,
+	"templates":           true,
+	"routingFile":         true,
+}
+
+type reloadResult struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restartRequired,omitempty"`
+}
+
+// reloadConfig re-reads config.yaml and applies what can be changed on a
+// running instance. A file that doesn't parse, or a template or routing rule
+// that fails on a sample alert, leaves everything untouched.
+func reloadConfig() (reloadResult, error) {
+	fresh, err := readConfig()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	tmpl, err := parseAlertTemplate(fresh)
+	if err == nil {
+		err = validateAlertTemplate(tmpl)
+	}
+	if err != nil {
+		return reloadResult{}, err
+	}
+	notifierTmpls, err := parseNotifierTemplates(fresh)
+	if err == nil {
+		err = validateNotifierTemplates(notifierTmpls)
+	}
+	if err != nil {
+		return reloadResult{}, fmt.Errorf("templates: %v", err)
+	}
+	rules, err := parseRoutingFile(fresh.String("routingFile", ""))
+	if err == nil {
+		err = validateRoutingRules(rules)
+	}
+	if err != nil {
+		return reloadResult{}, err
+	}
+	setAlertTemplate(tmpl)
+	setNotifierTemplates(notifierTmpls)
+	setRoutingRules(rules)
+	watchFiles(fresh)
+
+	result := reloadResult{Reloaded: []string{"messageTemplate", "templates", "routingFile"}}
+	keys := make(map[string]bool)
+	for key := range fresh {
+		keys[key] = true
+	}
+	for key := range conf {
+		keys[key] = true
+	}
+	for key := range keys {
+		if !reloadableKeys[key] && !reflect.DeepEqual(conf[key], fresh[key]) {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+	sort.Strings(result.RestartRequired)
+	return result, nil
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	result, err := reloadConfig()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the running config: %v\n", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Println("Config reloaded.")
+	if len(result.RestartRequired) > 0 {
+		log.Printf("Changes to %v only apply after a restart.\n", result.RestartRequired)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func handleTriggerPoll(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if role.isStandby() {
+		http.Error(w, "instance is on standby, promote it first", http.StatusConflict)
+		return
+	}
+	select {
+	case pollRequests <- struct{}{}:
+	default:
+		// A poll is already pending.
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "poll requested"})
+}
+
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	select {
+	case shutdownRequests <- struct{}{}:
+	default:
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"status": fmt.Sprintf("draining, shutting down within %s", shutdownGracePeriod),
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With apiToken set, /api/ requests need an "Authorization: Bearer <token>"
+// header. The health, metrics and version endpoints and the dashboard stay
+// open for probes and scrapers, but the dashboard's acknowledge form posts to
+// /api/acks, so it asks for the token and sends it as the token form field.
+var apiToken = conf.String("apiToken", "")
+
+func requireAPIToken(next http.Handler) http.Handler {
+	if apiToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			token, ok := requestToken(r)
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sefi-alarm"`)
+				http.Error(w, "missing or invalid API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestToken returns the bearer token of r, or for a form post from the
+// dashboard its token field.
+func requestToken(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return strings.CutPrefix(header, "Bearer ")
+	}
+	if r.Method == http.MethodPost {
+		if token := r.PostFormValue("token"); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// dashboardCSRF is the token the dashboard puts in its forms, so a page of
+// another site can't post them for a browser that reaches the API. It
+// changes on every start.
+var dashboardCSRF = newCSRFToken()
+
+func newCSRFToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// checkFormOrigin rejects a post made from another site, by its Origin or
+// Sec-Fetch-Site header, and a post without an Authorization header that
+// doesn't carry the dashboard's CSRF token. It reports whether r may go on.
+func checkFormOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(dashboardCSRF)) != 1 {
+		http.Error(w, "missing or invalid CSRF token, reload the dashboard or send an Authorization header", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// sameOrigin reports whether r comes from a page of the API itself, or from
+// a client that isn't a browser.
+func sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	return site == "" || site == "same-origin" || site == "none"
+}
+
+// warnOpenAPI logs when the admin endpoints are reachable from other hosts
+// without a token.
+func warnOpenAPI() {
+	if apiToken != "" || localOnly(apiListen) {
+		return
+	}
+	log.Printf("The local API on %s takes admin requests without a token, set apiToken to require one.\n", apiListen)
+}
+
+// localOnly reports whether address can only be reached from this host.
+func localOnly(address string) bool {
+	if strings.HasPrefix(address, "unix:") {
+		return true
+	}
+	host, _, _ := strings.Cut(address, ":")
+	return host == "127.0.0.1" || host == "localhost" || host == "[::1]"
+}
+
+// IntegrationStatus is what the admin API reports about one integration.
+type IntegrationStatus struct {
+	IntegrationID int        `json:"integrationId"`
+	Name          string     `json:"name,omitempty"`
+	Type          string     `json:"type,omitempty"`
+	State         string     `json:"state,omitempty"`
+	LastPollAt    *time.Time `json:"lastPollAt,omitempty"`
+	LastPollError string     `json:"lastPollError,omitempty"`
+	LastNewErrors int        `json:"lastNewErrors"`
+	LastAlertAt   *time.Time `json:"lastAlertAt,omitempty"`
+	AlertState    string     `json:"alertState,omitempty"`
+	Digest        bool       `json:"digest"`
+	SilencedUntil *time.Time `json:"silencedUntil,omitempty"`
+	OpenTicket    bool       `json:"openTicket"`
+}
+
+// pollTracker remembers the latest poll and alert of each integration.
+type pollTracker struct {
+	mu           sync.Mutex
+	integrations map[int]*IntegrationStatus
+}
+
+var polls = &pollTracker{integrations: make(map[int]*IntegrationStatus)}
+
+func (p *pollTracker) getLocked(integrationID int) *IntegrationStatus {
+	s, ok := p.integrations[integrationID]
+	if !ok {
+		s = &IntegrationStatus{IntegrationID: integrationID}
+		p.integrations[integrationID] = s
+	}
+	return s
+}
+
+func (p *pollTracker) succeeded(integrationID, newErrors int, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.getLocked(integrationID)
+	s.LastPollAt = &at
+	s.LastPollError = ""
+	s.LastNewErrors = newErrors
+}
+
+// lastPolled returns when integrationID was last polled successfully.
+func (p *pollTracker) lastPolled(integrationID int) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.integrations[integrationID]
+	if !ok || s.LastPollAt == nil {
+		return time.Time{}, false
+	}
+	return *s.LastPollAt, true
+}
+
+func (p *pollTracker) failed(integrationID int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.getLocked(integrationID).LastPollError = err.Error()
+}
+
+func (p *pollTracker) alerted(integrationID int, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.getLocked(integrationID).LastAlertAt = &at
+}
+
+// list reports every monitored integration, by ID.
+func (p *pollTracker) list(now time.Time) []IntegrationStatus {
+	p.mu.Lock()
+	var ids []int
+	for _, id := range monitored.current() {
+		ids = appendUnique(ids, id)
+	}
+	for id := range p.integrations {
+		ids = appendUnique(ids, id)
+	}
+	out := make([]IntegrationStatus, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, *p.getLocked(id))
+	}
+	p.mu.Unlock()
+
+	for i := range out {
+		s := &out[i]
+		if in, ok := integrationMeta.get(s.IntegrationID); ok {
+			s.Name, s.Type, s.State = in.Name, in.Type, integrationState(in)
+		}
+		s.AlertState = alertStates.state(s.IntegrationID)
+		s.Digest = digestMode(s.IntegrationID)
+		if silence, ok := silences.active(s.IntegrationID, now); ok {
+			until := silence.Until
+			s.SilencedUntil = &until
+		}
+		s.OpenTicket = tickets.hasOpen(notifierGitHub, s.IntegrationID)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IntegrationID < out[j].IntegrationID })
+	return out
+}
+
+func handleAlertStates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, alertStates.list())
+}
+
+func handleIntegrations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, polls.list(time.Now().UTC()))
+}
+
+// handleAlerts lists the notifications sent recently, newest first, from the
+// history store.
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	since := 24 * time.Hour
+	if s := r.URL.Query().Get("since"); s != "" {
+		d, err := parseSince(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = d
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := history.notifications(time.Now().UTC().Add(-since), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
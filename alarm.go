@@ -1,234 +1,721 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/jcotoBan/SEFI-Alarm/filter"
+	"github.com/jcotoBan/SEFI-Alarm/notify"
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
 )
 
 var (
 	conf            = loadConfig()
-	bearerToken     = conf["bearerToken"].(string)
-	integrationID   = fmt.Sprintf("%d", conf["integrationId"].(int))
-	tenantID        = fmt.Sprintf("%d", conf["tenantId"].(int))
-	endpointURL     = setRegionUrl(conf["region"].(string)) + integrationID + "/" + tenantID
-	checkInterval   = time.Duration((conf["pollIntervalSecs"].(int))) * time.Second
-	slackWebhookURL = conf["slackWebhookUrl"].(string)
-	integrationURL  = setIntegrationUrl(conf["region"].(string))
+	bearerToken     = conf.String("bearerToken", "")
+	integrationID   = fmt.Sprintf("%d", conf.Int("integrationId", 0))
+	tenantID        = fmt.Sprintf("%d", conf.Int("tenantId", 0))
+	region          = conf.String("region", "")
+	checkInterval   = time.Duration(conf.Int("pollIntervalSecs", 0)) * time.Second
+	slackWebhookURL = conf.String("slackWebhookUrl", "")
+	integrationURL  = setIntegrationUrl(region)
+
+	// Errors are fetched sysdig.pageSize at a time, up to sysdig.maxPages
+	// pages per poll.
+	sysdigClient = &sysdig.Client{
+		HTTPClient: httpClient,
+		APIBase:    lookupRegion(region).APIBase,
+		Token:      bearerToken,
+		TenantID:   conf.Int("tenantId", 0),
+		PageSize:   conf.Int("sysdig.pageSize", sysdig.DefaultPageSize),
+		MaxPages:   conf.Int("sysdig.maxPages", sysdig.DefaultMaxPages),
+		FetchPage:  fetchErrorsPage,
+	}
+
+	shutdownGracePeriod = time.Duration(conf.Int("shutdownGracePeriodSecs", 10)) * time.Second
 )
 
-type Payload struct {
-	CustomerID    int        `json:"customerId"`
-	IntegrationID int        `json:"integrationId"`
-	Count         int        `json:"count"`
-	Errors        []ErrorLog `json:"errors"`
+// The Sysdig and Slack types come from the sysdig and notify packages,
+// which other tools can import on their own.
+type (
+	Payload  = sysdig.Payload
+	ErrorLog = sysdig.ErrorLog
+
+	SlackMessage = notify.SlackMessage
+	SlackBlock   = notify.SlackBlock
+	SlackText    = notify.SlackText
+	SlackElement = notify.SlackElement
+	SlackFile    = notify.SlackFile
+)
+
+func errorsURL(integrationID int) string {
+	return sysdigClient.ErrorsURL(integrationID)
 }
 
-type ErrorLog struct {
-	Error     string `json:"error"`
-	Timestamp string `json:"timestamp"`
+// With sysdig.timeFilter, for an errors endpoint taking from and to, polls
+// only ask for the errors since the last poll of the integration, with some
+// overlap for errors recorded late, and never for more than the minute new
+// errors are looked for in.
+var sysdigTimeFilter = conf.Bool("sysdig.timeFilter", false)
+
+const timeFilterOverlap = 15 * time.Second
+
+// sysdig.clockSkewSecs is how far ahead of the local clock an error may be
+// timestamped and still count as new, for when the clock of the API runs
+// ahead. Errors further ahead are skipped, and logged.
+var clockSkew = time.Duration(conf.Int("sysdig.clockSkewSecs", 0)) * time.Second
+
+// pollQuery is the query of a poll of integrationID at now.
+func pollQuery(integrationID int, now time.Time) sysdig.ErrorsQuery {
+	if !sysdigTimeFilter {
+		return sysdig.ErrorsQuery{}
+	}
+	from := now.Add(-1 * time.Minute)
+	if last, ok := polls.lastPolled(integrationID); ok && last.Add(-timeFilterOverlap).After(from) {
+		from = last.Add(-timeFilterOverlap)
+	}
+	return sysdig.ErrorsQuery{From: from}
 }
 
-type SlackMessage struct {
-	Text string `json:"text"`
+// pollEndpoint fetches every page of the errors of an integration matching
+// query.
+func pollEndpoint(ctx context.Context, integrationID int, query sysdig.ErrorsQuery) (*Payload, error) {
+	payload, err := sysdigClient.Errors(ctx, integrationID, query)
+	if errors.Is(err, sysdig.ErrTooManyPages) {
+		log.Printf("Integration %d has more errors than %d pages hold, raise sysdig.maxPages to see them all; processing the first %d errors only.\n",
+			integrationID, sysdigClient.MaxPages, len(payload.Errors))
+		return payload, nil
+	}
+	return payload, err
 }
 
-func setRegionUrl(region string) string {
+// fetchErrorsPage sends the request for a page of errors, bounding and
+// archiving the response.
+func fetchErrorsPage(req *http.Request) (*Payload, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data: %v", err)
+	}
+	defer resp.Body.Close()
 
-	baseurlus1 := "https://secure.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurlus2 := "https://us2.app.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurlus4 := "https://app.us4.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurleu1 := "https://eu1.app.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurlau1 := "https://app.au1.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurlme2 := "https://app.me2.sysdig.com/api/v1/eventsForwarding/errors/"
-	baseurlin1 := "https://app.in1.sysdig.com/api/v1/eventsForwarding/errors/"
+	if resp.StatusCode != http.StatusOK {
+		return nil, sysdigAPIError(resp)
+	}
 
-	switch region {
+	body, truncated, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if truncated {
+		truncatedResponsesTotal.inc()
+		if !partialResponses {
+			return nil, fmt.Errorf("response body is larger than %d MB, raise http.maxResponseMB or set http.partialResponses: true", maxResponseBytes>>20)
+		}
+		payload, err := decodePartialPayload(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse truncated response: %v", err)
+		}
+		log.Printf("Response body is larger than %d MB, processing the first %d errors only.\n", maxResponseBytes>>20, len(payload.Errors))
+		return payload, nil
+	}
 
-	case "us1":
-		return baseurlus1
-	case "us2":
-		return baseurlus2
-	case "us4":
-		return baseurlus4
-	case "eu1":
-		return baseurleu1
-	case "au1":
-		return baseurlau1
-	case "me2":
-		return baseurlme2
-	case "in1":
-		return baseurlin1
-	default:
-		return baseurlus1
+	archivePayload(time.Now().UTC(), body)
 
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
 	}
+
+	return &payload, nil
 }
 
-func setIntegrationUrl(region string) string {
+func sendSlackNotification(ctx context.Context, message SlackMessage) error {
+	if slackBotMode() {
+		_, err := postSlackMessage(ctx, message)
+		return err
+	}
 
-	baseurlus1 := "https://secure.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurlus2 := "https://us2.app.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurlus4 := "https://app.us4.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurleu1 := "https://eu1.app.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurlau1 := "https://app.au1.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurlme2 := "https://app.me2.sysdig.com/secure/#/settings/events-forwarding/"
-	baseurlin1 := "https://app.in1.sysdig.com/secure/#/settings/events-forwarding/"
+	// Incoming webhooks are bound to a single channel and can't thread.
+	message.Channel, message.ThreadTS, message.TS = "", "", ""
+	message.Metadata = nil
+	return postSlackWebhook(ctx, message)
+}
 
-	switch region {
+func postSlackWebhook(ctx context.Context, payload interface{}) error {
+	return slackClient.PostWebhook(ctx, payload)
+}
 
-	case "us1":
-		return baseurlus1
-	case "us2":
-		return baseurlus2
-	case "us4":
-		return baseurlus4
-	case "eu1":
-		return baseurleu1
-	case "au1":
-		return baseurlau1
-	case "me2":
-		return baseurlme2
-	case "in1":
-		return baseurlin1
-	default:
-		return baseurlus1
+// postDeclaredWebhook posts message to the webhook of a notifier resource,
+// see operator.go, which like any incoming webhook can't thread.
+func postDeclaredWebhook(ctx context.Context, webhook string, message SlackMessage) error {
+	client := *slackClient
+	client.WebhookURL = webhook
+	message.Channel, message.ThreadTS, message.TS = "", "", ""
+	message.Metadata = nil
+	return client.PostWebhook(ctx, message)
+}
 
+func createSlackMessage(errors []ErrorLog, payload *Payload, integrationUrl string) SlackMessage {
+	// A template failing on a real alert is rolled back to the one it
+	// replaced, down to the built-in layout.
+	for tmpl := currentAlertTemplate(); tmpl != nil; {
+		text, err := renderTemplate(tmpl, newTemplateData(errors, payload, integrationUrl))
+		if err == nil {
+			return SlackMessage{Channel: routedChannel(errors, payload), Text: text}
+		}
+		tmpl = rollbackAlertTemplate(tmpl)
+		if tmpl != nil {
+			log.Printf("Error rendering message template, rolled back to the previous template: %v\n", err)
+		} else {
+			log.Printf("Error rendering message template, using the default layout: %v\n", err)
+		}
 	}
-}
 
-func loadConfig() map[string]interface{} {
+	link := integrationUrl + fmt.Sprintf("%d", payload.IntegrationID)
+	title := "Events forwarding errors on integration " + integrationLabel(payload.IntegrationID)
 
-	obj := make(map[string]interface{})
+	errorLines, more := errorListing(errors)
+	var moreText, moreMrkdwn string
+	if more > 0 {
+		moreText, moreMrkdwn = overflowNote(more, payload.IntegrationID)
+		moreText += "\n"
+	}
 
-	data, err := os.ReadFile("config.yaml")
-	if err != nil {
-		panic(err)
+	text := title + "\n" + errorLines + moreText + "\n" + "You can check the integration in the following link: " + link
+	blocks := []SlackBlock{
+		{
+			Type: "header",
+			Text: &SlackText{Type: "plain_text", Text: title},
+		},
 	}
 
-	err = yaml.Unmarshal(data, &obj)
-	if err != nil {
-		panic(err)
+	// Mentions only notify people when they appear in a text or section
+	// block; header blocks are plain text.
+	if mentions := routedMentions(errors, payload); len(mentions) > 0 {
+		text = mentionText(mentions) + " " + text
+		blocks = append(blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: mentionText(mentions)},
+		})
 	}
 
-	configMap := obj["config"].(map[string]interface{})
+	category := dominantCategory(errors)
+	severity := alertSeverity(errors, payload)
+	text += "\nSeverity: " + severity
+	fields := []SlackText{
+		{Type: "mrkdwn", Text: "*Severity*\n" + severity},
+		{Type: "mrkdwn", Text: "*Tenant*\n" + tenantID},
+		{Type: "mrkdwn", Text: "*Region*\n" + region},
+		{Type: "mrkdwn", Text: "*Recent errors*\n" + formatCount(int64(len(errors)))},
+		{Type: "mrkdwn", Text: "*Total errors*\n" + formatCount(int64(payload.Count))},
+		{Type: "mrkdwn", Text: "*Category*\n" + category},
+	}
+	if sampled := samplingNote(payload.IntegrationID); sampled != "" {
+		text += "\nSampled: " + sampled
+		fields = append(fields, SlackText{Type: "mrkdwn", Text: "*Sampled*\n" + sampled})
+	}
+	if team := ownerTeam(payload.IntegrationID); team != "" {
+		text += "\nOwner: " + team
+		fields = append(fields, SlackText{Type: "mrkdwn", Text: "*Owner*\n" + team})
+	}
+	if in, ok := integrationMeta.get(payload.IntegrationID); ok {
+		if in.Type != "" {
+			fields = append(fields, SlackText{Type: "mrkdwn", Text: "*Type*\n" + in.Type})
+		}
+		if state := integrationState(in); state != "" {
+			fields = append(fields, SlackText{Type: "mrkdwn", Text: "*State*\n" + state})
+		}
+	}
+	blocks = append(blocks,
+		SlackBlock{
+			Type:   "section",
+			Fields: fields,
+		},
+	)
+	blocks = append(blocks, SlackBlock{
+		Type: "section",
+		Text: &SlackText{Type: "mrkdwn", Text: "```\n" + errorLines + "```"},
+	})
+	if more > 0 {
+		blocks = append(blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: moreMrkdwn},
+		})
+	}
+	if pattern := failurePattern(payload.Errors); pattern != "" {
+		text += "\nPattern: " + pattern
+		blocks = append(blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: "*Pattern:* " + pattern},
+		})
+	}
+	if hint := remediationHint(category); hint != "" {
+		text += "\nHint: " + hint
+		blocks = append(blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: "*Hint:* " + hint},
+		})
+	}
+	if footer, ok := podFooter(); ok {
+		blocks = append(blocks, footer)
+	}
 
-	return (configMap)
+	return SlackMessage{
+		Channel: routedChannel(errors, payload),
+		// Text is only shown in notifications and clients that can't render blocks.
+		Text: text,
+		Blocks: append(blocks,
+			SlackBlock{
+				Type: "actions",
+				Elements: []SlackElement{
+					{
+						Type: "button",
+						Text: &SlackText{Type: "plain_text", Text: "Open integration"},
+						URL:  link,
+					},
+				},
+			},
+		),
+	}
 }
 
-func pollEndpoint() (*Payload, error) {
-	client := &http.Client{}
+// createTicketDraft is the ticket opened for errors on the issue trackers.
+func createTicketDraft(errors []ErrorLog, payload *Payload, integrationUrl string) TicketDraft {
+	body := fmt.Sprintf("SEFI-Alarm detected %d new events forwarding errors on integration %s (tenant %s, region %s).\n\n```\n",
+		len(errors), integrationLabel(payload.IntegrationID), tenantID, region)
+	for _, err := range errors {
+		body += formatErrorTime(err.Timestamp) + " " + err.Error + "\n"
+	}
+	body += "```\n\nIntegration: " + integrationUrl + fmt.Sprintf("%d", payload.IntegrationID)
+	if pattern := failurePattern(payload.Errors); pattern != "" {
+		body += "\n\nPattern: " + pattern
+	}
+	if hint := remediationHint(dominantCategory(errors)); hint != "" {
+		body += "\n\nHint: " + hint
+	}
+	body += "\n\nSeverity: " + alertSeverity(errors, payload)
+	if team := ownerTeam(payload.IntegrationID); team != "" {
+		body += "\n\nOwner: " + team
+	}
+	if pod.detected() {
+		body += "\n\nSent by pod " + pod.String() + "."
+	}
 
-	req, err := http.NewRequest("GET", endpointURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+	draft := TicketDraft{
+		Title: "Events forwarding errors on integration " + integrationLabel(payload.IntegrationID),
+		Body:  body,
+	}
+	templates := currentNotifierTemplates()
+	data := newTemplateData(errors, payload, integrationUrl)
+	if title, ok := renderNotifierTemplate(templates.ticketTitle, false, data); ok {
+		draft.Title = strings.TrimSpace(title)
+	}
+	if body, ok := renderNotifierTemplate(templates.ticketBody, true, data); ok {
+		draft.Body = body
 	}
+	return draft
+}
 
-	req.Header.Set("Authorization", "Bearer "+bearerToken)
+// pollRequests asks the poll loop for an immediate poll.
+var pollRequests = make(chan struct{}, 1)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data: %v", err)
+// pollLoop polls on a fixed ticker, so failed polls wait for the next tick
+// just like successful ones instead of retrying in a hot loop.
+func pollLoop(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		pollOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-pollRequests:
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+// notifyNewErrors queues the notifications for new errors of an integration,
+// or adds them to its digest.
+func notifyNewErrors(ctx context.Context, recentErrors []ErrorLog, payload *Payload, now time.Time) {
+	ctx, span := startSpan(ctx, "notify", spanKindInternal)
+	defer span.finish(nil)
+	trace := traceparent(ctx)
+	enqueue := func(n *Notification) {
+		n.Trace = trace
+		notifications.enqueue(n)
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+	if alertStateEnabled {
+		if recentErrors = alertStates.observe(payload.IntegrationID, recentErrors, now); len(recentErrors) == 0 {
+			span.set("deduplicated", true)
+			return
+		}
+	}
+	severity := alertSeverity(recentErrors, payload)
+	span.set("severity", severity)
+	if severities.notifies(severity, notifierEvents) {
+		if n := correlations.alert(recentErrors, payload, now); n != nil {
+			enqueue(n)
+		}
 	}
 
-	var payload Payload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	if digestMode(payload.IntegrationID) {
+		span.set("digest", true)
+		if severities.notifies(severity, notifierSlack) {
+			digests.add(payload.IntegrationID, recentErrors)
+		}
+		return
 	}
+	if severities.notifies(severity, notifierSlack) {
+		message := createSlackMessage(recentErrors, payload, integrationURL)
+		if storms.buffering(message.Channel, payload.IntegrationID, now) {
+			span.set("digest", true)
+			digests.add(payload.IntegrationID, recentErrors)
+		} else {
+			n := &Notification{
+				IntegrationID: payload.IntegrationID,
+				Message:       message,
+				Variables:     workflowVariables(recentErrors, payload, integrationURL),
+				Reason:        reasonThresholdExceeded,
+				Trace:         trace,
+				QueuedAt:      now,
+				Attachment:    payloadAttachment(recentErrors, payload, now),
+			}
+			if !batches.add(n) {
+				enqueue(n)
+			}
+			escalations.track(payload.IntegrationID, message, now)
+		}
+	}
+	if severities.notifies(severity, notifierGitHub) {
+		for _, n := range ticketNotifications(payload.IntegrationID, createTicketDraft(recentErrors, payload, integrationURL)) {
+			n.QueuedAt = now
+			enqueue(n)
+		}
+	}
+	status.alerted(now)
+	polls.alerted(payload.IntegrationID, now)
+}
 
-	return &payload, nil
+// pollResult sums up one poll of every monitored integration.
+type pollResult struct {
+	newErrors int
+	failed    bool
 }
 
-func sendSlackNotification(message string) error {
-	slackPayload := SlackMessage{
-		Text: message,
+// pollOnce runs a single poll, filter and notify cycle.
+func pollOnce(ctx context.Context) pollResult {
+	var result pollResult
+	if role.isStandby() {
+		return result
 	}
+	started := time.Now()
+	ctx, span := startSpan(ctx, "poll", spanKindInternal)
+	defer func() {
+		now := time.Now().UTC()
+		batches.flush(now)
+		observePollCycle(now.Sub(started), now)
+		groups.evaluate(now)
+		span.set("new_errors", result.newErrors)
+		if result.failed {
+			span.finish(fmt.Errorf("polling failed"))
+		} else {
+			span.finish(nil)
+		}
+	}()
+	for _, id := range monitored.list(ctx) {
+		if ctx.Err() != nil {
+			return result
+		}
+		if wait := sysdigRateLimit.remaining(); wait > 0 {
+			log.Printf("Skipping poll, the Sysdig API asked us to wait another %s\n", wait.Round(time.Second))
+			result.failed = true
+			return result
+		}
+		n, err := pollIntegration(ctx, id)
+		result.newErrors += n
+		if err != nil {
+			result.failed = true
+		}
+	}
+	return result
+}
 
-	payloadBytes, err := json.Marshal(slackPayload)
+// pollIntegration polls one integration and alerts on its new errors. It
+// returns how many there were.
+func pollIntegration(ctx context.Context, integrationID int) (newErrors int, err error) {
+	ctx, span := startSpan(ctx, "poll integration", spanKindInternal)
+	span.set("integration.id", integrationID)
+	defer func() {
+		span.set("new_errors", newErrors)
+		span.finish(err)
+	}()
+
+	payload, err := pollWithRetry(ctx, integrationID)
+	if ctx.Err() != nil {
+		log.Println("Poll interrupted by shutdown.")
+		return 0, ctx.Err()
+	}
+	if errors.Is(err, errCircuitOpen) {
+		log.Println("Skipping poll, the circuit breaker is open.")
+		return 0, err
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal slack payload: %v", err)
+		var ae *authError
+		if errors.As(err, &ae) {
+			authAlerts.failed(ae, time.Now().UTC())
+		} else {
+			log.Printf("Error fetching data for integration %d: %v\n", integrationID, err)
+		}
+		status.pollFailed(err)
+		polls.failed(integrationID, err)
+		pollsTotal.inc("failure")
+		pollHealth.failed(err, time.Now().UTC())
+		return 0, err
 	}
 
-	resp, err := http.Post(slackWebhookURL, "application/json", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return fmt.Errorf("failed to send slack notification: %v", err)
+	now := time.Now().UTC()
+	status.pollSucceeded(now)
+	pollHealth.succeeded(now)
+	authAlerts.succeeded()
+	pollsTotal.inc("success")
+	integrationPayloadErrors.set(float64(payload.Count), strconv.Itoa(payload.IntegrationID))
+	window := filter.LastMinute(now)
+	window.Until = now.Add(clockSkew)
+	window.IsNew = func(timestamp time.Time) bool { return seen.isNew(payload.IntegrationID, timestamp) }
+	recentErrors, newest, invalid := window.Recent(payload.Errors)
+	recentErrors = append(recentErrors, unparsed.fresh(payload.IntegrationID, invalid)...)
+	if ahead := window.Ahead(payload.Errors); ahead > 0 {
+		log.Printf("Skipping %d errors of integration %d timestamped more than %s ahead of the local clock, see sysdig.clockSkewSecs.\n",
+			ahead, payload.IntegrationID, formatDuration(clockSkew))
+	}
+	for i := range recentErrors {
+		recentErrors[i].Category = classifyError(recentErrors[i].Error)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("slack notification failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	recentErrors = samples.keep(payload.IntegrationID, recentErrors)
+	recentErrors = claimNew(payload.IntegrationID, recentErrors)
+	integrationErrorsTotal.add(float64(len(recentErrors)), strconv.Itoa(payload.IntegrationID))
+	for _, err := range recentErrors {
+		integrationErrorsByCategory.inc(strconv.Itoa(payload.IntegrationID), err.Category)
 	}
 
-	return nil
+	if len(recentErrors) > 0 {
+		integrationMeta.ensure(payload.IntegrationID)
+
+		fmt.Println(payload.IntegrationID)
+
+		alertedErrors.add(payload.IntegrationID, recentErrors)
+		canary.compare(payload.IntegrationID, dominantCategory(recentErrors), now)
+		history.record(payload.IntegrationID, recentErrors, now)
+
+		_, span := startSpan(ctx, "filter", spanKindInternal)
+		kept, muted := silences.filter(payload.IntegrationID, recentErrors, now)
+		if len(muted) > 0 {
+			log.Printf("Not notifying %d new errors on integration %d: silenced.\n", len(muted), payload.IntegrationID)
+		}
+		span.set("silenced", len(muted))
+		if met := alertConditions.filter(kept, payload); len(met) < len(kept) {
+			log.Printf("Not notifying %d new errors on integration %d: they don't meet its condition.\n", len(kept)-len(met), payload.IntegrationID)
+			span.set("unmet_condition", len(kept)-len(met))
+			kept = met
+		}
+		span.set("kept", len(kept))
+		span.finish(nil)
+		if len(kept) > 0 {
+			notifyNewErrors(ctx, kept, payload, now)
+		}
+		seen.advance(payload.IntegrationID, newest)
+	} else {
+		log.Println("No new errors found.")
+	}
+
+	for _, n := range correlations.resolveQuiet(now) {
+		notifications.enqueue(n)
+	}
+	if alertStateEnabled {
+		for _, n := range alertStates.resolveQuiet(now) {
+			notifications.enqueue(n)
+		}
+	}
+	polls.succeeded(payload.IntegrationID, len(recentErrors), now)
+	return len(recentErrors), nil
 }
 
-func createSlackMessage(errors []ErrorLog, payload *Payload, integrationUrl string) string {
-	message := "Recent Errors found on integration: " + fmt.Sprintf("%d", payload.IntegrationID) + "\n"
-	for _, err := range errors {
-		message += err.Error + "\n"
+// runOnce performs a single poll/evaluate/notify cycle for cron jobs and CI
+// gates and returns the exit code.
+func runOnce() int {
+	// Without the retry loop, each run retries what is due by then.
+	for _, n := range redeliveries.due(time.Now().UTC()) {
+		notifications.enqueue(n)
+	}
+	result := pollOnce(context.Background())
+	notifications.drain(shutdownGracePeriod)
+	flushTraces()
+	pingHeartbeatOnce(result.failed)
+	if err := payloadArchive.close(); err != nil {
+		log.Printf("Error closing payload archive: %v\n", err)
+	}
+	history.close()
+
+	switch {
+	case result.failed:
+		return 2
+	case result.newErrors > 0:
+		log.Printf("Found %d new errors.\n", result.newErrors)
+		return 1
+	default:
+		return 0
 	}
-	message += "\n" + "You can check the integration in the following link: " + integrationUrl + fmt.Sprintf("%d", payload.IntegrationID)
-	return message
 }
 
 func main() {
-	for {
-		payload, err := pollEndpoint()
-		if err != nil {
-			log.Printf("Error fetching data: %v\n", err)
-			continue
-		}
+	args := normalizeLegacyFlags(os.Args[1:])
+	// The build info is printed whatever state config.yaml is in.
+	if versionRequested(args) {
+		fmt.Println(currentBuildInfo())
+		return
+	}
+	checkConfig()
+	root := newRootCommand()
+	root.SetArgs(args)
+	if err := root.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
 
-		now := time.Now().UTC()
-		oneMinuteAgo := now.Add(-1 * time.Minute)
-		var recentErrors []ErrorLog
+// runDaemon polls until SIGINT/SIGTERM, or only once when once is set.
+func runDaemon(once bool) {
+	logPodPrefix()
+	if integrationID == "0" && !discoveryEnabled {
+		log.Fatalf("integrationId is not set in config.yaml. Set it, or enable discovery to monitor every integration of the tenant.")
+	}
 
-		for _, err := range payload.Errors {
-			timestamp, parseErr := time.Parse(time.RFC3339Nano, err.Timestamp)
-			if parseErr != nil {
-				log.Printf("Error parsing timestamp: %v\n", parseErr)
-				continue
-			}
+	logFeatureFlags()
+	logStatelessTradeoffs()
+	logStandby()
+	if err := checkStateDir(); err != nil {
+		log.Fatalf("%v. Point stateDir at a writable volume (for example a tmpfs or emptyDir mount) or set stateless: true.", err)
+	}
 
-			if timestamp.After(oneMinuteAgo) && timestamp.Before(now) {
-				recentErrors = append(recentErrors, err)
-			}
-		}
+	tuning.apply()
+	notifications.start(tuning.notificationWorkers)
+	if !role.isStandby() {
+		notifications.replayOutbox()
+	}
 
-		if len(recentErrors) > 0 {
+	integrationMeta.prefetch()
+	if once {
+		os.Exit(runOnce())
+	}
 
-			fmt.Println(payload.IntegrationID)
+	apiServer, err := startAPIServer()
+	if err != nil {
+		log.Fatalf("Error starting local API: %v", err)
+	}
+	// After an upgrade the previous process holds on to the debug listener
+	// until it exits.
+	if handover == nil {
+		startDebugServer()
+	}
 
-			slackMessage := createSlackMessage(recentErrors, payload, integrationURL)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	upgrades := upgradeSignals()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	loops := map[string]func(context.Context){
+		"poll loop":          pollLoop,
+		"digest loop":        digestLoop,
+		"remote-write loop":  remoteWriteLoop,
+		"update check":       updateCheckLoop,
+		"ticket status":      ticketStatusLoop,
+		"self monitor":       selfMonitorLoop,
+		"instance heartbeat": instanceLoop,
+		"canary trial":       canaryLoop,
+		"owners directory":   ownersLoop,
+		"forwarding probe":   probeLoop,
+		"escalation":         escalationLoop,
+		"storm digest":       stormLoop,
+		"trace export":       traceExportLoop,
+		"OTLP metrics":       otlpMetricsLoop,
+		"heartbeat ping":     heartbeatLoop,
+		"leader election":    leaderElectionLoop,
+		"owner reports":      ownerReportLoop,
+		"operator":           operatorLoop,
+		"hot reload":         hotReloadLoop,
+		"profiling":          profilingLoop,
+		"notification retry": redeliveryLoop,
+		"rate limit summary": throttleLoop,
+	}
+	var workers sync.WaitGroup
+	for name, loop := range loops {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			supervise(name, func() { loop(ctx) })
+		}()
+	}
+	if handover != nil {
+		handover.awaitParent()
+	}
 
-			err := sendSlackNotification(slackMessage)
-			if err != nil {
-				log.Printf("Error sending Slack notification: %v\n", err)
-			} else {
-				log.Println("Slack notification sent successfully.")
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, stopping polling and draining notifications.\n", sig)
+			break wait
+		case <-shutdownRequests:
+			log.Println("Drain requested through the API, stopping polling and draining notifications.")
+			break wait
+		case sig := <-upgrades:
+			log.Printf("Received %s, starting the new binary.\n", sig)
+			if err := upgrade(apiListener); err != nil {
+				log.Printf("Upgrade failed, carrying on: %v\n", err)
+				continue
 			}
-		} else {
-			log.Println("No new errors found.")
+			log.Println("New process is ready, stopping polling and draining notifications.")
+			break wait
 		}
+	}
+	// Cancelling aborts an in-flight poll right away. A second signal skips
+	// the drain entirely.
+	cancel()
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s again, exiting immediately.\n", sig)
+		os.Exit(1)
+	}()
+
+	// Wait for the loops so no checkpoint or digest is written mid-exit.
+	workers.Wait()
+
+	notifications.drain(shutdownGracePeriod)
+	flushTraces()
+
+	if err := payloadArchive.close(); err != nil {
+		log.Printf("Error closing payload archive: %v\n", err)
+	}
+	history.close()
 
-		time.Sleep(checkInterval)
+	if apiServer != nil {
+		apiServer.Close()
 	}
+	stopDebugServer()
+	log.Println("Shutdown complete.")
 }
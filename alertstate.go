@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const alertStatesFile = "alerts.json"
+
+// With alertState.enabled, new errors no longer each produce a notification.
+// They feed alerts, one per group key (the integration, or the integration
+// and error category with alertState.groupBy: category), that go from firing
+// to resolved like Alertmanager's:
+//
+//   - the first errors of a group fire its alert and notify;
+//   - more errors while it fires only notify again once
+//     alertState.repeatIntervalMins passed since the last notification;
+//   - a group without errors for alertState.resolveAfterMins is resolved,
+//     with a resolution notice.
+var (
+	alertStateEnabled   = conf.Bool("alertState.enabled", false)
+	alertGroupBy        = conf.String("alertState.groupBy", "integration")
+	alertRepeatInterval = time.Duration(conf.Int("alertState.repeatIntervalMins", 240)) * time.Minute
+	alertResolveAfter   = time.Duration(conf.Int("alertState.resolveAfterMins", 30)) * time.Minute
+)
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// Alert is the state of one group of errors.
+type Alert struct {
+	GroupKey       string     `json:"groupKey"`
+	IntegrationID  int        `json:"integrationId"`
+	Category       string     `json:"category,omitempty"`
+	State          string     `json:"state"`
+	StartsAt       time.Time  `json:"startsAt"`
+	LastErrorAt    time.Time  `json:"lastErrorAt"`
+	LastNotifiedAt time.Time  `json:"lastNotifiedAt"`
+	EndsAt         *time.Time `json:"endsAt,omitempty"`
+	Errors         int        `json:"errors"`
+	Notifications  int        `json:"notifications"`
+}
+
+var alertsFiring = metrics.newGauge("sefi_alerts_firing",
+	"Alerts currently firing, by integration.", "integration_id")
+
+type alertStore struct {
+	mu     sync.Mutex
+	alerts map[string]*Alert
+}
+
+var alertStates = loadAlertStates()
+
+func loadAlertStates() *alertStore {
+	if alertGroupBy != "integration" && alertGroupBy != "category" {
+		addConfigProblem("alertState.groupBy must be integration or category, got %q", alertGroupBy)
+	}
+	s := &alertStore{alerts: make(map[string]*Alert)}
+	if _, err := loadState(alertStatesFile, &s.alerts); err != nil {
+		log.Printf("Error loading alert states: %v\n", err)
+	}
+	s.updateGaugeLocked()
+	return s
+}
+
+func (s *alertStore) reload() {
+	alerts := make(map[string]*Alert)
+	if _, err := loadState(alertStatesFile, &alerts); err != nil {
+		log.Printf("Error reloading alert states: %v\n", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alerts = alerts
+	s.updateGaugeLocked()
+}
+
+func (s *alertStore) saveLocked() {
+	if err := saveState(alertStatesFile, s.alerts); err != nil {
+		log.Printf("Error saving alert states: %v\n", err)
+	}
+}
+
+func (s *alertStore) updateGaugeLocked() {
+	firing := make(map[int]int)
+	for _, a := range s.alerts {
+		if a.State == alertFiring {
+			firing[a.IntegrationID]++
+		} else if _, ok := firing[a.IntegrationID]; !ok {
+			firing[a.IntegrationID] = 0
+		}
+	}
+	for id, n := range firing {
+		alertsFiring.set(float64(n), strconv.Itoa(id))
+	}
+}
+
+// alertGroupKey returns the key of the alert err belongs to.
+func alertGroupKey(integrationID int, err ErrorLog) (key, category string) {
+	key = fmt.Sprintf("%s/%d", tenantID, integrationID)
+	if alertGroupBy == "category" {
+		category = err.Category
+		key += "/" + category
+	}
+	return key, category
+}
+
+// observe feeds new errors of integrationID into their alerts and returns
+// the ones to notify about now.
+func (s *alertStore) observe(integrationID int, errors []ErrorLog, now time.Time) []ErrorLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := make(map[string][]ErrorLog)
+	for _, err := range errors {
+		key, category := alertGroupKey(integrationID, err)
+		groups[key] = append(groups[key], err)
+
+		a, ok := s.alerts[key]
+		if !ok || a.State == alertResolved {
+			a = &Alert{GroupKey: key, IntegrationID: integrationID, Category: category, State: alertFiring, StartsAt: now}
+			s.alerts[key] = a
+		}
+		a.Errors++
+		a.LastErrorAt = now
+	}
+
+	var notify []ErrorLog
+	for key, grouped := range groups {
+		a := s.alerts[key]
+		switch {
+		case a.Notifications == 0:
+			log.Printf("Alert %s is firing.\n", key)
+		case now.Sub(a.LastNotifiedAt) >= alertRepeatInterval:
+			log.Printf("Alert %s is still firing, notifying again after %s.\n", key, alertRepeatInterval)
+		default:
+			log.Printf("Alert %s is already firing, not notifying %d new errors before %s.\n",
+				key, len(grouped), a.LastNotifiedAt.Add(alertRepeatInterval).Format(time.RFC3339))
+			continue
+		}
+		a.LastNotifiedAt = now
+		a.Notifications++
+		notify = append(notify, grouped...)
+	}
+	s.updateGaugeLocked()
+	s.saveLocked()
+	return notify
+}
+
+// resolveQuiet resolves the alerts without errors for alertState.resolveAfterMins
+// and returns their resolution notices.
+func (s *alertStore) resolveQuiet(now time.Time) []*Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Notification
+	for key, a := range s.alerts {
+		switch {
+		case a.State == alertFiring && now.Sub(a.LastErrorAt) >= alertResolveAfter:
+			a.State = alertResolved
+			ended := now
+			a.EndsAt = &ended
+			log.Printf("Alert %s is resolved after %s.\n", key, now.Sub(a.StartsAt).Round(time.Second))
+			out = append(out, resolvedNotification(*a))
+		case a.State == alertResolved && a.EndsAt != nil && now.Sub(*a.EndsAt) >= 7*24*time.Hour:
+			delete(s.alerts, key)
+		}
+	}
+	if len(out) > 0 {
+		s.updateGaugeLocked()
+		s.saveLocked()
+	}
+	return out
+}
+
+func resolvedNotification(a Alert) *Notification {
+	title := "Resolved: events forwarding errors on integration " + integrationLabel(a.IntegrationID)
+	if a.Category != "" {
+		title += " (" + a.Category + ")"
+	}
+	text := fmt.Sprintf("No new errors for %s. The alert fired for %s with %s errors.",
+		formatDuration(alertResolveAfter), formatDuration(a.EndsAt.Sub(a.StartsAt)), formatCount(int64(a.Errors)))
+	blocks := []SlackBlock{
+		{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+		{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+	}
+	if footer, ok := podFooter(); ok {
+		blocks = append(blocks, footer)
+	}
+	return &Notification{
+		IntegrationID: a.IntegrationID,
+		Message: SlackMessage{
+			Channel: alertChannel(a.IntegrationID, a.Category),
+			Text:    title + "\n" + text,
+			Blocks:  blocks,
+		},
+		Reason:   reasonRecovered,
+		QueuedAt: *a.EndsAt,
+	}
+}
+
+// state returns the state of the alerts of integrationID: firing if any is.
+func (s *alertStore) state(integrationID int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := ""
+	for _, a := range s.alerts {
+		if a.IntegrationID != integrationID {
+			continue
+		}
+		if a.State == alertFiring {
+			return alertFiring
+		}
+		state = alertResolved
+	}
+	return state
+}
+
+// firingSince returns when the earliest firing alert of integrationID
+// started.
+func (s *alertStore) firingSince(integrationID int) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var since time.Time
+	for _, a := range s.alerts {
+		if a.IntegrationID == integrationID && a.State == alertFiring && (since.IsZero() || a.StartsAt.Before(since)) {
+			since = a.StartsAt
+		}
+	}
+	return since, !since.IsZero()
+}
+
+func (s *alertStore) list() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Alert, 0, len(s.alerts))
+	for _, a := range s.alerts {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GroupKey < out[j].GroupKey })
+	return out
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The local API is off unless apiListen is set. It takes either a TCP
+// address ("127.0.0.1:8080") or a Unix socket path ("unix:/run/sefi/api.sock")
+// for hosts where opening ports is not allowed; apiSocketMode sets the
+// socket's file permissions.
+var (
+	apiListen     = conf.String("apiListen", "")
+	apiSocketMode = conf.String("apiSocketMode", "0660")
+)
+
+// daemonStatus is what the health endpoint reports about the poll loop.
+type daemonStatus struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	lastPollAt    time.Time
+	lastPollError string
+	lastAlertAt   time.Time
+	latestVersion string
+}
+
+var status = &daemonStatus{startedAt: time.Now().UTC()}
+
+func (s *daemonStatus) pollSucceeded(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPollAt = at
+	s.lastPollError = ""
+}
+
+func (s *daemonStatus) pollFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPollError = err.Error()
+}
+
+func (s *daemonStatus) updateAvailable(latest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latestVersion = latest
+}
+
+func (s *daemonStatus) alerted(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAlertAt = at
+}
+
+type healthResponse struct {
+	Status        string     `json:"status"`
+	Role          string     `json:"role"`
+	StartedAt     time.Time  `json:"startedAt"`
+	LastPollAt    *time.Time `json:"lastPollAt,omitempty"`
+	LastPollError string     `json:"lastPollError,omitempty"`
+	LastAlertAt   *time.Time `json:"lastAlertAt,omitempty"`
+	QueuedAlerts  int        `json:"queuedAlerts"`
+	Stateless     bool       `json:"stateless"`
+	Storage       string     `json:"storage"`
+	Version       string     `json:"version"`
+	LatestVersion string     `json:"latestVersion,omitempty"`
+}
+
+func (s *daemonStatus) health() healthResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := healthResponse{
+		Status:        "ok",
+		Role:          role.name(),
+		StartedAt:     s.startedAt,
+		LastPollError: s.lastPollError,
+		QueuedAlerts:  notifications.depth(),
+		Stateless:     stateless,
+		Storage:       storageBackend,
+		Version:       version,
+		LatestVersion: s.latestVersion,
+	}
+	if !s.lastPollAt.IsZero() {
+		at := s.lastPollAt
+		resp.LastPollAt = &at
+	}
+	if !s.lastAlertAt.IsZero() {
+		at := s.lastAlertAt
+		resp.LastAlertAt = &at
+	}
+	// Unhealthy once no poll has succeeded for three intervals.
+	if resp.Role == "active" && time.Since(s.startedAt) > 3*checkInterval && time.Since(s.lastPollAt) > 3*checkInterval {
+		resp.Status = "degraded"
+	}
+	return resp
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := status.health()
+	code := http.StatusOK
+	if health.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing API response: %v\n", err)
+	}
+}
+
+func newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealth)
+	if prometheusMetrics {
+		mux.HandleFunc("/metrics", handleMetrics)
+	}
+	mux.HandleFunc("/version", handleVersion)
+	if dashboardEnabled {
+		mux.HandleFunc("/", handleDashboard)
+		mux.HandleFunc("/acks", handleAckList)
+	}
+	mux.HandleFunc("/api/acks", handleAcks)
+	mux.HandleFunc("/api/tickets", handleTickets)
+	mux.HandleFunc("/api/search", handleSearch)
+	mux.HandleFunc("/api/promote", handlePromote)
+	mux.HandleFunc("/api/silences", handleSilences)
+	mux.HandleFunc("/api/poll", handleTriggerPoll)
+	mux.HandleFunc("/api/reload", handleReload)
+	mux.HandleFunc("/api/drain", handleDrain)
+	mux.HandleFunc("/api/canary", handleCanary)
+	mux.HandleFunc("/api/canary/promote", handleCanaryPromote)
+	mux.HandleFunc("/api/integrations", handleIntegrations)
+	mux.HandleFunc("/api/alerts", handleAlerts)
+	mux.HandleFunc("/api/alert-states", handleAlertStates)
+	mux.HandleFunc("/api/budgets", handleBudgets)
+	mux.HandleFunc("/api/owners", handleOwners)
+	mux.HandleFunc("/api/groups", handleGroups)
+	return requireAPIToken(mux)
+}
+
+// listen opens a TCP listener, or a Unix socket when address starts with
+// "unix:". A socket file left behind by an unclean exit is replaced.
+func listen(address, socketMode string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %v", socketMode, err)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	// Created under a umask leaving at most mode, so the socket is never
+	// reachable with wider permissions before the Chmod.
+	var listener net.Listener
+	err = withUmask(fs.FileMode(mode), func() error {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// apiListener is the listener of the local API, handed over on upgrades.
+var apiListener net.Listener
+
+// startAPIServer serves the local API in the background. It returns nil when
+// the API is disabled.
+func startAPIServer() (*http.Server, error) {
+	if apiListen == "" {
+		return nil, nil
+	}
+
+	// After an upgrade the listener of the previous process is reused, so
+	// no request is refused in between.
+	if handover != nil && handover.listener != nil {
+		apiListener = handover.listener
+	} else {
+		listener, err := listen(apiListen, apiSocketMode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", apiListen, err)
+		}
+		apiListener = listener
+	}
+	listener := apiListener
+
+	server := &http.Server{Handler: newAPIHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("API server stopped: %v\n", err)
+		}
+	}()
+	log.Printf("Serving local API on %s\n", apiListen)
+	warnOpenAPI()
+	return server, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of Sysdig API failures, for logs, the sefi_sysdig_api_errors_total
+// labels and self-alerts.
+const (
+	apiErrorAuth        = "auth"
+	apiErrorRateLimited = "rate_limited"
+	apiErrorNotFound    = "not_found"
+	apiErrorClient      = "client"
+	apiErrorUnavailable = "unavailable"
+	apiErrorServer      = "server"
+	apiErrorNetwork     = "network"
+)
+
+// maxErrorBodyBytes bounds how much of an error response is read.
+const maxErrorBodyBytes = 16 << 10
+
+var sysdigAPIErrors = metrics.newCounter("sefi_sysdig_api_errors_total",
+	"Failed Sysdig API responses, by kind and status code.", "kind", "status")
+
+// statusError is returned for non-200 responses from the Sysdig API, with
+// what the response body said about the failure.
+type statusError struct {
+	StatusCode int
+	Kind       string
+	// Message and Code are the error message and code of a JSON body, or
+	// the start of any other body.
+	Message   string
+	Code      string
+	RequestID string
+}
+
+func (e *statusError) Error() string {
+	s := fmt.Sprintf("the Sysdig API returned %d %s [%s]", e.StatusCode, http.StatusText(e.StatusCode), e.Kind)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	var details []string
+	if e.Code != "" && e.Code != strconv.Itoa(e.StatusCode) {
+		details = append(details, "code "+e.Code)
+	}
+	if e.RequestID != "" {
+		details = append(details, "request "+e.RequestID)
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
+}
+
+// sysdigAPIError turns a failed response of the Sysdig API into an
+// authError, a rateLimitedError or a statusError, and counts it.
+func sysdigAPIError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	message, code := apiErrorDetails(body)
+
+	var err error
+	kind := statusKind(resp.StatusCode)
+	switch kind {
+	case apiErrorRateLimited:
+		err = newRateLimitedError("sysdig", resp)
+	case apiErrorAuth:
+		err = newAuthError(resp.StatusCode, message)
+	default:
+		err = &statusError{
+			StatusCode: resp.StatusCode,
+			Kind:       kind,
+			Message:    message,
+			Code:       code,
+			RequestID:  firstHeader(resp.Header, "X-Request-Id", "X-Sysdig-Request-Id", "X-Amzn-Trace-Id"),
+		}
+	}
+	sysdigAPIErrors.inc(kind, strconv.Itoa(resp.StatusCode))
+	return err
+}
+
+func statusKind(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return apiErrorAuth
+	case statusCode == http.StatusTooManyRequests:
+		return apiErrorRateLimited
+	case statusCode == http.StatusNotFound:
+		return apiErrorNotFound
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout:
+		return apiErrorUnavailable
+	case statusCode >= 500:
+		return apiErrorServer
+	}
+	return apiErrorClient
+}
+
+// apiErrorKind classifies any error of a Sysdig API call.
+func apiErrorKind(err error) string {
+	var se *statusError
+	var ae *authError
+	var rl *rateLimitedError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &se):
+		return se.Kind
+	case errors.As(err, &ae):
+		return apiErrorAuth
+	case errors.As(err, &rl):
+		return apiErrorRateLimited
+	}
+	return apiErrorNetwork
+}
+
+// apiErrorDetails extracts the message and code of an error body, which
+// comes in several shapes: {"message": ...}, {"error": "..."},
+// {"error": {"message": ..., "code": ...}} or {"errors": [{...}]}. Other
+// bodies, such as the HTML of a proxy error page, are stripped of their tags
+// and cut to their start.
+func apiErrorDetails(body []byte) (message, code string) {
+	var parsed map[string]interface{}
+	if json.Unmarshal(body, &parsed) != nil {
+		text := strings.Join(strings.Fields(htmlTags.ReplaceAllString(string(body), " ")), " ")
+		if len(text) > 200 {
+			text = text[:200] + "…"
+		}
+		return text, ""
+	}
+
+	fields := parsed
+	switch e := parsed["error"].(type) {
+	case string:
+		message = e
+	case map[string]interface{}:
+		fields = e
+	}
+	if list, ok := parsed["errors"].([]interface{}); ok && len(list) > 0 {
+		if first, ok := list[0].(map[string]interface{}); ok {
+			fields = first
+		}
+	}
+	for _, key := range []string{"message", "detail", "description", "error_description"} {
+		if s, ok := fields[key].(string); ok && s != "" {
+			message = s
+			break
+		}
+	}
+	for _, key := range []string{"code", "reason", "type"} {
+		if v, ok := fields[key]; ok && v != nil {
+			code = fmt.Sprint(v)
+			break
+		}
+	}
+	return message, code
+}
+
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+func firstHeader(h http.Header, names ...string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
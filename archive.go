@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Raw payloads can be archived to the state directory, one file per day with
+// one JSON record per poll. Archives are zstd-compressed by default since
+// error payloads are repetitive and compress extremely well.
+var (
+	archiveEnabled     = conf.Bool("archive.enabled", false)
+	archiveCompression = conf.String("archive.compression", "zstd")
+)
+
+type archiveRecord struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type payloadArchiver struct {
+	mu     sync.Mutex
+	day    string
+	file   *os.File
+	writer io.WriteCloser
+}
+
+var payloadArchive = &payloadArchiver{}
+
+// compressedExtension returns the file suffix used for compression.
+func compressedExtension(compression string) string {
+	if compression == "zstd" {
+		return ".zst"
+	}
+	return ""
+}
+
+// newCompressedWriter wraps w in a streaming compressor. Closing the returned
+// writer finishes the compressed stream but leaves w open.
+func newCompressedWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "none", "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// newDecompressedReader is the read-side counterpart of newCompressedWriter,
+// choosing the codec from the file name.
+func newDecompressedReader(r io.Reader, name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, ".zst") {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// flusher is implemented by compressors that can emit buffered data without
+// ending the stream.
+type flusher interface {
+	Flush() error
+}
+
+func (a *payloadArchiver) write(fetchedAt time.Time, body []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	day := fetchedAt.UTC().Format("2006-01-02")
+	if a.day != day {
+		if err := a.closeLocked(); err != nil {
+			log.Printf("Error closing payload archive: %v\n", err)
+		}
+		if err := a.openLocked(day); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(archiveRecord{FetchedAt: fetchedAt, Payload: json.RawMessage(body)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive record: %v", err)
+	}
+	if _, err := a.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write archive record: %v", err)
+	}
+
+	// Flush every record so a crash only loses the record being written.
+	if f, ok := a.writer.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("failed to flush archive: %v", err)
+		}
+	}
+	return nil
+}
+
+func (a *payloadArchiver) openLocked(day string) error {
+	dir := filepath.Join(stateDir, "archive")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	// Appending to an existing zstd file just adds another frame, which
+	// decoders read back as one continuous stream.
+	name := filepath.Join(dir, "payloads-"+day+".jsonl"+compressedExtension(archiveCompression))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+
+	writer, err := newCompressedWriter(file, archiveCompression)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.day, a.file, a.writer = day, file, writer
+	return nil
+}
+
+func (a *payloadArchiver) closeLocked() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.writer.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.day, a.file, a.writer = "", nil, nil
+	return err
+}
+
+func (a *payloadArchiver) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeLocked()
+}
+
+func archivePayload(fetchedAt time.Time, body []byte) {
+	if !archiveEnabled || stateless {
+		return
+	}
+	if err := payloadArchive.write(fetchedAt, body); err != nil {
+		log.Printf("Error archiving payload: %v\n", err)
+	}
+}
+
+// readArchive calls fn for every record in an archive file, compressed or not.
+// A malformed line, such as a record a crash cut short, is skipped with a
+// warning and the records after it are still read.
+func readArchive(name string, fn func(archiveRecord) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newDecompressedReader(file, name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Skipping malformed record on line %d of %s: %v\n", line, name, err)
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return nil
+}
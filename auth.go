@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// notifyAuthFailures sends a dedicated notification the first time the API
+// rejects the bearer token, instead of waiting for the generic
+// "cannot reach Sysdig" alert.
+var notifyAuthFailures = conf.Bool("selfMonitor.notifyAuthFailures", false)
+
+var authFailuresTotal = metrics.newCounter("sefi_auth_failures_total",
+	"Sysdig API responses rejecting the bearer token, by status code.", "status")
+
+// authError is returned when the Sysdig API answers 401 or 403.
+type authError struct {
+	StatusCode int
+	// Message is what the response body said, if anything.
+	Message string
+}
+
+func (e *authError) Error() string {
+	s := "the Sysdig API rejected the request with 401 Unauthorized: the bearer token is invalid or expired"
+	if e.StatusCode == 403 {
+		s = "the Sysdig API rejected the request with 403 Forbidden: the bearer token lacks permission to read events forwarding errors for this integration and tenant"
+	}
+	if e.Message != "" {
+		s += " (" + e.Message + ")"
+	}
+	return s
+}
+
+func newAuthError(statusCode int, message string) *authError {
+	authFailuresTotal.inc(fmt.Sprint(statusCode))
+	return &authError{StatusCode: statusCode, Message: message}
+}
+
+// authAlert remembers whether the current run of auth failures was already
+// announced.
+type authAlert struct {
+	mu      sync.Mutex
+	alerted bool
+}
+
+var authAlerts = &authAlert{}
+
+func (a *authAlert) failed(err *authError, at time.Time) {
+	log.Printf("Authentication failed: %v. Update bearerToken in config.yaml.\n", err)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.alerted || !notifyAuthFailures {
+		return
+	}
+	a.alerted = true
+	sendSelfAlert(at, reasonFeedStale, "SEFI-Alarm token rejected by Sysdig",
+		err.Error()+". Polling continues, but no forwarding errors are detected until bearerToken is replaced.")
+}
+
+func (a *authAlert) succeeded() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.alerted = false
+}
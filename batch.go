@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// With batching.enabled, the Slack alerts of one poll cycle that go to the
+// same channel are posted as one message, with a section per integration,
+// instead of one post each. A batch over the 50 blocks or 40,000 characters
+// of a Slack message, or listing more than messages.maxErrors errors, is
+// split into several messages. A batched message isn't threaded under the
+// incidents of its integrations. Workflow webhooks take the variables of a
+// single alert, so they are never batched, nor are alerts with the payload
+// attached.
+var batchingEnabled = conf.Bool("batching.enabled", false)
+
+// maxSlackBlocks is the most blocks Slack takes in one message.
+const maxSlackBlocks = 50
+
+var batchedAlerts = metrics.newCounter("sefi_batched_alerts_total",
+	"Alerts posted as part of a batched message.")
+
+type alertBatch struct {
+	mu        sync.Mutex
+	channels  []string
+	byChannel map[string][]*Notification
+}
+
+var batches = &alertBatch{byChannel: make(map[string][]*Notification)}
+
+// add keeps the Slack alert n for the batch of its channel, reporting false
+// when alerts aren't batched.
+func (b *alertBatch) add(n *Notification) bool {
+	if !batchingEnabled || slackWorkflowMode() || n.Attachment != nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	channel := n.Message.Channel
+	if _, ok := b.byChannel[channel]; !ok {
+		b.channels = append(b.channels, channel)
+	}
+	b.byChannel[channel] = append(b.byChannel[channel], n)
+	return true
+}
+
+// flush queues the alerts of the cycle: alone when a channel got one, as
+// few messages as Slack's caps allow otherwise.
+func (b *alertBatch) flush(now time.Time) {
+	b.mu.Lock()
+	channels, byChannel := b.channels, b.byChannel
+	b.channels, b.byChannel = nil, make(map[string][]*Notification)
+	b.mu.Unlock()
+
+	for _, channel := range channels {
+		alerts := byChannel[channel]
+		if len(alerts) == 1 {
+			notifications.enqueue(alerts[0])
+			continue
+		}
+		chunks := splitBatch(alerts)
+		log.Printf("Batching the alerts of %d integrations into %d message(s).\n", len(alerts), len(chunks))
+		batchedAlerts.add(float64(len(alerts)))
+		for i, chunk := range chunks {
+			if len(chunk) == 1 {
+				notifications.enqueue(chunk[0])
+				continue
+			}
+			part := ""
+			if len(chunks) > 1 {
+				part = fmt.Sprintf(" (%d of %d)", i+1, len(chunks))
+			}
+			notifications.enqueue(&Notification{
+				Message:    batchMessage(channel, chunk, part),
+				Reason:     reasonThresholdExceeded,
+				Unthreaded: true,
+				Trace:      chunk[0].Trace,
+				QueuedAt:   now,
+			})
+		}
+	}
+}
+
+// splitBatch cuts alerts into the batches of one message each, within the
+// blocks and text Slack takes and listing no more than messages.maxErrors
+// errors together. An alert over a cap on its own still gets a message.
+func splitBatch(alerts []*Notification) [][]*Notification {
+	var chunks [][]*Notification
+	var chunk []*Notification
+	// The header, and the title of the text.
+	blocks, text, listed := 1, 100, 0
+	for _, n := range alerts {
+		nBlocks := len(n.Message.Blocks) + 1 // and its divider
+		nText := utf8.RuneCountInString(n.Message.Text) + 2
+		nListed := listedErrors(n.Message)
+		if len(chunk) > 0 && (blocks+nBlocks > maxSlackBlocks || text+nText > maxSlackText ||
+			(messageMaxErrors > 0 && listed+nListed > messageMaxErrors)) {
+			chunks = append(chunks, chunk)
+			chunk, blocks, text, listed = nil, 1, 100, 0
+		}
+		chunk = append(chunk, n)
+		blocks, text, listed = blocks+nBlocks, text+nText, listed+nListed
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// listedErrors counts the error lines of the listing of an alert message.
+func listedErrors(message SlackMessage) int {
+	for _, block := range message.Blocks {
+		if block.Type == "section" && block.Text != nil && strings.HasPrefix(block.Text.Text, "```\n") {
+			return strings.Count(strings.TrimSuffix(strings.TrimPrefix(block.Text.Text, "```\n"), "```"), "\n")
+		}
+	}
+	return 0
+}
+
+// batchMessage puts the alerts into one message, each keeping its own
+// sections under its title. part numbers the message when the batch took
+// several.
+func batchMessage(channel string, alerts []*Notification, part string) SlackMessage {
+	title := "Events forwarding errors on " + formatCount(int64(len(alerts))) + " integrations" + part
+	texts := make([]string, 0, len(alerts))
+	blocks := []SlackBlock{{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}}}
+	withBlocks := true
+	for _, n := range alerts {
+		texts = append(texts, n.Message.Text)
+		if len(n.Message.Blocks) == 0 {
+			// A message template only renders text.
+			withBlocks = false
+			continue
+		}
+		blocks = append(blocks, SlackBlock{Type: "divider"})
+		for _, block := range n.Message.Blocks {
+			if block.Type == "header" && block.Text != nil {
+				block = SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: "*" + block.Text.Text + "*"}}
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	if templated, ok := templatedSummary(title, strings.Join(texts, "\n\n"), notifierSlack); ok {
+		return SlackMessage{Channel: channel, Text: truncateText(templated, maxSlackText)}
+	}
+	message := SlackMessage{Channel: channel, Text: truncateText(title+"\n\n"+strings.Join(texts, "\n\n"), maxSlackText)}
+	if withBlocks {
+		message.Blocks = blocks
+	}
+	return message
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The circuit breaker stops calling the Sysdig API after
+// circuitBreaker.failureThreshold consecutive failed requests. While open,
+// polls are skipped; every circuitBreaker.probeIntervalSecs a single probe
+// request is let through and closes the circuit again if it succeeds.
+var (
+	breakerThreshold     = conf.Int("circuitBreaker.failureThreshold", 5)
+	breakerProbeInterval = time.Duration(conf.Int("circuitBreaker.probeIntervalSecs", 300)) * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+var circuitBreakerState = metrics.newGauge("sefi_circuit_breaker_state",
+	"State of the Sysdig API circuit breaker: 0 closed, 1 open, 2 half-open.")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	nextProbe time.Time
+	lastErr   error
+}
+
+var sysdigBreaker = &circuitBreaker{}
+
+// allow reports whether a request may be sent now. When the probe interval
+// has passed it moves the breaker to half-open and lets exactly one through.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.nextProbe) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		log.Println("Circuit breaker half-open, probing the Sysdig API.")
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight.
+		return false
+	}
+	return true
+}
+
+// record feeds the outcome of a request allowed by allow into the breaker.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Println("Circuit breaker closed, the Sysdig API is reachable again.")
+			sendSelfAlert(now, reasonRecovered, "SEFI-Alarm monitoring restored",
+				fmt.Sprintf("Requests to the Sysdig API succeed again after the circuit breaker was open for %s.",
+					now.Sub(b.openedAt).Round(time.Second)))
+		}
+		b.setState(breakerClosed)
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+
+	switch {
+	case b.state == breakerHalfOpen:
+		b.setState(breakerOpen)
+		b.nextProbe = now.Add(breakerProbeInterval)
+		log.Printf("Circuit breaker probe failed (%v), next probe at %s\n", err, b.nextProbe.Format(time.RFC3339))
+	case b.state == breakerClosed && b.failures >= breakerThreshold:
+		b.setState(breakerOpen)
+		b.openedAt = now
+		b.nextProbe = now.Add(breakerProbeInterval)
+		log.Printf("Circuit breaker opened after %d consecutive failures: %v\n", b.failures, err)
+		sendSelfAlert(now, reasonPollerDegraded, "SEFI-Alarm monitoring degraded",
+			fmt.Sprintf("The Sysdig API failed %d times in a row, so polling is paused and retried every %s. "+
+				"Forwarding errors are not being detected until it recovers. Latest error: %v",
+				b.failures, breakerProbeInterval, err))
+	}
+}
+
+// inconclusive is called instead of record when a request said nothing about
+// the API's health, so a half-open breaker waits for the next probe.
+func (b *circuitBreaker) inconclusive(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen)
+		b.nextProbe = now.Add(breakerProbeInterval)
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	circuitBreakerState.set(float64(state))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const budgetsFile = "budgets.json"
+
+// Monthly budgets cap how many notifications a destination gets, keeping
+// paging costs predictable. Destinations are Slack channels in bot-token mode
+// ("#oncall"), "slack" for the webhook, "github" and "events":
+//
+//	budgets:
+//	  "#oncall-pager":
+//	    monthly: 200
+//	    fallback: "#oncall"
+//
+// A warning self-alert goes out once 80% of a budget is used. Past the cap,
+// notifications go to the fallback Slack channel when one is set, within its
+// own budget, and are dropped otherwise.
+type channelBudget struct {
+	Monthly  int
+	Fallback string
+}
+
+var channelBudgets = loadChannelBudgets()
+
+const budgetWarnRatio = 0.8
+
+var (
+	budgetUsed = metrics.newGauge("sefi_budget_used",
+		"Notifications sent this month to a destination with a budget.", "destination")
+	budgetLimit = metrics.newGauge("sefi_budget_limit",
+		"Monthly notification budget of a destination.", "destination")
+	budgetRerouted = metrics.newCounter("sefi_budget_rerouted_total",
+		"Notifications sent to a fallback because their destination's budget was used up.", "destination")
+	budgetDropped = metrics.newCounter("sefi_budget_dropped_total",
+		"Notifications dropped because their destination's budget was used up.", "destination")
+)
+
+func loadChannelBudgets() map[string]channelBudget {
+	out := make(map[string]channelBudget)
+	v, ok := conf.Lookup("budgets")
+	if !ok {
+		return out
+	}
+	section, ok := asSection(v)
+	if !ok {
+		addConfigProblem("budgets must map destinations to a monthly cap and fallback")
+		return out
+	}
+	for destination, value := range section {
+		entry, ok := asSection(value)
+		if !ok {
+			addConfigProblem("budgets.%s must have monthly and fallback", destination)
+			continue
+		}
+		budget := channelBudget{
+			Monthly:  configMap(entry).Int("monthly", 0),
+			Fallback: configMap(entry).String("fallback", ""),
+		}
+		if budget.Monthly <= 0 {
+			addConfigProblem("budgets.%s.monthly must be a positive number", destination)
+			continue
+		}
+		out[destination] = budget
+		budgetLimit.set(float64(budget.Monthly), destination)
+	}
+	return out
+}
+
+// budgetUsage is the persisted count of the current month.
+type budgetUsage struct {
+	Month  string            `json:"month"`
+	Sent   map[string]int    `json:"sent"`
+	Warned map[string]string `json:"warned"`
+}
+
+type budgetTracker struct {
+	mu    sync.Mutex
+	usage budgetUsage
+}
+
+var budgets = loadBudgetTracker()
+
+func loadBudgetTracker() *budgetTracker {
+	b := &budgetTracker{}
+	if _, err := loadState(budgetsFile, &b.usage); err != nil {
+		log.Printf("Error loading notification budgets, counting from zero: %v\n", err)
+	}
+	b.rollLocked(time.Now().UTC())
+	for destination, sent := range b.usage.Sent {
+		budgetUsed.set(float64(sent), destination)
+	}
+	return b
+}
+
+func (b *budgetTracker) reload() {
+	var usage budgetUsage
+	if _, err := loadState(budgetsFile, &usage); err != nil {
+		log.Printf("Error reloading notification budgets: %v\n", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.usage = usage
+	b.rollLocked(time.Now().UTC())
+}
+
+// rollLocked starts the count over when a new month begins.
+func (b *budgetTracker) rollLocked(now time.Time) {
+	month := now.Format("2006-01")
+	if b.usage.Month == month && b.usage.Sent != nil {
+		return
+	}
+	b.usage = budgetUsage{Month: month, Sent: make(map[string]int), Warned: make(map[string]string)}
+	for destination := range channelBudgets {
+		budgetUsed.set(0, destination)
+	}
+}
+
+// allow reports whether destination has budget left this month.
+func (b *budgetTracker) allow(destination string, now time.Time) bool {
+	budget, ok := channelBudgets[destination]
+	if !ok {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+	return b.usage.Sent[destination] < budget.Monthly
+}
+
+// spend counts a notification delivered to destination and warns when its
+// budget is running out.
+func (b *budgetTracker) spend(destination string, now time.Time) {
+	budget, ok := channelBudgets[destination]
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+
+	b.usage.Sent[destination]++
+	sent := b.usage.Sent[destination]
+	budgetUsed.set(float64(sent), destination)
+
+	level := ""
+	switch {
+	case sent >= budget.Monthly:
+		level = "exhausted"
+	case float64(sent) >= budgetWarnRatio*float64(budget.Monthly):
+		level = "warning"
+	}
+	if level != "" && b.usage.Warned[destination] != level {
+		b.usage.Warned[destination] = level
+		then := "further notifications are dropped"
+		if budget.Fallback != "" {
+			then = "further notifications go to " + budget.Fallback
+		}
+		if level == "warning" {
+			sendSelfAlert(now, "", "SEFI-Alarm notification budget almost used",
+				fmt.Sprintf("%s got %d of its %d notifications for %s. Once the budget is used up, %s.", destination, sent, budget.Monthly, b.usage.Month, then))
+		} else {
+			sendSelfAlert(now, "", "SEFI-Alarm notification budget used up",
+				fmt.Sprintf("%s got all %d of its notifications for %s, %s until next month.", destination, budget.Monthly, b.usage.Month, then))
+		}
+	}
+
+	if err := saveState(budgetsFile, b.usage); err != nil {
+		log.Printf("Error saving notification budgets: %v\n", err)
+	}
+}
+
+// notificationBudgetKey names the budget n is counted against.
+func notificationBudgetKey(n *Notification) string {
+	switch n.Notifier {
+	case notifierGitHub, notifierEvents:
+		return n.Notifier
+	}
+	if slackBotMode() && !slackWorkflowMode() {
+		if n.Message.Channel != "" {
+			return n.Message.Channel
+		}
+		return slackChannel
+	}
+	return "slack"
+}
+
+// deliverOverBudget sends n, whose destination has no budget left, to the
+// fallback channel as a plain Slack message, or drops it.
+func deliverOverBudget(ctx context.Context, n *Notification, destination string, now time.Time) error {
+	fallback := channelBudgets[destination].Fallback
+	if fallback == "" || !budgets.allow(fallback, now) {
+		log.Printf("Dropping %s notification for integration %d: the monthly budget of %s is used up.\n", notifierName(n), n.IntegrationID, destination)
+		budgetDropped.inc(destination)
+		return nil
+	}
+
+	message := n.Message
+	switch {
+	case n.Ticket != nil:
+		message = SlackMessage{Text: n.Ticket.Title + "\n" + n.Ticket.Body}
+	case n.Event != nil:
+		message = SlackMessage{Text: n.Event.Summary + "\n" + n.Event.Description}
+	}
+	message.Channel, message.ThreadTS = fallback, ""
+	message.Metadata = slackMetadata(n)
+	if err := sendSlackNotification(ctx, message); err != nil {
+		return err
+	}
+	log.Printf("Sent %s notification for integration %d to %s: the monthly budget of %s is used up.\n", notifierName(n), n.IntegrationID, fallback, destination)
+	budgetRerouted.inc(destination)
+	budgets.spend(fallback, now)
+	return nil
+}
+
+// BudgetStatus is the usage of one budget, as the API reports it.
+type BudgetStatus struct {
+	Destination string `json:"destination"`
+	Month       string `json:"month"`
+	Sent        int    `json:"sent"`
+	Monthly     int    `json:"monthly"`
+	Fallback    string `json:"fallback,omitempty"`
+}
+
+func (b *budgetTracker) list(now time.Time) []BudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+
+	out := make([]BudgetStatus, 0, len(channelBudgets))
+	for destination, budget := range channelBudgets {
+		out = append(out, BudgetStatus{
+			Destination: destination,
+			Month:       b.usage.Month,
+			Sent:        b.usage.Sent[destination],
+			Monthly:     budget.Monthly,
+			Fallback:    budget.Fallback,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Destination < out[j].Destination })
+	return out
+}
+
+func handleBudgets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, budgets.list(time.Now().UTC()))
+}
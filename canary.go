@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A candidate config can run in shadow mode next to the active one: every
+// alert decision is also made with the candidate's routing and filters, and
+// where the two differ the log says what the candidate would have done. After
+// the trial period a report is sent and, with autoPromote, the candidate
+// atomically replaces config.yaml. Trials need features.canary.
+var (
+	canaryConfigFile  = conf.String("canary.configFile", "")
+	canaryTrialPeriod = time.Duration(conf.Int("canary.trialHours", 24)) * time.Hour
+	canaryAutoPromote = conf.Bool("canary.autoPromote", false)
+)
+
+var (
+	canaryEvaluations = metrics.newCounter("sefi_canary_evaluations_total",
+		"Alert decisions also made with the candidate config.")
+	canaryDifferences = metrics.newCounter("sefi_canary_differences_total",
+		"Alert decisions the candidate config would have made differently.")
+)
+
+// routing is the part of a config that decides whether and where the alerts
+// of an integration go.
+type routing struct {
+	channel            string
+	channelOverrides   map[string]string
+	owners             map[int]Owner
+	categoryChannels   map[string]string
+	digestIntegrations []string
+	namePattern        *regexp.Regexp
+	typePattern        *regexp.Regexp
+	correlation        bool
+	github             bool
+}
+
+func routingFrom(c configMap) (routing, error) {
+	r := routing{
+		channel:            c.String("slackChannel", ""),
+		channelOverrides:   c.StringMap("slackChannelOverrides"),
+		categoryChannels:   c.StringMap("slackCategoryChannels"),
+		digestIntegrations: c.StringList("digest.integrations"),
+		correlation:        c.String("eventCorrelation.url", "") != "",
+		github:             c.String("github.token", "") != "" && c.String("github.repo", "") != "",
+	}
+	owners, err := ownersFrom(c)
+	if err != nil {
+		return routing{}, fmt.Errorf("invalid owners.integrations: %v", err)
+	}
+	r.owners = owners
+	for key, re := range map[string]**regexp.Regexp{"discovery.namePattern": &r.namePattern, "discovery.typePattern": &r.typePattern} {
+		if pattern := c.String(key, ""); pattern != "" {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return routing{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*re = compiled
+		}
+	}
+	return r, nil
+}
+
+// decide describes what happens to new errors of integrationID whose
+// dominant category is category.
+func (r routing) decide(integrationID int, category string) string {
+	if in, ok := integrationMeta.get(integrationID); ok {
+		if r.namePattern != nil && !r.namePattern.MatchString(in.Name) {
+			return "not monitored (discovery.namePattern)"
+		}
+		if r.typePattern != nil && !r.typePattern.MatchString(in.Type) {
+			return "not monitored (discovery.typePattern)"
+		}
+	}
+
+	var actions []string
+	if r.correlation {
+		actions = append(actions, "event correlation")
+	}
+	id := strconv.Itoa(integrationID)
+	if containsString(r.digestIntegrations, id) {
+		actions = append(actions, "digest")
+		return strings.Join(actions, ", ")
+	}
+	channel := r.channel
+	owner, ok := r.owners[integrationID]
+	if !ok {
+		owner, _ = owners.fetchedOwner(integrationID)
+	}
+	if owner.SlackChannel != "" {
+		channel = owner.SlackChannel
+	}
+	if override, ok := r.channelOverrides[id]; ok {
+		channel = override
+	}
+	if override, ok := r.categoryChannels[category]; ok {
+		channel = override
+	}
+	if channel == "" {
+		channel = "the webhook channel"
+	}
+	actions = append(actions, "Slack "+channel)
+	if r.github {
+		actions = append(actions, "GitHub issue")
+	}
+	return strings.Join(actions, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// canaryDifference is a decision the candidate would have made differently.
+type canaryDifference struct {
+	At            time.Time `json:"at"`
+	IntegrationID int       `json:"integrationId"`
+	Category      string    `json:"category"`
+	Active        string    `json:"active"`
+	Candidate     string    `json:"candidate"`
+}
+
+type canaryTrial struct {
+	mu          sync.Mutex
+	active      routing
+	candidate   routing
+	loaded      bool
+	startedAt   time.Time
+	evaluations int
+	differences []canaryDifference
+	reported    bool
+}
+
+var canary = loadCanary()
+
+func loadCanary() *canaryTrial {
+	t := &canaryTrial{startedAt: time.Now().UTC()}
+	if canaryConfigFile == "" || !featureEnabled("canary") {
+		return t
+	}
+	if err := t.load(); err != nil {
+		log.Printf("Error loading canary config, not running a trial: %v\n", err)
+	}
+	return t
+}
+
+func (t *canaryTrial) load() error {
+	candidate, err := readConfigFile(canaryConfigFile)
+	if err != nil {
+		return err
+	}
+	candidateRouting, err := routingFrom(candidate)
+	if err != nil {
+		return fmt.Errorf("%s: %v", canaryConfigFile, err)
+	}
+	activeRouting, err := routingFrom(conf)
+	if err != nil {
+		return err
+	}
+	t.active, t.candidate, t.loaded = activeRouting, candidateRouting, true
+	log.Printf("Evaluating candidate config %s in shadow mode for %s.\n", canaryConfigFile, canaryTrialPeriod)
+	return nil
+}
+
+// compare makes the decision for new errors of integrationID with both
+// configs and logs what the candidate would have done differently.
+func (t *canaryTrial) compare(integrationID int, category string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		return
+	}
+
+	t.evaluations++
+	canaryEvaluations.inc()
+	active, candidate := t.active.decide(integrationID, category), t.candidate.decide(integrationID, category)
+	if active == candidate {
+		return
+	}
+	canaryDifferences.inc()
+	log.Printf("Canary: the candidate config would have sent the %s errors of integration %d to %s instead of %s.\n",
+		category, integrationID, candidate, active)
+	t.differences = append(t.differences, canaryDifference{
+		At: now, IntegrationID: integrationID, Category: category, Active: active, Candidate: candidate,
+	})
+	// Keep the recent ones, the count is in the metric.
+	if len(t.differences) > 100 {
+		t.differences = t.differences[len(t.differences)-100:]
+	}
+}
+
+type canaryStatus struct {
+	ConfigFile  string             `json:"configFile"`
+	StartedAt   time.Time          `json:"startedAt"`
+	EndsAt      time.Time          `json:"endsAt"`
+	Evaluations int                `json:"evaluations"`
+	Differences []canaryDifference `json:"differences"`
+}
+
+func (t *canaryTrial) status() (canaryStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		return canaryStatus{}, false
+	}
+	return canaryStatus{
+		ConfigFile:  canaryConfigFile,
+		StartedAt:   t.startedAt,
+		EndsAt:      t.startedAt.Add(canaryTrialPeriod),
+		Evaluations: t.evaluations,
+		Differences: append([]canaryDifference{}, t.differences...),
+	}, true
+}
+
+// promote swaps the candidate in for config.yaml with a rename, keeping the
+// old file as config.yaml.previous, and reloads what can be reloaded.
+func (t *canaryTrial) promote() (reloadResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		return reloadResult{}, fmt.Errorf("no candidate config is being evaluated")
+	}
+
+	data, err := os.ReadFile(canaryConfigFile)
+	if err != nil {
+		return reloadResult{}, err
+	}
+	if current, err := os.ReadFile(configFile); err == nil {
+		if err := os.WriteFile(configFile+".previous", current, 0o600); err != nil {
+			return reloadResult{}, fmt.Errorf("failed to back up %s: %v", configFile, err)
+		}
+	}
+	tmp := configFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return reloadResult{}, fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, configFile); err != nil {
+		os.Remove(tmp)
+		return reloadResult{}, fmt.Errorf("failed to replace %s: %v", configFile, err)
+	}
+	t.loaded = false
+	log.Printf("Promoted candidate config %s to %s, the previous one is in %s.previous.\n", canaryConfigFile, configFile, configFile)
+
+	result, err := reloadConfig()
+	if err != nil {
+		return result, fmt.Errorf("promoted, but reloading failed: %v", err)
+	}
+	if len(result.RestartRequired) > 0 {
+		log.Printf("Changes to %v only apply after a restart.\n", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// canaryLoop ends the trial: it reports how the candidate did and promotes
+// it when autoPromote is set.
+func canaryLoop(ctx context.Context) {
+	status, ok := canary.status()
+	if !ok {
+		return
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(status.EndsAt)):
+	}
+
+	status, ok = canary.status()
+	if !ok {
+		return
+	}
+	summary := fmt.Sprintf("The candidate config %s made %d of %d alert decisions differently during its %s trial.",
+		status.ConfigFile, len(status.Differences), status.Evaluations, canaryTrialPeriod)
+	if !canaryAutoPromote {
+		sendSelfAlert(time.Now().UTC(), "", "SEFI-Alarm canary config trial ended",
+			summary+" Promote it with `sefi-alarm ctl canary promote` or remove canary.configFile.")
+		return
+	}
+	if _, err := canary.promote(); err != nil {
+		sendSelfAlert(time.Now().UTC(), reasonPollerDegraded, "SEFI-Alarm canary config promotion failed", summary+" "+err.Error())
+		return
+	}
+	sendSelfAlert(time.Now().UTC(), "", "SEFI-Alarm canary config promoted", summary+" It is now the active config.")
+}
+
+func handleCanary(w http.ResponseWriter, r *http.Request) {
+	status, ok := canary.status()
+	if !ok {
+		http.Error(w, "no candidate config is being evaluated", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func handleCanaryPromote(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	result, err := canary.promote()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const checkpointsFile = "checkpoints.json"
+
+// checkpoints remembers, per integration, the newest error timestamp that was
+// already alerted on so overlapping polls and restarts don't alert twice.
+type checkpoints struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+var seen = loadCheckpoints()
+
+func loadCheckpoints() *checkpoints {
+	c := &checkpoints{lastSeen: make(map[string]time.Time)}
+	if _, err := loadState(checkpointsFile, &c.lastSeen); err != nil {
+		log.Printf("Error loading checkpoints, starting without dedup history: %v\n", err)
+	}
+	return c
+}
+
+// reload replaces the checkpoints with the ones on disk, which the active
+// instance keeps writing while this one is on standby.
+func (c *checkpoints) reload() {
+	lastSeen := make(map[string]time.Time)
+	if _, err := loadState(checkpointsFile, &lastSeen); err != nil {
+		log.Printf("Error reloading checkpoints: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSeen = lastSeen
+}
+
+// isNew reports whether an error at timestamp has not been alerted on yet.
+func (c *checkpoints) isNew(integrationID int, timestamp time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return timestamp.After(c.lastSeen[strconv.Itoa(integrationID)])
+}
+
+// advance moves the checkpoint for integrationID forward to timestamp and
+// persists it.
+func (c *checkpoints) advance(integrationID int, timestamp time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strconv.Itoa(integrationID)
+	if !timestamp.After(c.lastSeen[key]) {
+		return
+	}
+	c.lastSeen[key] = timestamp
+
+	if err := saveState(checkpointsFile, c.lastSeen); err != nil {
+		log.Printf("Error saving checkpoints: %v\n", err)
+	}
+}
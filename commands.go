@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+	"github.com/spf13/cobra"
+)
+
+func newRootCommand() *cobra.Command {
+	var once, exportRules bool
+
+	run := func(cmd *cobra.Command, args []string) error {
+		if exportRules {
+			return writePrometheusRules(os.Stdout)
+		}
+		runDaemon(once)
+		return nil
+	}
+
+	root := &cobra.Command{
+		Use:          "sefi-alarm",
+		Short:        "Alert on Sysdig events forwarding errors",
+		SilenceUsage: true,
+		// Without a subcommand the daemon runs, as it always did.
+		RunE:    run,
+		Version: version,
+	}
+	root.SetVersionTemplate(currentBuildInfo().String() + "\n")
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Poll the Sysdig API and notify about new errors (the default)",
+		Args:  cobra.NoArgs,
+		RunE:  run,
+	}
+	for _, cmd := range []*cobra.Command{root, runCmd} {
+		cmd.Flags().BoolVar(&once, "once", false, "poll once, deliver the alerts and exit with 1 if new errors were found (2 if polling failed)")
+		cmd.Flags().BoolVar(&exportRules, "export-prometheus-rules", false, "print Prometheus alerting rules equivalent to the config and exit")
+	}
+
+	root.AddCommand(
+		runCmd,
+		newValidateCommand(),
+		newTestNotifyCommand(),
+		newProbeCommand(),
+		newVersionCommand(),
+		newQueryCommand(),
+		newExportCommand(),
+		newHistoryCommand(),
+		newExplainCommand(),
+		newExplainSeverityCommand(),
+		newCtlCommand(),
+		newOperatorCommand(),
+	)
+	return root
+}
+
+// normalizeLegacyFlags rewrites the single-dash long flags of earlier
+// releases ("-once") to the form the CLI parses ("--once"), so existing
+// cron entries keep working.
+func normalizeLegacyFlags(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch strings.SplitN(arg, "=", 2)[0] {
+		case "-once", "-export-prometheus-rules", "-version":
+			arg = "-" + arg
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+// versionRequested reports whether args ask for the version, through the
+// version command or the --version flag.
+func versionRequested(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "version", "--version", "-v":
+		return true
+	}
+	return false
+}
+
+func newValidateCommand() *cobra.Command {
+	var offline bool
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check config.yaml and the Sysdig and Slack credentials, exit non-zero on problems",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems := validateConfig()
+			// Probing with an incomplete config would only repeat its problems.
+			if len(problems) == 0 && !offline {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				problems = checkConnectivity(ctx)
+			}
+			if len(problems) == 0 {
+				fmt.Println("config.yaml is valid.")
+				return nil
+			}
+			for _, problem := range problems {
+				fmt.Fprintln(os.Stderr, "- "+problem)
+			}
+			return fmt.Errorf("config.yaml has %d problem(s)", len(problems))
+		},
+	}
+	cmd.Flags().BoolVar(&offline, "offline", false, "only check the config, without calling the Sysdig API or Slack")
+	return cmd
+}
+
+// validateConfig lists what keeps the config from working. Syntax errors,
+// missing required settings, settings of the wrong type and unknown regions
+// are already rejected while the config is loaded.
+func validateConfig() []string {
+	var problems []string
+	if bearerToken == "" {
+		problems = append(problems, "bearerToken is empty")
+	}
+	if integrationID == "0" && !discoveryEnabled {
+		problems = append(problems, "integrationId is not set and discovery is disabled")
+	}
+	if tenantID == "" || tenantID == "0" {
+		problems = append(problems, "tenantId is not set")
+	}
+	if checkInterval <= 0 {
+		problems = append(problems, "pollIntervalSecs must be positive")
+	}
+	if slackWebhookURL == "" && !slackBotMode() {
+		problems = append(problems, "no Slack destination: set slackWebhookUrl, or slackBotToken and slackChannel")
+	}
+	if err := checkStateDir(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if correlationEnabled() {
+		if _, err := correlationPayload(&CorrelationEvent{Tags: map[string]string{}}); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+func newTestNotifyCommand() *cobra.Command {
+	var integration int
+	cmd := &cobra.Command{
+		Use:   "test-notify",
+		Short: "Send a test alert through every configured notifier",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			if integration == 0 {
+				ids := monitored.list(ctx)
+				if len(ids) == 0 {
+					return fmt.Errorf("no integration to send the test alert for, use --integration")
+				}
+				integration = ids[0]
+			}
+
+			failed := 0
+			for _, result := range sendTestAlerts(ctx, integration) {
+				if result.Err != nil {
+					failed++
+					fmt.Printf("FAIL %s: %v\n", result.Notifier, result.Err)
+				} else {
+					fmt.Printf("OK   %s\n", result.Notifier)
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d notifiers failed", failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&integration, "integration", 0, "integration the test alert is about (default the first monitored one)")
+	return cmd
+}
+
+func newProbeCommand() *cobra.Command {
+	var verifyAfter time.Duration
+	cmd := &cobra.Command{
+		Use:   "probe [integration...]",
+		Short: "Send a test event through integrations and check it was forwarded",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			ids, err := integrationArgs(ctx, args)
+			if err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, result := range probeAll(ctx, ids, verifyAfter) {
+				switch {
+				case result.Err == errProbeUnsupported:
+					fmt.Printf("SKIP %d: %v\n", result.IntegrationID, result.Err)
+				case result.Err != nil:
+					failed++
+					fmt.Printf("FAIL %d: %v\n", result.IntegrationID, result.Err)
+				default:
+					fmt.Printf("OK   %d\n", result.IntegrationID)
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d integrations failed the probe", failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&verifyAfter, "verify-after", probeVerifyAfter, "how long to wait before checking the error feed")
+	return cmd
+}
+
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(currentBuildInfo())
+		},
+	}
+}
+
+func newQueryCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "query [integration...]",
+		Short: "Fetch and print the current errors without notifying",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			ids, err := integrationArgs(ctx, args)
+			if err != nil {
+				return err
+			}
+
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "INTEGRATION\tTIMESTAMP\tCATEGORY\tERROR")
+			for _, id := range ids {
+				payload, err := pollEndpoint(ctx, id, sysdig.ErrorsQuery{})
+				if err != nil {
+					return fmt.Errorf("integration %d: %v", id, err)
+				}
+				for _, e := range payload.Errors {
+					fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", id, e.Timestamp, classifyError(e.Error), e.Error)
+				}
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newExportCommand() *cobra.Command {
+	var format, output, compress string
+	cmd := &cobra.Command{
+		Use:   "export [integration...]",
+		Short: "Write the current errors as JSON or CSV, without notifying",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "json" && format != "csv" {
+				return fmt.Errorf("unknown format %q, use json or csv", format)
+			}
+			if compress != "none" && compress != "zstd" {
+				return fmt.Errorf("unknown compression %q, use none or zstd", compress)
+			}
+			ctx := context.Background()
+			ids, err := integrationArgs(ctx, args)
+			if err != nil {
+				return err
+			}
+
+			var records []exportedError
+			for _, id := range ids {
+				payload, err := pollEndpoint(ctx, id, sysdig.ErrorsQuery{})
+				if err != nil {
+					return fmt.Errorf("integration %d: %v", id, err)
+				}
+				integrationMeta.load(ctx, id)
+				records = append(records, exportRecords(id, payload.Errors)...)
+			}
+
+			w := os.Stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("failed to create %s: %v", output, err)
+				}
+				defer f.Close()
+				w = f
+			}
+			// The same streaming compressor as the payload archive.
+			cw, err := newCompressedWriter(w, compress)
+			if err != nil {
+				return err
+			}
+			if err := writeExport(cw, format, records); err != nil {
+				return err
+			}
+			if err := cw.Close(); err != nil {
+				return fmt.Errorf("failed to compress the export: %v", err)
+			}
+			if w != os.Stdout {
+				if err := w.Close(); err != nil {
+					return fmt.Errorf("failed to write %s: %v", output, err)
+				}
+				fmt.Fprintf(os.Stderr, "Wrote %d errors to %s\n", len(records), output)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "json", "output format, json or csv")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write to (default stdout)")
+	cmd.Flags().StringVar(&compress, "compress", "none", "compression of the output, none or zstd")
+	return cmd
+}
+
+// integrationArgs parses the integration IDs given on the command line, or
+// returns the monitored integrations when there are none.
+func integrationArgs(ctx context.Context, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return monitored.list(ctx), nil
+	}
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("integration must be a numeric ID, got %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func newExplainSeverityCommand() *cobra.Command {
+	var integration, count int
+	var message string
+	cmd := &cobra.Command{
+		Use:   "explain-severity --integration <id> [--error <message>]",
+		Short: "Show which level of the severity hierarchy decides an alert's severity",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if integration == 0 {
+				return fmt.Errorf("--integration is required")
+			}
+			integrationMeta.load(context.Background(), integration)
+			errors := []ErrorLog{{Error: message, Category: classifyError(message)}}
+			explainSeverity(os.Stdout, errors, &Payload{IntegrationID: integration, Count: count, Errors: errors})
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&integration, "integration", 0, "integration the alert is about")
+	cmd.Flags().StringVar(&message, "error", "", "error message of the alert")
+	cmd.Flags().IntVar(&count, "count", 1, "errors in the payload")
+	return cmd
+}
+
+func newExplainCommand() *cobra.Command {
+	var at string
+	var integration int
+	var window time.Duration
+	cmd := &cobra.Command{
+		Use:   "explain --at <timestamp> --integration <id>",
+		Short: "Replay the archived polls around a time and explain what was notified and why",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			t, err := parseExplainTime(at)
+			if err != nil {
+				return err
+			}
+			defer history.close()
+			return explain(os.Stdout, integration, t, window)
+		},
+	}
+	cmd.Flags().StringVar(&at, "at", "", "time to explain, e.g. 2024-05-01T13:45:00Z")
+	cmd.Flags().IntVar(&integration, "integration", 0, "integration to explain")
+	cmd.Flags().DurationVar(&window, "window", 10*time.Minute, "polls this long before and after --at are shown")
+	cmd.MarkFlagRequired("at")
+	cmd.MarkFlagRequired("integration")
+	return cmd
+}
+
+func newOperatorCommand() *cobra.Command {
+	operator := &cobra.Command{
+		Use:   "operator",
+		Short: "Manage the custom resources of operator mode",
+	}
+	operator.AddCommand(&cobra.Command{
+		Use:   "crds",
+		Short: "Print the CRDs and ClusterRole of operator mode, for kubectl apply -f -",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Print(operatorManifests)
+		},
+	})
+	return operator
+}
+
+func newHistoryCommand() *cobra.Command {
+	history := &cobra.Command{
+		Use:   "history",
+		Short: "Query the error history",
+	}
+	var limit int
+	search := &cobra.Command{
+		Use:   "search <error text>",
+		Short: "Find past occurrences of an error message",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return historySearch(strings.Join(args, " "), limit)
+		},
+	}
+	search.Flags().IntVar(&limit, "limit", 20, "maximum number of occurrences to print")
+
+	var since, integration string
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "Sum up errors and notifications per integration",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return historyStats(since, integration)
+		},
+	}
+	stats.Flags().StringVar(&since, "since", "30d", "period to sum up, e.g. 30d or 12h")
+	stats.Flags().StringVar(&integration, "integration", "", "only integrations with this ID or whose name contains this")
+
+	var notificationsSince string
+	var notificationsLimit int
+	notifications := &cobra.Command{
+		Use:   "notifications",
+		Short: "List the notifications sent, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return historyNotifications(notificationsSince, notificationsLimit)
+		},
+	}
+	notifications.Flags().StringVar(&notificationsSince, "since", "7d", "period to list, e.g. 7d or 12h")
+	notifications.Flags().IntVar(&notificationsLimit, "limit", 50, "maximum number of notifications to print")
+
+	var reportTeam string
+	var reportSend bool
+	report := &cobra.Command{
+		Use:   "report",
+		Short: "Print the owner reports for the last period, or email them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return historyReport(reportTeam, reportSend)
+		},
+	}
+	report.Flags().StringVar(&reportTeam, "team", "", "only the report of this team")
+	report.Flags().BoolVar(&reportSend, "send", false, "email the reports instead of printing them")
+
+	history.AddCommand(search, stats, notifications, report)
+	return history
+}
+
+func historySearch(query string, limit int) error {
+	entries, err := history.search(strings.TrimSpace(query), limit)
+	if err != nil {
+		return err
+	}
+	defer history.close()
+
+	if len(entries) == 0 {
+		fmt.Println("No matching errors in history.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OCCURRED\tINTEGRATION\tFINGERPRINT\tERROR")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.OccurredAt.Format(time.RFC3339), e.IntegrationID, e.Fingerprint, e.Error)
+	}
+	return tw.Flush()
+}
+
+func historyStats(since, integration string) error {
+	period, err := parseSince(since)
+	if err != nil {
+		return err
+	}
+	stats, err := history.stats(time.Now().UTC().Add(-period), strings.TrimSpace(integration))
+	if err != nil {
+		return err
+	}
+	defer history.close()
+
+	if len(stats) == 0 {
+		fmt.Printf("No errors or notifications in the last %s.\n", since)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTEGRATION\tERRORS\tDAYS\tLAST\tNOTIFIED\tFAILED\tCATEGORIES")
+	for _, s := range stats {
+		last := "-"
+		if s.LastAt != nil {
+			last = s.LastAt.Format(time.RFC3339)
+		}
+		label := strconv.Itoa(s.IntegrationID)
+		if s.IntegrationName != "" {
+			label = fmt.Sprintf("%s (%d)", s.IntegrationName, s.IntegrationID)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%d\t%s\n", label,
+			s.Errors, s.DaysWithErrors, last, s.Notifications, s.FailedNotifications, formatCategoryCounts(s.Categories))
+	}
+	return tw.Flush()
+}
+
+func historyReport(team string, send bool) error {
+	now := time.Now().UTC()
+	reports, err := buildOwnerReports(now.Add(-ownerReportPeriod()), now)
+	if err != nil {
+		return err
+	}
+	defer history.close()
+
+	printed := 0
+	for _, report := range reports {
+		if team != "" && report.Team != team {
+			continue
+		}
+		printed++
+		if !send {
+			to := strings.Join(report.To, ", ")
+			if to == "" {
+				to = "(no email set, not sent)"
+			}
+			fmt.Printf("To: %s\nSubject: %s\n\n%s\n", to, report.subject(), report.body())
+			continue
+		}
+		if len(report.To) == 0 {
+			fmt.Printf("Not emailing %s: no email set.\n", report.Team)
+			continue
+		}
+		if err := checkOwnerReportConfig(); err != nil {
+			return err
+		}
+		if err := sendEmail(report.To, report.subject(), report.body()); err != nil {
+			return fmt.Errorf("emailing the report of %s: %v", report.Team, err)
+		}
+		fmt.Printf("Emailed the report of %s to %s.\n", report.Team, strings.Join(report.To, ", "))
+	}
+	if printed == 0 {
+		fmt.Println("No team owns an integration.")
+	}
+	return nil
+}
+
+func historyNotifications(since string, limit int) error {
+	period, err := parseSince(since)
+	if err != nil {
+		return err
+	}
+	entries, err := history.notifications(time.Now().UTC().Add(-period), limit)
+	if err != nil {
+		return err
+	}
+	defer history.close()
+
+	if len(entries) == 0 {
+		fmt.Printf("No notifications in the last %s.\n", since)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SENT\tINTEGRATION\tNOTIFIER\tREASON\tRESULT\tTITLE")
+	for _, e := range entries {
+		result := "delivered"
+		switch {
+		case e.Held:
+			result = "held: " + e.Error
+		case !e.Delivered:
+			result = "failed: " + e.Error
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", e.SentAt.Format(time.RFC3339), e.IntegrationID, e.Notifier, e.Reason, result, e.Title)
+	}
+	return tw.Flush()
+}
+
+// formatCategoryCounts renders counts as "auth=3 timeout=1", most frequent
+// first.
+func formatCategoryCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Alert conditions decide which new errors are worth an alert, as an
+// expression evaluated for each error. conditions.default applies to every
+// integration without its own under conditions.integrations:
+//
+//	conditions:
+//	  default: 'category != "rate_limit"'
+//	  integrations:
+//	    "1234": 'count > 5 && error.matches("timeout")'
+//
+// Expressions can use
+//
+//	error        the error message         string
+//	category     its error category        string
+//	count        errors in the payload     number
+//	recent       new errors in the poll    number
+//	integration  the integration ID        number
+//	name, type   the integration's         string
+//	tenant       the tenant ID             string
+//
+// with ==, !=, <, <=, >, >=, &&, || and !, parentheses, and the string methods
+// matches, contains, startsWith and endsWith. Errors of integrations without
+// a condition are always alerted.
+type conditionSet struct {
+	fallback     *condition
+	integrations map[int]*condition
+}
+
+var alertConditions = loadConditions()
+
+func loadConditions() conditionSet {
+	set, err := conditionsFrom(conf)
+	if err != nil {
+		addConfigProblem("conditions: %v", err)
+	}
+	return set
+}
+
+func conditionsFrom(c configMap) (conditionSet, error) {
+	set := conditionSet{integrations: make(map[int]*condition)}
+	if text := c.String("conditions.default", ""); text != "" {
+		cond, err := parseCondition(text)
+		if err != nil {
+			return conditionSet{}, fmt.Errorf("conditions.default: %v", err)
+		}
+		set.fallback = cond
+	}
+	v, ok := c.Lookup("conditions.integrations")
+	if !ok {
+		return set, nil
+	}
+	section, ok := asSection(v)
+	if !ok {
+		return conditionSet{}, fmt.Errorf("conditions.integrations must map integration IDs to expressions")
+	}
+	for key, value := range section {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return conditionSet{}, fmt.Errorf("conditions.integrations: %q is not an integration ID", key)
+		}
+		cond, err := parseCondition(fmt.Sprint(value))
+		if err != nil {
+			return conditionSet{}, fmt.Errorf("conditions.integrations.%d: %v", id, err)
+		}
+		set.integrations[id] = cond
+	}
+	return set, nil
+}
+
+func (s conditionSet) forIntegration(integrationID int) *condition {
+	if cond, ok := s.integrations[integrationID]; ok {
+		return cond
+	}
+	return s.fallback
+}
+
+// filter returns the errors of payload that meet the integration's
+// condition. An expression that fails to evaluate alerts, so a mistake in it
+// can't hide errors.
+func (s conditionSet) filter(errors []ErrorLog, payload *Payload) []ErrorLog {
+	cond := s.forIntegration(payload.IntegrationID)
+	if cond == nil {
+		return errors
+	}
+	vars := conditionVars(payload, len(errors))
+	var kept []ErrorLog
+	for _, err := range errors {
+		vars["error"] = err.Error
+		vars["category"] = err.Category
+		met, evalErr := cond.eval(vars)
+		if evalErr != nil {
+			log.Printf("Error evaluating the condition of integration %d, alerting: %v\n", payload.IntegrationID, evalErr)
+			met = true
+		}
+		if met {
+			kept = append(kept, err)
+		}
+	}
+	return kept
+}
+
+// conditionVars returns the variables of an expression evaluated on a poll of
+// payload with recent new errors, except the per-error ones.
+func conditionVars(payload *Payload, recent int) map[string]interface{} {
+	in, _ := integrationMeta.get(payload.IntegrationID)
+	return map[string]interface{}{
+		"count":       float64(payload.Count),
+		"recent":      float64(recent),
+		"integration": float64(payload.IntegrationID),
+		"name":        in.Name,
+		"type":        in.Type,
+		"tenant":      tenantID,
+	}
+}
+
+// condition is a parsed expression.
+type condition struct {
+	text string
+	root conditionNode
+}
+
+type conditionNode interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+var conditionVariables = map[string]bool{
+	"error": true, "category": true, "count": true, "recent": true,
+	"integration": true, "name": true, "type": true, "tenant": true,
+}
+
+func (c *condition) eval(vars map[string]interface{}) (bool, error) {
+	v, err := c.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%q is not true or false", c.text)
+	}
+	return b, nil
+}
+
+func parseCondition(text string) (*condition, error) {
+	tokens, err := tokenizeCondition(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &condition{text: text, root: root}, nil
+}
+
+type conditionToken struct {
+	kind string // "ident", "number", "string" or "op"
+	text string
+}
+
+func tokenizeCondition(text string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(text) && (unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j])) || text[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, conditionToken{"ident", text[i:j]})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(text) && (unicode.IsDigit(rune(text[j])) || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, conditionToken{"number", text[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(text) && rune(text[j]) != c; j++ {
+				if text[j] == '\\' && j+1 < len(text) {
+					j++
+				}
+				sb.WriteByte(text[j])
+			}
+			if j >= len(text) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, conditionToken{"string", sb.String()})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ".", ","} {
+				if strings.HasPrefix(text[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, conditionToken{"op", op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) or() (conditionNode, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right conditionNode
+		if right, err = p.and(); err == nil {
+			left = logicalNode{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *conditionParser) and() (conditionNode, error) {
+	left, err := p.not()
+	for err == nil && p.accept("&&") {
+		var right conditionNode
+		if right, err = p.not(); err == nil {
+			left = logicalNode{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *conditionParser) not() (conditionNode, error) {
+	if p.accept("!") {
+		operand, err := p.not()
+		return notNode{operand}, err
+	}
+	return p.comparison()
+}
+
+func (p *conditionParser) comparison() (conditionNode, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			right, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			return compareNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) primary() (conditionNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	if p.accept("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+	var node conditionNode
+	switch token.kind {
+	case "number":
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		node = literalNode{n}
+	case "string":
+		node = literalNode{token.text}
+	case "ident":
+		switch {
+		case token.text == "true" || token.text == "false":
+			node = literalNode{token.text == "true"}
+		case conditionVariables[token.text]:
+			node = variableNode(token.text)
+		default:
+			return nil, fmt.Errorf("unknown variable %q", token.text)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+
+	for p.accept(".") {
+		call, err := p.method(node)
+		if err != nil {
+			return nil, err
+		}
+		node = call
+	}
+	return node, nil
+}
+
+// method parses a string method call on receiver. Regular expressions given
+// as literals are compiled once, here.
+func (p *conditionParser) method(receiver conditionNode) (conditionNode, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != "ident" {
+		return nil, fmt.Errorf("expected a method name after .")
+	}
+	name := p.tokens[p.pos].text
+	p.pos++
+	switch name {
+	case "matches", "contains", "startsWith", "endsWith":
+	default:
+		return nil, fmt.Errorf("unknown method %q", name)
+	}
+	if !p.accept("(") {
+		return nil, fmt.Errorf("expected ( after %s", name)
+	}
+	arg, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(")") {
+		return nil, fmt.Errorf("%s takes one argument", name)
+	}
+
+	call := methodNode{name: name, receiver: receiver, arg: arg}
+	if lit, ok := arg.(literalNode); ok && name == "matches" {
+		pattern, ok := lit.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches takes a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		call.re = re
+	}
+	return call, nil
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+type variableNode string
+
+func (n variableNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return vars[string(n)], nil
+}
+
+type notNode struct{ operand conditionNode }
+
+func (n notNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs true or false, got %v", v)
+	}
+	return !b, nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	operand := func(node conditionNode) (bool, error) {
+		v, err := node.eval(vars)
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s needs true or false, got %v", n.op, v)
+		}
+		return b, nil
+	}
+	left, err := operand(n.left)
+	if err != nil {
+		return nil, err
+	}
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+	return operand(n.right)
+}
+
+type compareNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n compareNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v with %v", left, right)
+		}
+		switch n.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		default:
+			return l >= r, nil
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %q with %v", l, right)
+		}
+		switch n.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		default:
+			return l >= r, nil
+		}
+	case bool:
+		r, ok := right.(bool)
+		if !ok || (n.op != "==" && n.op != "!=") {
+			return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+		}
+		return (l == r) == (n.op == "=="), nil
+	}
+	return nil, fmt.Errorf("cannot compare %v", left)
+}
+
+type methodNode struct {
+	name     string
+	receiver conditionNode
+	arg      conditionNode
+	re       *regexp.Regexp
+}
+
+func (n methodNode) eval(vars map[string]interface{}) (interface{}, error) {
+	receiver, err := n.receiver.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := receiver.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s is a string method, called on %v", n.name, receiver)
+	}
+	v, err := n.arg.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	arg, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s takes a string, got %v", n.name, v)
+	}
+
+	switch n.name {
+	case "matches":
+		re := n.re
+		if re == nil {
+			if re, err = regexp.Compile(arg); err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %v", arg, err)
+			}
+		}
+		return re.MatchString(s), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	default:
+		return strings.HasSuffix(s, arg), nil
+	}
+}
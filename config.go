@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/jcotoBan/SEFI-Alarm/config"
+)
+
+// configMap is the parsed "config" block of config.yaml, see config.Map.
+type configMap = config.Map
+
+const configFile = "config.yaml"
+
+// readConfig parses the config block of config.yaml.
+func readConfig() (configMap, error) {
+	return readConfigFile(configFile)
+}
+
+// readConfigFile parses the config block of a file laid out like config.yaml.
+func readConfigFile(name string) (configMap, error) {
+	return config.ReadFile(name)
+}
+
+func asSection(v interface{}) (map[string]interface{}, bool) {
+	return config.AsSection(v)
+}
+
+func asStringList(v interface{}) []string {
+	return config.AsStringList(v)
+}
+
+// requiredSettings are the settings every run needs, and what they hold.
+var requiredSettings = []struct{ key, want string }{
+	{"bearerToken", "text"},
+	{"tenantId", "a whole number"},
+	{"region", "text"},
+	{"pollIntervalSecs", "a whole number"},
+}
+
+// loadConfig reads config.yaml. Its problems, a required setting missing as
+// well as a wrong type or an unknown value, are collected as they are read
+// and reported together by checkConfig. A config.yaml that can't be read is
+// taken as empty, so that version still works without one.
+func loadConfig() configMap {
+	c, err := readConfig()
+	if err != nil {
+		addConfigProblem("%s", configFileProblem(err))
+		return configMap{}
+	}
+
+	configMismatches.root = c
+	config.OnMismatch = configMismatches.add
+	for _, problem := range requiredSettingProblems(c) {
+		addConfigProblem("%s", problem)
+	}
+	return c
+}
+
+// requiredSettingProblems checks the settings every run needs.
+func requiredSettingProblems(c configMap) []string {
+	var problems []string
+	for _, s := range requiredSettings {
+		v, ok := c.Lookup(s.key)
+		if !ok {
+			problems = append(problems, s.key+" is not set")
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			if s.want != "text" {
+				problems = append(problems, mismatchProblem(s.key, s.want, v))
+			} else if v == "" {
+				problems = append(problems, s.key+" is empty")
+			}
+		case int:
+			if s.want != "a whole number" {
+				problems = append(problems, mismatchProblem(s.key, s.want, v))
+			} else if v <= 0 {
+				problems = append(problems, s.key+" must be positive")
+			}
+		default:
+			problems = append(problems, mismatchProblem(s.key, s.want, v))
+		}
+	}
+	return problems
+}
+
+// configFileProblem explains why config.yaml couldn't be read.
+func configFileProblem(err error) string {
+	if os.IsNotExist(err) {
+		dir, _ := os.Getwd()
+		return fmt.Sprintf("%s was not found in %s: copy config.yaml.template to %s and fill it in", configFile, dir, configFile)
+	}
+	return err.Error()
+}
+
+// mismatchProblem says that key holds got where it takes want.
+func mismatchProblem(key, want string, got interface{}) string {
+	problem := fmt.Sprintf("%s must be %s, not %s", key, want, describeConfigValue(got))
+	if s, ok := got.(string); ok {
+		_, intErr := strconv.Atoi(s)
+		_, boolErr := strconv.ParseBool(s)
+		if (want == "a whole number" && intErr == nil) || (want == "true or false" && boolErr == nil) {
+			problem += " (remove the quotes)"
+		}
+	}
+	return problem
+}
+
+func describeConfigValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "a mapping"
+	}
+	return fmt.Sprint(v)
+}
+
+func exitOnConfigProblems(problems []string) {
+	fmt.Fprintf(os.Stderr, "%s has %d problem(s):\n", configFile, len(problems))
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, "- "+problem)
+	}
+	os.Exit(1)
+}
+
+// configMismatchLog collects the problems of the settings of config.yaml:
+// the settings read with the wrong type, and those addConfigProblem reports.
+// Until checkConfig runs they are kept to be reported at once; after it,
+// settings read at run time with the wrong type are logged and their
+// defaults used.
+type configMismatchLog struct {
+	root configMap
+
+	mu       sync.Mutex
+	checked  bool
+	seen     map[string]bool
+	problems []string
+}
+
+var configMismatches = &configMismatchLog{seen: make(map[string]bool)}
+
+func (m *configMismatchLog) add(c configMap, path, want string, got interface{}) {
+	// Sections taken apart by their readers are read with paths relative
+	// to the section, which would be misleading here.
+	if v, ok := m.root.Lookup(path); !ok || !reflect.DeepEqual(v, got) {
+		return
+	}
+	problem := mismatchProblem(path, want, got)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[problem] {
+		return
+	}
+	m.seen[problem] = true
+	if m.checked {
+		log.Printf("Ignoring a setting of %s, using its default: %s\n", configFile, problem)
+		return
+	}
+	m.problems = append(m.problems, problem)
+}
+
+// addConfigProblem records a problem with a setting, found while the config
+// is read, for checkConfig to report with the others. The setting should be
+// read as unset meanwhile, so the rest of the config can still be checked.
+// Found after startup, such as on a reload, the problem is logged and the
+// default kept, like a setting of the wrong type.
+func addConfigProblem(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	m := configMismatches
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checked {
+		log.Printf("Ignoring a setting of %s, using its default: %s\n", configFile, problem)
+		return
+	}
+	if !m.seen[problem] {
+		m.seen[problem] = true
+		m.problems = append(m.problems, problem)
+	}
+}
+
+// checkConfig exits with the problems found while the config was read.
+func checkConfig() {
+	m := configMismatches
+	m.mu.Lock()
+	problems := m.problems
+	m.checked = true
+	m.mu.Unlock()
+	if len(problems) > 0 {
+		exitOnConfigProblems(problems)
+	}
+}
@@ -0,0 +1,167 @@
+// Package config reads files laid out like config.yaml, whose settings sit
+// under a top-level config block.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Map is the parsed config block. Optional settings are read through its
+// accessors, which take a dotted path ("section.key") and fall back to the
+// given default when the key is absent or left empty.
+type Map map[string]interface{}
+
+// OnMismatch, when set, is told about every setting an accessor finds but
+// can't read, such as a quoted number asked for with Int. want describes
+// what the accessor takes. The accessor falls back to its default either
+// way.
+var OnMismatch func(c Map, path, want string, got interface{})
+
+func (c Map) mismatch(path, want string, got interface{}) {
+	if OnMismatch != nil {
+		OnMismatch(c, path, want, got)
+	}
+}
+
+// ReadFile parses the config block of a file laid out like config.yaml.
+func ReadFile(name string) (Map, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	section, ok := AsSection(obj["config"])
+	if !ok {
+		return nil, fmt.Errorf("%s has no config block, the settings go under a top-level config: key", name)
+	}
+	return section, nil
+}
+
+// Lookup returns the value at path, if it is set.
+func (c Map) Lookup(path string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(c)
+	for _, key := range strings.Split(path, ".") {
+		section, ok := AsSection(current)
+		if !ok {
+			return nil, false
+		}
+		current, ok = section[key]
+		if !ok || current == nil {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (c Map) String(path, def string) string {
+	if v, ok := c.Lookup(path); ok {
+		s, ok := v.(string)
+		if !ok {
+			c.mismatch(path, "text", v)
+		} else if s != "" {
+			return s
+		}
+	}
+	return def
+}
+
+func (c Map) Int(path string, def int) int {
+	if v, ok := c.Lookup(path); ok {
+		if i, ok := v.(int); ok {
+			return i
+		}
+		c.mismatch(path, "a whole number", v)
+	}
+	return def
+}
+
+func (c Map) Bool(path string, def bool) bool {
+	if v, ok := c.Lookup(path); ok {
+		if b, ok := v.(bool); ok {
+			return b
+		}
+		c.mismatch(path, "true or false", v)
+	}
+	return def
+}
+
+// StringList returns the list at path. A single string is treated as a list
+// with one element.
+func (c Map) StringList(path string) []string {
+	v, ok := c.Lookup(path)
+	if !ok {
+		return nil
+	}
+	if _, ok := v.([]interface{}); !ok {
+		if _, ok := v.(string); !ok {
+			c.mismatch(path, "a list", v)
+		}
+	}
+	return AsStringList(v)
+}
+
+// AsStringList reads a decoded YAML list, or a single string, as strings.
+func AsStringList(v interface{}) []string {
+	switch list := v.(type) {
+	case string:
+		if list == "" {
+			return nil
+		}
+		return []string{list}
+	case []interface{}:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			if item != nil {
+				out = append(out, fmt.Sprint(item))
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// StringMap returns the mapping at path with keys and values rendered as
+// strings, so both "12345: x" and "name: x" entries can be looked up by text.
+func (c Map) StringMap(path string) map[string]string {
+	out := make(map[string]string)
+	v, ok := c.Lookup(path)
+	if !ok {
+		return out
+	}
+	section, ok := AsSection(v)
+	if !ok {
+		c.mismatch(path, "a mapping", v)
+		return out
+	}
+	for key, value := range section {
+		if value != nil {
+			out[key] = fmt.Sprint(value)
+		}
+	}
+	return out
+}
+
+// AsSection normalizes a decoded YAML mapping. yaml.v3 only produces
+// map[string]interface{} when every key is a string; mappings keyed by
+// integration IDs come back as map[interface{}]interface{}.
+func AsSection(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			out[fmt.Sprint(key)] = value
+		}
+		return out, true
+	}
+	return nil, false
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+config:
+  region: eu1
+  empty: ""
+  tenantId: 12345
+  quoted: "30"
+  stateless: true
+  slack:
+    channel: "#alerts"
+    retries: 3
+  channels: ["#a", "#b"]
+  channel: "#single"
+  webhooks:
+    12345: https://hooks.example.com/a
+    team: https://hooks.example.com/b
+  unset:
+`
+
+func readTestConfig(t *testing.T) Map {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return c
+}
+
+// recordMismatches collects what OnMismatch is told until the test ends.
+func recordMismatches(t *testing.T) *[]string {
+	var got []string
+	OnMismatch = func(c Map, path, want string, value interface{}) {
+		got = append(got, fmt.Sprintf("%s: %s", path, want))
+	}
+	t.Cleanup(func() { OnMismatch = nil })
+	return &got
+}
+
+func TestReadFileWithoutConfigBlock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte("region: eu1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(name); err == nil || !strings.Contains(err.Error(), "no config block") {
+		t.Errorf("ReadFile() error = %v, want a missing config block", err)
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	c := readTestConfig(t)
+	tests := []struct {
+		name         string
+		get          func() interface{}
+		want         interface{}
+		wantMismatch string
+	}{
+		{name: "string", get: func() interface{} { return c.String("region", "us1") }, want: "eu1"},
+		{name: "string missing", get: func() interface{} { return c.String("missing", "us1") }, want: "us1"},
+		{name: "string empty", get: func() interface{} { return c.String("empty", "us1") }, want: "us1"},
+		{name: "string unset", get: func() interface{} { return c.String("unset", "us1") }, want: "us1"},
+		{name: "string nested", get: func() interface{} { return c.String("slack.channel", "") }, want: "#alerts"},
+		{name: "string through a value", get: func() interface{} { return c.String("region.name", "x") }, want: "x"},
+		{name: "string from a number", get: func() interface{} { return c.String("tenantId", "x") }, want: "x", wantMismatch: "tenantId: text"},
+		{name: "int", get: func() interface{} { return c.Int("tenantId", 0) }, want: 12345},
+		{name: "int nested", get: func() interface{} { return c.Int("slack.retries", 1) }, want: 3},
+		{name: "int missing", get: func() interface{} { return c.Int("missing", 60) }, want: 60},
+		{name: "int quoted", get: func() interface{} { return c.Int("quoted", 60) }, want: 60, wantMismatch: "quoted: a whole number"},
+		{name: "bool", get: func() interface{} { return c.Bool("stateless", false) }, want: true},
+		{name: "bool missing", get: func() interface{} { return c.Bool("missing", true) }, want: true},
+		{name: "bool from text", get: func() interface{} { return c.Bool("region", false) }, want: false, wantMismatch: "region: true or false"},
+		{name: "list", get: func() interface{} { return c.StringList("channels") }, want: []string{"#a", "#b"}},
+		{name: "list from a string", get: func() interface{} { return c.StringList("channel") }, want: []string{"#single"}},
+		{name: "list missing", get: func() interface{} { return c.StringList("missing") }, want: []string(nil)},
+		{name: "list from a mapping", get: func() interface{} { return c.StringList("slack") }, want: []string(nil), wantMismatch: "slack: a list"},
+		{
+			name: "map with number keys",
+			get:  func() interface{} { return c.StringMap("webhooks") },
+			want: map[string]string{"12345": "https://hooks.example.com/a", "team": "https://hooks.example.com/b"},
+		},
+		{name: "map missing", get: func() interface{} { return c.StringMap("missing") }, want: map[string]string{}},
+		{name: "map from a list", get: func() interface{} { return c.StringMap("channels") }, want: map[string]string{}, wantMismatch: "channels: a mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches := recordMismatches(t)
+			if got := tt.get(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+			if got := strings.Join(*mismatches, "; "); got != tt.wantMismatch {
+				t.Errorf("mismatches = %q, want %q", got, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c := readTestConfig(t)
+	tests := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"region", "eu1", true},
+		{"slack.retries", 3, true},
+		{"webhooks.12345", "https://hooks.example.com/a", true},
+		{"unset", nil, false},
+		{"slack.missing", nil, false},
+		{"region.name", nil, false},
+	}
+	for _, tt := range tests {
+		got, found := c.Lookup(tt.path)
+		if found != tt.found || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %#v, %v, want %#v, %v", tt.path, got, found, tt.want, tt.found)
+		}
+	}
+}
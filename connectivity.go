@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkConnectivity probes the Sysdig API and Slack with the configured
+// credentials and lists what would keep alerts from working, each with what
+// to change. Nothing is posted to Slack.
+func checkConnectivity(ctx context.Context) []string {
+	var problems []string
+	if problem := checkSysdigAPI(ctx); problem != "" {
+		problems = append(problems, problem)
+	}
+	if problem := checkSlack(ctx); problem != "" {
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// checkSysdigAPI fetches the errors of the configured integration, or the
+// integration list when they are discovered, which needs the same token.
+func checkSysdigAPI(ctx context.Context) string {
+	base := lookupRegion(region).APIBase
+
+	url := base + discoveryPath
+	what := "list the integrations"
+	if integrationID != "0" {
+		id, _ := strconv.Atoi(integrationID)
+		url = errorsURL(id)
+		what = "read the errors of integration " + integrationID
+	}
+
+	status, err := probeSysdig(ctx, url)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return fmt.Sprintf("cannot resolve the Sysdig API host for region %s (%s): check region and http.proxyUrl", region, base)
+		}
+		return fmt.Sprintf("cannot reach the Sysdig API for region %s (%s): %v; check region, http.proxyUrl and http.tls", region, base, err)
+	}
+
+	switch {
+	case status == http.StatusOK:
+		return ""
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		problem := fmt.Sprintf("the Sysdig API in region %s rejected bearerToken with status %d: check that the token is valid and allowed to %s", region, status, what)
+		if other := regionAcceptingToken(ctx, region, strings.TrimPrefix(url, base)); other != "" {
+			problem += fmt.Sprintf("; the token works in region %s, set region: %s", other, other)
+		}
+		return problem
+	case status == http.StatusNotFound && integrationID != "0":
+		return fmt.Sprintf("integration %s with tenant %s was not found in region %s: check integrationId, tenantId and region", integrationID, tenantID, region)
+	case status == http.StatusTooManyRequests:
+		// Reachable and authenticated far enough to be throttled.
+		return ""
+	default:
+		return fmt.Sprintf("the Sysdig API in region %s answered %s with status %d", region, url, status)
+	}
+}
+
+func probeSysdig(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bearerToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBytes))
+	return resp.StatusCode, nil
+}
+
+// regionAcceptingToken returns the first other SaaS region where the token
+// is accepted for path, a common mistake being a token from another region.
+func regionAcceptingToken(ctx context.Context, skip, path string) string {
+	names := make([]string, 0, len(builtinRegions))
+	for name := range builtinRegions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == skip {
+			continue
+		}
+		status, err := probeSysdig(ctx, builtinRegions[name].APIBase+path)
+		if err == nil && status != http.StatusUnauthorized && status != http.StatusForbidden {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkSlack verifies the bot token with auth.test, or that the webhook
+// exists by posting an empty payload: Slack rejects it as a bad request
+// without posting anything, while an unknown or revoked webhook gets a 403,
+// 404 or 410.
+func checkSlack(ctx context.Context) string {
+	if slackBotMode() && !slackWorkflowMode() {
+		if _, err := callSlackAPI(ctx, "auth.test", map[string]string{}); err != nil {
+			return fmt.Sprintf("Slack rejected slackBotToken: %v; check the token and that the app is installed in the workspace", err)
+		}
+		return ""
+	}
+	if slackWebhookURL == "" {
+		return ""
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", slackWebhookURL, bytes.NewBufferString("{}"))
+	if err != nil {
+		return fmt.Sprintf("slackWebhookUrl is not a valid URL: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Sprintf("cannot reach the Slack webhook: %v; check slackWebhookUrl and http.proxyUrl", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusBadRequest, http.StatusTooManyRequests:
+		return ""
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return fmt.Sprintf("the Slack webhook does not exist or was revoked (status %d: %s): create a new one and update slackWebhookUrl", resp.StatusCode, strings.TrimSpace(string(body)))
+	default:
+		return fmt.Sprintf("the Slack webhook answered with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
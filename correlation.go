@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifierEvents   = "events"
+	correlationsFile = "correlations.json"
+)
+
+// The event correlation notifier feeds an AIOps layer such as BigPanda or
+// Moogsoft. Each integration is one alert, identified by a stable dedup key,
+// that turns critical when errors come in and ok once the integration has
+// been quiet for eventCorrelation.resolveAfterMins.
+var (
+	correlationURL          = conf.String("eventCorrelation.url", "")
+	correlationFormat       = conf.String("eventCorrelation.format", "generic")
+	correlationAppKey       = conf.String("eventCorrelation.appKey", "")
+	correlationBearerToken  = conf.String("eventCorrelation.bearerToken", "")
+	correlationHeaders      = conf.StringMap("eventCorrelation.headers")
+	correlationTags         = conf.StringMap("eventCorrelation.tags")
+	correlationResolveAfter = time.Duration(conf.Int("eventCorrelation.resolveAfterMins", 60)) * time.Minute
+)
+
+// CorrelationEvent is a status change of an integration's alert.
+type CorrelationEvent struct {
+	DedupKey    string            `json:"dedupKey"`
+	Status      string            `json:"status"`
+	Summary     string            `json:"summary"`
+	Description string            `json:"description"`
+	Reason      string            `json:"reason"`
+	Tags        map[string]string `json:"tags"`
+	At          time.Time         `json:"at"`
+}
+
+func correlationEnabled() bool {
+	return correlationURL != ""
+}
+
+func correlationDedupKey(integrationID int) string {
+	return fmt.Sprintf("sefi-alarm/%s/%d", tenantID, integrationID)
+}
+
+// correlationStore remembers which integrations are critical, so recovery is
+// reported once and survives restarts.
+type correlationStore struct {
+	mu       sync.Mutex
+	critical map[string]time.Time
+}
+
+var correlations = loadCorrelations()
+
+func loadCorrelations() *correlationStore {
+	c := &correlationStore{critical: make(map[string]time.Time)}
+	if _, err := loadState(correlationsFile, &c.critical); err != nil {
+		log.Printf("Error loading event correlation state: %v\n", err)
+	}
+	return c
+}
+
+func (c *correlationStore) reload() {
+	critical := make(map[string]time.Time)
+	if _, err := loadState(correlationsFile, &critical); err != nil {
+		log.Printf("Error reloading event correlation state: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.critical = critical
+}
+
+func (c *correlationStore) saveLocked() {
+	if err := saveState(correlationsFile, c.critical); err != nil {
+		log.Printf("Error saving event correlation state: %v\n", err)
+	}
+}
+
+// alert returns the critical event for new errors of an integration.
+func (c *correlationStore) alert(errors []ErrorLog, payload *Payload, at time.Time) *Notification {
+	if !correlationEnabled() {
+		return nil
+	}
+	c.mu.Lock()
+	c.critical[strconv.Itoa(payload.IntegrationID)] = at
+	c.saveLocked()
+	c.mu.Unlock()
+
+	description := ""
+	for _, err := range errors {
+		description += err.Error + "\n"
+	}
+	tags := correlationEventTags(payload.IntegrationID)
+	tags["recent_errors"] = strconv.Itoa(len(errors))
+	tags["total_errors"] = strconv.Itoa(payload.Count)
+	tags["category"] = dominantCategory(errors)
+	tags["severity"] = alertSeverity(errors, payload)
+	if in, ok := integrationMeta.get(payload.IntegrationID); ok {
+		tags["integration_name"] = in.Name
+		tags["integration_type"] = in.Type
+	}
+	tags["integration_url"] = integrationURL + strconv.Itoa(payload.IntegrationID)
+
+	summary := "Events forwarding errors on integration " + integrationLabel(payload.IntegrationID)
+	templates := currentNotifierTemplates()
+	data := newTemplateData(errors, payload, integrationURL)
+	if text, ok := renderNotifierTemplate(templates.eventSummary, false, data); ok {
+		summary = strings.TrimSpace(text)
+	}
+	if text, ok := renderNotifierTemplate(templates.eventDescription, true, data); ok {
+		description = text
+	}
+
+	return &Notification{
+		Notifier:      notifierEvents,
+		IntegrationID: payload.IntegrationID,
+		Reason:        reasonThresholdExceeded,
+		Event: &CorrelationEvent{
+			DedupKey:    correlationDedupKey(payload.IntegrationID),
+			Status:      "critical",
+			Reason:      reasonThresholdExceeded,
+			Summary:     summary,
+			Description: description,
+			Tags:        tags,
+			At:          at,
+		},
+		QueuedAt: at,
+	}
+}
+
+// resolveQuiet returns ok events for the critical integrations without new
+// errors for correlationResolveAfter.
+func (c *correlationStore) resolveQuiet(now time.Time) []*Notification {
+	if !correlationEnabled() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []*Notification
+	for key, last := range c.critical {
+		if now.Sub(last) < correlationResolveAfter {
+			continue
+		}
+		delete(c.critical, key)
+		id, _ := strconv.Atoi(key)
+		out = append(out, &Notification{
+			Notifier:      notifierEvents,
+			IntegrationID: id,
+			Reason:        reasonRecovered,
+			Event: &CorrelationEvent{
+				DedupKey:    correlationDedupKey(id),
+				Status:      "ok",
+				Reason:      reasonRecovered,
+				Summary:     fmt.Sprintf("Integration %d has had no events forwarding errors for %s", id, now.Sub(last).Round(time.Minute)),
+				Description: "",
+				Tags:        correlationEventTags(id),
+				At:          now,
+			},
+			QueuedAt: now,
+		})
+	}
+	if len(out) > 0 {
+		c.saveLocked()
+	}
+	return out
+}
+
+func correlationEventTags(integrationID int) map[string]string {
+	tags := map[string]string{
+		"integration_id": strconv.Itoa(integrationID),
+		"tenant_id":      tenantID,
+		"region":         region,
+		"source":         "sefi-alarm",
+	}
+	for key, value := range pod.labels() {
+		tags[key] = value
+	}
+	if team := ownerTeam(integrationID); team != "" {
+		tags["owner"] = team
+	}
+	for key, value := range correlationTags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// correlationPayload shapes e for the configured platform.
+func correlationPayload(e *CorrelationEvent) (interface{}, error) {
+	if e.Reason != "" {
+		tags := make(map[string]string, len(e.Tags)+1)
+		for key, value := range e.Tags {
+			tags[key] = value
+		}
+		tags["reason"] = e.Reason
+		copied := *e
+		copied.Tags = tags
+		e = &copied
+	}
+	switch correlationFormat {
+	case "bigpanda":
+		// BigPanda correlates alerts on host and check; tags are top-level
+		// attributes.
+		body := map[string]interface{}{
+			"app_key":             correlationAppKey,
+			"status":              e.Status,
+			"host":                "sysdig-integration-" + e.Tags["integration_id"],
+			"check":               "events-forwarding",
+			"description":         e.Summary + "\n" + e.Description,
+			"timestamp":           e.At.Unix(),
+			"incident_identifier": e.DedupKey,
+		}
+		for key, value := range e.Tags {
+			if _, taken := body[key]; !taken {
+				body[key] = value
+			}
+		}
+		return body, nil
+	case "moogsoft":
+		// Moogsoft severities: 0 clear, 2 minor, 3 major, 5 critical.
+		severity := map[string]int{severityInfo: 2, severityWarning: 3}[e.Tags["severity"]]
+		switch {
+		case e.Status == "ok":
+			severity = 0
+		case severity == 0:
+			severity = 5
+		}
+		return map[string]interface{}{
+			"signature":   e.DedupKey,
+			"source_id":   e.Tags["integration_id"],
+			"external_id": e.DedupKey,
+			"manager":     "SEFI-Alarm",
+			"source":      "sysdig-integration-" + e.Tags["integration_id"],
+			"class":       "events-forwarding",
+			"agent":       "sefi-alarm",
+			"type":        "EventsForwardingError",
+			"severity":    severity,
+			"description": e.Summary + "\n" + e.Description,
+			"agent_time":  e.At.Unix(),
+			"tags":        e.Tags,
+		}, nil
+	case "generic":
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unknown eventCorrelation.format %q, use generic, bigpanda or moogsoft", correlationFormat)
+	}
+}
+
+func sendCorrelationEvent(ctx context.Context, n *Notification) error {
+	if n.Event == nil {
+		return fmt.Errorf("event correlation notification without event")
+	}
+	body, err := correlationPayload(n.Event)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal correlation event: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", correlationURL, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create correlation request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if correlationBearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+correlationBearerToken)
+	}
+	for key, value := range correlationHeaders {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send correlation event: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError("events", resp)
+	}
+	if resp.StatusCode/100 != 2 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("correlation event failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
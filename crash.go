@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// A panic in one of the loops is recovered, written to a crash report in the
+// state directory and optionally announced, after which the loop is restarted
+// instead of the whole process dying.
+var (
+	crashNotify  = conf.Bool("crashReports.notify", false)
+	crashChannel = conf.String("crashReports.channel", slackChannel)
+)
+
+// supervise runs fn until it returns normally, restarting it with a growing
+// delay whenever it panics.
+func supervise(name string, fn func()) {
+	delay := time.Second
+	for {
+		if !runRecovered(name, fn) {
+			return
+		}
+		log.Printf("Restarting %s in %s\n", name, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+// runRecovered calls fn and reports whether it panicked.
+func runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			reportCrash(name, r, debug.Stack())
+		}
+	}()
+	fn()
+	return false
+}
+
+func reportCrash(name string, r interface{}, stack []byte) {
+	now := time.Now().UTC()
+	log.Printf("Recovered panic in %s: %v\n%s", name, r, stack)
+
+	if path, err := writeCrashReport(now, name, r, stack); err != nil {
+		log.Printf("Error writing crash report: %v\n", err)
+	} else if path != "" {
+		log.Printf("Crash report written to %s\n", path)
+	}
+
+	if crashNotify {
+		notifications.enqueue(&Notification{
+			Message: SlackMessage{
+				Channel: crashChannel,
+				Text:    fmt.Sprintf("SEFI-Alarm recovered from a panic in %s: %v\n```\n%s```", name, r, truncateStack(stack, 2500)),
+			},
+			Reason:   reasonPollerDegraded,
+			QueuedAt: now,
+		})
+	}
+}
+
+func writeCrashReport(at time.Time, name string, r interface{}, stack []byte) (string, error) {
+	if stateless {
+		return "", nil
+	}
+
+	dir := filepath.Join(stateDir, "crashes")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("crash-%s-%s.txt", at.Format("20060102T150405.000Z"), name))
+	report := fmt.Sprintf("time: %s\nversion: %s\nworker: %s\npanic: %v\n\n%s", at.Format(time.RFC3339Nano), version, name, r, stack)
+	return path, os.WriteFile(path, []byte(report), 0o600)
+}
+
+func truncateStack(stack []byte, limit int) string {
+	if len(stack) <= limit {
+		return string(stack)
+	}
+	return string(stack[:limit]) + "\n…"
+}
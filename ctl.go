@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newCtlCommand talks to a running instance through its local API, at
+// apiListen unless --addr says otherwise.
+func newCtlCommand() *cobra.Command {
+	var addr, token string
+	ctl := &cobra.Command{
+		Use:   "ctl",
+		Short: "Control a running instance through its API",
+	}
+	ctl.PersistentFlags().StringVar(&addr, "addr", apiListen, "API address of the running instance, host:port or unix:/path")
+	ctl.PersistentFlags().StringVar(&token, "token", apiToken, "API token, if the instance requires one")
+
+	client := func() (*ctlClient, error) {
+		if addr == "" {
+			return nil, fmt.Errorf("apiListen is not set in config.yaml, pass --addr")
+		}
+		return newCtlClient(addr, token), nil
+	}
+	simple := func(use, short, method, path string) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				c, err := client()
+				if err != nil {
+					return err
+				}
+				return c.print(method, path, nil)
+			},
+		}
+	}
+
+	var silenceTenant, silenceError string
+	silenceCmd := &cobra.Command{
+		Use:   "silence <integration|any> <duration> [reason]",
+		Short: "Mute alerts for a while (e.g. 2h), by integration, tenant or error",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := 0
+			if args[0] != "any" {
+				var err error
+				if id, err = strconv.Atoi(args[0]); err != nil {
+					return fmt.Errorf("integration must be a numeric ID or any, got %q", args[0])
+				}
+			}
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			return c.print("POST", "/api/silences", silenceRequest{
+				IntegrationID: id,
+				Tenant:        silenceTenant,
+				ErrorPattern:  silenceError,
+				Duration:      args[1],
+				Reason:        strings.Join(args[2:], " "),
+				By:            os.Getenv("USER"),
+			})
+		},
+	}
+	silenceCmd.Flags().StringVar(&silenceTenant, "tenant", "", "only silence alerts of this tenant ID")
+	silenceCmd.Flags().StringVar(&silenceError, "error", "", "only silence errors matching this regular expression")
+
+	canaryCmd := simple("canary", "Show how the candidate config compares to the active one", "GET", "/api/canary")
+	canaryCmd.AddCommand(simple("promote", "Replace config.yaml with the candidate config", "POST", "/api/canary/promote"))
+
+	ctl.AddCommand(
+		simple("status", "Show the health of the instance", "GET", "/healthz"),
+		simple("integrations", "Show the status of each integration", "GET", "/api/integrations"),
+		simple("groups", "Show the rollup of each integration group", "GET", "/api/groups"),
+		simple("alerts", "List the alerts sent in the last day", "GET", "/api/alerts"),
+		simple("alert-states", "Show which alerts are firing or resolved", "GET", "/api/alert-states"),
+		simple("silences", "List active silences", "GET", "/api/silences"),
+		simple("owners", "List the owners of integrations", "GET", "/api/owners"),
+		simple("budgets", "Show this month's notification budgets", "GET", "/api/budgets"),
+		silenceCmd,
+		&cobra.Command{
+			Use:   "unsilence <id>",
+			Short: "Remove a silence",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				c, err := client()
+				if err != nil {
+					return err
+				}
+				return c.print("DELETE", "/api/silences?id="+url.QueryEscape(args[0]), nil)
+			},
+		},
+		simple("reload", "Reload config.yaml", "POST", "/api/reload"),
+		simple("trigger-poll", "Poll right away", "POST", "/api/poll"),
+		simple("drain", "Deliver queued notifications and shut down", "POST", "/api/drain"),
+		canaryCmd,
+	)
+	return ctl
+}
+
+type ctlClient struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func newCtlClient(addr, token string) *ctlClient {
+	transport := &http.Transport{}
+	base := "http://" + addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://sefi-alarm"
+	}
+	return &ctlClient{
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		base:   base,
+		token:  token,
+	}
+}
+
+// print sends the request and writes the response body to stdout, failing on
+// any non-2xx status.
+func (c *ctlClient) print(method, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payloadBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payloadBytes)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the running instance: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+	if len(data) > 0 {
+		fmt.Println(strings.TrimSpace(string(data)))
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The dashboard is served at / of apiListen unless dashboard is set to false.
+var dashboardEnabled = conf.Bool("dashboard", true)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SEFI-Alarm</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+.acked { color: #2a7a2a; }
+.failed { color: #b00020; }
+code { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>SEFI-Alarm</h1>
+<p>{{.Health.Status}}, {{.Health.Role}} since {{.Health.StartedAt.Format "2006-01-02 15:04"}}. {{.Health.QueuedAlerts}} notifications queued. Version {{.Health.Version}}.</p>
+
+{{with .Groups}}
+<h2>Groups</h2>
+<table>
+<tr><th>Group</th><th>Integrations</th><th>Failing</th><th>Status</th></tr>
+{{range .}}
+<tr>
+<td>{{.Name}} <small>{{.Label}}</small></td>
+<td>{{len .Integrations}}</td>
+<td>{{len .Failing}}{{with .Failing}} ({{range $i, $id := .}}{{if $i}}, {{end}}{{$id}}{{end}}){{end}}</td>
+<td>{{with .FiringSince}}<span class="failed">alerting since {{.Format "2006-01-02 15:04"}}</span>{{else}}{{if .Failing}}degraded{{else}}ok{{end}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Integrations</h2>
+<table>
+<tr><th>Integration</th><th>State</th><th>Last poll</th><th>New errors</th><th>Last alert</th><th>Notes</th></tr>
+{{range .Integrations}}
+<tr>
+<td>{{.IntegrationID}} {{.Name}}{{with .Type}} ({{.}}){{end}}</td>
+<td>{{.State}}</td>
+<td>{{with .LastPollAt}}{{.Format "2006-01-02 15:04:05"}}{{else}}—{{end}}{{with .LastPollError}}<div class="failed">{{.}}</div>{{end}}</td>
+<td>{{.LastNewErrors}}</td>
+<td>{{with .LastAlertAt}}{{.Format "2006-01-02 15:04"}}{{else}}—{{end}}</td>
+<td>{{if .Digest}}digest {{end}}{{with .SilencedUntil}}silenced until {{.Format "2006-01-02 15:04"}} {{end}}{{if .OpenTicket}}ticket open{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="6">No integrations polled yet.</td></tr>
+{{end}}
+</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Integration</th><th>Error</th><th>Acknowledgement</th></tr>
+{{range .Errors}}
+<tr>
+<td>{{.Timestamp}}</td>
+<td>{{.IntegrationID}}</td>
+<td><code>{{.Error}}</code></td>
+<td>
+{{with .Ack}}<div class="acked">✔ {{.By}}: {{.Note}} ({{.At.Format "2006-01-02 15:04"}})</div>{{end}}
+<form method="post" action="api/acks">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="integrationId" value="{{.IntegrationID}}">
+<input type="hidden" name="error" value="{{.Error}}">
+<input name="by" placeholder="Name" size="10">
+<input name="note" placeholder="Note" size="30">
+{{if $.TokenRequired}}<input type="password" name="token" placeholder="API token" size="12" required>{{end}}
+<button type="submit">Acknowledge</button>
+</form>
+</td>
+</tr>
+{{else}}
+<tr><td colspan="4">No errors alerted since startup.</td></tr>
+{{end}}
+</table>
+
+<h2>Notifications</h2>
+<table>
+<tr><th>Sent</th><th>Integration</th><th>Notifier</th><th>Notification</th><th>Result</th></tr>
+{{range .Notifications}}
+<tr><td>{{.SentAt.Format "2006-01-02 15:04:05"}}</td><td>{{.IntegrationID}}</td><td>{{.Notifier}}</td><td>{{.Title}}{{with .Reason}} <small>{{.}}</small>{{end}}</td><td>{{if .Delivered}}delivered{{else}}<span class="failed">{{.Error}}</span>{{end}}</td></tr>
+{{else}}
+<tr><td colspan="5">{{or .NotificationsError "Nothing sent in the last day."}}</td></tr>
+{{end}}
+</table>
+
+<h2>Silences</h2>
+<table>
+<tr><th>Matches</th><th>Until</th><th>By</th><th>Reason</th></tr>
+{{range .Silences}}
+<tr><td>{{.Describe}}</td><td>{{.Until.Format "2006-01-02 15:04"}}</td><td>{{.By}}</td><td>{{.Reason}}</td></tr>
+{{else}}
+<tr><td colspan="4">No active silences.</td></tr>
+{{end}}
+</table>
+
+<h2>Tickets</h2>
+<table>
+<tr><th>Opened</th><th>Integration</th><th>Ticket</th><th>Status</th><th>Resolved</th></tr>
+{{range .Tickets}}
+<tr><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{.IntegrationID}}</td><td><a href="{{.URL}}">{{.Notifier}} #{{.ExternalID}}</a> {{.Title}}</td><td>{{.Status}}</td><td>{{with .ResolvedAt}}{{.Format "2006-01-02 15:04"}}{{else}}—{{end}}</td></tr>
+{{else}}
+<tr><td colspan="5">No tickets opened.</td></tr>
+{{end}}
+</table>
+
+<h2>Acknowledgements</h2>
+<table>
+<tr><th>When</th><th>Integration</th><th>Error</th><th>By</th><th>Note</th></tr>
+{{range .Acks}}
+<tr><td>{{.At.Format "2006-01-02 15:04"}}</td><td>{{.IntegrationID}}</td><td><code>{{.Error}}</code></td><td>{{.By}}</td><td>{{.Note}}</td></tr>
+{{else}}
+<tr><td colspan="5">None yet.</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+type dashboardError struct {
+	recentError
+	Ack *Acknowledgement
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var rows []dashboardError
+	for _, e := range alertedErrors.list() {
+		row := dashboardError{recentError: e}
+		if ack, ok := acks.latest(e.Fingerprint); ok {
+			row.Ack = &ack
+		}
+		rows = append(rows, row)
+	}
+
+	now := time.Now().UTC()
+	data := struct {
+		Health             healthResponse
+		Groups             []GroupStatus
+		Integrations       []IntegrationStatus
+		Errors             []dashboardError
+		Notifications      []NotificationEntry
+		NotificationsError string
+		Silences           []Silence
+		Tickets            []Ticket
+		Acks               []Acknowledgement
+		CSRF               string
+		TokenRequired      bool
+	}{
+		Health:        status.health(),
+		Groups:        groups.list(now),
+		Integrations:  polls.list(now),
+		Errors:        rows,
+		Silences:      silences.list(now),
+		Tickets:       tickets.list(),
+		Acks:          acks.all(),
+		CSRF:          dashboardCSRF,
+		TokenRequired: apiToken != "",
+	}
+	if entries, err := history.notifications(now.Add(-24*time.Hour), 50); err != nil {
+		data.NotificationsError = "Notification history unavailable: " + err.Error()
+	} else {
+		data.Notifications = entries
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("Error rendering dashboard: %v\n", err)
+	}
+}
+
+// handleAckList serves the acknowledgements next to the dashboard, read-only
+// since only /api/ requests are authenticated.
+func handleAckList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed, acknowledge through /api/acks", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, acks.all())
+}
+
+// handleAcks lists acknowledgements (GET) or records one (POST, from the
+// dashboard form or as form-encoded API call). It is served under /api/, so
+// recording one needs the API token when apiToken is set, and posts from
+// other sites are turned away: API calls send an Authorization header, the
+// dashboard form its CSRF token.
+func handleAcks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, acks.all())
+	case http.MethodPost:
+		if !checkFormOrigin(w, r) {
+			return
+		}
+		integrationID, err := strconv.Atoi(r.FormValue("integrationId"))
+		message := r.FormValue("error")
+		if err != nil || message == "" {
+			http.Error(w, "integrationId and error are required", http.StatusBadRequest)
+			return
+		}
+
+		ack := Acknowledgement{
+			Fingerprint:   errorFingerprint(integrationID, message),
+			IntegrationID: integrationID,
+			Error:         message,
+			Note:          strings.TrimSpace(r.FormValue("note")),
+			By:            strings.TrimSpace(r.FormValue("by")),
+			At:            time.Now().UTC(),
+		}
+		if ack.By == "" {
+			ack.By = "anonymous"
+		}
+		acks.add(ack)
+		log.Printf("Error %s on integration %d acknowledged by %s: %s\n", ack.Fingerprint, integrationID, ack.By, ack.Note)
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusCreated, ack)
+			return
+		}
+		// Back from api/acks to the dashboard.
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
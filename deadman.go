@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SEFI-Alarm can ping a dead man's switch (healthchecks.io, Cronitor or any
+// URL that alerts when it stops being called) so the monitor is monitored
+// too. heartbeat.url is pinged every heartbeat.intervalSecs while polls
+// succeed; once none did for heartbeat.staleAfterSecs (three poll intervals
+// by default) it is no longer pinged, or heartbeat.failUrl is pinged instead
+// where the service has one (healthchecks.io's <url>/fail, Cronitor's
+// ?state=fail). Standby instances don't ping, and --once pings after a
+// successful run.
+var (
+	heartbeatURL        = conf.String("heartbeat.url", "")
+	heartbeatFailURL    = conf.String("heartbeat.failUrl", "")
+	heartbeatMethod     = strings.ToUpper(conf.String("heartbeat.method", "GET"))
+	heartbeatInterval   = time.Duration(conf.Int("heartbeat.intervalSecs", 60)) * time.Second
+	heartbeatStaleAfter = time.Duration(conf.Int("heartbeat.staleAfterSecs", 3*int(checkInterval/time.Second))) * time.Second
+)
+
+var heartbeatPings = metrics.newCounter("sefi_heartbeat_pings_total",
+	"Pings of the dead man's switch, by result.", "result")
+
+func heartbeatLoop(ctx context.Context) {
+	if heartbeatURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if role.isStandby() {
+				continue
+			}
+			if stale := now.Sub(pollHealth.lastSucceeded()); stale >= heartbeatStaleAfter {
+				if heartbeatFailURL != "" {
+					pingHeartbeat(ctx, heartbeatFailURL, fmt.Sprintf("no successful poll for %s", stale.Round(time.Second)))
+				}
+				continue
+			}
+			pingHeartbeat(ctx, heartbeatURL, "")
+		}
+	}
+}
+
+// pingHeartbeat calls url, with body as the request body for services that
+// show it next to the ping.
+func pingHeartbeat(ctx context.Context, url, body string) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var reader io.Reader
+	if body != "" && heartbeatMethod != "GET" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, heartbeatMethod, url, reader)
+	if err != nil {
+		log.Printf("Error creating heartbeat ping: %v\n", err)
+		heartbeatPings.inc("failure")
+		return
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("Error pinging heartbeat URL: %v\n", err)
+		heartbeatPings.inc("failure")
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Heartbeat ping failed with status %d\n", resp.StatusCode)
+		heartbeatPings.inc("failure")
+		return
+	}
+	heartbeatPings.inc("success")
+}
+
+// pingHeartbeatOnce reports the outcome of a --once run.
+func pingHeartbeatOnce(failed bool) {
+	switch {
+	case heartbeatURL == "":
+	case !failed:
+		pingHeartbeat(context.Background(), heartbeatURL, "")
+	case heartbeatFailURL != "":
+		pingHeartbeat(context.Background(), heartbeatFailURL, "polling failed")
+	}
+}
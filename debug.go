@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+// debugListen serves the net/http/pprof profiles under /debug/pprof/ on a
+// listener of their own, a TCP address or "unix:/path" like apiListen, so
+// they can be kept off the network the API is reachable from. Off unless set.
+var debugListen = conf.String("debugListen", "")
+
+var debugServer struct {
+	mu     sync.Mutex
+	server *http.Server
+}
+
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startDebugServer serves the profiles in the background. Failing to listen
+// is logged only: profiling is not worth stopping the process for.
+func startDebugServer() {
+	if debugListen == "" {
+		return
+	}
+	listener, err := listen(debugListen, apiSocketMode)
+	if err != nil {
+		log.Printf("Error starting debug listener on %s: %v\n", debugListen, err)
+		return
+	}
+
+	// No WriteTimeout: CPU profiles and traces take as long as asked.
+	server := &http.Server{Handler: newDebugHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Debug server stopped: %v\n", err)
+		}
+	}()
+	debugServer.mu.Lock()
+	debugServer.server = server
+	debugServer.mu.Unlock()
+	log.Printf("Serving pprof profiles on %s/debug/pprof/\n", debugListen)
+	if !localOnly(debugListen) {
+		log.Printf("The debug listener on %s is reachable from other hosts without authentication.\n", debugListen)
+	}
+}
+
+func stopDebugServer() {
+	debugServer.mu.Lock()
+	defer debugServer.mu.Unlock()
+	if debugServer.server != nil {
+		debugServer.server.Close()
+	}
+}
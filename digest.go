@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/schedule"
+)
+
+const digestFile = "digest.json"
+
+// Integrations listed under digest.integrations don't alert in real time.
+// Their errors are collected and sent as one summary per integration at the
+// top of every hour or day (UTC), depending on digest.interval.
+var (
+	digestIntegrations = conf.StringList("digest.integrations")
+	digestInterval     = conf.String("digest.interval", "hourly")
+)
+
+type digestEntry struct {
+	IntegrationID int            `json:"integrationId"`
+	StartedAt     time.Time      `json:"startedAt"`
+	Total         int            `json:"total"`
+	FirstSeen     time.Time      `json:"firstSeen"`
+	LastSeen      time.Time      `json:"lastSeen"`
+	Messages      map[string]int `json:"messages"`
+}
+
+type digestBuffer struct {
+	mu      sync.Mutex
+	entries map[string]*digestEntry
+}
+
+var digests = loadDigestBuffer()
+
+func loadDigestBuffer() *digestBuffer {
+	d := &digestBuffer{entries: make(map[string]*digestEntry)}
+	if _, err := loadState(digestFile, &d.entries); err != nil {
+		log.Printf("Error loading pending digests: %v\n", err)
+	}
+	return d
+}
+
+func (d *digestBuffer) reload() {
+	entries := make(map[string]*digestEntry)
+	if _, err := loadState(digestFile, &entries); err != nil {
+		log.Printf("Error reloading pending digests: %v\n", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = entries
+}
+
+func digestMode(integrationID int) bool {
+	for _, id := range digestIntegrations {
+		if id == strconv.Itoa(integrationID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *digestBuffer) add(integrationID int, errors []ErrorLog) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := strconv.Itoa(integrationID)
+	entry, ok := d.entries[key]
+	if !ok {
+		entry = &digestEntry{IntegrationID: integrationID, StartedAt: time.Now().UTC(), Messages: make(map[string]int)}
+		d.entries[key] = entry
+	}
+
+	for _, e := range errors {
+		timestamp, err := e.Time()
+		if err == nil {
+			if entry.FirstSeen.IsZero() || timestamp.Before(entry.FirstSeen) {
+				entry.FirstSeen = timestamp
+			}
+			if timestamp.After(entry.LastSeen) {
+				entry.LastSeen = timestamp
+			}
+		}
+		entry.Messages[e.Error]++
+		entry.Total++
+	}
+
+	if err := saveState(digestFile, d.entries); err != nil {
+		log.Printf("Error saving pending digests: %v\n", err)
+	}
+}
+
+// flush queues one summary per integration with buffered errors and empties
+// the buffer.
+func (d *digestBuffer) flush(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, entry := range d.entries {
+		queueDigest(entry, now)
+	}
+	if len(d.entries) > 0 {
+		log.Printf("Queued %s digests for %d integrations.\n", digestInterval, len(d.entries))
+	}
+
+	d.entries = make(map[string]*digestEntry)
+	if err := saveState(digestFile, d.entries); err != nil {
+		log.Printf("Error saving pending digests: %v\n", err)
+	}
+}
+
+// flushIntegrations queues the summaries of the given integrations only,
+// ahead of the next digest.
+func (d *digestBuffer) flushIntegrations(integrationIDs []int, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	flushed := false
+	for _, id := range integrationIDs {
+		key := strconv.Itoa(id)
+		if entry, ok := d.entries[key]; ok {
+			queueDigest(entry, now)
+			delete(d.entries, key)
+			flushed = true
+		}
+	}
+	if !flushed {
+		return
+	}
+	if err := saveState(digestFile, d.entries); err != nil {
+		log.Printf("Error saving pending digests: %v\n", err)
+	}
+}
+
+func queueDigest(entry *digestEntry, now time.Time) {
+	notifications.enqueue(&Notification{
+		IntegrationID: entry.IntegrationID,
+		Message:       createDigestMessage(entry, integrationURL),
+		Reason:        reasonThresholdExceeded,
+		QueuedAt:      now,
+	})
+}
+
+// digestPeriod is how often digests are sent, hourly unless daily.
+func digestPeriod() schedule.Period {
+	if digestInterval == "daily" {
+		return schedule.Daily
+	}
+	return schedule.Hourly
+}
+
+func digestLoop(ctx context.Context) {
+	schedule.Run(ctx, digestPeriod(), func(time.Time) {
+		if !role.isStandby() {
+			digests.flush(time.Now().UTC())
+		}
+	})
+}
+
+func createDigestMessage(entry *digestEntry, integrationUrl string) SlackMessage {
+	link := integrationUrl + fmt.Sprintf("%d", entry.IntegrationID)
+	title := fmt.Sprintf("%s digest for integration %s", capitalize(digestInterval), integrationLabel(entry.IntegrationID))
+
+	type messageCount struct {
+		message string
+		count   int
+	}
+	var counts []messageCount
+	for message, count := range entry.Messages {
+		counts = append(counts, messageCount{message, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].message < counts[j].message
+	})
+
+	lines := ""
+	for _, c := range counts {
+		lines += fmt.Sprintf("%5s × %s\n", formatCount(int64(c.count)), c.message)
+	}
+
+	window := "unknown"
+	if !entry.FirstSeen.IsZero() {
+		window = formatTimestamp(entry.FirstSeen) + " – " + formatTimestamp(entry.LastSeen)
+	}
+
+	message := SlackMessage{
+		Channel: slackChannelFor(entry.IntegrationID),
+		Text:    fmt.Sprintf("%s: %s errors\n%s\nYou can check the integration in the following link: %s", title, formatCount(int64(entry.Total)), lines, link),
+		Blocks: []SlackBlock{
+			{
+				Type: "header",
+				Text: &SlackText{Type: "plain_text", Text: title},
+			},
+			{
+				Type: "section",
+				Fields: []SlackText{
+					{Type: "mrkdwn", Text: "*Errors*\n" + formatCount(int64(entry.Total))},
+					{Type: "mrkdwn", Text: "*Distinct messages*\n" + formatCount(int64(len(counts)))},
+					{Type: "mrkdwn", Text: "*Window*\n" + window},
+				},
+			},
+			{
+				Type: "section",
+				Text: &SlackText{Type: "mrkdwn", Text: "```\n" + lines + "```"},
+			},
+			{
+				Type: "actions",
+				Elements: []SlackElement{
+					{
+						Type: "button",
+						Text: &SlackText{Type: "plain_text", Text: "Open integration"},
+						URL:  link,
+					},
+				},
+			},
+		},
+	}
+
+	// Acknowledgements made since the digest window opened, so teammates see
+	// what is already being handled.
+	if acked := acks.since(entry.IntegrationID, entry.StartedAt); len(acked) > 0 {
+		notes := "*Acknowledged*"
+		for _, ack := range acked {
+			notes += fmt.Sprintf("\n• `%s` — %s (%s)", ack.Error, ack.Note, ack.By)
+		}
+		message.Text += "\n" + notes
+		// Keep the button last.
+		last := len(message.Blocks) - 1
+		message.Blocks = append(message.Blocks[:last:last],
+			SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: notes}},
+			message.Blocks[last])
+	}
+	if templated, ok := templatedSummary(title, strings.TrimPrefix(message.Text, title+": "), notifierSlack); ok {
+		message = SlackMessage{Channel: message.Channel, Text: templated}
+	}
+	return message
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
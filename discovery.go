@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With discovery enabled, the integrations to poll are listed from the
+// Sysdig API every discovery.intervalMins instead of being limited to
+// integrationId, so new integrations are covered without a config change.
+// namePattern and typePattern are regular expressions narrowing the list.
+var (
+	discoveryEnabled     = conf.Bool("discovery.enabled", false)
+	discoveryPath        = conf.String("discovery.path", "/api/v1/eventsForwarding/integrations")
+	discoveryInterval    = time.Duration(conf.Int("discovery.intervalMins", 15)) * time.Minute
+	discoveryNamePattern = compileDiscoveryPattern("discovery.namePattern")
+	discoveryTypePattern = compileDiscoveryPattern("discovery.typePattern")
+)
+
+var monitoredIntegrations = metrics.newGauge("sefi_monitored_integrations",
+	"Event-forwarding integrations being polled.")
+
+func compileDiscoveryPattern(key string) *regexp.Regexp {
+	pattern := conf.String(key, "")
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		addConfigProblem("%s is not a valid pattern: %v", key, err)
+		return nil
+	}
+	return re
+}
+
+// integrationInfo is an entry of the Sysdig integrations API.
+type integrationInfo struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Enabled *bool  `json:"enabled"`
+}
+
+// integrationSet is the list of integrations polled each interval: the
+// configured or discovered ones, and those declared by Kubernetes resources
+// in operator mode.
+type integrationSet struct {
+	mu          sync.Mutex
+	ids         []int
+	declared    []int
+	refreshedAt time.Time
+}
+
+var monitored = newIntegrationSet()
+
+func newIntegrationSet() *integrationSet {
+	s := &integrationSet{}
+	if id, _ := strconv.Atoi(integrationID); id != 0 {
+		s.ids = []int{id}
+	}
+	monitoredIntegrations.set(float64(len(s.ids)))
+	return s
+}
+
+// current returns the integrations without refreshing the list.
+func (s *integrationSet) current() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allLocked()
+}
+
+func (s *integrationSet) allLocked() []int {
+	out := append([]int(nil), s.ids...)
+	for _, id := range s.declared {
+		out = appendUnique(out, id)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// declare replaces the integrations declared by Kubernetes resources.
+func (s *integrationSet) declare(ids []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if !containsInt(s.declared, id) {
+			log.Printf("Integration %d declared by a Kubernetes resource, now monitoring it.\n", id)
+		}
+	}
+	for _, id := range s.declared {
+		if !containsInt(ids, id) && !containsInt(s.ids, id) {
+			log.Printf("Integration %d is no longer declared by a Kubernetes resource, no longer monitoring it.\n", id)
+		}
+	}
+	s.declared = ids
+	monitoredIntegrations.set(float64(len(s.allLocked())))
+}
+
+// list returns the integrations to poll, refreshing them first when
+// discovery is due. A failed discovery keeps the previous list.
+func (s *integrationSet) list(ctx context.Context) []int {
+	if !discoveryEnabled {
+		return s.current()
+	}
+
+	s.mu.Lock()
+	due := time.Since(s.refreshedAt) >= discoveryInterval
+	s.mu.Unlock()
+	if !due {
+		return s.current()
+	}
+
+	found, err := discoverIntegrations(ctx)
+	if err != nil {
+		log.Printf("Error discovering integrations, polling the previous list: %v\n", err)
+		return s.current()
+	}
+	// The configured integration is always polled, even if filtered out.
+	if id, _ := strconv.Atoi(integrationID); id != 0 {
+		found = appendUnique(found, id)
+	}
+	sort.Ints(found)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range found {
+		if !containsInt(s.ids, id) {
+			log.Printf("Discovered integration %d, now monitoring it.\n", id)
+		}
+	}
+	for _, id := range s.ids {
+		if !containsInt(found, id) {
+			log.Printf("Integration %d is gone or filtered out, no longer monitoring it.\n", id)
+		}
+	}
+	s.ids = found
+	s.refreshedAt = time.Now()
+	all := s.allLocked()
+	monitoredIntegrations.set(float64(len(all)))
+	return all
+}
+
+func discoverIntegrations(ctx context.Context) ([]int, error) {
+	integrations, err := listIntegrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, in := range integrations {
+		if in.Enabled != nil && !*in.Enabled {
+			continue
+		}
+		if discoveryNamePattern != nil && !discoveryNamePattern.MatchString(in.Name) {
+			continue
+		}
+		if discoveryTypePattern != nil && !discoveryTypePattern.MatchString(in.Type) {
+			continue
+		}
+		ids = appendUnique(ids, in.ID)
+	}
+	return ids, nil
+}
+
+// listIntegrations fetches every event-forwarding integration of the tenant
+// and refreshes the metadata used to enrich alerts.
+func listIntegrations(ctx context.Context) ([]integrationInfo, error) {
+	url := lookupRegion(region).APIBase + discoveryPath
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bearerToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list integrations: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, sysdigAPIError(resp)
+	}
+
+	body, truncated, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if truncated {
+		return nil, fmt.Errorf("integration list is larger than %d MB", maxResponseBytes>>20)
+	}
+
+	integrations, err := parseIntegrationList(body)
+	if err != nil {
+		return nil, err
+	}
+	integrationMeta.store(integrations)
+	return integrations, nil
+}
+
+// parseIntegrationList accepts a bare array as well as the array wrapped in
+// an "integrations" or "data" field.
+func parseIntegrationList(body []byte) ([]integrationInfo, error) {
+	var list []integrationInfo
+	if err := json.Unmarshal(body, &list); err == nil {
+		return list, nil
+	}
+
+	var wrapped struct {
+		Integrations []integrationInfo `json:"integrations"`
+		Data         []integrationInfo `json:"data"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse integration list: %v", err)
+	}
+	return append(wrapped.Integrations, wrapped.Data...), nil
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(ids []int, id int) []int {
+	if containsInt(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const escalationsFile = "escalations.json"
+
+// Escalation steps run while an alert stays unacknowledged and unresolved,
+// each once, afterMins after the first alert of the incident:
+//
+//	escalation:
+//	  steps:
+//	    - afterMins: 15
+//	      action: renotify          # post the alert again
+//	    - afterMins: 30
+//	      action: channel           # post it to another channel
+//	      channel: "#oncall-leads"
+//	    - afterMins: 60
+//	      action: page              # send a critical event correlation event
+//
+// An acknowledgement of any of the integration's errors stops the escalation,
+// and so does its resolution: the alert state resolving with
+// alertState.enabled, otherwise escalation.resolveAfterMins without new
+// errors.
+type escalationStep struct {
+	After   time.Duration
+	Action  string
+	Channel string
+}
+
+const (
+	escalateRenotify = "renotify"
+	escalateChannel  = "channel"
+	escalatePage     = "page"
+)
+
+var (
+	escalationSteps        = loadEscalationSteps()
+	escalationResolveAfter = time.Duration(conf.Int("escalation.resolveAfterMins", 60)) * time.Minute
+)
+
+var escalationsTotal = metrics.newCounter("sefi_escalations_total",
+	"Escalation steps run, by action.", "action")
+
+func loadEscalationSteps() []escalationStep {
+	v, ok := conf.Lookup("escalation.steps")
+	if !ok {
+		return nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		addConfigProblem("escalation.steps must be a list of afterMins and action")
+		return nil
+	}
+	var steps []escalationStep
+	for i, item := range list {
+		entry, ok := asSection(item)
+		if !ok {
+			addConfigProblem("escalation.steps[%d] must have afterMins and action", i)
+			continue
+		}
+		step := escalationStep{
+			After:   time.Duration(configMap(entry).Int("afterMins", 0)) * time.Minute,
+			Action:  configMap(entry).String("action", ""),
+			Channel: configMap(entry).String("channel", ""),
+		}
+		problem := ""
+		switch {
+		case step.After <= 0:
+			problem = fmt.Sprintf("escalation.steps[%d].afterMins must be a positive number", i)
+		case step.Action == escalateChannel && step.Channel == "":
+			problem = fmt.Sprintf("escalation.steps[%d] escalates to a channel but sets none", i)
+		case step.Action == escalatePage && !correlationEnabled():
+			problem = fmt.Sprintf("escalation.steps[%d] pages, which needs eventCorrelation.url", i)
+		case step.Action != escalateRenotify && step.Action != escalateChannel && step.Action != escalatePage:
+			problem = fmt.Sprintf("escalation.steps[%d].action must be renotify, channel or page, got %q", i, step.Action)
+		}
+		if problem != "" {
+			addConfigProblem("%s", problem)
+			continue
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// escalation is an incident being escalated. Message is its latest alert,
+// which escalation steps post again.
+type escalation struct {
+	IntegrationID int          `json:"integrationId"`
+	StartedAt     time.Time    `json:"startedAt"`
+	LastErrorAt   time.Time    `json:"lastErrorAt"`
+	StepsDone     int          `json:"stepsDone"`
+	Message       SlackMessage `json:"message"`
+}
+
+type escalationStore struct {
+	mu        sync.Mutex
+	incidents map[string]*escalation
+}
+
+var escalations = loadEscalations()
+
+func loadEscalations() *escalationStore {
+	s := &escalationStore{incidents: make(map[string]*escalation)}
+	if _, err := loadState(escalationsFile, &s.incidents); err != nil {
+		log.Printf("Error loading escalations: %v\n", err)
+	}
+	return s
+}
+
+func (s *escalationStore) reload() {
+	incidents := make(map[string]*escalation)
+	if _, err := loadState(escalationsFile, &incidents); err != nil {
+		log.Printf("Error reloading escalations: %v\n", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incidents = incidents
+}
+
+func (s *escalationStore) saveLocked() {
+	if err := saveState(escalationsFile, s.incidents); err != nil {
+		log.Printf("Error saving escalations: %v\n", err)
+	}
+}
+
+// track starts escalating the incident of integrationID when an alert for it
+// is sent, or keeps the ongoing one up to date.
+func (s *escalationStore) track(integrationID int, message SlackMessage, now time.Time) {
+	if len(escalationSteps) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strconv.Itoa(integrationID)
+	e, ok := s.incidents[key]
+	if !ok {
+		e = &escalation{IntegrationID: integrationID, StartedAt: now}
+		s.incidents[key] = e
+	}
+	e.LastErrorAt = now
+	e.Message = message
+	s.saveLocked()
+}
+
+// due runs the escalation steps whose time has come, and forgets incidents
+// that were acknowledged or resolved.
+func (s *escalationStore) due(now time.Time) []*Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Notification
+	changed := false
+	for key, e := range s.incidents {
+		if acked := acks.since(e.IntegrationID, e.StartedAt); len(acked) > 0 {
+			log.Printf("Stopping escalation of integration %d: acknowledged by %s.\n", e.IntegrationID, acked[0].By)
+			delete(s.incidents, key)
+			changed = true
+			continue
+		}
+		if escalationResolved(e, now) {
+			delete(s.incidents, key)
+			changed = true
+			continue
+		}
+		for e.StepsDone < len(escalationSteps) && now.Sub(e.StartedAt) >= escalationSteps[e.StepsDone].After {
+			step := escalationSteps[e.StepsDone]
+			e.StepsDone++
+			changed = true
+			log.Printf("Escalating integration %d after %s without acknowledgement: %s.\n", e.IntegrationID, step.After, step.Action)
+			escalationsTotal.inc(step.Action)
+			out = append(out, escalationNotification(e, step, now))
+		}
+	}
+	if changed {
+		s.saveLocked()
+	}
+	return out
+}
+
+func escalationResolved(e *escalation, now time.Time) bool {
+	if alertStateEnabled {
+		return alertStates.state(e.IntegrationID) != alertFiring
+	}
+	return now.Sub(e.LastErrorAt) >= escalationResolveAfter
+}
+
+func escalationNotification(e *escalation, step escalationStep, now time.Time) *Notification {
+	title := fmt.Sprintf("Escalated: unacknowledged for %s", formatDuration(step.After))
+	if step.Action == escalatePage {
+		description := e.Message.Text
+		tags := correlationEventTags(e.IntegrationID)
+		tags["escalation"] = step.After.String()
+		return &Notification{
+			Notifier:      notifierEvents,
+			IntegrationID: e.IntegrationID,
+			Reason:        reasonEscalated,
+			Event: &CorrelationEvent{
+				DedupKey:    correlationDedupKey(e.IntegrationID),
+				Status:      "critical",
+				Reason:      reasonEscalated,
+				Summary:     title + ": events forwarding errors on integration " + integrationLabel(e.IntegrationID),
+				Description: description,
+				Tags:        tags,
+				At:          now,
+			},
+			QueuedAt: now,
+		}
+	}
+
+	message := e.Message
+	message.Text = title + "\n" + message.Text
+	message.Blocks = append([]SlackBlock{{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: "*" + title + "*"}}}, message.Blocks...)
+	if step.Action == escalateChannel {
+		message.Channel = step.Channel
+	}
+	return &Notification{
+		IntegrationID: e.IntegrationID,
+		Message:       message,
+		Reason:        reasonEscalated,
+		Unthreaded:    step.Action == escalateChannel,
+		QueuedAt:      now,
+	}
+}
+
+// escalationLoop runs the escalation steps as they come due.
+func escalationLoop(ctx context.Context) {
+	if len(escalationSteps) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if role.isStandby() {
+				continue
+			}
+			for _, n := range escalations.due(now.UTC()) {
+				notifications.enqueue(n)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// explainPoll is an archived poll of the integration being explained.
+type explainPoll struct {
+	fetchedAt time.Time
+	payload   Payload
+}
+
+// explain replays the archived polls of integrationID around at through the
+// same checks pollIntegration makes, and prints for each poll within window
+// which errors were new, deduplicated or filtered out and whether that led
+// to a notification. The dedup checkpoint is rebuilt by replaying the polls
+// of the day before the window too.
+func explain(w io.Writer, integrationID int, at time.Time, window time.Duration) error {
+	from, to := at.Add(-window), at.Add(window)
+	polls, err := archivedPolls(integrationID, from.Add(-24*time.Hour), to)
+	if err != nil {
+		return err
+	}
+	if len(polls) == 0 {
+		if !archiveEnabled {
+			return fmt.Errorf("no archived payloads for integration %d around %s; payloads are only kept with archive.enabled: true", integrationID, at.Format(time.RFC3339))
+		}
+		return fmt.Errorf("no archived payloads for integration %d around %s", integrationID, at.Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(w, "Integration %s, polls from %s to %s\n", integrationLabel(integrationID), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	fmt.Fprintf(w, "Dedup checkpoint rebuilt from %d archived polls since %s.\n", len(polls), polls[0].fetchedAt.Format(time.RFC3339))
+
+	var checkpoint time.Time
+	shown := 0
+	for _, poll := range polls {
+		inWindow := !poll.fetchedAt.Before(from) && !poll.fetchedAt.After(to)
+		if inWindow {
+			shown++
+			fmt.Fprintf(w, "\nPoll at %s: %d errors in the payload, %d in total\n", poll.fetchedAt.Format(time.RFC3339), len(poll.payload.Errors), poll.payload.Count)
+		}
+
+		oneMinuteAgo := poll.fetchedAt.Add(-time.Minute)
+		var recentErrors []ErrorLog
+		newest := checkpoint
+		for _, e := range poll.payload.Errors {
+			timestamp, parseErr := e.Time()
+			verdict := ""
+			switch {
+			case parseErr != nil:
+				e.Category = classifyError(e.Error)
+				e.InvalidTimestamp = true
+				recentErrors = append(recentErrors, e)
+				verdict = "FLAGGED   unparsable timestamp, alerted once"
+			case !timestamp.After(oneMinuteAgo):
+				verdict = "FILTERED  older than a minute before the poll"
+			case !timestamp.Before(poll.fetchedAt.Add(clockSkew)):
+				verdict = "FILTERED  timestamp after the poll"
+			case !timestamp.After(checkpoint):
+				verdict = "DEDUPED   not after the checkpoint " + checkpoint.Format(time.RFC3339Nano)
+			default:
+				e.Category = classifyError(e.Error)
+				recentErrors = append(recentErrors, e)
+				verdict = "NEW       " + e.Category
+				if timestamp.After(newest) {
+					newest = timestamp
+				}
+			}
+			if inWindow {
+				fmt.Fprintf(w, "  %s  %s  %s\n", e.Timestamp, verdict, e.Error)
+			}
+		}
+		if inWindow {
+			fmt.Fprintf(w, "  => %s\n", explainDecision(recentErrors, &poll.payload, poll.fetchedAt))
+		}
+		checkpoint = newest
+	}
+	if shown == 0 {
+		fmt.Fprintf(w, "\nNo archived poll between %s and %s.\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	entries, err := history.notifications(from, 1000)
+	if err != nil {
+		fmt.Fprintf(w, "\nNotifications sent: unknown, %v\n", err)
+		return nil
+	}
+	fmt.Fprintln(w, "\nNotifications sent:")
+	sent := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.IntegrationID != integrationID || e.SentAt.After(to) {
+			continue
+		}
+		sent++
+		result := "delivered"
+		switch {
+		case e.Held:
+			result = "held: " + e.Error
+		case !e.Delivered:
+			result = "failed: " + e.Error
+		}
+		fmt.Fprintf(w, "  %s  %s  %s  %s  %s\n", e.SentAt.Format(time.RFC3339), e.Notifier, e.Reason, result, e.Title)
+	}
+	if sent == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	return nil
+}
+
+// explainDecision says what pollIntegration does with the new errors of a
+// poll made at fetchedAt. Silences are only known while they are kept, so an
+// expired one doesn't show.
+func explainDecision(recentErrors []ErrorLog, payload *Payload, fetchedAt time.Time) string {
+	if len(recentErrors) == 0 {
+		return "no new errors, nothing to notify"
+	}
+	id := payload.IntegrationID
+	kept, muted := filterSilenced(silences.list(time.Now().UTC()), id, recentErrors, func(silence Silence) bool {
+		return !fetchedAt.Before(silence.CreatedAt) && fetchedAt.Before(silence.Until)
+	})
+	if len(kept) == 0 {
+		return fmt.Sprintf("%d new errors, not notified: silenced", len(recentErrors))
+	}
+	met := alertConditions.filter(kept, payload)
+	if len(met) == 0 {
+		return fmt.Sprintf("%d new errors, not notified: they don't meet the condition %q", len(recentErrors), alertConditions.forIntegration(id).text)
+	}
+	recentErrors = met
+
+	severity, decidedBy := severities.decide(recentErrors, payload)
+	var actions []string
+	if correlationEnabled() && severities.notifies(severity, notifierEvents) {
+		actions = append(actions, "critical event correlation event")
+	}
+	category := dominantCategory(recentErrors)
+	slack := severities.notifies(severity, notifierSlack)
+	switch {
+	case digestMode(id) && slack:
+		actions = append(actions, "added to the "+digestInterval+" digest")
+	case digestMode(id):
+	default:
+		if slack {
+			actions = append(actions, fmt.Sprintf("Slack alert (category %s) to %s", category, describeSlackDestination(alertChannel(id, category))))
+		}
+		if githubEnabled() && severities.notifies(severity, notifierGitHub) {
+			if ticket, ok := openTicketAt(id, fetchedAt); ok {
+				actions = append(actions, "no GitHub issue, #"+ticket.ExternalID+" was open")
+			} else {
+				actions = append(actions, "GitHub issue")
+			}
+		}
+	}
+	if len(actions) == 0 {
+		actions = append(actions, "no notifier takes "+severity+" alerts")
+	}
+	if len(muted) > 0 {
+		actions = append(actions, fmt.Sprintf("%d more silenced", len(muted)))
+	}
+	if unmet := len(kept) - len(met); unmet > 0 {
+		actions = append(actions, fmt.Sprintf("%d more not meeting the condition", unmet))
+	}
+	return fmt.Sprintf("%d new errors, notified with severity %s (%s): %s", len(recentErrors), severity, decidedBy, strings.Join(actions, ", "))
+}
+
+// openTicketAt returns the GitHub ticket of integrationID that was open at t.
+func openTicketAt(integrationID int, t time.Time) (Ticket, bool) {
+	for _, ticket := range tickets.list() {
+		if ticket.Notifier == notifierGitHub && ticket.IntegrationID == integrationID &&
+			ticket.CreatedAt.Before(t) && (ticket.ResolvedAt == nil || ticket.ResolvedAt.After(t)) {
+			return ticket, true
+		}
+	}
+	return Ticket{}, false
+}
+
+// archivedPolls reads the archived polls of integrationID fetched between
+// from and to, oldest first.
+func archivedPolls(integrationID int, from, to time.Time) ([]explainPoll, error) {
+	names, err := filepath.Glob(filepath.Join(stateDir, "archive", "payloads-*.jsonl*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var polls []explainPoll
+	for _, name := range names {
+		day := strings.TrimPrefix(filepath.Base(name), "payloads-")
+		if len(day) < 10 {
+			continue
+		}
+		if d, err := time.Parse("2006-01-02", day[:10]); err != nil || d.Add(24*time.Hour).Before(from) || d.After(to) {
+			continue
+		}
+		err := readArchive(name, func(record archiveRecord) error {
+			if record.FetchedAt.Before(from) || record.FetchedAt.After(to) {
+				return nil
+			}
+			var payload Payload
+			if err := json.Unmarshal(record.Payload, &payload); err != nil || payload.IntegrationID != integrationID {
+				return nil
+			}
+			polls = append(polls, explainPoll{fetchedAt: record.FetchedAt, payload: payload})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(polls, func(i, j int) bool { return polls[i].fetchedAt.Before(polls[j].fetchedAt) })
+	return polls, nil
+}
+
+// parseExplainTime accepts RFC 3339 timestamps and, in UTC, the shorter
+// 2006-01-02T15:04 and 2006-01-02 15:04 forms.
+func parseExplainTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, use e.g. 2024-05-01T13:45:00Z", s)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// exportedError is one row of `sefi-alarm export`.
+type exportedError struct {
+	IntegrationID   int    `json:"integrationId"`
+	IntegrationName string `json:"integrationName,omitempty"`
+	TenantID        string `json:"tenantId"`
+	Timestamp       string `json:"timestamp"`
+	Category        string `json:"category"`
+	Error           string `json:"error"`
+}
+
+func exportRecords(integrationID int, errors []ErrorLog) []exportedError {
+	name := ""
+	if in, ok := integrationMeta.get(integrationID); ok {
+		name = in.Name
+	}
+	out := make([]exportedError, len(errors))
+	for i, e := range errors {
+		out[i] = exportedError{
+			IntegrationID:   integrationID,
+			IntegrationName: name,
+			TenantID:        tenantID,
+			Timestamp:       e.Timestamp,
+			Category:        classifyError(e.Error),
+			Error:           e.Error,
+		}
+	}
+	return out
+}
+
+// writeExport writes records as an indented JSON array or as CSV with a
+// header row.
+func writeExport(w io.Writer, format string, records []exportedError) error {
+	if format == "json" {
+		if records == nil {
+			records = []exportedError{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("failed to encode errors: %v", err)
+		}
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"integration_id", "integration_name", "tenant_id", "timestamp", "category", "error"})
+	for _, r := range records {
+		cw.Write([]string{strconv.Itoa(r.IntegrationID), r.IntegrationName, r.TenantID, r.Timestamp, r.Category, r.Error})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// Experimental subsystems ship dark behind the features: config block and are
+// only turned on per deployment, e.g.
+//
+//	features:
+//	  operator: true
+//
+// Their own settings configure them, but they stay off until their flag is
+// set, except hot reload, which is on unless features.hotReload is false.
+// Entries that are not available yet are reserved names: enabling them only
+// logs a warning.
+type experimentalFeature struct {
+	description string
+	available   bool
+	// settings is the section configuring the feature.
+	settings string
+	// enabledByDefault turns the feature on unless its flag is false.
+	enabledByDefault bool
+}
+
+var experimentalFeatures = map[string]experimentalFeature{
+	"anomalyDetection": {description: "flag integrations whose error rate deviates from their baseline"},
+	"autoRemediation":  {description: "run remediation actions for known error categories"},
+	"receiveMode":      {description: "accept pushed error events instead of polling"},
+	"operator":         {description: "declare monitors and silences as Kubernetes resources", available: true, settings: "kubernetes.operator"},
+	"canary":           {description: "evaluate a candidate config in shadow mode", available: true, settings: "canary"},
+	"sampling":         {description: "keep 1 in N of the new errors of noisy integrations", available: true, settings: "sampling"},
+	"hotReload":        {description: "reload config.yaml when the template or routing file changes", available: true, settings: "hotReload", enabledByDefault: true},
+}
+
+// featureEnabled reports whether the experimental feature name is available
+// in this build and switched on in the config.
+func featureEnabled(name string) bool {
+	feature, ok := experimentalFeatures[name]
+	return ok && feature.available && conf.Bool("features."+name, feature.enabledByDefault)
+}
+
+// logFeatureFlags reports enabled experimental features at startup and warns
+// about flags that won't do anything.
+func logFeatureFlags() {
+	flags := conf.StringMap("features")
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !conf.Bool("features."+name, false) {
+			continue
+		}
+		feature, ok := experimentalFeatures[name]
+		switch {
+		case !ok:
+			log.Printf("Unknown feature flag %q is ignored.\n", name)
+		case !feature.available:
+			log.Printf("Feature %q (%s) is not available in this build and stays off.\n", name, feature.description)
+		default:
+			log.Printf("Experimental feature %q enabled: %s.\n", name, feature.description)
+		}
+	}
+
+	names = names[:0]
+	for name := range experimentalFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		feature := experimentalFeatures[name]
+		if _, ok := conf.Lookup(feature.settings); ok && feature.settings != "" && !featureEnabled(name) {
+			log.Printf("%s is configured but stays off, set features.%s: true to turn it on.\n", feature.settings, name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package filter picks the errors of a Sysdig payload worth alerting on.
+package filter
+
+import (
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+)
+
+// Window selects the errors timestamped after From and before Until. Until
+// may be set past now to allow for an API clock running ahead.
+type Window struct {
+	From  time.Time
+	Until time.Time
+	// IsNew, when set, is asked about each error in the window, so errors
+	// already alerted on in an earlier, overlapping poll are skipped.
+	IsNew func(timestamp time.Time) bool
+}
+
+// LastMinute is the window polls use: the minute before now.
+func LastMinute(now time.Time) Window {
+	return Window{From: now.Add(-1 * time.Minute), Until: now}
+}
+
+// Ahead counts the errors timestamped at or after Until, which Recent skips.
+func (w Window) Ahead(errs []sysdig.ErrorLog) int {
+	ahead := 0
+	for _, e := range errs {
+		if timestamp, err := e.Time(); err == nil && !timestamp.Before(w.Until) {
+			ahead++
+		}
+	}
+	return ahead
+}
+
+// Recent returns the errors of the window in payload order and the newest
+// timestamp among them. The errors whose timestamp doesn't parse can't be
+// placed in the window, they are returned in invalid for the caller to deal
+// with.
+func (w Window) Recent(errs []sysdig.ErrorLog) (recent []sysdig.ErrorLog, newest time.Time, invalid []sysdig.ErrorLog) {
+	for _, e := range errs {
+		timestamp, err := e.Time()
+		if err != nil {
+			invalid = append(invalid, e)
+			continue
+		}
+		if !timestamp.After(w.From) || !timestamp.Before(w.Until) {
+			continue
+		}
+		if w.IsNew != nil && !w.IsNew(timestamp) {
+			continue
+		}
+		recent = append(recent, e)
+		if timestamp.After(newest) {
+			newest = timestamp
+		}
+	}
+	return recent, newest, invalid
+}
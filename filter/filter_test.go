@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+)
+
+func errorAt(name string, t time.Time) sysdig.ErrorLog {
+	return sysdig.ErrorLog{Error: name, Timestamp: t.Format(time.RFC3339Nano)}
+}
+
+func names(errs []sysdig.ErrorLog) string {
+	var out []string
+	for _, e := range errs {
+		out = append(out, e.Error)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestWindowRecent(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	w := LastMinute(now)
+	tests := []struct {
+		name        string
+		errs        []sysdig.ErrorLog
+		isNew       func(time.Time) bool
+		wantRecent  string
+		wantNewest  time.Time
+		wantInvalid string
+	}{
+		{name: "empty"},
+		{
+			name:       "at from is out",
+			errs:       []sysdig.ErrorLog{errorAt("from", w.From)},
+			wantRecent: "",
+		},
+		{
+			name:       "just after from is in",
+			errs:       []sysdig.ErrorLog{errorAt("after", w.From.Add(time.Nanosecond))},
+			wantRecent: "after",
+			wantNewest: w.From.Add(time.Nanosecond),
+		},
+		{
+			name:       "just before until is in",
+			errs:       []sysdig.ErrorLog{errorAt("before", w.Until.Add(-time.Nanosecond))},
+			wantRecent: "before",
+			wantNewest: w.Until.Add(-time.Nanosecond),
+		},
+		{
+			name: "at until is out",
+			errs: []sysdig.ErrorLog{errorAt("until", w.Until)},
+		},
+		{
+			name: "before the window is out",
+			errs: []sysdig.ErrorLog{errorAt("old", w.From.Add(-time.Second))},
+		},
+		{
+			name: "payload order is kept",
+			errs: []sysdig.ErrorLog{
+				errorAt("b", now.Add(-10*time.Second)),
+				errorAt("a", now.Add(-50*time.Second)),
+				errorAt("c", now.Add(-30*time.Second)),
+			},
+			wantRecent: "b,a,c",
+			wantNewest: now.Add(-10 * time.Second),
+		},
+		{
+			name: "unparsable timestamps are invalid",
+			errs: []sysdig.ErrorLog{
+				{Error: "bad", Timestamp: "yesterday"},
+				errorAt("ok", now.Add(-time.Second)),
+				{Error: "empty"},
+			},
+			wantRecent:  "ok",
+			wantNewest:  now.Add(-time.Second),
+			wantInvalid: "bad,empty",
+		},
+		{
+			name: "seen errors are skipped",
+			errs: []sysdig.ErrorLog{
+				errorAt("seen", now.Add(-40*time.Second)),
+				errorAt("new", now.Add(-20*time.Second)),
+			},
+			isNew:      func(t time.Time) bool { return t.After(now.Add(-30 * time.Second)) },
+			wantRecent: "new",
+			wantNewest: now.Add(-20 * time.Second),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := w
+			w.IsNew = tt.isNew
+			recent, newest, invalid := w.Recent(tt.errs)
+			if got := names(recent); got != tt.wantRecent {
+				t.Errorf("recent = %q, want %q", got, tt.wantRecent)
+			}
+			if !newest.Equal(tt.wantNewest) {
+				t.Errorf("newest = %v, want %v", newest, tt.wantNewest)
+			}
+			if got := names(invalid); got != tt.wantInvalid {
+				t.Errorf("invalid = %q, want %q", got, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestWindowAhead(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	w := LastMinute(now)
+	errs := []sysdig.ErrorLog{
+		errorAt("before", now.Add(-time.Nanosecond)),
+		errorAt("at", now),
+		errorAt("after", now.Add(time.Second)),
+		{Error: "bad", Timestamp: "yesterday"},
+	}
+	if got := w.Ahead(errs); got != 2 {
+		t.Errorf("Ahead() = %d, want 2", got)
+	}
+}
+
+func TestLastMinute(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	w := LastMinute(now)
+	if !w.From.Equal(now.Add(-time.Minute)) || !w.Until.Equal(now) {
+		t.Errorf("LastMinute() = %v to %v", w.From, w.Until)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The GitHub notifier opens an issue per incident in github.repo
+// ("owner/name"), using github.apiUrl for GitHub Enterprise.
+var (
+	githubToken  = conf.String("github.token", "")
+	githubRepo   = conf.String("github.repo", "")
+	githubAPIURL = conf.String("github.apiUrl", "https://api.github.com")
+	githubLabels = conf.StringList("github.labels")
+)
+
+func githubEnabled() bool {
+	return githubToken != "" && githubRepo != ""
+}
+
+type githubIssue struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	State   string `json:"state"`
+}
+
+func callGitHub(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payloadBytes, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal github payload: %v", err)
+		}
+		reader = bytes.NewReader(payloadBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, githubAPIURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create github request: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+githubToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call github: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("github request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse github response: %v", err)
+	}
+	return nil
+}
+
+// openGitHubIssue creates the issue for n and records it as a ticket.
+func openGitHubIssue(ctx context.Context, n *Notification) error {
+	if n.Ticket == nil {
+		return fmt.Errorf("github notification without ticket content")
+	}
+	// An earlier notification in the queue may already have opened one.
+	if tickets.hasOpen(notifierGitHub, n.IntegrationID) {
+		return nil
+	}
+
+	request := map[string]interface{}{
+		"title": n.Ticket.Title,
+		"body":  n.Ticket.Body,
+	}
+	if len(githubLabels) > 0 {
+		request["labels"] = githubLabels
+	}
+
+	var issue githubIssue
+	if err := callGitHub(ctx, "POST", "/repos/"+githubRepo+"/issues", request, &issue); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tickets.add(&Ticket{
+		Notifier:      notifierGitHub,
+		ExternalID:    strconv.Itoa(issue.Number),
+		URL:           issue.HTMLURL,
+		IntegrationID: n.IntegrationID,
+		Title:         n.Ticket.Title,
+		CreatedAt:     now,
+		Status:        issue.State,
+		CheckedAt:     now,
+	})
+	return nil
+}
+
+// gitHubIssueStatus returns the state of issue number and whether that counts
+// as resolved.
+func gitHubIssueStatus(ctx context.Context, number string) (string, bool, error) {
+	var issue githubIssue
+	if err := callGitHub(ctx, "GET", "/repos/"+githubRepo+"/issues/"+number, nil, &issue); err != nil {
+		return "", false, err
+	}
+	return issue.State, issue.State == "closed", nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const groupsFile = "groups.json"
+
+// Integrations can be grouped under groups, by environment, customer or
+// downstream, for a rollup on the dashboard and at /api/groups:
+//
+//	groups:
+//	  prod:
+//	    label: prod forwarders
+//	    integrations: [101, 102, 103, 104, 105]
+//	    alertThreshold: 3
+//	    slackChannel: "#prod-alerts"
+//
+// A member is failing while its alert fires, or for failingWindowMins (30 by
+// default) after it alerted. Once alertThreshold members fail at the same
+// time the group alerts too ("3 of 5 prod forwarders failing"), on top of
+// the alerts of each integration, and announces when it is back under the
+// threshold. Without alertThreshold the group is only rolled up.
+type integrationGroup struct {
+	Name          string        `json:"name"`
+	Label         string        `json:"label"`
+	Integrations  []int         `json:"integrations"`
+	Threshold     int           `json:"alertThreshold,omitempty"`
+	SlackChannel  string        `json:"slackChannel,omitempty"`
+	FailingWindow time.Duration `json:"-"`
+}
+
+// GroupStatus is the rollup of one group.
+type GroupStatus struct {
+	integrationGroup
+	Failing     []int      `json:"failing"`
+	FiringSince *time.Time `json:"firingSince,omitempty"`
+}
+
+var groupsFiring = metrics.newGauge("sefi_group_failing_integrations",
+	"Failing integrations of each group.", "group")
+
+type groupTracker struct {
+	mu     sync.Mutex
+	groups []integrationGroup
+	// firing holds the groups over their threshold, since when.
+	firing map[string]time.Time
+}
+
+var groups = loadGroups()
+
+func loadGroups() *groupTracker {
+	parsed, err := groupsFrom(conf)
+	if err != nil {
+		addConfigProblem("groups: %v", err)
+	}
+	g := &groupTracker{groups: parsed, firing: make(map[string]time.Time)}
+	if _, err := loadState(groupsFile, &g.firing); err != nil {
+		log.Printf("Error loading group alerts: %v\n", err)
+	}
+	return g
+}
+
+func (g *groupTracker) reload() {
+	firing := make(map[string]time.Time)
+	if _, err := loadState(groupsFile, &firing); err != nil {
+		log.Printf("Error reloading group alerts: %v\n", err)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.firing = firing
+}
+
+// groupsFrom reads the groups block of c, sorted by name.
+func groupsFrom(c configMap) ([]integrationGroup, error) {
+	v, ok := c.Lookup("groups")
+	if !ok {
+		return nil, nil
+	}
+	section, ok := asSection(v)
+	if !ok {
+		return nil, fmt.Errorf("groups must map group names to their integrations")
+	}
+
+	out := make([]integrationGroup, 0, len(section))
+	for name, value := range section {
+		entry, ok := asSection(value)
+		if !ok {
+			return nil, fmt.Errorf("group %s must list its integrations", name)
+		}
+		group := integrationGroup{
+			Name:          name,
+			Label:         configMap(entry).String("label", name+" integrations"),
+			Threshold:     configMap(entry).Int("alertThreshold", 0),
+			SlackChannel:  configMap(entry).String("slackChannel", ""),
+			FailingWindow: time.Duration(configMap(entry).Int("failingWindowMins", 30)) * time.Minute,
+		}
+		for _, item := range configMap(entry).StringList("integrations") {
+			id, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %q is not an integration ID", name, item)
+			}
+			group.Integrations = appendUnique(group.Integrations, id)
+		}
+		if len(group.Integrations) == 0 {
+			return nil, fmt.Errorf("group %s must list its integrations", name)
+		}
+		if group.Threshold < 0 || group.Threshold > len(group.Integrations) {
+			return nil, fmt.Errorf("alertThreshold of group %s must be at most its %d integrations", name, len(group.Integrations))
+		}
+		out = append(out, group)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// list rolls up every group from the status of its members.
+func (g *groupTracker) list(now time.Time) []GroupStatus {
+	statuses := make(map[int]IntegrationStatus)
+	for _, s := range polls.list(now) {
+		statuses[s.IntegrationID] = s
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]GroupStatus, 0, len(g.groups))
+	for _, group := range g.groups {
+		rollup := GroupStatus{integrationGroup: group, Failing: []int{}}
+		for _, id := range group.Integrations {
+			s := statuses[id]
+			if s.AlertState == alertFiring || s.LastAlertAt != nil && now.Sub(*s.LastAlertAt) < group.FailingWindow {
+				rollup.Failing = append(rollup.Failing, id)
+			}
+		}
+		if since, ok := g.firing[group.Name]; ok {
+			rollup.FiringSince = &since
+		}
+		out = append(out, rollup)
+	}
+	return out
+}
+
+// evaluate sends the alerts of the groups that crossed their threshold, and
+// the notices of those back under it.
+func (g *groupTracker) evaluate(now time.Time) {
+	if len(g.groups) == 0 {
+		return
+	}
+	rollups := g.list(now)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	changed := false
+	for _, r := range rollups {
+		groupsFiring.set(float64(len(r.Failing)), r.Name)
+		if r.Threshold == 0 {
+			continue
+		}
+		since, firing := g.firing[r.Name]
+		switch {
+		case !firing && len(r.Failing) >= r.Threshold:
+			g.firing[r.Name] = now
+			changed = true
+			groupNotice(r, now, reasonThresholdExceeded,
+				fmt.Sprintf("%d of %d %s failing", len(r.Failing), len(r.Integrations), r.Label),
+				"Failing: "+groupMembers(r.Failing)+".")
+		case firing && len(r.Failing) < r.Threshold:
+			delete(g.firing, r.Name)
+			changed = true
+			groupNotice(r, now, reasonRecovered,
+				fmt.Sprintf("%s recovered: %d of %d failing", capitalize(r.Label), len(r.Failing), len(r.Integrations)),
+				fmt.Sprintf("Back under the threshold of %d after %s.", r.Threshold, formatDuration(now.Sub(since))))
+		}
+	}
+	if changed {
+		if err := saveState(groupsFile, g.firing); err != nil {
+			log.Printf("Error saving group alerts: %v\n", err)
+		}
+	}
+}
+
+func groupMembers(ids []int) string {
+	labels := make([]string, 0, len(ids))
+	for _, id := range ids {
+		labels = append(labels, integrationLabel(id))
+	}
+	return strings.Join(labels, ", ")
+}
+
+func groupNotice(r GroupStatus, at time.Time, reason, title, text string) {
+	log.Printf("Group %s: %s. %s\n", r.Name, title, text)
+	channel := r.SlackChannel
+	if channel == "" {
+		channel = slackChannel
+	}
+	blocks := []SlackBlock{
+		{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+		{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+	}
+	if footer, ok := podFooter(); ok {
+		blocks = append(blocks, footer)
+	}
+	notifications.enqueue(&Notification{
+		Message: SlackMessage{
+			Channel: channel,
+			Text:    title + "\n" + text,
+			Blocks:  blocks,
+		},
+		Reason:   reason,
+		QueuedAt: at,
+	})
+}
+
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, groups.list(time.Now().UTC()))
+}
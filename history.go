@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const historyFile = "history.db"
+
+var (
+	historyEnabled       = conf.Bool("history.enabled", true)
+	historyRetentionDays = conf.Int("history.retentionDays", 90)
+)
+
+// HistoryEntry is one error occurrence recorded in the history store.
+type HistoryEntry struct {
+	IntegrationID int       `json:"integrationId"`
+	Fingerprint   string    `json:"fingerprint"`
+	Error         string    `json:"error"`
+	OccurredAt    time.Time `json:"occurredAt"`
+	RecordedAt    time.Time `json:"recordedAt"`
+}
+
+// errorHistory keeps every detected error and every notification delivery
+// attempt in the SQLite database of the store, with an FTS5 index over the
+// error messages so past occurrences of an error string can be found long
+// after the alert scrolled out of Slack.
+type errorHistory struct {
+	mu   sync.Mutex
+	db   *sql.DB
+	err  error
+	init bool
+}
+
+var history = &errorHistory{}
+
+// historyMigrations bring the schema up to date, the database's user_version
+// being the number already applied. The first one is idempotent since it
+// predates the versioning.
+var historyMigrations = []string{`
+CREATE TABLE IF NOT EXISTS errors (
+	id             INTEGER PRIMARY KEY,
+	integration_id INTEGER NOT NULL,
+	fingerprint    TEXT NOT NULL,
+	error          TEXT NOT NULL,
+	occurred_at    INTEGER NOT NULL,
+	recorded_at    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS errors_occurred_at ON errors (occurred_at);
+CREATE VIRTUAL TABLE IF NOT EXISTS errors_fts USING fts5(error, content='errors', content_rowid='id');
+CREATE TRIGGER IF NOT EXISTS errors_ai AFTER INSERT ON errors BEGIN
+	INSERT INTO errors_fts (rowid, error) VALUES (new.id, new.error);
+END;
+CREATE TRIGGER IF NOT EXISTS errors_ad AFTER DELETE ON errors BEGIN
+	INSERT INTO errors_fts (errors_fts, rowid, error) VALUES ('delete', old.id, old.error);
+END;
+`, `
+ALTER TABLE errors ADD COLUMN category TEXT NOT NULL DEFAULT '';
+ALTER TABLE errors ADD COLUMN integration_name TEXT NOT NULL DEFAULT '';
+CREATE TABLE notifications (
+	id             INTEGER PRIMARY KEY,
+	integration_id INTEGER NOT NULL,
+	notifier       TEXT NOT NULL,
+	reason         TEXT NOT NULL,
+	title          TEXT NOT NULL,
+	delivered      INTEGER NOT NULL,
+	error          TEXT NOT NULL,
+	sent_at        INTEGER NOT NULL
+);
+CREATE INDEX notifications_sent_at ON notifications (sent_at);
+`}
+
+// open returns the database, creating it and its schema on first use.
+func (h *errorHistory) open() (*sql.DB, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.init {
+		return h.db, h.err
+	}
+	h.init = true
+
+	if !historyEnabled {
+		h.err = fmt.Errorf("history is disabled in config.yaml")
+		return nil, h.err
+	}
+	dsn := state.historyDSN()
+	if dsn == "" {
+		h.err = fmt.Errorf("history is not kept in stateless mode")
+		return nil, h.err
+	}
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		h.err = fmt.Errorf("error opening history: %v", err)
+		return nil, h.err
+	}
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		h.err = fmt.Errorf("error creating history schema: %v", err)
+		return nil, h.err
+	}
+	h.db = db
+	return h.db, nil
+}
+
+func migrateHistory(db *sql.DB) error {
+	var applied int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&applied); err != nil {
+		return err
+	}
+	for v := applied; v < len(historyMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(historyMigrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", v+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, v+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record stores the new errors of integrationID and drops entries older than
+// the retention period.
+func (h *errorHistory) record(integrationID int, errs []ErrorLog, now time.Time) {
+	if !historyEnabled || stateless {
+		return
+	}
+	db, err := h.open()
+	if err != nil {
+		log.Printf("Error recording history: %v\n", err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error recording history: %v\n", err)
+		return
+	}
+	defer tx.Rollback()
+
+	name := ""
+	if in, ok := integrationMeta.get(integrationID); ok {
+		name = in.Name
+	}
+	for _, e := range errs {
+		occurredAt, parseErr := e.Time()
+		if parseErr != nil {
+			occurredAt = now
+		}
+		if _, err := tx.Exec(`INSERT INTO errors (integration_id, integration_name, fingerprint, error, category, occurred_at, recorded_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			integrationID, name, errorFingerprint(integrationID, e.Error), e.Error, e.Category, occurredAt.UnixNano(), now.UnixNano()); err != nil {
+			log.Printf("Error recording history: %v\n", err)
+			return
+		}
+	}
+	if historyRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -historyRetentionDays)
+		if _, err := tx.Exec(`DELETE FROM errors WHERE occurred_at < ?`, cutoff.UnixNano()); err != nil {
+			log.Printf("Error pruning history: %v\n", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error recording history: %v\n", err)
+	}
+}
+
+// recordNotification stores the outcome of delivering n, dropping entries
+// older than the retention period.
+func (h *errorHistory) recordNotification(n *Notification, deliveryErr error, now time.Time) {
+	if !historyEnabled || stateless {
+		return
+	}
+	db, err := h.open()
+	if err != nil {
+		log.Printf("Error recording notification history: %v\n", err)
+		return
+	}
+
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	if _, err := db.Exec(`INSERT INTO notifications (integration_id, notifier, reason, title, delivered, error, sent_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		n.IntegrationID, notifierName(n), n.Reason, notificationTitle(n), deliveryErr == nil, errText, now.UnixNano()); err != nil {
+		log.Printf("Error recording notification history: %v\n", err)
+		return
+	}
+	if historyRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -historyRetentionDays)
+		if _, err := db.Exec(`DELETE FROM notifications WHERE sent_at < ?`, cutoff.UnixNano()); err != nil {
+			log.Printf("Error pruning notification history: %v\n", err)
+		}
+	}
+}
+
+// notificationTitle is the first line of what n says.
+func notificationTitle(n *Notification) string {
+	switch {
+	case n.Ticket != nil:
+		return n.Ticket.Title
+	case n.Event != nil:
+		return n.Event.Summary
+	}
+	title, _, _ := strings.Cut(n.Message.Text, "\n")
+	return title
+}
+
+// IntegrationStats sums up the history of one integration over a period.
+type IntegrationStats struct {
+	IntegrationID       int            `json:"integrationId"`
+	IntegrationName     string         `json:"integrationName,omitempty"`
+	Errors              int            `json:"errors"`
+	DaysWithErrors      int            `json:"daysWithErrors"`
+	FirstAt             *time.Time     `json:"firstAt,omitempty"`
+	LastAt              *time.Time     `json:"lastAt,omitempty"`
+	Categories          map[string]int `json:"categories"`
+	Notifications       int            `json:"notifications"`
+	FailedNotifications int            `json:"failedNotifications"`
+}
+
+// stats sums up the errors and notifications since the given time, per
+// integration, most errors first. filter, when set, keeps the integrations
+// whose ID it is or whose name contains it.
+func (h *errorHistory) stats(since time.Time, filter string) ([]*IntegrationStats, error) {
+	db, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*IntegrationStats)
+	get := func(id int) *IntegrationStats {
+		s, ok := byID[id]
+		if !ok {
+			s = &IntegrationStats{IntegrationID: id, Categories: make(map[string]int)}
+			byID[id] = s
+		}
+		return s
+	}
+
+	rows, err := db.Query(`SELECT integration_id, MAX(integration_name), category, COUNT(*), MIN(occurred_at), MAX(occurred_at)
+		FROM errors WHERE occurred_at >= ? GROUP BY integration_id, category`, since.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, count int
+		var name, category string
+		var first, last int64
+		if err := rows.Scan(&id, &name, &category, &count, &first, &last); err != nil {
+			return nil, fmt.Errorf("error reading history: %v", err)
+		}
+		s := get(id)
+		if name != "" {
+			s.IntegrationName = name
+		}
+		if category == "" {
+			category = categoryOther
+		}
+		s.Categories[category] += count
+		s.Errors += count
+		firstAt, lastAt := time.Unix(0, first).UTC(), time.Unix(0, last).UTC()
+		if s.FirstAt == nil || firstAt.Before(*s.FirstAt) {
+			s.FirstAt = &firstAt
+		}
+		if s.LastAt == nil || lastAt.After(*s.LastAt) {
+			s.LastAt = &lastAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+
+	// Days with errors are counted over all categories.
+	dayRows, err := db.Query(`SELECT integration_id, COUNT(DISTINCT occurred_at / 86400000000000)
+		FROM errors WHERE occurred_at >= ? GROUP BY integration_id`, since.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+	defer dayRows.Close()
+	for dayRows.Next() {
+		var id, dayCount int
+		if err := dayRows.Scan(&id, &dayCount); err != nil {
+			return nil, fmt.Errorf("error reading history: %v", err)
+		}
+		get(id).DaysWithErrors = dayCount
+	}
+
+	notificationRows, err := db.Query(`SELECT integration_id, COUNT(*), SUM(CASE WHEN delivered = 0 AND error != ? THEN 1 ELSE 0 END)
+		FROM notifications WHERE sent_at >= ? AND integration_id != 0 GROUP BY integration_id`, errThrottled.Error(), since.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("error reading notification history: %v", err)
+	}
+	defer notificationRows.Close()
+	for notificationRows.Next() {
+		var id, count, failed int
+		if err := notificationRows.Scan(&id, &count, &failed); err != nil {
+			return nil, fmt.Errorf("error reading notification history: %v", err)
+		}
+		s := get(id)
+		s.Notifications, s.FailedNotifications = count, failed
+	}
+
+	var out []*IntegrationStats
+	for _, s := range byID {
+		if s.IntegrationName == "" {
+			if in, ok := integrationMeta.get(s.IntegrationID); ok {
+				s.IntegrationName = in.Name
+			}
+		}
+		if filter != "" && strconv.Itoa(s.IntegrationID) != filter &&
+			!strings.Contains(strings.ToLower(s.IntegrationName), strings.ToLower(filter)) {
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Errors != out[j].Errors {
+			return out[i].Errors > out[j].Errors
+		}
+		return out[i].IntegrationID < out[j].IntegrationID
+	})
+	return out, nil
+}
+
+// NotificationEntry is one delivery attempt recorded in the history store.
+type NotificationEntry struct {
+	IntegrationID int    `json:"integrationId"`
+	Notifier      string `json:"notifier"`
+	Reason        string `json:"reason,omitempty"`
+	Title         string `json:"title"`
+	Delivered     bool   `json:"delivered"`
+	// Held is set for notifications held back by the rate limit, which
+	// weren't delivered but didn't fail either.
+	Held   bool      `json:"held,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	SentAt time.Time `json:"sentAt"`
+}
+
+// notifications returns up to limit delivery attempts since the given time,
+// newest first.
+func (h *errorHistory) notifications(since time.Time, limit int) ([]NotificationEntry, error) {
+	db, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT integration_id, notifier, reason, title, delivered, error, sent_at
+		FROM notifications WHERE sent_at >= ? ORDER BY sent_at DESC LIMIT ?`, since.UnixNano(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading notification history: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []NotificationEntry{}
+	for rows.Next() {
+		var entry NotificationEntry
+		var sentAt int64
+		if err := rows.Scan(&entry.IntegrationID, &entry.Notifier, &entry.Reason, &entry.Title, &entry.Delivered, &entry.Error, &sentAt); err != nil {
+			return nil, fmt.Errorf("error reading notification history: %v", err)
+		}
+		entry.SentAt = time.Unix(0, sentAt).UTC()
+		entry.Held = !entry.Delivered && entry.Error == errThrottled.Error()
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading notification history: %v", err)
+	}
+	return entries, nil
+}
+
+// parseSince parses a period such as 30d, 12h or 90m.
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid period %q, use e.g. 30d or 12h", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q, use e.g. 30d or 12h", s)
+	}
+	return d, nil
+}
+
+// search returns up to limit entries whose message contains query, best
+// matches first. The query is matched as a phrase, so error strings can be
+// pasted as-is without FTS5 syntax getting in the way.
+func (h *errorHistory) search(query string, limit int) ([]HistoryEntry, error) {
+	db, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+
+	phrase := `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+	rows, err := db.Query(`SELECT e.integration_id, e.fingerprint, e.error, e.occurred_at, e.recorded_at
+		FROM errors_fts JOIN errors e ON e.id = errors_fts.rowid
+		WHERE errors_fts MATCH ?
+		ORDER BY rank, e.occurred_at DESC
+		LIMIT ?`, phrase, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching history: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		var occurredAt, recordedAt int64
+		if err := rows.Scan(&entry.IntegrationID, &entry.Fingerprint, &entry.Error, &occurredAt, &recordedAt); err != nil {
+			return nil, fmt.Errorf("error reading history: %v", err)
+		}
+		entry.OccurredAt = time.Unix(0, occurredAt).UTC()
+		entry.RecordedAt = time.Unix(0, recordedAt).UTC()
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+	return entries, nil
+}
+
+func (h *errorHistory) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.db != nil {
+		h.db.Close()
+		h.db = nil
+	}
+	h.init, h.err = false, nil
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := history.search(query, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageTemplateFile and routingFile are checked for changes every
+// hotReload.intervalSecs (0, or features.hotReload: false, turns it off),
+// and config.yaml is reloaded when one has changed. The new template and rules are first tried on a sample
+// alert; if they fail, or the file doesn't parse, the previous version keeps
+// running until the file is fixed. A template that passes the sample but
+// fails on a real alert is rolled back to the previous one.
+var hotReloadInterval = time.Duration(conf.Int("hotReload.intervalSecs", 10)) * time.Second
+
+var hotReloads = metrics.newCounter("sefi_hot_reloads_total",
+	"Reloads after a template or routing file changed, by result.", "result")
+
+// watchedFile is a file as it was when last applied.
+type watchedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func statWatched(path string) watchedFile {
+	w := watchedFile{path: path}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	return w
+}
+
+var (
+	watchMu sync.Mutex
+	watched = watchedFilesOf(conf)
+)
+
+func watchedFilesOf(c configMap) []watchedFile {
+	var files []watchedFile
+	for _, key := range []string{"messageTemplateFile", "routingFile"} {
+		if path := c.String(key, ""); path != "" {
+			files = append(files, statWatched(path))
+		}
+	}
+	return files
+}
+
+// watchFiles starts watching the files c points at, as they are now.
+func watchFiles(c configMap) {
+	files := watchedFilesOf(c)
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	watched = files
+}
+
+// changedFiles returns the watched files that changed since the last check.
+// Each change is tried once: after a failed reload, the next edit is.
+func changedFiles() []string {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	var changed []string
+	for i, w := range watched {
+		now := statWatched(w.path)
+		if now != w {
+			changed = append(changed, w.path)
+			watched[i] = now
+		}
+	}
+	return changed
+}
+
+func hotReloadLoop(ctx context.Context) {
+	if hotReloadInterval <= 0 || !featureEnabled("hotReload") {
+		return
+	}
+
+	ticker := time.NewTicker(hotReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed := changedFiles()
+		if len(changed) == 0 {
+			continue
+		}
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("Not applying the change to %s, keeping the previous version: %v\n", strings.Join(changed, ", "), err)
+			hotReloads.inc("failure")
+			continue
+		}
+		log.Printf("Reloaded config.yaml after %s changed.\n", strings.Join(changed, ", "))
+		hotReloads.inc("success")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// One client is shared by every outbound call so connections to the Sysdig
+// API and Slack are kept alive between polls. The timeouts make sure a stuck
+// connection fails the request instead of hanging the loop.
+var (
+	httpConnectTimeout = time.Duration(conf.Int("http.connectTimeoutSecs", 10)) * time.Second
+	httpReadTimeout    = time.Duration(conf.Int("http.readTimeoutSecs", 30)) * time.Second
+	httpRequestTimeout = time.Duration(conf.Int("http.requestTimeoutSecs", 60)) * time.Second
+
+	// httpProxyURL sends the Sysdig API and notifier calls through an explicit
+	// proxy instead of HTTP_PROXY/HTTPS_PROXY. Hosts in http.noProxy, or in
+	// NO_PROXY when it is unset, are still reached directly.
+	httpProxyURL = conf.String("http.proxyUrl", "")
+	httpNoProxy  = conf.StringList("http.noProxy")
+
+	// The TLS options are for Sysdig on-prem behind an internal PKI. The CA
+	// file is added to the system roots, so Slack and GitHub keep working.
+	httpCAFile             = conf.String("http.tls.caFile", "")
+	httpTLSMinVersion      = conf.String("http.tls.minVersion", "1.2")
+	httpInsecureSkipVerify = conf.Bool("http.tls.insecureSkipVerify", false)
+
+	// A client certificate is presented to every server that asks for one,
+	// for gateways in front of the Sysdig API or webhooks requiring mTLS.
+	httpCertFile = conf.String("http.tls.certFile", "")
+	httpKeyFile  = conf.String("http.tls.keyFile", "")
+)
+
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		addConfigProblem("%v", err)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           proxyFunc(),
+		DialContext: (&net.Dialer{
+			Timeout:   httpConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   httpConnectTimeout,
+		ResponseHeaderTimeout: httpReadTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   httpRequestTimeout,
+	}
+}
+
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	if httpProxyURL == "" && httpNoProxy == nil {
+		return http.ProxyFromEnvironment
+	}
+
+	cfg := httpproxy.FromEnvironment()
+	if httpProxyURL != "" {
+		cfg.HTTPProxy = httpProxyURL
+		cfg.HTTPSProxy = httpProxyURL
+	}
+	if httpNoProxy != nil {
+		cfg.NoProxy = strings.Join(httpNoProxy, ",")
+	} else if cfg.NoProxy == "" {
+		cfg.NoProxy = os.Getenv("no_proxy")
+	}
+
+	proxy := cfg.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[httpTLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown http.tls.minVersion %q, use one of 1.0, 1.1, 1.2 or 1.3", httpTLSMinVersion)
+	}
+	cfg := &tls.Config{MinVersion: minVersion}
+
+	if httpCAFile != "" {
+		pem, err := os.ReadFile(httpCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", httpCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (httpCertFile == "") != (httpKeyFile == "") {
+		return nil, fmt.Errorf("http.tls.certFile and http.tls.keyFile must be set together")
+	}
+	if httpCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(httpCertFile, httpKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if httpInsecureSkipVerify {
+		log.Println("WARNING: http.tls.insecureSkipVerify is set, TLS certificates are NOT verified. " +
+			"Anyone on the network path can read the bearer token. Use http.tls.caFile instead.")
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const instancesDir = "instances"
+
+var (
+	instanceID        = conf.String("instanceId", defaultInstanceID())
+	instanceHeartbeat = time.Duration(conf.Int("instances.heartbeatSecs", 30)) * time.Second
+)
+
+var duplicateInstances = metrics.newGauge("sefi_duplicate_instances",
+	"Other live instances found in the shared state directory claiming the same integrations.")
+
+// instanceRecord is the heartbeat every instance writes to the shared state
+// directory. When stateDir sits on a volume shared by an HA pair, the records
+// of the peers show whether two of them poll the same integrations and would
+// both page for every error.
+type instanceRecord struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname"`
+	PID          int       `json:"pid"`
+	Standby      bool      `json:"standby,omitempty"`
+	Integrations []int     `json:"integrations"`
+	StartedAt    time.Time `json:"startedAt"`
+	At           time.Time `json:"at"`
+}
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func claimedIntegrations() []int {
+	return monitored.current()
+}
+
+func heartbeatFile(id string) string {
+	return path.Join(instancesDir, strings.ReplaceAll(id, "/", "_")+".json")
+}
+
+// instanceLoop writes this instance's heartbeat and warns, once per peer,
+// about other live instances claiming the same integrations. On standby it
+// instead reloads the shared state and watches for the active instance.
+func instanceLoop(ctx context.Context) {
+	if stateless {
+		return
+	}
+	hostname, _ := os.Hostname()
+	self := instanceRecord{
+		ID:           instanceID,
+		Hostname:     hostname,
+		PID:          os.Getpid(),
+		Integrations: claimedIntegrations(),
+		StartedAt:    status.startedAt,
+	}
+	defer func() {
+		if err := removeState(heartbeatFile(self.ID)); err != nil {
+			log.Printf("Error removing instance heartbeat: %v\n", err)
+		}
+	}()
+
+	warned := map[string]bool{}
+	leader := &leaderWatch{lastSeen: time.Now().UTC()}
+	ticker := time.NewTicker(instanceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		self.At = time.Now().UTC()
+		self.Standby = role.isStandby()
+		self.Integrations = claimedIntegrations()
+		if err := saveState(heartbeatFile(self.ID), self); err != nil {
+			log.Printf("Error writing instance heartbeat: %v\n", err)
+		}
+
+		peers := livePeers(self)
+		if self.Standby {
+			reloadState()
+			leader.check(peers, self.At)
+		} else {
+			warnDuplicateInstances(self, peers, warned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// livePeers returns the other instances with a recent heartbeat that claim
+// some of the integrations of self.
+func livePeers(self instanceRecord) []instanceRecord {
+	names, err := state.list(instancesDir)
+	if err != nil {
+		log.Printf("Error listing instance heartbeats: %v\n", err)
+		return nil
+	}
+
+	var peers []instanceRecord
+	for _, name := range names {
+		if path.Ext(name) != ".json" {
+			continue
+		}
+		var peer instanceRecord
+		if _, err := loadState(name, &peer); err != nil {
+			log.Printf("Error reading instance heartbeat: %v\n", err)
+			continue
+		}
+		if peer.ID == self.ID || self.At.Sub(peer.At) > 3*instanceHeartbeat {
+			continue
+		}
+		if len(sharedIntegrations(self.Integrations, peer.Integrations)) == 0 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// warnDuplicateInstances alerts about active peers; standby peers are
+// expected to share the integrations.
+func warnDuplicateInstances(self instanceRecord, peers []instanceRecord, warned map[string]bool) {
+	live := map[string]bool{}
+	for _, peer := range peers {
+		if peer.Standby {
+			continue
+		}
+		shared := sharedIntegrations(self.Integrations, peer.Integrations)
+		live[peer.ID] = true
+		if warned[peer.ID] {
+			continue
+		}
+		warned[peer.ID] = true
+		sendSelfAlert(self.At, reasonPollerDegraded, "Duplicate SEFI-Alarm instance detected",
+			fmt.Sprintf("Instance %s (host %s, pid %d, running since %s) also polls integration(s) %s, so every error is alerted twice. "+
+				"Stop one of them or give them different integrations. This instance is %s.",
+				peer.ID, peer.Hostname, peer.PID, peer.StartedAt.Format(time.RFC3339), joinInts(shared), self.ID))
+	}
+
+	for id := range warned {
+		if !live[id] {
+			log.Printf("Instance %s no longer claims the same integrations.\n", id)
+			delete(warned, id)
+		}
+	}
+	duplicateInstances.set(float64(len(live)))
+}
+
+func sharedIntegrations(a, b []int) []int {
+	var shared []int
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				shared = append(shared, x)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+func joinInts(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ", ")
+}
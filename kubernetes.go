@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// When running in Kubernetes, the pod, namespace and node are added to logs,
+// metrics and alerts so it's clear which replica raised an alert in sharded
+// setups. They come from the POD_NAME, POD_NAMESPACE and NODE_NAME variables,
+// which the deployment should set through the downward API; the pod name
+// falls back to the hostname and the namespace to the service account's.
+var kubernetesEnrich = conf.Bool("kubernetes.enrich", true)
+
+type podInfo struct {
+	Name      string
+	Namespace string
+	Node      string
+}
+
+var pod = detectPod()
+
+var podInfoGauge = metrics.newGauge("sefi_pod_info",
+	"Kubernetes pod the instance runs in, always 1.", "pod", "namespace", "node")
+
+func detectPod() podInfo {
+	if !kubernetesEnrich || os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return podInfo{}
+	}
+
+	p := podInfo{
+		Name:      os.Getenv("POD_NAME"),
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Node:      os.Getenv("NODE_NAME"),
+	}
+	if p.Name == "" {
+		p.Name, _ = os.Hostname()
+	}
+	if p.Namespace == "" {
+		if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+			p.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+	podInfoGauge.set(1, p.Name, p.Namespace, p.Node)
+	return p
+}
+
+func (p podInfo) detected() bool {
+	return p.Name != ""
+}
+
+// String is "namespace/pod on node", leaving out what isn't known.
+func (p podInfo) String() string {
+	s := p.Name
+	if p.Namespace != "" {
+		s = p.Namespace + "/" + s
+	}
+	if p.Node != "" {
+		s += " on " + p.Node
+	}
+	return s
+}
+
+// labels returns the pod labels added to remote-written samples and event
+// correlation tags.
+func (p podInfo) labels() map[string]string {
+	if !p.detected() {
+		return nil
+	}
+	labels := map[string]string{"pod": p.Name}
+	if p.Namespace != "" {
+		labels["namespace"] = p.Namespace
+	}
+	if p.Node != "" {
+		labels["node"] = p.Node
+	}
+	return labels
+}
+
+// logPodPrefix prefixes every log line with the pod.
+func logPodPrefix() {
+	if pod.detected() {
+		log.SetPrefix("[" + pod.String() + "] ")
+	}
+}
+
+// podFooter returns the block naming the pod at the end of Slack messages.
+func podFooter() (SlackBlock, bool) {
+	if !pod.detected() {
+		return SlackBlock{}, false
+	}
+	return SlackBlock{
+		Type: "section",
+		Text: &SlackText{Type: "mrkdwn", Text: "_Sent by pod " + pod.String() + "_"},
+	}, true
+}
+
+// withPodLabels adds the pod labels to samples pushed through remote-write,
+// which have no scrape target to get them from. Labels a sample already has
+// are kept.
+func withPodLabels(samples []metricSample) []metricSample {
+	labels := pod.labels()
+	if labels == nil {
+		return samples
+	}
+	for _, s := range samples {
+		for name, value := range labels {
+			if _, ok := s.labels[name]; !ok {
+				s.labels[name] = value
+			}
+		}
+	}
+	return samples
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// With kubernetes.leaderElection.enabled, replicas of a Deployment elect a
+// leader through a coordination.k8s.io Lease: only the holder polls and
+// notifies, the others wait on standby, and when the leader stops renewing
+// the lease for leaseDurationSecs another replica takes it over. The pod's
+// service account needs get, create and update on leases in its namespace.
+var (
+	leaderElectionEnabled = conf.Bool("kubernetes.leaderElection.enabled", false)
+	leaseName             = conf.String("kubernetes.leaderElection.leaseName", "sefi-alarm")
+	leaseNamespace        = conf.String("kubernetes.leaderElection.namespace", "")
+	leaseDuration         = time.Duration(conf.Int("kubernetes.leaderElection.leaseDurationSecs", 15)) * time.Second
+	leaseRetryPeriod      = time.Duration(conf.Int("kubernetes.leaderElection.retryPeriodSecs", 5)) * time.Second
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// leaseTimeFormat is the MicroTime format of the Kubernetes API.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var leaderGauge = metrics.newGauge("sefi_leader",
+	"1 while this replica holds the leader election lease.")
+
+var errKubeConflict = errors.New("the object was updated concurrently")
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// expired reports whether the holder stopped renewing the lease.
+func (l *lease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := time.Duration(l.Spec.LeaseDurationSeconds) * time.Second
+	if duration <= 0 {
+		duration = leaseDuration
+	}
+	return now.After(renewed.Add(duration))
+}
+
+// kubeClient talks to the API server with the pod's service account.
+type kubeClient struct {
+	client    *http.Client
+	base      string
+	tokenFile string
+}
+
+func newKubeClient(timeout time.Duration) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in the service account CA")
+	}
+	return &kubeClient{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+		base:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+	}, nil
+}
+
+func (c *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	// The token is re-read since the kubelet rotates it.
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case in != nil && method == "PATCH":
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	case in != nil:
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errStateNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return errKubeConflict
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s %s failed with status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func leasePath(namespace string) string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + namespace + "/leases"
+}
+
+// leaderElector holds or waits for the lease.
+type leaderElector struct {
+	client     *kubeClient
+	namespace  string
+	identity   string
+	leading    bool
+	lastRenew  time.Time
+	lastHolder string
+}
+
+// tryAcquire creates, renews or takes over the lease. It reports whether
+// this replica holds it, and whether it took it over from another one.
+func (e *leaderElector) tryAcquire(ctx context.Context, now time.Time) (leading, tookOver bool, err error) {
+	current := &lease{}
+	err = e.client.do(ctx, "GET", leasePath(e.namespace)+"/"+leaseName, nil, current)
+	stamp := now.UTC().Format(leaseTimeFormat)
+	if errors.Is(err, errStateNotFound) {
+		created := &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: leaseName, Namespace: e.namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(leaseDuration / time.Second),
+				AcquireTime:          stamp,
+				RenewTime:            stamp,
+			},
+		}
+		if err := e.client.do(ctx, "POST", leasePath(e.namespace), created, nil); err != nil {
+			return false, false, err
+		}
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	holder := current.Spec.HolderIdentity
+	e.lastHolder = holder
+	if holder != e.identity && !current.expired(now) {
+		return false, false, nil
+	}
+
+	tookOver = holder != e.identity && holder != ""
+	if holder != e.identity {
+		current.Spec.HolderIdentity = e.identity
+		current.Spec.AcquireTime = stamp
+		current.Spec.LeaseTransitions++
+	}
+	current.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	current.Spec.RenewTime = stamp
+	// The resourceVersion makes a concurrent takeover fail with a conflict.
+	if err := e.client.do(ctx, "PUT", leasePath(e.namespace)+"/"+leaseName, current, nil); err != nil {
+		return false, false, err
+	}
+	return true, tookOver, nil
+}
+
+// release gives up the lease on shutdown so another replica takes over
+// without waiting for it to expire.
+func (e *leaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRetryPeriod)
+	defer cancel()
+
+	current := &lease{}
+	if err := e.client.do(ctx, "GET", leasePath(e.namespace)+"/"+leaseName, nil, current); err != nil {
+		log.Printf("Error releasing the leader lease: %v\n", err)
+		return
+	}
+	if current.Spec.HolderIdentity != e.identity {
+		return
+	}
+	current.Spec.HolderIdentity = ""
+	current.Spec.RenewTime = time.Now().UTC().Add(-leaseDuration).Format(leaseTimeFormat)
+	if err := e.client.do(ctx, "PUT", leasePath(e.namespace)+"/"+leaseName, current, nil); err != nil {
+		log.Printf("Error releasing the leader lease: %v\n", err)
+		return
+	}
+	log.Println("Released the leader lease.")
+}
+
+func (e *leaderElector) step(ctx context.Context, now time.Time) {
+	leading, tookOver, err := e.tryAcquire(ctx, now)
+	switch {
+	case err != nil && !errors.Is(err, errKubeConflict):
+		log.Printf("Error renewing the leader lease: %v\n", err)
+		// A leader that cannot renew steps down before its lease expires
+		// and another replica may take over.
+		if e.leading && now.Sub(e.lastRenew) < leaseDuration-leaseRetryPeriod {
+			return
+		}
+		leading = false
+	case err != nil:
+		leading = false
+	}
+
+	if leading {
+		e.lastRenew = now
+		if !e.leading {
+			leaderGauge.set(1)
+			log.Printf("Acquired the leader lease %s/%s.\n", e.namespace, leaseName)
+		}
+		// Also corrects an instance demoted or promoted through the API.
+		if role.isStandby() {
+			if tookOver {
+				role.promote(fmt.Sprintf("took over the leader lease from %s", e.lastHolder))
+			} else {
+				role.takeOver("acquired the leader lease")
+			}
+		}
+	} else {
+		if e.leading {
+			leaderGauge.set(0)
+		}
+		if !role.isStandby() {
+			reason := "the leader lease is held by " + e.lastHolder
+			if err != nil {
+				reason = "the leader lease could not be renewed"
+			}
+			role.demote(reason)
+		}
+	}
+	e.leading = leading
+}
+
+func leaderElectionLoop(ctx context.Context) {
+	if !leaderElectionEnabled {
+		return
+	}
+	client, err := newKubeClient(leaseRetryPeriod)
+	if err != nil {
+		log.Fatalf("kubernetes.leaderElection is enabled in config.yaml, but: %v", err)
+	}
+	namespace := leaseNamespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	if namespace == "" {
+		log.Fatalf("Set kubernetes.leaderElection.namespace in config.yaml, the pod's namespace is unknown.")
+	}
+	e := &leaderElector{client: client, namespace: namespace, identity: instanceID}
+	log.Printf("Waiting for the leader lease %s/%s as %s.\n", namespace, leaseName, instanceID)
+
+	ticker := time.NewTicker(leaseRetryPeriod)
+	defer ticker.Stop()
+	for {
+		e.step(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			if e.leading {
+				e.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// The timezone database is embedded, as release images don't ship one.
+	_ "time/tzdata"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+)
+
+// locale, e.g. de or en-GB, sets how durations, counts and timestamps are
+// written in alert messages and message templates: "1 Std. 23 Min." rather
+// than "1h23m0s", "12.345" rather than "12345". Unset, they keep the plain
+// Go formats and RFC 3339 timestamps.
+var messageLocale = loadLocale(conf.String("locale", ""))
+
+// Timestamps are written in timezone, an IANA name such as Europe/Madrid
+// (UTC by default), and with timestampFormat, a Go time layout such as
+// "2006-01-02 15:04:05 MST", when it is set instead of the locale's.
+var (
+	messageTimezone        = loadTimezone(conf.String("timezone", "UTC"))
+	messageTimestampFormat = conf.String("timestampFormat", "")
+)
+
+// localeFormat holds the conventions of one locale.
+type localeFormat struct {
+	group    string
+	decimal  string
+	dateTime string
+	// units are the suffixes of days, hours, minutes and seconds, and
+	// joiner what separates two units.
+	units  [4]string
+	joiner string
+}
+
+var locales = map[string]*localeFormat{
+	"en":    {group: ",", decimal: ".", dateTime: "Jan 2, 2006 3:04 PM MST", units: [4]string{"d", "h", "m", "s"}, joiner: " "},
+	"en-gb": {group: ",", decimal: ".", dateTime: "2 Jan 2006 15:04 MST", units: [4]string{"d", "h", "m", "s"}, joiner: " "},
+	"de":    {group: ".", decimal: ",", dateTime: "02.01.2006 15:04 MST", units: [4]string{" Tg.", " Std.", " Min.", " Sek."}, joiner: " "},
+	"es":    {group: ".", decimal: ",", dateTime: "02/01/2006 15:04 MST", units: [4]string{" d", " h", " min", " s"}, joiner: " "},
+	"fr":    {group: "\u202f", decimal: ",", dateTime: "02/01/2006 15:04 MST", units: [4]string{" j", " h", " min", " s"}, joiner: " "},
+	"it":    {group: ".", decimal: ",", dateTime: "02/01/2006 15:04 MST", units: [4]string{" g", " h", " min", " s"}, joiner: " "},
+	"ja":    {group: ",", decimal: ".", dateTime: "2006/01/02 15:04 MST", units: [4]string{"日", "時間", "分", "秒"}, joiner: ""},
+	"nl":    {group: ".", decimal: ",", dateTime: "02-01-2006 15:04 MST", units: [4]string{" d", " u", " min", " s"}, joiner: " "},
+	"pt":    {group: ".", decimal: ",", dateTime: "02/01/2006 15:04 MST", units: [4]string{" d", " h", " min", " s"}, joiner: " "},
+}
+
+// loadLocale returns the conventions of name, falling back from a regional
+// variant (pt-BR) to its language, or nil when name is empty.
+func loadLocale(name string) *localeFormat {
+	if name == "" {
+		return nil
+	}
+	key := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	l, ok := locales[key]
+	if !ok {
+		language, _, _ := strings.Cut(key, "-")
+		l, ok = locales[language]
+	}
+	if !ok {
+		names := make([]string, 0, len(locales))
+		for name := range locales {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		addConfigProblem("locale %q is unknown, use one of %s", name, strings.Join(names, ", "))
+		return nil
+	}
+	return l
+}
+
+func loadTimezone(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		addConfigProblem("timezone %q is unknown, use an IANA name such as Europe/Madrid", name)
+		return time.UTC
+	}
+	return loc
+}
+
+// formatDuration writes d with its two largest units, e.g. "1h 23m".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if messageLocale == nil {
+		return d.String()
+	}
+	l := messageLocale
+
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	parts := []int64{int64(d / (24 * time.Hour)), int64(d/time.Hour) % 24, int64(d/time.Minute) % 60, int64(d/time.Second) % 60}
+	first := 0
+	for first < 3 && parts[first] == 0 {
+		first++
+	}
+	out := []string{formatCount(parts[first]) + l.units[first]}
+	// 1h 0m reads as an exact hour, so a zero second unit is left out.
+	if first < 3 && parts[first+1] != 0 {
+		out = append(out, formatCount(parts[first+1])+l.units[first+1])
+	}
+	return sign + strings.Join(out, l.joiner)
+}
+
+// formatCount writes n with the locale's digit grouping.
+func formatCount(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	if messageLocale == nil {
+		return digits
+	}
+	return groupDigits(digits, messageLocale.group)
+}
+
+func groupDigits(digits, group string) string {
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(group)
+		}
+		b.WriteRune(c)
+	}
+	return sign + b.String()
+}
+
+// formatNumber writes v, an integer or a float, with the locale's grouping
+// and decimal separator.
+func formatNumber(v float64) string {
+	if v == float64(int64(v)) {
+		return formatCount(int64(v))
+	}
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if messageLocale == nil {
+		return s
+	}
+	whole, fraction, _ := strings.Cut(s, ".")
+	return groupDigits(whole, messageLocale.group) + messageLocale.decimal + fraction
+}
+
+// formatTimestamp writes t in the configured timezone, RFC 3339 without a
+// locale or timestampFormat.
+func formatTimestamp(t time.Time) string {
+	t = t.In(messageTimezone)
+	switch {
+	case messageTimestampFormat != "":
+		return t.Format(messageTimestampFormat)
+	case messageLocale == nil:
+		return t.Format(time.RFC3339)
+	}
+	return t.Format(messageLocale.dateTime)
+}
+
+// formatErrorTime writes the timestamp of a Sysdig error with formatTimestamp,
+// or as is when it doesn't parse.
+func formatErrorTime(timestamp string) string {
+	t, err := sysdig.ParseTimestamp(timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return formatTimestamp(t)
+}
+
+// The template functions take what templateData holds: durations, the
+// ints and floats of counts, and times or the RFC 3339 strings Sysdig sends.
+func templateDuration(v interface{}) (string, error) {
+	switch d := v.(type) {
+	case time.Duration:
+		return formatDuration(d), nil
+	case string:
+		parsed, err := time.ParseDuration(d)
+		if err != nil {
+			return "", fmt.Errorf("duration: %v", err)
+		}
+		return formatDuration(parsed), nil
+	}
+	return "", fmt.Errorf("duration: cannot format %T", v)
+}
+
+func templateNumber(v interface{}) (string, error) {
+	switch n := v.(type) {
+	case int:
+		return formatCount(int64(n)), nil
+	case int64:
+		return formatCount(n), nil
+	case float64:
+		return formatNumber(n), nil
+	}
+	return "", fmt.Errorf("number: cannot format %T", v)
+}
+
+func templateTime(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return formatTimestamp(t), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return formatTimestamp(*t), nil
+	case string:
+		parsed, err := sysdig.ParseTimestamp(t)
+		if err != nil {
+			return t, nil
+		}
+		return formatTimestamp(parsed), nil
+	}
+	return "", fmt.Errorf("time: cannot format %T", v)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mentionsFor returns the Slack mentions (e.g. "<@U123>" or "<!subteam^S123>")
+// to ping for an alert of severity on integrationID. Integration-specific
+// mentions, then those of the integration's owner, then those of the
+// severity under mentions.severities, replace the default list rather than
+// adding to it.
+func mentionsFor(integrationID int, severity string) []string {
+	if v, ok := conf.Lookup("mentions.integrations"); ok {
+		if section, ok := asSection(v); ok {
+			if mentions, ok := section[strconv.Itoa(integrationID)]; ok {
+				return asStringList(mentions)
+			}
+		}
+	}
+	if owner, ok := owners.get(integrationID); ok && len(owner.Mentions) > 0 {
+		return owner.Mentions
+	}
+	if mentions := conf.StringList("mentions.severities." + severity); len(mentions) > 0 {
+		return mentions
+	}
+	return conf.StringList("mentions.default")
+}
+
+func mentionText(mentions []string) string {
+	return strings.Join(mentions, " ")
+}
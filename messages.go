@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Alerts list the errors by time, each with when it happened (see timezone)
+// and identical messages once with their count. Slack rejects long
+// messages, so they list at most messages.maxErrors messages, each cut to
+// messages.maxErrorLength characters, and no more than a section block
+// holds. The errors left out are counted, with a link to
+// dashboardUrl, the address the dashboard is reached at, or to the
+// integration in Sysdig when it isn't set.
+var (
+	messageMaxErrors      = conf.Int("messages.maxErrors", 20)
+	messageMaxErrorLength = conf.Int("messages.maxErrorLength", 500)
+	dashboardURL          = strings.TrimRight(conf.String("dashboardUrl", ""), "/")
+)
+
+// maxSectionText is the most characters Slack takes in a section block,
+// less the code fence around the errors.
+const maxSectionText = 3000 - len("```\n```")
+
+// maxSlackText is the most characters of message text Slack shows.
+const maxSlackText = 40000
+
+// errorGroup is the errors with one message, first seen at First and last
+// at Last.
+type errorGroup struct {
+	Error            string
+	Count            int
+	First, Last      string
+	InvalidTimestamp bool
+}
+
+// groupErrors sorts errors by time and groups identical messages, in the
+// order each was first seen. Errors whose timestamp doesn't parse go last.
+func groupErrors(errors []ErrorLog) []*errorGroup {
+	sorted := make([]ErrorLog, len(errors))
+	copy(sorted, errors)
+	times := make(map[string]time.Time, len(sorted))
+	for _, e := range sorted {
+		if t, err := e.Time(); err == nil {
+			times[e.Timestamp] = t
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, iok := times[sorted[i].Timestamp]
+		tj, jok := times[sorted[j].Timestamp]
+		if iok != jok {
+			return iok
+		}
+		return ti.Before(tj)
+	})
+
+	var groups []*errorGroup
+	byError := make(map[string]*errorGroup)
+	for _, e := range sorted {
+		key := e.Error
+		if e.InvalidTimestamp {
+			key = "\x00" + key
+		}
+		g, ok := byError[key]
+		if !ok {
+			g = &errorGroup{Error: e.Error, First: e.Timestamp, InvalidTimestamp: e.InvalidTimestamp}
+			byError[key] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+		g.Last = e.Timestamp
+	}
+	return groups
+}
+
+// unknownTime stands for the time of errors whose timestamp doesn't parse,
+// showing it as is.
+func unknownTime(g *errorGroup) string {
+	s := "⚠ time unknown"
+	if g.Count > 1 {
+		s = "×" + formatCount(int64(g.Count)) + " " + s
+	}
+	if g.First != "" {
+		s += " (" + g.First + ")"
+	}
+	return s
+}
+
+// errorListing returns the lines the errors are listed with, one per
+// message, and how many errors didn't fit.
+func errorListing(errors []ErrorLog) (lines string, more int) {
+	var b strings.Builder
+	left := len(errors)
+	for i, g := range groupErrors(errors) {
+		line := truncateText(g.Error, messageMaxErrorLength) + "\n"
+		switch {
+		case g.InvalidTimestamp:
+			line = unknownTime(g) + "  " + line
+		case g.Count > 1 && g.First == g.Last:
+			line = fmt.Sprintf("×%s at %s  %s", formatCount(int64(g.Count)), formatErrorTime(g.First), line)
+		case g.Count > 1:
+			line = fmt.Sprintf("×%s between %s and %s  %s", formatCount(int64(g.Count)), formatErrorTime(g.First), formatErrorTime(g.Last), line)
+		case g.First != "":
+			line = formatErrorTime(g.First) + "  " + line
+		}
+		if (messageMaxErrors > 0 && i >= messageMaxErrors) || utf8.RuneCountInString(b.String()+line) > maxSectionText {
+			return b.String(), left
+		}
+		b.WriteString(line)
+		left -= g.Count
+	}
+	return b.String(), 0
+}
+
+// truncateText cuts s to max characters, ending it with an ellipsis.
+func truncateText(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
+
+// overflowLink is where the errors left out of an alert can be read.
+func overflowLink(integrationID int) (url, label string) {
+	if dashboardURL != "" {
+		return dashboardURL + "/", "the dashboard"
+	}
+	return integrationURL + strconv.Itoa(integrationID), "the integration in Sysdig"
+}
+
+// overflowNote says how many errors were left out, in plain text and in
+// Slack mrkdwn.
+func overflowNote(more, integrationID int) (text, mrkdwn string) {
+	url, label := overflowLink(integrationID)
+	count := formatCount(int64(more))
+	return fmt.Sprintf("…and %s more, see %s: %s", count, label, url),
+		fmt.Sprintf("_…and %s more, see <%s|%s>_", count, url, label)
+}
+
+// With messages.attachPayload and a bot token, an alert leaving errors out
+// gets the JSON of every new error attached in its thread, so the full
+// detail is a click away.
+var messageAttachPayload = conf.Bool("messages.attachPayload", false)
+
+// payloadAttachment is the file attached to the alert about errors, or nil
+// when they all fit in the message.
+func payloadAttachment(errors []ErrorLog, payload *Payload, now time.Time) *SlackFile {
+	if !messageAttachPayload || !slackBotMode() || slackWorkflowMode() {
+		return nil
+	}
+	if _, more := errorListing(errors); more == 0 {
+		return nil
+	}
+	content, err := json.MarshalIndent(Payload{
+		CustomerID:    payload.CustomerID,
+		IntegrationID: payload.IntegrationID,
+		Count:         len(errors),
+		Errors:        errors,
+	}, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling the errors of integration %d: %v\n", payload.IntegrationID, err)
+		return nil
+	}
+	return &SlackFile{
+		Filename: fmt.Sprintf("integration-%d-errors-%s.json", payload.IntegrationID, now.Format("20060102T150405Z")),
+		Title:    fmt.Sprintf("%s new errors on integration %s", formatCount(int64(len(errors))), integrationLabel(payload.IntegrationID)),
+		Content:  content,
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// enrichAlerts adds the integration's name, type and enabled state from the
+// integrations API to alerts, which otherwise only know its numeric ID.
+// Lookups are cached for enrichment.ttlMins and made at most once every
+// enrichment.minIntervalSecs, in the background, so enrichment never holds
+// up a poll: an alert on an integration that isn't known yet goes out
+// without its name.
+var (
+	enrichAlerts        = conf.Bool("enrichment.enabled", true)
+	metadataTTL         = time.Duration(conf.Int("enrichment.ttlMins", 60)) * time.Minute
+	metadataMinInterval = time.Duration(conf.Int("enrichment.minIntervalSecs", 60)) * time.Second
+)
+
+const metadataLookupTimeout = 30 * time.Second
+
+var metadataLookups = metrics.newCounter("sefi_metadata_lookups_total",
+	"Integration metadata lookups, by result (success, failure or throttled).", "result")
+
+type integrationMetadata struct {
+	mu        sync.Mutex
+	known     map[int]integrationInfo
+	fetchedAt map[int]time.Time
+
+	// notBefore spaces lookups out, and is pushed further when the API
+	// rate limits them. refreshing is set while a lookup runs.
+	notBefore  time.Time
+	refreshing bool
+}
+
+var integrationMeta = &integrationMetadata{known: make(map[int]integrationInfo), fetchedAt: make(map[int]time.Time)}
+
+func (m *integrationMetadata) store(integrations []integrationInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, in := range integrations {
+		m.known[in.ID] = in
+		m.fetchedAt[in.ID] = now
+	}
+}
+
+func (m *integrationMetadata) freshLocked(integrationID int, now time.Time) bool {
+	fetchedAt, ok := m.fetchedAt[integrationID]
+	return ok && now.Sub(fetchedAt) < metadataTTL
+}
+
+// ensure starts a background lookup if integrationID isn't known or its
+// metadata expired. Failures only cost alerts their metadata.
+func (m *integrationMetadata) ensure(integrationID int) {
+	if !enrichAlerts {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.freshLocked(integrationID, time.Now()) {
+		m.refreshLocked()
+	}
+}
+
+// prefetch fills the cache in the background on startup, so the first alerts
+// already have their metadata.
+func (m *integrationMetadata) prefetch() {
+	if !enrichAlerts {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshLocked()
+}
+
+// refreshLocked lists the integrations in the background, unless a lookup
+// runs already or the last one was too recent.
+func (m *integrationMetadata) refreshLocked() {
+	now := time.Now()
+	if m.refreshing {
+		return
+	}
+	if now.Before(m.notBefore) {
+		metadataLookups.inc("throttled")
+		return
+	}
+	m.refreshing = true
+	m.notBefore = now.Add(metadataMinInterval)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), metadataLookupTimeout)
+		defer cancel()
+		err := m.lookup(ctx)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.refreshing = false
+		var rl *rateLimitedError
+		if errors.As(err, &rl) && time.Now().Add(rl.RetryAfter).After(m.notBefore) {
+			m.notBefore = time.Now().Add(rl.RetryAfter)
+		}
+		if err != nil {
+			log.Printf("Error looking up integration metadata: %v\n", err)
+		}
+	}()
+}
+
+// load looks integrationID up unless its metadata is fresh, waiting for the
+// result, for commands that have nothing else to do meanwhile.
+func (m *integrationMetadata) load(ctx context.Context, integrationID int) {
+	if !enrichAlerts {
+		return
+	}
+	m.mu.Lock()
+	fresh := m.freshLocked(integrationID, time.Now())
+	m.mu.Unlock()
+	if fresh {
+		return
+	}
+	if err := m.lookup(ctx); err != nil {
+		log.Printf("Error looking up metadata of integration %d: %v\n", integrationID, err)
+	}
+}
+
+func (m *integrationMetadata) lookup(ctx context.Context) error {
+	if _, err := listIntegrations(ctx); err != nil {
+		metadataLookups.inc("failure")
+		return err
+	}
+	metadataLookups.inc("success")
+	return nil
+}
+
+// get returns what is known about integrationID, even if it expired, as
+// stale metadata beats none.
+func (m *integrationMetadata) get(integrationID int) (integrationInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	in, ok := m.known[integrationID]
+	return in, ok
+}
+
+// integrationLabel names an integration in titles: its name and ID when the
+// name is known, the ID alone otherwise.
+func integrationLabel(integrationID int) string {
+	if in, ok := integrationMeta.get(integrationID); ok && in.Name != "" {
+		return fmt.Sprintf("%s (%d)", in.Name, integrationID)
+	}
+	return fmt.Sprintf("%d", integrationID)
+}
+
+// integrationState describes the enabled flag, empty when unknown.
+func integrationState(in integrationInfo) string {
+	switch {
+	case in.Enabled == nil:
+		return ""
+	case *in.Enabled:
+		return "enabled"
+	default:
+		return "disabled"
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A deliberately small metrics registry: counters and gauges with labels,
+// rendered in the Prometheus text format on /metrics and pushed through
+// remote-write or OTLP when those are configured.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+}
+
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+// metricSample is one series value with its full label set, __name__ included.
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+var metrics = &metricsRegistry{}
+
+var (
+	pollsTotal = metrics.newCounter("sefi_polls_total",
+		"Polls of the Sysdig events forwarding errors API.", "result")
+	integrationErrorsTotal = metrics.newCounter("sefi_integration_errors_total",
+		"New forwarding errors detected per integration.", "integration_id")
+	integrationPayloadErrors = metrics.newGauge("sefi_integration_payload_errors",
+		"Error count reported by the API for the integration on the last poll.", "integration_id")
+	notificationsTotal = metrics.newCounter("sefi_notifications_total",
+		"Notification delivery attempts.", "result")
+)
+
+func (r *metricsRegistry) register(name, help, kind string, labelNames []string) *metricFamily {
+	f := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (r *metricsRegistry) newCounter(name, help string, labelNames ...string) *metricFamily {
+	return r.register(name, help, "counter", labelNames)
+}
+
+func (r *metricsRegistry) newGauge(name, help string, labelNames ...string) *metricFamily {
+	return r.register(name, help, "gauge", labelNames)
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *metricFamily) add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value += v
+}
+
+func (f *metricFamily) inc(labelValues ...string) {
+	f.add(1, labelValues...)
+}
+
+func (f *metricFamily) set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value = v
+}
+
+func (f *metricFamily) sortedSeries() []*metricSeries {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]*metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		copied := *s
+		out = append(out, &copied)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, ",") < strings.Join(out[j].labelValues, ",")
+	})
+	return out
+}
+
+func (r *metricsRegistry) snapshotFamilies() []*metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*metricFamily(nil), r.families...)
+}
+
+// writeText renders every family in the Prometheus text exposition format.
+func (r *metricsRegistry) writeText(w io.Writer) error {
+	for _, f := range r.snapshotFamilies() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		for _, s := range f.sortedSeries() {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues), formatValue(s.value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// samples returns the current value of every series.
+func (r *metricsRegistry) samples() []metricSample {
+	var out []metricSample
+	for _, f := range r.snapshotFamilies() {
+		for _, s := range f.sortedSeries() {
+			labels := map[string]string{"__name__": f.name}
+			for i, name := range f.labelNames {
+				labels[name] = s.labelValues[i]
+			}
+			out = append(out, metricSample{labels: labels, value: s.value})
+		}
+	}
+	return out
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeText(w)
+}
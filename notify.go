@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const notifierGitHub = "github"
+
+// notifierTimeoutSecs bounds each delivery attempt to a notifier (slack,
+// github or events), so a slow destination gives its worker back and the
+// retry queue takes over, while the other notifiers keep delivering:
+//
+//	notifierTimeoutSecs:
+//	  slack: 10
+//	  github: 30
+//
+// A notifier left out only has the http.requestTimeoutSecs of each request.
+var notifierTimeouts = loadNotifierTimeouts()
+
+func loadNotifierTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for name, value := range conf.StringMap("notifierTimeoutSecs") {
+		if name != notifierSlack && name != notifierGitHub && name != notifierEvents {
+			addConfigProblem("notifierTimeoutSecs has an unknown notifier %q, use slack, github or events", name)
+			continue
+		}
+		secs, err := strconv.Atoi(value)
+		if err != nil || secs < 1 {
+			addConfigProblem("notifierTimeoutSecs.%s must be a positive number of seconds, got %q", name, value)
+			continue
+		}
+		timeouts[name] = time.Duration(secs) * time.Second
+	}
+	return timeouts
+}
+
+// notifierKind is the config name of the notifier of n: slack, github or
+// events.
+func notifierKind(n *Notification) string {
+	if n.Notifier == "" {
+		return notifierSlack
+	}
+	return n.Notifier
+}
+
+// notifierTimeout returns the timeout of deliveries like n, 0 for none.
+func notifierTimeout(n *Notification) time.Duration {
+	return notifierTimeouts[notifierKind(n)]
+}
+
+// deliverNotification hands n to the notifier it is addressed to, within the
+// destination's monthly budget.
+func deliverNotification(ctx context.Context, n *Notification) (err error) {
+	ctx, span := startSpan(withTraceparent(ctx, n.Trace), "deliver", spanKindClient)
+	defer func() { span.finish(err) }()
+
+	now := time.Now().UTC()
+	destination := notificationBudgetKey(n)
+	span.set("notifier", notifierName(n))
+	span.set("destination", destination)
+	span.set("integration.id", n.IntegrationID)
+	span.set("reason", n.Reason)
+	if !n.QueuedAt.IsZero() {
+		span.set("queued.seconds", now.Sub(n.QueuedAt).Seconds())
+	}
+	if timeout := notifierTimeout(n); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if !throttle.allow(n, now) {
+		span.set("throttled", true)
+		return errThrottled
+	}
+	if !budgets.allow(destination, now) {
+		span.set("over_budget", true)
+		return deliverOverBudget(ctx, n, destination, now)
+	}
+	err = dispatchNotification(ctx, n)
+	if err == nil {
+		budgets.spend(destination, now)
+	}
+	return err
+}
+
+func dispatchNotification(ctx context.Context, n *Notification) error {
+	switch n.Notifier {
+	case notifierGitHub:
+		return openGitHubIssue(ctx, n)
+	case notifierEvents:
+		return sendCorrelationEvent(ctx, n)
+	default:
+		return deliverToSlack(ctx, n)
+	}
+}
+
+func notifierName(n *Notification) string {
+	switch n.Notifier {
+	case notifierGitHub:
+		return "GitHub"
+	case notifierEvents:
+		return "event correlation"
+	default:
+		return "Slack"
+	}
+}
+
+// ticketNotifications returns the ticket notifications to queue next to the
+// Slack alert for integrationID. An integration with an unresolved ticket
+// doesn't get another one.
+func ticketNotifications(integrationID int, draft TicketDraft) []*Notification {
+	var out []*Notification
+	if githubEnabled() && !tickets.hasOpen(notifierGitHub, integrationID) {
+		d := draft
+		out = append(out, &Notification{Notifier: notifierGitHub, IntegrationID: integrationID, Ticket: &d, Reason: reasonThresholdExceeded})
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SlackFile is a file shared in a channel, shown as a snippet when its
+// content is text.
+type SlackFile struct {
+	Filename string `json:"filename"`
+	Title    string `json:"title"`
+	Content  []byte `json:"content"`
+}
+
+// UploadFile shares file in channel with the bot token, as a reply in the
+// thread of threadTS when it is set. It goes through the external upload
+// methods: getting an upload URL, sending the content there and completing
+// the upload, which shares the file.
+func (s *Slack) UploadFile(ctx context.Context, channel, threadTS string, file SlackFile) error {
+	upload, err := s.callForm(ctx, "files.getUploadURLExternal", url.Values{
+		"filename": {file.Filename},
+		"length":   {strconv.Itoa(len(file.Content))},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", upload.UploadURL, bytes.NewReader(file.Content))
+	if err != nil {
+		return fmt.Errorf("failed to create file upload request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %v", err)
+	}
+	defer resp.Body.Close()
+	if s.CheckResponse != nil {
+		if err := s.CheckResponse(resp); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("file upload failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	files, err := json.Marshal([]map[string]string{{"id": upload.FileID, "title": file.Title}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal files.completeUploadExternal files: %v", err)
+	}
+	args := url.Values{"files": {string(files)}, "channel_id": {channel}}
+	if threadTS != "" {
+		args.Set("thread_ts", threadTS)
+	}
+	_, err = s.callForm(ctx, "files.completeUploadExternal", args)
+	return err
+}
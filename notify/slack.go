@@ -0,0 +1,207 @@
+// Package notify posts alert messages to Slack, through an incoming webhook
+// or, with a bot token, the Web API.
+//
+//	slack := &notify.Slack{WebhookURL: url}
+//	err := slack.PostWebhook(ctx, notify.SlackMessage{Text: "Integration 42 is failing"})
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SlackAPIURL is where the Web API methods are served.
+const SlackAPIURL = "https://slack.com/api/"
+
+type SlackMessage struct {
+	Channel  string       `json:"channel,omitempty"`
+	ThreadTS string       `json:"thread_ts,omitempty"`
+	TS       string       `json:"ts,omitempty"`
+	Text     string       `json:"text"`
+	Blocks   []SlackBlock `json:"blocks,omitempty"`
+	// Metadata is only sent with the Web API, webhooks don't take it.
+	Metadata *SlackMetadata `json:"metadata,omitempty"`
+}
+
+type SlackBlock struct {
+	Type     string         `json:"type"`
+	Text     *SlackText     `json:"text,omitempty"`
+	Fields   []SlackText    `json:"fields,omitempty"`
+	Elements []SlackElement `json:"elements,omitempty"`
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type SlackElement struct {
+	Type string     `json:"type"`
+	Text *SlackText `json:"text,omitempty"`
+	URL  string     `json:"url,omitempty"`
+}
+
+// SlackMetadata is the message metadata of the Slack Web API, readable by
+// apps and workflows subscribed to the channel.
+type SlackMetadata struct {
+	EventType    string            `json:"event_type"`
+	EventPayload map[string]string `json:"event_payload"`
+}
+
+// SlackResponse is the reply of a Web API method.
+type SlackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+	// UploadURL and FileID are set by files.getUploadURLExternal.
+	UploadURL string `json:"upload_url,omitempty"`
+	FileID    string `json:"file_id,omitempty"`
+}
+
+// Slack posts to a workspace.
+type Slack struct {
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	WebhookURL string
+	BotToken   string
+	// APIURL defaults to SlackAPIURL.
+	APIURL string
+	// CheckResponse, when set, sees every response first; an error it
+	// returns is returned as is. It lets callers turn a 429 into their own
+	// rate limiting error.
+	CheckResponse func(*http.Response) error
+}
+
+func (s *Slack) do(req *http.Request) (*http.Response, error) {
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// PostWebhook posts payload, a SlackMessage or the variables of a workflow,
+// to the incoming webhook.
+func (s *Slack) PostWebhook(ctx context.Context, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal slack payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.WebhookURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create slack request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send slack notification: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if s.CheckResponse != nil {
+		if err := s.CheckResponse(resp); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("slack notification failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	return nil
+}
+
+// Call calls a Web API method with the bot token.
+func (s *Slack) Call(ctx context.Context, method string, body interface{}) (*SlackResponse, error) {
+	payloadBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %v", method, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL()+method, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return s.send(method, req)
+}
+
+// callForm calls a Web API method that only takes form arguments.
+func (s *Slack) callForm(ctx context.Context, method string, args url.Values) (*SlackResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL()+method, strings.NewReader(args.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.send(method, req)
+}
+
+func (s *Slack) apiURL() string {
+	if s.APIURL == "" {
+		return SlackAPIURL
+	}
+	return s.APIURL
+}
+
+// send sends the request of a Web API method with the bot token.
+func (s *Slack) send(method string, req *http.Request) (*SlackResponse, error) {
+	req.Header.Set("Authorization", "Bearer "+s.BotToken)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	if s.CheckResponse != nil {
+		if err := s.CheckResponse(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %v", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed with status %d: %s", method, resp.StatusCode, string(bodyBytes))
+	}
+
+	var result SlackResponse
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s response: %v", method, err)
+	}
+	// The Web API reports most failures with a 200 and ok=false.
+	if !result.OK {
+		return nil, fmt.Errorf("%s failed: %s", method, result.Error)
+	}
+	return &result, nil
+}
+
+// PostMessage posts message with chat.postMessage. The returned channel and
+// ts identify the message for threaded replies and later updates.
+func (s *Slack) PostMessage(ctx context.Context, message SlackMessage) (*SlackResponse, error) {
+	if message.Channel == "" {
+		return nil, fmt.Errorf("no Slack channel configured for bot-token mode")
+	}
+	message.TS = ""
+	return s.Call(ctx, "chat.postMessage", message)
+}
+
+// UpdateMessage replaces the content of a message posted earlier.
+func (s *Slack) UpdateMessage(ctx context.Context, channel, ts string, message SlackMessage) error {
+	message.Channel = channel
+	message.TS = ts
+	message.ThreadTS = ""
+	_, err := s.Call(ctx, "chat.update", message)
+	return err
+}
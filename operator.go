@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In operator mode (kubernetes.operator.enabled, with features.operator) the
+// integrations to monitor and their routing, their notifiers, and silences
+// can also be declared as custom resources, reconciled every
+// kubernetes.operator.resyncSecs so platform teams manage monitoring from
+// Git:
+//
+//   - a SysdigForwardingMonitor adds spec.integrationId to the monitored
+//     integrations, with the team owning it and where its alerts go
+//     (slackChannel, mentions, email), as an owners.integrations entry would,
+//     and spec.notifier naming a notifier of its namespace to post them to;
+//   - a SysdigForwardingNotifier is a Slack incoming webhook, its URL read
+//     from the key of a Secret of its namespace by spec.webhookUrlSecretRef,
+//     so the credentials of team channels stay out of config.yaml;
+//   - a SysdigForwardingSilence mutes alerts like POST /api/silences until
+//     spec.until, or for spec.duration from its creation.
+//
+// Resources are read from kubernetes.operator.namespace (the pod's by
+// default, * for all namespaces) and their status tells whether they were
+// applied. The default notifiers stay in config.yaml. "sefi-alarm operator
+// crds" prints the CRDs and the ClusterRole the service account needs.
+var (
+	operatorEnabled   = conf.Bool("kubernetes.operator.enabled", false) && featureEnabled("operator")
+	operatorNamespace = conf.String("kubernetes.operator.namespace", "")
+	operatorResync    = time.Duration(conf.Int("kubernetes.operator.resyncSecs", 30)) * time.Second
+)
+
+const (
+	operatorGroup   = "sefi-alarm.io"
+	operatorVersion = "v1alpha1"
+
+	monitorsResource  = "sysdigforwardingmonitors"
+	notifiersResource = "sysdigforwardingnotifiers"
+	silencesResource  = "sysdigforwardingsilences"
+
+	// declaredSilencePrefix marks the silences of resources in the silence
+	// store.
+	declaredSilencePrefix = "k8s:"
+)
+
+var operatorResources = metrics.newGauge("sefi_operator_resources",
+	"Custom resources applied in operator mode, by kind.", "kind")
+
+type resourceMetadata struct {
+	Name              string    `json:"name"`
+	Namespace         string    `json:"namespace"`
+	Generation        int64     `json:"generation"`
+	CreationTimestamp time.Time `json:"creationTimestamp"`
+}
+
+func (m resourceMetadata) key() string { return m.Namespace + "/" + m.Name }
+
+// resourceStatus is the status written back to each resource.
+type resourceStatus struct {
+	Phase              string `json:"phase,omitempty"`
+	Message            string `json:"message,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+const (
+	phaseApplied = "Applied"
+	phaseInvalid = "Invalid"
+	phaseExpired = "Expired"
+)
+
+type forwardingMonitor struct {
+	Metadata resourceMetadata `json:"metadata"`
+	Spec     struct {
+		IntegrationID int      `json:"integrationId"`
+		Team          string   `json:"team"`
+		SlackChannel  string   `json:"slackChannel"`
+		Mentions      []string `json:"mentions"`
+		Email         []string `json:"email"`
+		Notifier      string   `json:"notifier"`
+	} `json:"spec"`
+	Status resourceStatus `json:"status"`
+}
+
+// secretKeyRef points at the key of a Secret in the namespace of the
+// resource.
+type secretKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type forwardingNotifier struct {
+	Metadata resourceMetadata `json:"metadata"`
+	Spec     struct {
+		WebhookURLSecretRef secretKeyRef `json:"webhookUrlSecretRef"`
+	} `json:"spec"`
+	Status resourceStatus `json:"status"`
+}
+
+// declaredWebhooks are the Slack webhooks of the integrations whose monitor
+// names a notifier.
+type webhookDirectory struct {
+	mu            sync.Mutex
+	byIntegration map[int]string
+}
+
+var declaredWebhooks = &webhookDirectory{byIntegration: make(map[int]string)}
+
+func (d *webhookDirectory) get(integrationID int) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	url, ok := d.byIntegration[integrationID]
+	return url, ok
+}
+
+func (d *webhookDirectory) set(byIntegration map[int]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byIntegration = byIntegration
+}
+
+type forwardingSilence struct {
+	Metadata resourceMetadata `json:"metadata"`
+	Spec     struct {
+		IntegrationID int    `json:"integrationId"`
+		Tenant        string `json:"tenant"`
+		ErrorPattern  string `json:"errorPattern"`
+		Reason        string `json:"reason"`
+		Until         string `json:"until"`
+		Duration      string `json:"duration"`
+	} `json:"spec"`
+	Status resourceStatus `json:"status"`
+}
+
+// operator reconciles the resources into the monitored integrations, the
+// owners and the silences.
+type operator struct {
+	client    *kubeClient
+	namespace string
+	// missing remembers the resources whose CRD isn't installed, to log it
+	// once.
+	missing map[string]bool
+}
+
+func (o *operator) resourcePath(namespace, resource string) string {
+	base := "/apis/" + operatorGroup + "/" + operatorVersion
+	if namespace == "*" {
+		return base + "/" + resource
+	}
+	return base + "/namespaces/" + namespace + "/" + resource
+}
+
+// list reads the resources into out, reporting false when they couldn't be
+// read, in which case the previous declarations are kept.
+func (o *operator) list(ctx context.Context, resource string, out interface{}) bool {
+	err := o.client.do(ctx, "GET", o.resourcePath(o.namespace, resource), nil, out)
+	if errors.Is(err, errStateNotFound) {
+		if !o.missing[resource] {
+			log.Printf("The %s.%s CRD is not installed, install it with: sefi-alarm operator crds | kubectl apply -f -\n", resource, operatorGroup)
+			o.missing[resource] = true
+		}
+		return false
+	}
+	if err != nil {
+		log.Printf("Error listing %s: %v\n", resource, err)
+		return false
+	}
+	delete(o.missing, resource)
+	return true
+}
+
+// setStatus writes status to the resource unless it already has it.
+func (o *operator) setStatus(ctx context.Context, resource string, meta resourceMetadata, current, status resourceStatus) {
+	status.ObservedGeneration = meta.Generation
+	if current == status {
+		return
+	}
+	path := o.resourcePath(meta.Namespace, resource) + "/" + meta.Name + "/status"
+	if err := o.client.do(ctx, "PATCH", path, map[string]interface{}{"status": status}, nil); err != nil {
+		log.Printf("Error updating the status of %s %s: %v\n", resource, meta.key(), err)
+	}
+}
+
+// secretValue reads the key of a Secret of namespace.
+func (o *operator) secretValue(ctx context.Context, namespace string, ref secretKeyRef) (string, error) {
+	if ref.Name == "" || ref.Key == "" {
+		return "", fmt.Errorf("set the name and key of the Secret")
+	}
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	path := "/api/v1/namespaces/" + namespace + "/secrets/" + ref.Name
+	if err := o.client.do(ctx, "GET", path, nil, &secret); errors.Is(err, errStateNotFound) {
+		return "", fmt.Errorf("secret %s not found", ref.Name)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %v", ref.Name, err)
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok || len(value) == 0 {
+		return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// reconcileNotifiers reads the notifiers, returning the webhook of each by
+// key, or false when they couldn't be listed.
+func (o *operator) reconcileNotifiers(ctx context.Context, active bool) (map[string]string, bool) {
+	var notifiers struct {
+		Items []forwardingNotifier `json:"items"`
+	}
+	if !o.list(ctx, notifiersResource, &notifiers) {
+		return nil, false
+	}
+	webhooks := make(map[string]string)
+	for _, n := range notifiers.Items {
+		status := resourceStatus{Phase: phaseApplied, Message: "Posting to the Slack webhook of secret " + n.Spec.WebhookURLSecretRef.Name + "."}
+		webhook, err := o.secretValue(ctx, n.Metadata.Namespace, n.Spec.WebhookURLSecretRef)
+		if err == nil {
+			if u, parseErr := url.Parse(webhook); parseErr != nil || u.Scheme != "https" || u.Host == "" {
+				err = fmt.Errorf("the webhook URL in secret %s must be an https URL", n.Spec.WebhookURLSecretRef.Name)
+			}
+		}
+		if err != nil {
+			status = resourceStatus{Phase: phaseInvalid, Message: "spec.webhookUrlSecretRef: " + err.Error() + "."}
+		} else {
+			webhooks[n.Metadata.key()] = webhook
+		}
+		if active {
+			o.setStatus(ctx, notifiersResource, n.Metadata, n.Status, status)
+		}
+	}
+	operatorResources.set(float64(len(webhooks)), "SysdigForwardingNotifier")
+	return webhooks, true
+}
+
+func (o *operator) reconcile(ctx context.Context, now time.Time) {
+	// Standby instances keep the integrations and owners current for a
+	// promotion, but only the active one writes silences and statuses.
+	active := !role.isStandby()
+
+	webhooks, notifiersListed := o.reconcileNotifiers(ctx, active)
+
+	var monitors struct {
+		Items []forwardingMonitor `json:"items"`
+	}
+	if o.list(ctx, monitorsResource, &monitors) {
+		sort.Slice(monitors.Items, func(i, j int) bool {
+			return monitors.Items[i].Metadata.key() < monitors.Items[j].Metadata.key()
+		})
+		var ids []int
+		declared := make(map[int]Owner)
+		claimedBy := make(map[int]string)
+		integrationWebhooks := make(map[int]string)
+		for _, m := range monitors.Items {
+			status := resourceStatus{Phase: phaseApplied, Message: fmt.Sprintf("Monitoring integration %d.", m.Spec.IntegrationID)}
+			webhook, hasWebhook := webhooks[m.Metadata.Namespace+"/"+m.Spec.Notifier]
+			switch id := m.Spec.IntegrationID; {
+			case id <= 0:
+				status = resourceStatus{Phase: phaseInvalid, Message: "spec.integrationId must be a positive integration ID."}
+			case claimedBy[id] != "":
+				status = resourceStatus{Phase: phaseInvalid, Message: fmt.Sprintf("Integration %d is already declared by %s.", id, claimedBy[id])}
+			case m.Spec.Notifier != "" && notifiersListed && !hasWebhook:
+				status = resourceStatus{Phase: phaseInvalid, Message: fmt.Sprintf("spec.notifier %s is not an applied SysdigForwardingNotifier of namespace %s.", m.Spec.Notifier, m.Metadata.Namespace)}
+			default:
+				claimedBy[id] = m.Metadata.key()
+				ids = append(ids, id)
+				owner := Owner{Team: m.Spec.Team, SlackChannel: m.Spec.SlackChannel, Mentions: m.Spec.Mentions, Email: m.Spec.Email}
+				if owner.Team != "" || owner.SlackChannel != "" || len(owner.Mentions) > 0 || len(owner.Email) > 0 {
+					declared[id] = owner
+				}
+				if hasWebhook {
+					integrationWebhooks[id] = webhook
+				}
+			}
+			if active {
+				o.setStatus(ctx, monitorsResource, m.Metadata, m.Status, status)
+			}
+		}
+		sort.Ints(ids)
+		monitored.declare(ids)
+		owners.setDeclared(declared)
+		// Without the notifiers listed, the previous webhooks are kept.
+		if notifiersListed {
+			declaredWebhooks.set(integrationWebhooks)
+		}
+		operatorResources.set(float64(len(ids)), "SysdigForwardingMonitor")
+	}
+
+	if !active {
+		return
+	}
+	var silenceList struct {
+		Items []forwardingSilence `json:"items"`
+	}
+	if o.list(ctx, silencesResource, &silenceList) {
+		var declared []Silence
+		for _, r := range silenceList.Items {
+			silence, err := r.silence()
+			status := resourceStatus{Phase: phaseApplied}
+			switch {
+			case err != nil:
+				status = resourceStatus{Phase: phaseInvalid, Message: err.Error()}
+			case !silence.Until.After(now):
+				status = resourceStatus{Phase: phaseExpired, Message: "Expired at " + silence.Until.Format(time.RFC3339) + "."}
+			default:
+				status.Message = "Silencing " + silence.Describe() + " until " + silence.Until.Format(time.RFC3339) + "."
+				declared = append(declared, silence)
+			}
+			o.setStatus(ctx, silencesResource, r.Metadata, r.Status, status)
+		}
+		silences.replaceDeclared(declaredSilencePrefix, declared, now)
+		operatorResources.set(float64(len(declared)), "SysdigForwardingSilence")
+	}
+}
+
+// silence turns the resource into a silence of the silence store.
+func (r forwardingSilence) silence() (Silence, error) {
+	silence := Silence{
+		ID:            declaredSilencePrefix + r.Metadata.key(),
+		IntegrationID: r.Spec.IntegrationID,
+		Tenant:        r.Spec.Tenant,
+		ErrorPattern:  r.Spec.ErrorPattern,
+		Reason:        r.Spec.Reason,
+		By:            "kubernetes:" + r.Metadata.key(),
+		CreatedAt:     r.Metadata.CreationTimestamp.UTC(),
+	}
+	switch {
+	case r.Spec.Until != "" && r.Spec.Duration != "":
+		return Silence{}, fmt.Errorf("set spec.until or spec.duration, not both")
+	case r.Spec.Until != "":
+		until, err := time.Parse(time.RFC3339, r.Spec.Until)
+		if err != nil {
+			return Silence{}, fmt.Errorf("spec.until must be an RFC 3339 time: %v", err)
+		}
+		silence.Until = until.UTC()
+	case r.Spec.Duration != "":
+		d, err := parseSince(r.Spec.Duration)
+		if err != nil {
+			return Silence{}, fmt.Errorf("spec.duration: %v", err)
+		}
+		silence.Until = silence.CreatedAt.Add(d)
+	default:
+		return Silence{}, fmt.Errorf("set spec.until or spec.duration")
+	}
+	if err := silence.compile(); err != nil {
+		return Silence{}, err
+	}
+	return silence, nil
+}
+
+func operatorLoop(ctx context.Context) {
+	if !operatorEnabled {
+		return
+	}
+	client, err := newKubeClient(30 * time.Second)
+	if err != nil {
+		log.Fatalf("kubernetes.operator is enabled in config.yaml, but: %v", err)
+	}
+	namespace := operatorNamespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	if namespace == "" {
+		log.Fatalf("Set kubernetes.operator.namespace in config.yaml, the pod's namespace is unknown.")
+	}
+	o := &operator{client: client, namespace: namespace, missing: make(map[string]bool)}
+	if namespace == "*" {
+		log.Println("Reconciling SEFI-Alarm resources in all namespaces.")
+	} else {
+		log.Printf("Reconciling SEFI-Alarm resources in namespace %s.\n", namespace)
+	}
+
+	ticker := time.NewTicker(operatorResync)
+	defer ticker.Stop()
+	for {
+		o.reconcile(ctx, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// operatorManifests are the CRDs of operator mode and the ClusterRole that
+// lets the service account read them and update their status.
+var operatorManifests = strings.NewReplacer("GROUP", operatorGroup, "VERSION", operatorVersion).Replace(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: sysdigforwardingmonitors.GROUP
+spec:
+  group: GROUP
+  scope: Namespaced
+  names:
+    kind: SysdigForwardingMonitor
+    listKind: SysdigForwardingMonitorList
+    plural: sysdigforwardingmonitors
+    singular: sysdigforwardingmonitor
+    shortNames: [sfm]
+  versions:
+    - name: VERSION
+      served: true
+      storage: true
+      subresources:
+        status: {}
+      additionalPrinterColumns:
+        - {name: Integration, type: integer, jsonPath: .spec.integrationId}
+        - {name: Team, type: string, jsonPath: .spec.team}
+        - {name: Phase, type: string, jsonPath: .status.phase}
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [integrationId]
+              properties:
+                integrationId: {type: integer, minimum: 1}
+                team: {type: string}
+                slackChannel: {type: string}
+                mentions: {type: array, items: {type: string}}
+                email: {type: array, items: {type: string}}
+                notifier: {type: string}
+            status:
+              type: object
+              properties:
+                phase: {type: string}
+                message: {type: string}
+                observedGeneration: {type: integer}
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: sysdigforwardingnotifiers.GROUP
+spec:
+  group: GROUP
+  scope: Namespaced
+  names:
+    kind: SysdigForwardingNotifier
+    listKind: SysdigForwardingNotifierList
+    plural: sysdigforwardingnotifiers
+    singular: sysdigforwardingnotifier
+    shortNames: [sfn]
+  versions:
+    - name: VERSION
+      served: true
+      storage: true
+      subresources:
+        status: {}
+      additionalPrinterColumns:
+        - {name: Secret, type: string, jsonPath: .spec.webhookUrlSecretRef.name}
+        - {name: Phase, type: string, jsonPath: .status.phase}
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [webhookUrlSecretRef]
+              properties:
+                webhookUrlSecretRef:
+                  type: object
+                  required: [name, key]
+                  properties:
+                    name: {type: string}
+                    key: {type: string}
+            status:
+              type: object
+              properties:
+                phase: {type: string}
+                message: {type: string}
+                observedGeneration: {type: integer}
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: sysdigforwardingsilences.GROUP
+spec:
+  group: GROUP
+  scope: Namespaced
+  names:
+    kind: SysdigForwardingSilence
+    listKind: SysdigForwardingSilenceList
+    plural: sysdigforwardingsilences
+    singular: sysdigforwardingsilence
+    shortNames: [sfs]
+  versions:
+    - name: VERSION
+      served: true
+      storage: true
+      subresources:
+        status: {}
+      additionalPrinterColumns:
+        - {name: Integration, type: integer, jsonPath: .spec.integrationId}
+        - {name: Until, type: string, jsonPath: .spec.until}
+        - {name: Phase, type: string, jsonPath: .status.phase}
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              properties:
+                integrationId: {type: integer}
+                tenant: {type: string}
+                errorPattern: {type: string}
+                reason: {type: string}
+                until: {type: string, format: date-time}
+                duration: {type: string}
+            status:
+              type: object
+              properties:
+                phase: {type: string}
+                message: {type: string}
+                observedGeneration: {type: integer}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: sefi-alarm-operator
+rules:
+  - apiGroups: [GROUP]
+    resources: [sysdigforwardingmonitors, sysdigforwardingnotifiers, sysdigforwardingsilences]
+    verbs: [get, list, watch]
+  - apiGroups: [GROUP]
+    resources: [sysdigforwardingmonitors/status, sysdigforwardingnotifiers/status, sysdigforwardingsilences/status]
+    verbs: [get, patch, update]
+  # The webhook URLs of the notifiers.
+  - apiGroups: [""]
+    resources: [secrets]
+    verbs: [get]
+`)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics can also be pushed to an OpenTelemetry collector over OTLP/HTTP
+// (<otlpMetrics.endpoint>/v1/metrics, JSON encoded), for environments where
+// nothing scrapes us. Counters become cumulative sums since startup, gauges
+// stay gauges; the resource is named like the traces (tracing.serviceName).
+// With prometheusMetrics: false, /metrics is not served at all.
+var (
+	otlpMetricsEndpoint = strings.TrimSuffix(conf.String("otlpMetrics.endpoint", ""), "/")
+	otlpMetricsHeaders  = conf.StringMap("otlpMetrics.headers")
+	otlpMetricsInterval = time.Duration(conf.Int("otlpMetrics.intervalSecs", 60)) * time.Second
+	prometheusMetrics   = conf.Bool("prometheusMetrics", true)
+)
+
+// metricsStartedAt is the start of the cumulative counters.
+var metricsStartedAt = time.Now()
+
+func otlpMetricsLoop(ctx context.Context) {
+	if otlpMetricsEndpoint == "" {
+		return
+	}
+
+	ticker := time.NewTicker(otlpMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := pushOTLPMetrics(ctx, now); err != nil {
+				log.Printf("Error pushing metrics via OTLP: %v\n", err)
+			}
+		}
+	}
+}
+
+func pushOTLPMetrics(ctx context.Context, now time.Time) error {
+	return postOTLP(ctx, otlpMetricsEndpoint+"/v1/metrics", otlpMetricsHeaders, encodeOTLPMetrics(now))
+}
+
+// encodeOTLPMetrics builds an OTLP ExportMetricsServiceRequest in its JSON
+// mapping from every family of the registry.
+func encodeOTLPMetrics(now time.Time) map[string]interface{} {
+	start := strconv.FormatInt(metricsStartedAt.UnixNano(), 10)
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+
+	var encoded []map[string]interface{}
+	for _, f := range metrics.snapshotFamilies() {
+		series := f.sortedSeries()
+		if len(series) == 0 {
+			continue
+		}
+		points := make([]map[string]interface{}, 0, len(series))
+		for _, s := range series {
+			attributes := make([]map[string]interface{}, 0, len(f.labelNames))
+			for i, name := range f.labelNames {
+				attributes = append(attributes, otlpAttribute(name, s.labelValues[i]))
+			}
+			point := map[string]interface{}{
+				"attributes":   attributes,
+				"timeUnixNano": timestamp,
+				"asDouble":     s.value,
+			}
+			if f.kind == "counter" {
+				point["startTimeUnixNano"] = start
+			}
+			points = append(points, point)
+		}
+
+		metric := map[string]interface{}{"name": f.name, "description": f.help}
+		if f.kind == "counter" {
+			metric["sum"] = map[string]interface{}{
+				"aggregationTemporality": 2, // cumulative
+				"isMonotonic":            true,
+				"dataPoints":             points,
+			}
+		} else {
+			metric["gauge"] = map[string]interface{}{"dataPoints": points}
+		}
+		encoded = append(encoded, metric)
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource": otlpResource(),
+			"scopeMetrics": []map[string]interface{}{{
+				"scope":   otlpScope(),
+				"metrics": encoded,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const ownersFile = "owners.json"
+
+// Owner is the team responsible for an integration. Its alerts go to the
+// team's channel and mention its contacts, unless slackChannelOverrides or
+// mentions.integrations say otherwise for the integration. Email receives
+// the team's owner report.
+type Owner struct {
+	Team         string   `json:"team"`
+	SlackChannel string   `json:"slackChannel,omitempty"`
+	Mentions     []string `json:"mentions,omitempty"`
+	Email        []string `json:"email,omitempty"`
+}
+
+// Owners are set under owners.integrations by integration ID, and can be
+// fetched from owners.directoryUrl, which must serve the same mapping as
+// YAML or JSON, or declared by Kubernetes resources in operator mode.
+// Entries in config.yaml win over Kubernetes resources, which win over the
+// directory.
+var (
+	ownersDirectoryURL = conf.String("owners.directoryUrl", "")
+	ownersRefresh      = time.Duration(conf.Int("owners.refreshMins", 15)) * time.Minute
+)
+
+type ownerDirectory struct {
+	mu       sync.Mutex
+	static   map[int]Owner
+	declared map[int]Owner
+	fetched  map[int]Owner
+}
+
+var owners = newOwnerDirectory()
+
+func newOwnerDirectory() *ownerDirectory {
+	d := &ownerDirectory{declared: make(map[int]Owner), fetched: make(map[int]Owner)}
+	static, err := ownersFrom(conf)
+	if err != nil {
+		addConfigProblem("owners.integrations: %v", err)
+	}
+	d.static = static
+
+	// The last directory fetched keeps routing alerts while the directory
+	// is unreachable after a restart.
+	if ownersDirectoryURL != "" {
+		if _, err := loadState(ownersFile, &d.fetched); err != nil {
+			log.Printf("Error loading the cached owners directory: %v\n", err)
+		}
+	}
+	return d
+}
+
+// ownersFrom reads owners.integrations from c.
+func ownersFrom(c configMap) (map[int]Owner, error) {
+	v, ok := c.Lookup("owners.integrations")
+	if !ok {
+		return make(map[int]Owner), nil
+	}
+	section, ok := asSection(v)
+	if !ok {
+		return nil, fmt.Errorf("must map integration IDs to owners")
+	}
+	return parseOwners(section)
+}
+
+func parseOwners(section map[string]interface{}) (map[int]Owner, error) {
+	out := make(map[int]Owner, len(section))
+	for key, value := range section {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integration ID", key)
+		}
+		entry, ok := asSection(value)
+		if !ok {
+			return nil, fmt.Errorf("owner of integration %d must have a team", id)
+		}
+		owner := Owner{
+			Team:         configMap(entry).String("team", ""),
+			SlackChannel: configMap(entry).String("slackChannel", ""),
+			Mentions:     configMap(entry).StringList("mentions"),
+			Email:        configMap(entry).StringList("email"),
+		}
+		if owner.Team == "" {
+			return nil, fmt.Errorf("owner of integration %d must have a team", id)
+		}
+		out[id] = owner
+	}
+	return out, nil
+}
+
+// get returns the owner of integrationID.
+func (d *ownerDirectory) get(integrationID int) (Owner, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if owner, ok := d.static[integrationID]; ok {
+		return owner, true
+	}
+	if owner, ok := d.declared[integrationID]; ok {
+		return owner, true
+	}
+	owner, ok := d.fetched[integrationID]
+	return owner, ok
+}
+
+// setDeclared replaces the owners declared by Kubernetes resources.
+func (d *ownerDirectory) setDeclared(declared map[int]Owner) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.declared = declared
+}
+
+// fetchedOwner returns the owner of integrationID in the directory only.
+func (d *ownerDirectory) fetchedOwner(integrationID int) (Owner, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner, ok := d.fetched[integrationID]
+	return owner, ok
+}
+
+func (d *ownerDirectory) refresh(ctx context.Context) error {
+	fetched, err := fetchOwnerDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.fetched = fetched
+	d.mu.Unlock()
+
+	if err := saveState(ownersFile, fetched); err != nil {
+		log.Printf("Error caching the owners directory: %v\n", err)
+	}
+	return nil
+}
+
+func fetchOwnerDirectory(ctx context.Context) (map[int]Owner, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ownersDirectoryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json, application/yaml")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch owners directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read owners directory: %v", err)
+	}
+
+	// JSON is valid YAML, so one parser handles both.
+	var doc interface{}
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse owners directory: %v", err)
+	}
+	section, ok := asSection(doc)
+	if !ok {
+		return nil, fmt.Errorf("owners directory must map integration IDs to owners")
+	}
+	fetched, err := parseOwners(section)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owners directory: %v", err)
+	}
+	return fetched, nil
+}
+
+// ownersLoop keeps the owners directory up to date.
+func ownersLoop(ctx context.Context) {
+	if ownersDirectoryURL == "" {
+		return
+	}
+
+	for {
+		if err := owners.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error refreshing the owners directory, keeping the previous one: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ownersRefresh):
+		}
+	}
+}
+
+// ownerTeam names the team owning integrationID, empty if none does.
+func ownerTeam(integrationID int) string {
+	owner, _ := owners.get(integrationID)
+	return owner.Team
+}
+
+// OwnerEntry is an owner as the API lists it.
+type OwnerEntry struct {
+	IntegrationID int `json:"integrationId"`
+	Owner
+	Source string `json:"source"`
+}
+
+func (d *ownerDirectory) list() []OwnerEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var out []OwnerEntry
+	for id, owner := range d.fetched {
+		_, static := d.static[id]
+		_, declared := d.declared[id]
+		if !static && !declared {
+			out = append(out, OwnerEntry{IntegrationID: id, Owner: owner, Source: "directory"})
+		}
+	}
+	for id, owner := range d.declared {
+		if _, ok := d.static[id]; !ok {
+			out = append(out, OwnerEntry{IntegrationID: id, Owner: owner, Source: "kubernetes"})
+		}
+	}
+	for id, owner := range d.static {
+		out = append(out, OwnerEntry{IntegrationID: id, Owner: owner, Source: "config"})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IntegrationID < out[j].IntegrationID })
+	return out
+}
+
+func handleOwners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, owners.list())
+}
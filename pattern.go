@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gapBuckets are the upper bounds of the inter-error gap histogram.
+var gapBuckets = []struct {
+	label string
+	max   time.Duration
+}{
+	{"<1s", time.Second},
+	{"1-10s", 10 * time.Second},
+	{"10-60s", time.Minute},
+	{"1-10m", 10 * time.Minute},
+	{">10m", math.MaxInt64},
+}
+
+// failurePattern characterizes the gaps between errors: a steady stream
+// points at a hard outage of the destination, bursts at throttling or
+// intermittent network trouble. It returns "" with fewer than three
+// timestamps, too few to tell.
+func failurePattern(errors []ErrorLog) string {
+	var times []time.Time
+	for _, e := range errors {
+		if t, err := e.Time(); err == nil {
+			times = append(times, t)
+		}
+	}
+	if len(times) < 3 {
+		return ""
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	gaps := make([]float64, 0, len(times)-1)
+	counts := make([]int, len(gapBuckets))
+	var sum float64
+	for i := 1; i < len(times); i++ {
+		gap := times[i].Sub(times[i-1])
+		gaps = append(gaps, gap.Seconds())
+		sum += gap.Seconds()
+		for b, bucket := range gapBuckets {
+			if gap < bucket.max {
+				counts[b]++
+				break
+			}
+		}
+	}
+	mean := sum / float64(len(gaps))
+
+	var variance float64
+	for _, g := range gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	variance /= float64(len(gaps))
+
+	// The coefficient of variation is ~0 for evenly spaced errors and grows
+	// above 1 when they come in clusters.
+	kind := "intermittent"
+	if mean > 0 {
+		switch cv := math.Sqrt(variance) / mean; {
+		case cv < 0.5:
+			kind = "continuous"
+		case cv > 1:
+			kind = "bursty"
+		}
+	} else {
+		kind = "bursty"
+	}
+
+	var histogram []string
+	for b, bucket := range gapBuckets {
+		if counts[b] > 0 {
+			histogram = append(histogram, fmt.Sprintf("%s: %d", bucket.label, counts[b]))
+		}
+	}
+	avg := time.Duration(mean * float64(time.Second)).Round(10 * time.Millisecond)
+	return fmt.Sprintf("%s, %d errors over %s, average gap %s (gaps %s)",
+		kind, len(times), times[len(times)-1].Sub(times[0]).Round(time.Second), avg, strings.Join(histogram, ", "))
+}
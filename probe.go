@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+)
+
+// The forwarding probe asks Sysdig to send a test event through each
+// monitored integration every probe.intervalMins, then checks the error feed
+// probe.verifyAfterSecs later. Misconfigured destinations are caught without
+// waiting for a real policy event to fail. probe.path is the test endpoint,
+// {id} standing for the integration; integrations whose type the API can't
+// test are skipped.
+var (
+	probeEnabled     = conf.Bool("probe.enabled", false)
+	probePath        = conf.String("probe.path", "/api/v1/eventsForwarding/integrations/{id}/test")
+	probeInterval    = time.Duration(conf.Int("probe.intervalMins", 60)) * time.Minute
+	probeVerifyAfter = time.Duration(conf.Int("probe.verifyAfterSecs", 120)) * time.Second
+)
+
+var (
+	probeSuccess = metrics.newGauge("sefi_probe_success",
+		"Whether the last forwarding probe of an integration succeeded.", "integration_id")
+	probeLastRun = metrics.newGauge("sefi_probe_last_run_timestamp_seconds",
+		"Unix time of the last forwarding probe of an integration.", "integration_id")
+)
+
+// errProbeUnsupported is returned when the API can't test an integration.
+var errProbeUnsupported = fmt.Errorf("the Sysdig API can't send a test event through this integration")
+
+// probeResult is the outcome of probing one integration.
+type probeResult struct {
+	IntegrationID int
+	Err           error
+}
+
+// sendProbeEvent asks Sysdig to forward a test event through integrationID.
+func sendProbeEvent(ctx context.Context, integrationID int) error {
+	url := lookupRegion(region).APIBase + strings.ReplaceAll(probePath, "{id}", strconv.Itoa(integrationID))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bearerToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send test event: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return sysdigAPIError(resp)
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return errProbeUnsupported
+	case resp.StatusCode/100 != 2:
+		// The test endpoint reports a destination refusing the event in the
+		// response, which is worth showing as is.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("test event failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// probeIntegration sends a test event through integrationID and reports any
+// forwarding error that showed up by verifyAfter.
+func probeIntegration(ctx context.Context, integrationID int, verifyAfter time.Duration) error {
+	sentAt := time.Now().UTC()
+	if err := sendProbeEvent(ctx, integrationID); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(verifyAfter):
+	}
+
+	query := sysdig.ErrorsQuery{}
+	if sysdigTimeFilter {
+		query.From = sentAt
+	}
+	payload, err := pollEndpoint(ctx, integrationID, query)
+	if err != nil {
+		return fmt.Errorf("failed to check the error feed after the test event: %v", err)
+	}
+	for _, e := range payload.Errors {
+		timestamp, err := e.Time()
+		if err == nil && !timestamp.Before(sentAt) {
+			return fmt.Errorf("forwarding the test event failed: %s", e.Error)
+		}
+	}
+	return nil
+}
+
+// probeAll probes the integrations concurrently, as each waits for its
+// verification.
+func probeAll(ctx context.Context, ids []int, verifyAfter time.Duration) []probeResult {
+	results := make([]probeResult, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probeResult{IntegrationID: id, Err: probeIntegration(ctx, id, verifyAfter)}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// probeTracker alerts once when the probe of an integration starts failing
+// and once when it passes again.
+type probeTracker struct {
+	mu          sync.Mutex
+	failing     map[int]bool
+	unsupported map[int]bool
+}
+
+var probes = &probeTracker{failing: make(map[int]bool), unsupported: make(map[int]bool)}
+
+func (p *probeTracker) skip(integrationID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unsupported[integrationID]
+}
+
+func (p *probeTracker) record(result probeResult, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := result.IntegrationID
+	label := strconv.Itoa(id)
+	if result.Err == errProbeUnsupported {
+		log.Printf("Not probing integration %d: %v.\n", id, result.Err)
+		p.unsupported[id] = true
+		return
+	}
+	probeLastRun.set(float64(now.Unix()), label)
+
+	if result.Err != nil {
+		probeSuccess.set(0, label)
+		log.Printf("Forwarding probe of integration %d failed: %v\n", id, result.Err)
+		if !p.failing[id] {
+			p.failing[id] = true
+			notifications.enqueue(probeNotification(id, reasonProbeFailed, "Forwarding probe failed on integration "+integrationLabel(id),
+				fmt.Sprintf("A test event sent through the integration was not forwarded: %v", result.Err), now))
+		}
+		return
+	}
+
+	probeSuccess.set(1, label)
+	if p.failing[id] {
+		delete(p.failing, id)
+		notifications.enqueue(probeNotification(id, reasonRecovered, "Forwarding probe passes again on integration "+integrationLabel(id),
+			"A test event sent through the integration was forwarded without errors.", now))
+	}
+}
+
+func probeNotification(integrationID int, reason, title, text string, at time.Time) *Notification {
+	blocks := []SlackBlock{
+		{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+		{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+	}
+	if footer, ok := podFooter(); ok {
+		blocks = append(blocks, footer)
+	}
+	return &Notification{
+		IntegrationID: integrationID,
+		Message: SlackMessage{
+			Channel: slackChannelFor(integrationID),
+			Text:    title + "\n" + text,
+			Blocks:  blocks,
+		},
+		Reason:   reason,
+		QueuedAt: at,
+	}
+}
+
+// probeLoop probes the monitored integrations every probe.intervalMins.
+func probeLoop(ctx context.Context) {
+	if !probeEnabled {
+		return
+	}
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if role.isStandby() {
+			continue
+		}
+
+		var ids []int
+		for _, id := range monitored.list(ctx) {
+			if !probes.skip(id) {
+				ids = append(ids, id)
+			}
+		}
+		for _, result := range probeAll(ctx, ids, probeVerifyAfter) {
+			if ctx.Err() != nil {
+				return
+			}
+			probes.record(result, time.Now().UTC())
+		}
+	}
+}
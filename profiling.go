@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// When poll cycles keep taking longer than profiling.pollLatencySecs, or
+// more than profiling.queueDepth notifications keep waiting, for
+// profiling.sustainedMins, a CPU profile (profiling.cpuSecs long), a heap
+// profile and a goroutine dump are written to stateDir/profiles, once per
+// such episode. Only the latest profiling.keep snapshots are kept. Both
+// thresholds are off unless set, and nothing is written in stateless mode.
+var (
+	profilingPollLatency = time.Duration(conf.Int("profiling.pollLatencySecs", 0)) * time.Second
+	profilingQueueDepth  = conf.Int("profiling.queueDepth", 0)
+	profilingSustained   = time.Duration(conf.Int("profiling.sustainedMins", 5)) * time.Minute
+	profilingCPUTime     = time.Duration(conf.Int("profiling.cpuSecs", 10)) * time.Second
+	profilingKeep        = conf.Int("profiling.keep", 5)
+)
+
+var (
+	pollCycleDuration = metrics.newGauge("sefi_poll_cycle_duration_seconds",
+		"How long the last poll cycle took, over every integration.")
+	profileSnapshots = metrics.newCounter("sefi_profile_snapshots_total",
+		"Profiling snapshots written, by trigger.", "trigger")
+)
+
+const profilesDir = "profiles"
+
+// slowWatch tracks since when a measure has been over its threshold.
+type slowWatch struct {
+	mu sync.Mutex
+	// since is zero while the measure is under the threshold.
+	since time.Time
+	// captured is set once the episode got its snapshot.
+	captured bool
+}
+
+func (w *slowWatch) observe(over bool, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case !over:
+		w.since, w.captured = time.Time{}, false
+	case w.since.IsZero():
+		w.since = now
+	}
+}
+
+// due reports whether the measure has been over its threshold for
+// profilingSustained and the episode has no snapshot yet, marking it taken.
+func (w *slowWatch) due(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() || w.captured || now.Sub(w.since) < profilingSustained {
+		return false
+	}
+	w.captured = true
+	return true
+}
+
+var slowPolls, deepQueue slowWatch
+
+// observePollCycle records how long a poll cycle took.
+func observePollCycle(d time.Duration, now time.Time) {
+	pollCycleDuration.set(d.Seconds())
+	if profilingPollLatency > 0 {
+		slowPolls.observe(d > profilingPollLatency, now)
+	}
+}
+
+func profilingLoop(ctx context.Context) {
+	if profilingPollLatency <= 0 && profilingQueueDepth <= 0 {
+		return
+	}
+	if stateless {
+		log.Println("Not writing profiling snapshots in stateless mode.")
+		return
+	}
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			now = now.UTC()
+			if profilingQueueDepth > 0 {
+				deepQueue.observe(notifications.depth() > profilingQueueDepth, now)
+			}
+			trigger := ""
+			switch {
+			case slowPolls.due(now):
+				trigger = "poll_latency"
+			case deepQueue.due(now):
+				trigger = "queue_depth"
+			default:
+				continue
+			}
+			if path, err := writeProfileSnapshot(ctx, now, trigger); err != nil {
+				log.Printf("Error writing profiling snapshot: %v\n", err)
+			} else {
+				log.Printf("Sustained %s, profiling snapshot written to %s\n", trigger, path)
+				profileSnapshots.inc(trigger)
+			}
+		}
+	}
+}
+
+// writeProfileSnapshot writes the profiles to a directory of their own and
+// prunes the oldest snapshots.
+func writeProfileSnapshot(ctx context.Context, at time.Time, trigger string) (string, error) {
+	root := filepath.Join(stateDir, profilesDir)
+	dir := filepath.Join(root, fmt.Sprintf("%s-%s", at.Format("20060102T150405Z"), trigger))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	if err := writeCPUProfile(ctx, filepath.Join(dir, "cpu.pprof")); err != nil {
+		// Someone may be profiling through debugListen; the other profiles
+		// are still worth having.
+		log.Printf("Skipping the CPU profile: %v\n", err)
+	}
+	runtime.GC()
+	if err := writeProfile("heap", filepath.Join(dir, "heap.pprof"), 0); err != nil {
+		return "", err
+	}
+	if err := writeProfile("goroutine", filepath.Join(dir, "goroutines.txt"), 2); err != nil {
+		return "", err
+	}
+	pruneProfileSnapshots(root, profilingKeep)
+	return dir, nil
+}
+
+func writeCPUProfile(ctx context.Context, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := pprof.StartCPUProfile(f); err != nil {
+		os.Remove(path)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(profilingCPUTime):
+	}
+	pprof.StopCPUProfile()
+	return nil
+}
+
+func writeProfile(name, path string, debug int) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.Lookup(name).WriteTo(f, debug)
+}
+
+// pruneProfileSnapshots removes all but the newest keep snapshots, whose
+// names sort by time.
+func pruneProfileSnapshots(root string, keep int) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	for len(dirs) > max(keep, 1) {
+		if err := os.RemoveAll(filepath.Join(root, dirs[0])); err != nil {
+			log.Printf("Error removing old profiling snapshot: %v\n", err)
+		}
+		dirs = dirs[1:]
+	}
+}
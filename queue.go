@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const outboxFile = "outbox.json"
+
+// Notification is a message waiting to be delivered by one notifier: a Slack
+// message by default, or a ticket to open when Notifier names a tracker.
+// Unthreaded Slack messages are posted to their own channel rather than the
+// integration's incident thread. Trace is the traceparent of the poll that
+// queued the notification, when tracing is on.
+// Notifications that are still queued when the process shuts down are
+// persisted to the outbox and delivered on the next start. Attempts counts
+// the failed deliveries, see notificationRetry. Attachment is shared in the
+// thread of the Slack message once it is posted, see messages.attachPayload.
+type Notification struct {
+	Notifier      string            `json:"notifier,omitempty"`
+	IntegrationID int               `json:"integrationId"`
+	Message       SlackMessage      `json:"message"`
+	Ticket        *TicketDraft      `json:"ticket,omitempty"`
+	Variables     map[string]string `json:"variables,omitempty"`
+	Event         *CorrelationEvent `json:"event,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+	Unthreaded    bool              `json:"unthreaded,omitempty"`
+	Trace         string            `json:"trace,omitempty"`
+	QueuedAt      time.Time         `json:"queuedAt"`
+	Attempts      int               `json:"attempts,omitempty"`
+	Attachment    *SlackFile        `json:"attachment,omitempty"`
+}
+
+type notificationQueue struct {
+	size int
+	done chan struct{}
+
+	// ctx bounds deliveries; drain cancels it when the grace period ends so
+	// a hanging request doesn't hold up the exit.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	ready   *sync.Cond
+	items   []*Notification
+	closed  bool
+	aborted bool
+	kept    []*Notification
+
+	// inFlight holds notifications being delivered and busy the integrations
+	// they belong to, per notifier. Each integration has at most one delivery
+	// in flight to a notifier so its alerts (and Slack threads) stay in order
+	// across workers, while other notifiers go ahead.
+	inFlight map[*Notification]bool
+	busy     map[deliveryKey]bool
+
+	// replaying holds the notifications replayed from the outbox, which is
+	// only removed once they have all been delivered or handed to the
+	// redelivery store, so a crash meanwhile replays them again.
+	replaying map[*Notification]bool
+
+	// perDestination bounds the deliveries in flight to one destination, so
+	// a slow one can't take every worker and hold up the others.
+	perDestination int
+	active         map[string]int
+}
+
+// deliveryKey orders the deliveries of an integration to a notifier.
+type deliveryKey struct {
+	notifier      string
+	integrationID int
+}
+
+// notificationDestination names where n is delivered: the notifier, and for
+// the Slack Web API the channel, since each channel is posted separately.
+func notificationDestination(n *Notification) string {
+	name := notifierName(n)
+	if n.Notifier == "" && slackBotMode() && !slackWorkflowMode() {
+		name += " " + n.Message.Channel
+	}
+	return name
+}
+
+var notificationsInFlight = metrics.newGauge("sefi_notifications_in_flight",
+	"Notifications being delivered, by destination.", "destination")
+
+var notifications = newNotificationQueue(tuning.queueSize, tuning.destinationWorkers)
+
+func newNotificationQueue(size, perDestination int) *notificationQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &notificationQueue{
+		size:           size,
+		done:           make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+		inFlight:       make(map[*Notification]bool),
+		busy:           make(map[deliveryKey]bool),
+		replaying:      make(map[*Notification]bool),
+		perDestination: max(1, perDestination),
+		active:         make(map[string]int),
+	}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// enqueue hands n to the delivery worker. Once the queue is closed, or when it
+// is full, n is kept aside so it ends up in the outbox instead of being lost.
+func (q *notificationQueue) enqueue(n *Notification) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.kept = append(q.kept, n)
+		return
+	}
+	if len(q.items) >= q.size {
+		log.Printf("Notification queue is full, keeping notification for integration %d for the outbox\n", n.IntegrationID)
+		q.kept = append(q.kept, n)
+		return
+	}
+
+	q.items = append(q.items, n)
+	q.ready.Broadcast()
+}
+
+// depth is the number of notifications waiting for delivery.
+func (q *notificationQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) + len(q.inFlight)
+}
+
+// waiting is the number of Slack messages waiting for delivery to channel.
+func (q *notificationQueue) waiting(channel string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	for _, n := range q.items {
+		if n.Notifier == "" && n.Message.Channel == channel {
+			count++
+		}
+	}
+	return count
+}
+
+// next blocks until a notification is available whose destination has a free
+// slot and whose notifier has no delivery in flight for the integration, and
+// marks it as in flight. It returns nil once the queue is closed and empty, or
+// drain gave up on it.
+func (q *notificationQueue) next() *Notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.aborted {
+			return nil
+		}
+		for i, n := range q.items {
+			destination := notificationDestination(n)
+			key := deliveryKey{notifierName(n), n.IntegrationID}
+			if !q.busy[key] && q.active[destination] < q.perDestination {
+				q.items = append(q.items[:i:i], q.items[i+1:]...)
+				q.inFlight[n] = true
+				q.busy[key] = true
+				q.active[destination]++
+				notificationsInFlight.set(float64(q.active[destination]), destination)
+				return n
+			}
+		}
+		if q.closed && len(q.items) == 0 {
+			return nil
+		}
+		q.ready.Wait()
+	}
+}
+
+// finish releases n after a delivery attempt. A failed notification is kept
+// for the outbox once the queue is closed, and reported as kept.
+func (q *notificationQueue) finish(n *Notification, err error) (kept bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	destination := notificationDestination(n)
+	delete(q.inFlight, n)
+	delete(q.busy, deliveryKey{notifierName(n), n.IntegrationID})
+	q.active[destination]--
+	notificationsInFlight.set(float64(q.active[destination]), destination)
+	if err != nil && q.closed && !q.aborted {
+		q.kept = append(q.kept, n)
+		kept = true
+	}
+	q.ready.Broadcast()
+	return kept
+}
+
+// start launches workers delivery goroutines.
+func (q *notificationQueue) start(workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := q.next(); n != nil; n = q.next() {
+				var err error
+				if runRecovered("notification worker", func() { err = deliverNotification(q.ctx, n) }) {
+					err = fmt.Errorf("delivery panicked")
+				}
+				if errors.Is(err, errThrottled) {
+					// Held for the summary, there is nothing to retry.
+					q.finish(n, nil)
+					history.recordNotification(n, err, time.Now().UTC())
+					log.Printf("Holding back %s notification for integration %d: over the rate limit.\n", notifierName(n), n.IntegrationID)
+					notificationsTotal.inc("throttled")
+					q.replayed(n)
+					continue
+				}
+				kept := q.finish(n, err)
+				history.recordNotification(n, err, time.Now().UTC())
+
+				if err != nil {
+					log.Printf("Error sending %s notification: %v\n", notifierName(n), err)
+					notificationsTotal.inc("failure")
+					if !kept && q.ctx.Err() == nil {
+						redeliveries.failed(n, err, time.Now().UTC())
+					}
+				} else {
+					log.Printf("%s notification sent successfully.\n", notifierName(n))
+					notificationsTotal.inc("success")
+				}
+				q.replayed(n)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(q.done)
+	}()
+}
+
+// drain stops accepting new notifications and keeps delivering the queued ones
+// until the queue is empty or the grace period runs out, starting with the
+// summaries of what the rate limit held back. Whatever could not be
+// delivered by then is written to the outbox.
+func (q *notificationQueue) drain(grace time.Duration) {
+	for _, n := range throttle.summaries(time.Now().UTC(), true) {
+		q.enqueue(n)
+	}
+
+	q.mu.Lock()
+	q.closed = true
+	q.ready.Broadcast()
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+	case <-time.After(grace):
+		log.Printf("Grace period of %s expired with notifications still queued\n", grace)
+	}
+	q.cancel()
+
+	q.mu.Lock()
+	q.aborted = true
+	undelivered := append(q.kept, q.items...)
+	for n := range q.inFlight {
+		// The request may still succeed after we exit; delivering it twice
+		// is better than not at all.
+		undelivered = append(undelivered, n)
+	}
+	q.items = nil
+	q.mu.Unlock()
+
+	if len(undelivered) == 0 {
+		q.mu.Lock()
+		if len(q.replaying) > 0 {
+			q.clearOutboxLocked()
+		}
+		q.mu.Unlock()
+		log.Println("Notification queue drained.")
+		return
+	}
+
+	if stateless {
+		log.Printf("Dropping %d undelivered notifications: stateless mode has no outbox.\n", len(undelivered))
+		return
+	}
+
+	if err := saveState(outboxFile, undelivered); err != nil {
+		log.Printf("Error persisting %d undelivered notifications: %v\n", len(undelivered), err)
+		return
+	}
+	log.Printf("Persisted %d undelivered notifications to the outbox.\n", len(undelivered))
+}
+
+// replayOutbox queues notifications left over from a previous run.
+func (q *notificationQueue) replayOutbox() {
+	var undelivered []*Notification
+	found, err := loadState(outboxFile, &undelivered)
+	if err != nil {
+		log.Printf("Error loading outbox: %v\n", err)
+		return
+	}
+	if !found {
+		return
+	}
+	if len(undelivered) == 0 {
+		q.mu.Lock()
+		q.clearOutboxLocked()
+		q.mu.Unlock()
+		return
+	}
+
+	log.Printf("Replaying %d notifications from the outbox.\n", len(undelivered))
+	q.mu.Lock()
+	for _, n := range undelivered {
+		q.replaying[n] = true
+	}
+	q.mu.Unlock()
+	for _, n := range undelivered {
+		q.enqueue(n)
+	}
+}
+
+// replayed marks n as done with, once it was delivered or handed to the
+// redelivery store, and removes the outbox after the last replayed one.
+// While draining the outbox is left to drain, which writes it again.
+func (q *notificationQueue) replayed(n *Notification) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.replaying[n] {
+		return
+	}
+	delete(q.replaying, n)
+	if len(q.replaying) == 0 && !q.closed {
+		q.clearOutboxLocked()
+	}
+}
+
+// clearOutboxLocked removes the outbox once what it held was replayed.
+func (q *notificationQueue) clearOutboxLocked() {
+	q.replaying = make(map[*Notification]bool)
+	if err := removeState(outboxFile); err != nil {
+		log.Printf("Error clearing outbox: %v\n", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is assumed when a 429 response carries no usable
+// Retry-After header.
+const defaultRetryAfter = 30 * time.Second
+
+var rateLimitedTotal = metrics.newCounter("sefi_rate_limited_total",
+	"Responses with status 429 (Too Many Requests), by target.", "target")
+
+// rateLimitedError is returned for 429 responses. RetryAfter is how long the
+// server asked us to wait.
+type rateLimitedError struct {
+	Target     string
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s rate limited the request, retry after %s", e.Target, e.RetryAfter)
+}
+
+func newRateLimitedError(target string, resp *http.Response) *rateLimitedError {
+	rateLimitedTotal.inc(target)
+	return &rateLimitedError{
+		Target:     target,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter understands both forms of the header: a number of seconds
+// and an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return defaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return defaultRetryAfter
+}
+
+// rateLimitGate holds back calls to a target until its Retry-After has
+// passed.
+type rateLimitGate struct {
+	name string
+
+	mu       sync.Mutex
+	notUntil time.Time
+}
+
+var (
+	sysdigRateLimit = &rateLimitGate{name: "Sysdig API"}
+	slackRateLimit  = &rateLimitGate{name: "Slack"}
+)
+
+func (g *rateLimitGate) delay(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(g.notUntil) {
+		g.notUntil = until
+		log.Printf("%s asked us to back off, holding requests until %s\n", g.name, until.UTC().Format(time.RFC3339))
+	}
+}
+
+// remaining returns how long calls still have to wait.
+func (g *rateLimitGate) remaining() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return max(time.Until(g.notUntil), 0)
+}
+
+// wait blocks until the gate opens or ctx is done.
+func (g *rateLimitGate) wait(ctx context.Context) error {
+	d := g.remaining()
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// deliverToSlack delivers n once Slack's Retry-After has passed, retrying a
+// rate-limited delivery up to three times.
+func deliverToSlack(ctx context.Context, n *Notification) error {
+	for attempt := 1; ; attempt++ {
+		if err := slackRateLimit.wait(ctx); err != nil {
+			return err
+		}
+
+		err := sendThreaded(ctx, n)
+		var rl *rateLimitedError
+		if !errors.As(err, &rl) || attempt >= 3 {
+			return err
+		}
+		slackRateLimit.delay(rl.RetryAfter)
+	}
+}
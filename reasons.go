@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/jcotoBan/SEFI-Alarm/notify"
+)
+
+// Reason codes say why an alert was sent, for automation consuming the event
+// correlation events, workflow webhooks and Slack message metadata, which
+// shouldn't have to parse the human-readable text.
+const (
+	// reasonThresholdExceeded: an integration has new forwarding errors.
+	reasonThresholdExceeded = "THRESHOLD_EXCEEDED"
+	// reasonFeedStale: the Sysdig API can't be read, so the error feed is no
+	// longer current and silence doesn't mean the integrations are healthy.
+	reasonFeedStale = "FEED_STALE"
+	// reasonPollerDegraded: SEFI-Alarm itself is impaired, e.g. its circuit
+	// breaker opened, it crashed or a second instance polls the same
+	// integrations.
+	reasonPollerDegraded = "POLLER_DEGRADED"
+	// reasonProbeFailed: a synthetic test event sent through an integration
+	// failed to be forwarded.
+	reasonProbeFailed = "PROBE_FAILED"
+	// reasonEscalated: an alert went unacknowledged for the time set by an
+	// escalation step.
+	reasonEscalated = "ESCALATED"
+	// reasonRecovered: a condition alerted on earlier has cleared.
+	reasonRecovered = "RECOVERED"
+	// reasonRateLimited: notifications were held back by the outbound rate
+	// limit, and are summed up instead.
+	reasonRateLimited = "RATE_LIMITED"
+)
+
+type SlackMetadata = notify.SlackMetadata
+
+func slackMetadata(n *Notification) *SlackMetadata {
+	if n.Reason == "" {
+		return nil
+	}
+	payload := map[string]string{"reason": n.Reason}
+	if n.IntegrationID != 0 {
+		payload["integration_id"] = strconv.Itoa(n.IntegrationID)
+	}
+	return &SlackMetadata{EventType: "sefi_alarm_alert", EventPayload: payload}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const redeliveryFile = "redelivery.json"
+
+// A notification that fails to deliver is retried with exponential backoff,
+// from notificationRetry.initialBackoffSecs up to maxBackoffSecs between
+// attempts, or after the wait a rate limited destination asked for. The
+// retries are kept in the state directory, so they survive restarts, and
+// given up once the notification is older than notificationRetry.maxAgeMins;
+// 0 drops failed notifications right away.
+var (
+	redeliveryMaxAge         = time.Duration(conf.Int("notificationRetry.maxAgeMins", 24*60)) * time.Minute
+	redeliveryInitialBackoff = time.Duration(conf.Int("notificationRetry.initialBackoffSecs", 30)) * time.Second
+	redeliveryMaxBackoff     = time.Duration(conf.Int("notificationRetry.maxBackoffSecs", 30*60)) * time.Second
+)
+
+var (
+	redeliveriesTotal = metrics.newCounter("sefi_notification_retries_total",
+		"Failed notifications scheduled for another attempt or given up on, by result.", "result")
+	redeliveriesPending = metrics.newGauge("sefi_notification_retries_pending",
+		"Failed notifications waiting for another attempt.")
+)
+
+type redelivery struct {
+	Notification *Notification `json:"notification"`
+	NextAt       time.Time     `json:"nextAt"`
+}
+
+type redeliveryQueue struct {
+	mu      sync.Mutex
+	Pending []*redelivery `json:"pending"`
+}
+
+var redeliveries = loadRedeliveryQueue()
+
+func loadRedeliveryQueue() *redeliveryQueue {
+	r := &redeliveryQueue{}
+	if _, err := loadState(redeliveryFile, r); err != nil {
+		log.Printf("Error loading notification retries: %v\n", err)
+	}
+	redeliveriesPending.set(float64(len(r.Pending)))
+	return r
+}
+
+func (r *redeliveryQueue) reload() {
+	fresh := loadRedeliveryQueue()
+	r.mu.Lock()
+	r.Pending = fresh.Pending
+	r.mu.Unlock()
+}
+
+func (r *redeliveryQueue) saveLocked() {
+	redeliveriesPending.set(float64(len(r.Pending)))
+	if err := saveState(redeliveryFile, r); err != nil {
+		log.Printf("Error saving notification retries: %v\n", err)
+	}
+}
+
+// failed schedules the next attempt at n after err, unless n is too old.
+func (r *redeliveryQueue) failed(n *Notification, err error, now time.Time) {
+	n.Attempts++
+	queuedAt := n.QueuedAt
+	if queuedAt.IsZero() {
+		queuedAt = now
+	}
+	if now.Sub(queuedAt) >= redeliveryMaxAge {
+		if redeliveryMaxAge > 0 {
+			log.Printf("Giving up on %s notification for integration %d after %d attempts over %s\n",
+				notifierName(n), n.IntegrationID, n.Attempts, formatDuration(now.Sub(queuedAt)))
+		}
+		redeliveriesTotal.inc("expired")
+		return
+	}
+
+	wait := redeliveryBackoff(n.Attempts)
+	var rl *rateLimitedError
+	if errors.As(err, &rl) && rl.RetryAfter > wait {
+		wait = rl.RetryAfter
+	}
+	log.Printf("Retrying %s notification for integration %d in %s\n", notifierName(n), n.IntegrationID, formatDuration(wait))
+	redeliveriesTotal.inc("scheduled")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Pending = append(r.Pending, &redelivery{Notification: n, NextAt: now.Add(wait)})
+	r.saveLocked()
+}
+
+// redeliveryBackoff returns the wait after failed attempt number attempt
+// (starting at 1).
+func redeliveryBackoff(attempt int) time.Duration {
+	wait := redeliveryInitialBackoff << (attempt - 1)
+	if wait > redeliveryMaxBackoff || wait <= 0 {
+		wait = redeliveryMaxBackoff
+	}
+	return wait
+}
+
+// due removes and returns the notifications whose next attempt is due, in
+// the order they were first queued.
+func (r *redeliveryQueue) due(now time.Time) []*Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []*Notification
+	kept := r.Pending[:0]
+	for _, p := range r.Pending {
+		if p.NextAt.After(now) {
+			kept = append(kept, p)
+		} else {
+			due = append(due, p.Notification)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	r.Pending = kept
+	r.saveLocked()
+	sort.SliceStable(due, func(i, j int) bool { return due[i].QueuedAt.Before(due[j].QueuedAt) })
+	return due
+}
+
+// redeliveryLoop hands the notifications due for another attempt back to
+// the queue.
+func redeliveryLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if role.isStandby() {
+				continue
+			}
+			for _, n := range redeliveries.due(time.Now().UTC()) {
+				notifications.enqueue(n)
+			}
+		}
+	}
+}
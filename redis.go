@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With storage.backend: redis the documents are Redis strings named
+// storage.redis.keyPrefix + name, so replicas in several clusters can share
+// one state. Each new error is also claimed there before it alerts (SET NX),
+// so two active replicas polling the same integrations notify it once.
+var (
+	storageRedisAddress  = conf.String("storage.redis.address", "")
+	storageRedisUsername = conf.String("storage.redis.username", "")
+	storageRedisPassword = conf.String("storage.redis.password", "")
+	storageRedisDB       = conf.Int("storage.redis.db", 0)
+	storageRedisPrefix   = conf.String("storage.redis.keyPrefix", "sefi-alarm:")
+	storageRedisTLS      = conf.Bool("storage.redis.tls", false)
+)
+
+// claimTTL outlives the one-minute window an error is considered new in, so
+// a replica polling late still finds the claim.
+const claimTTL = 15 * time.Minute
+
+const claimsDir = "claims"
+
+var errorClaims = metrics.newCounter("sefi_error_claims_total",
+	"New errors claimed in the shared store before alerting, by result.", "result")
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient speaks enough RESP for the store over a single connection,
+// opened on first use and again after a network error.
+type redisClient struct {
+	address  string
+	username string
+	password string
+	db       int
+	tls      bool
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisClient) connectLocked() error {
+	dialer := &net.Dialer{Timeout: httpConnectTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		config, cfgErr := newTLSConfig()
+		if cfgErr != nil {
+			return cfgErr
+		}
+		host, _, _ := net.SplitHostPort(c.address)
+		config.ServerName = host
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", c.address, err)
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := c.roundTripLocked(args); err != nil {
+			c.closeLocked()
+			return fmt.Errorf("failed to authenticate: %v", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTripLocked([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.closeLocked()
+			return fmt.Errorf("failed to select database %d: %v", c.db, err)
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn, c.reader = nil, nil
+}
+
+// do sends one command and returns its reply: a string, an int64, []byte
+// (nil for a missing key) or []interface{}.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTripLocked(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state after a network error.
+		c.closeLocked()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTripLocked(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(remoteStoreTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", line)
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// redisStore keeps the documents in Redis.
+type redisStore struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisStore() *redisStore {
+	return &redisStore{
+		client: &redisClient{
+			address:  storageRedisAddress,
+			username: storageRedisUsername,
+			password: storageRedisPassword,
+			db:       storageRedisDB,
+			tls:      storageRedisTLS,
+		},
+		prefix: storageRedisPrefix,
+	}
+}
+
+func (s *redisStore) get(name string) ([]byte, error) {
+	reply, err := s.client.do("GET", s.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET %s: %v", name, reply)
+	}
+	if data == nil {
+		return nil, errStateNotFound
+	}
+	return data, nil
+}
+
+func (s *redisStore) put(name string, data []byte) error {
+	_, err := s.client.do("SET", s.prefix+name, string(data))
+	return err
+}
+
+func (s *redisStore) remove(name string) error {
+	_, err := s.client.do("DEL", s.prefix+name)
+	return err
+}
+
+// list scans for the keys under dir. Redis has no directories, so deeper
+// names are filtered out.
+func (s *redisStore) list(dir string) ([]string, error) {
+	pattern := redisGlobEscaper.Replace(s.prefix+dir) + "/*"
+	var names []string
+	cursor := "0"
+	for {
+		reply, err := s.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected reply to SCAN: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			k, _ := key.([]byte)
+			name := strings.TrimPrefix(string(k), s.prefix)
+			if path.Dir(name) == dir {
+				names = append(names, name)
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// historyDSN keeps the history in memory, as with the remote backend.
+func (s *redisStore) historyDSN() string {
+	return "file:sefi-history?mode=memory&cache=shared"
+}
+
+// claim sets name unless it exists, reporting whether this call set it.
+func (s *redisStore) claim(name string, ttl time.Duration) (bool, error) {
+	reply, err := s.client.do("SET", s.prefix+name, instanceID, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// claimNew drops the errors another replica sharing the store already
+// claimed. Without a Redis store every error is kept, and so is every error
+// when Redis can't be reached: a duplicate alert beats a missed one.
+func claimNew(integrationID int, errs []ErrorLog) []ErrorLog {
+	store, ok := state.(*redisStore)
+	if !ok {
+		return errs
+	}
+	kept := errs[:0:0]
+	for _, e := range errs {
+		name := path.Join(claimsDir, strconv.Itoa(integrationID), errorFingerprint(integrationID, e.Error)+"-"+e.Timestamp)
+		won, err := store.claim(name, claimTTL)
+		if err != nil {
+			log.Printf("Error claiming a new error of integration %d, alerting anyway: %v\n", integrationID, err)
+			errorClaims.inc("error")
+			kept = append(kept, e)
+			continue
+		}
+		if !won {
+			errorClaims.inc("lost")
+			continue
+		}
+		errorClaims.inc("won")
+		kept = append(kept, e)
+	}
+	return kept
+}
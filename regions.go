@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jcotoBan/SEFI-Alarm/sysdig"
+)
+
+// sysdigRegion holds the base URLs of a Sysdig SaaS region or install, see
+// sysdig.Region.
+type sysdigRegion = sysdig.Region
+
+// builtinRegions are the Sysdig SaaS regions. More can be declared under
+// regions in config.yaml, each with an apiUrl and an optional uiUrl, and
+// region: custom reads them from customRegion for a single on-prem install.
+var builtinRegions = sysdig.Regions
+
+func setIntegrationUrl(region string) string {
+	return lookupRegion(region).UIBase + sysdig.IntegrationPath
+}
+
+func lookupRegion(name string) sysdigRegion {
+	switch name {
+	case "":
+		// Reported with the other required settings.
+		return sysdigRegion{}
+	case "custom":
+		return configuredRegion("customRegion")
+	}
+	if _, ok := conf.Lookup("regions." + name); ok {
+		return configuredRegion("regions." + name)
+	}
+	if region, ok := builtinRegions[name]; ok {
+		return region
+	}
+	addConfigProblem("region %q is unknown, use one of %s or custom", name, strings.Join(regionNames(), ", "))
+	return sysdigRegion{}
+}
+
+// configuredRegion reads a region declared in config.yaml under section. The
+// UI is assumed to live on the API host unless uiUrl says otherwise.
+func configuredRegion(section string) sysdigRegion {
+	apiBase := regionBaseURL(section + ".apiUrl")
+	uiBase := apiBase
+	if conf.String(section+".uiUrl", "") != "" {
+		uiBase = regionBaseURL(section + ".uiUrl")
+	}
+	return sysdigRegion{APIBase: apiBase, UIBase: uiBase}
+}
+
+func regionBaseURL(key string) string {
+	base := strings.TrimRight(conf.String(key, ""), "/")
+	if base == "" {
+		addConfigProblem("%s is not set", key)
+		return ""
+	}
+	if u, err := url.Parse(base); err != nil || u.Scheme == "" || u.Host == "" {
+		addConfigProblem("%s must be an absolute URL such as https://sysdig.example.com, got %q", key, base)
+		return ""
+	}
+	return base
+}
+
+func regionNames() []string {
+	names := make([]string, 0, len(builtinRegions))
+	for name := range builtinRegions {
+		names = append(names, name)
+	}
+	if v, ok := conf.Lookup("regions"); ok {
+		if section, ok := asSection(v); ok {
+			for name := range section {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Metrics can be pushed to a Prometheus remote-write endpoint (Mimir, Thanos
+// Receive, VictoriaMetrics, ...) so dashboards don't need to scrape us.
+var (
+	remoteWriteURL      = conf.String("remoteWrite.url", "")
+	remoteWriteInterval = time.Duration(conf.Int("remoteWrite.intervalSecs", 60)) * time.Second
+	remoteWriteUsername = conf.String("remoteWrite.username", "")
+	remoteWritePassword = conf.String("remoteWrite.password", "")
+	remoteWriteToken    = conf.String("remoteWrite.bearerToken", "")
+	remoteWriteHeaders  = conf.StringMap("remoteWrite.headers")
+)
+
+func remoteWriteLoop(ctx context.Context) {
+	if remoteWriteURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(remoteWriteInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := pushRemoteWrite(ctx, withPodLabels(metrics.samples()), now); err != nil {
+				log.Printf("Error pushing metrics via remote-write: %v\n", err)
+			}
+		}
+	}
+}
+
+func pushRemoteWrite(ctx context.Context, samples []metricSample, now time.Time) error {
+	body := snappy.Encode(nil, encodeWriteRequest(samples, now.UnixMilli()))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range remoteWriteHeaders {
+		req.Header.Set(name, value)
+	}
+	if remoteWriteToken != "" {
+		req.Header.Set("Authorization", "Bearer "+remoteWriteToken)
+	} else if remoteWriteUsername != "" {
+		req.SetBasicAuth(remoteWriteUsername, remoteWritePassword)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("remote-write failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// encodeWriteRequest hand-encodes a prometheus.WriteRequest protobuf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []metricSample, timestampMs int64) []byte {
+	var request []byte
+	for _, s := range samples {
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		// Remote-write receivers require labels sorted by name.
+		sort.Strings(names)
+
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = appendProtoBytes(label, 1, []byte(name))
+			label = appendProtoBytes(label, 2, []byte(s.labels[name]))
+			series = appendProtoBytes(series, 1, label)
+		}
+
+		var sample []byte
+		sample = binary.AppendUvarint(sample, 1<<3|1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.value))
+		sample = binary.AppendUvarint(sample, 2<<3|0)
+		sample = binary.AppendUvarint(sample, uint64(timestampMs))
+		series = appendProtoBytes(series, 2, sample)
+
+		request = appendProtoBytes(request, 1, series)
+	}
+	return request
+}
+
+// appendProtoBytes appends a length-delimited field.
+func appendProtoBytes(buf []byte, field int, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
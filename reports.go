@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcotoBan/SEFI-Alarm/schedule"
+)
+
+const ownerReportsFile = "owner-reports.json"
+
+// With ownerReports.enabled, each team in the owners directory is emailed a
+// summary of its own integrations' forwarding health from the error
+// history, every Monday (UTC) or every day, depending on
+// ownerReports.interval. Reports go to the email addresses of the team's
+// owner entries, through the SMTP server under smtp; teams without an
+// address are skipped.
+var (
+	ownerReportsEnabled  = conf.Bool("ownerReports.enabled", false)
+	ownerReportsInterval = conf.String("ownerReports.interval", "weekly")
+
+	smtpHost     = conf.String("smtp.host", "")
+	smtpPort     = conf.Int("smtp.port", 587)
+	smtpUsername = conf.String("smtp.username", "")
+	smtpPassword = conf.String("smtp.password", "")
+	smtpFrom     = conf.String("smtp.from", "")
+)
+
+var ownerReportsSent = metrics.newCounter("sefi_owner_reports_total",
+	"Owner reports emailed, by result.", "result")
+
+// ownerReportSchedule is when the reports are sent: every midnight, or every
+// Monday midnight.
+func ownerReportSchedule() schedule.Period {
+	if ownerReportsInterval == "daily" {
+		return schedule.Daily
+	}
+	return schedule.Weekly
+}
+
+// ownerReportPeriod is the span each report covers.
+func ownerReportPeriod() time.Duration {
+	return ownerReportSchedule().Length()
+}
+
+// reportLog remembers when the reports were last sent, so a restart or a
+// promoted standby doesn't send them twice.
+type reportLog struct {
+	mu       sync.Mutex
+	LastSent time.Time `json:"lastSent"`
+}
+
+var ownerReports = loadReportLog()
+
+func loadReportLog() *reportLog {
+	r := &reportLog{}
+	if _, err := loadState(ownerReportsFile, r); err != nil {
+		log.Printf("Error loading owner report state: %v\n", err)
+	}
+	return r
+}
+
+func (r *reportLog) reload() {
+	fresh := loadReportLog()
+	r.mu.Lock()
+	r.LastSent = fresh.LastSent
+	r.mu.Unlock()
+}
+
+func (r *reportLog) lastSent() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.LastSent
+}
+
+func (r *reportLog) sent(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.LastSent = at
+	if err := saveState(ownerReportsFile, r); err != nil {
+		log.Printf("Error saving owner report state: %v\n", err)
+	}
+}
+
+// teamReport is the report of one team.
+type teamReport struct {
+	Team         string
+	To           []string
+	Since, Until time.Time
+	Integrations []*IntegrationStats
+}
+
+// buildOwnerReports sums up the history between since and until for each
+// team that owns integrations, by team name.
+func buildOwnerReports(since, until time.Time) ([]*teamReport, error) {
+	stats, err := history.stats(since, "")
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*IntegrationStats, len(stats))
+	for _, s := range stats {
+		byID[s.IntegrationID] = s
+	}
+
+	byTeam := make(map[string]*teamReport)
+	for _, entry := range owners.list() {
+		report, ok := byTeam[entry.Team]
+		if !ok {
+			report = &teamReport{Team: entry.Team, Since: since, Until: until}
+			byTeam[entry.Team] = report
+		}
+		for _, address := range entry.Email {
+			if !containsString(report.To, address) {
+				report.To = append(report.To, address)
+			}
+		}
+		s, ok := byID[entry.IntegrationID]
+		if !ok {
+			s = &IntegrationStats{IntegrationID: entry.IntegrationID, Categories: map[string]int{}}
+			if in, ok := integrationMeta.get(entry.IntegrationID); ok {
+				s.IntegrationName = in.Name
+			}
+		}
+		report.Integrations = append(report.Integrations, s)
+	}
+
+	out := make([]*teamReport, 0, len(byTeam))
+	for _, report := range byTeam {
+		sort.Slice(report.Integrations, func(i, j int) bool {
+			a, b := report.Integrations[i], report.Integrations[j]
+			if a.Errors != b.Errors {
+				return a.Errors > b.Errors
+			}
+			return a.IntegrationID < b.IntegrationID
+		})
+		out = append(out, report)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Team < out[j].Team })
+	return out, nil
+}
+
+func (r *teamReport) subject() string {
+	return fmt.Sprintf("SEFI-Alarm %s report for %s", ownerReportsInterval, r.Team)
+}
+
+func (r *teamReport) body() string {
+	days := int(r.Until.Sub(r.Since).Round(24*time.Hour) / (24 * time.Hour))
+	var b strings.Builder
+	fmt.Fprintf(&b, "Forwarding health of the Sysdig integrations owned by %s, from %s to %s.\n",
+		r.Team, formatTimestamp(r.Since), formatTimestamp(r.Until))
+
+	failing := 0
+	for _, s := range r.Integrations {
+		if s.Errors > 0 {
+			failing++
+		}
+	}
+	fmt.Fprintf(&b, "%d of %d integrations had forwarding errors.\n", failing, len(r.Integrations))
+
+	for _, s := range r.Integrations {
+		label := strconv.Itoa(s.IntegrationID)
+		if s.IntegrationName != "" {
+			label = fmt.Sprintf("%s (%d)", s.IntegrationName, s.IntegrationID)
+		}
+		fmt.Fprintf(&b, "\n%s\n", label)
+		if s.Errors == 0 {
+			b.WriteString("  No forwarding errors.\n")
+		} else {
+			fmt.Fprintf(&b, "  Errors: %s, on %d of %d days (%s)\n", formatCount(int64(s.Errors)), s.DaysWithErrors, days, formatCategoryCounts(s.Categories))
+			fmt.Fprintf(&b, "  Last error: %s\n", formatTimestamp(*s.LastAt))
+		}
+		if s.Notifications > 0 {
+			fmt.Fprintf(&b, "  Alerts: %d sent, %d not delivered\n", s.Notifications, s.FailedNotifications)
+		}
+	}
+	if integrationURL != "" {
+		fmt.Fprintf(&b, "\nIntegrations: %s\n", integrationURL)
+	}
+	fmt.Fprintf(&b, "\nSent by SEFI-Alarm instance %s.\n", instanceID)
+	return b.String()
+}
+
+// sendEmail sends a plain text email through the SMTP server, with STARTTLS
+// when the server offers it.
+func sendEmail(to []string, subject, body string) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
+	}
+	address := net.JoinHostPort(smtpHost, strconv.Itoa(smtpPort))
+	if err := smtp.SendMail(address, auth, smtpFrom, to, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// sendOwnerReports emails each team its report for the period ending at
+// until.
+func sendOwnerReports(until time.Time) {
+	reports, err := buildOwnerReports(until.Add(-ownerReportPeriod()), until)
+	if err != nil {
+		log.Printf("Error building owner reports: %v\n", err)
+		ownerReportsSent.inc("failure")
+		return
+	}
+	for _, report := range reports {
+		if len(report.To) == 0 {
+			continue
+		}
+		body := report.body()
+		if templated, ok := templatedSummary(report.subject(), body, "email"); ok {
+			body = templated
+		}
+		if err := sendEmail(report.To, report.subject(), body); err != nil {
+			log.Printf("Error emailing the owner report of %s: %v\n", report.Team, err)
+			ownerReportsSent.inc("failure")
+			continue
+		}
+		ownerReportsSent.inc("success")
+	}
+}
+
+func checkOwnerReportConfig() error {
+	if ownerReportsInterval != "weekly" && ownerReportsInterval != "daily" {
+		return fmt.Errorf("ownerReports.interval must be weekly or daily, got %q", ownerReportsInterval)
+	}
+	if smtpHost == "" || smtpFrom == "" {
+		return fmt.Errorf("smtp.host and smtp.from must be set to email owner reports")
+	}
+	return nil
+}
+
+// ownerReportLoop sends the owner reports at every report boundary.
+func ownerReportLoop(ctx context.Context) {
+	if !ownerReportsEnabled {
+		return
+	}
+	if err := checkOwnerReportConfig(); err != nil {
+		log.Fatalf("ownerReports is enabled in config.yaml, but: %v", err)
+	}
+
+	schedule.Run(ctx, ownerReportSchedule(), func(next time.Time) {
+		if role.isStandby() || !ownerReports.lastSent().Before(next) {
+			return
+		}
+		// A team whose report failed is not retried before the next
+		// boundary, so the others don't get theirs twice.
+		sendOwnerReports(next)
+		ownerReports.sent(next)
+	})
+}
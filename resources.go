@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// resourceTuning sizes the process for the container or host it runs in.
+// Limits come from the cgroup (v2, then v1) and fall back to the host; every
+// derived value can be overridden under resources: in the config. The
+// GOMAXPROCS, GOGC and GOMEMLIMIT environment variables are honoured when set
+// and the config doesn't say otherwise.
+type resourceTuning struct {
+	cpus        float64
+	memoryLimit int64 // bytes, 0 when unlimited
+
+	notificationWorkers int
+	destinationWorkers  int
+	queueSize           int
+	gcPercent           int // -1 turns the collector off, like GOGC=off
+	maxProcs            int
+	softMemoryLimit     int64 // bytes, 0 for none
+}
+
+var tuning = detectResources()
+
+func detectResources() resourceTuning {
+	t := resourceTuning{cpus: float64(runtime.NumCPU())}
+	if quota, ok := cgroupCPUQuota(); ok && quota < t.cpus {
+		t.cpus = quota
+	}
+	t.memoryLimit = cgroupMemoryLimit()
+
+	// Delivery is I/O bound, so a couple of workers per CPU is plenty.
+	t.notificationWorkers = clamp(int(math.Ceil(t.cpus))*2, 1, 16)
+
+	// Leave most of a small memory limit to the rest of the process: one
+	// queued notification per 256KiB, between 50 and 5000.
+	t.queueSize = 1000
+	if t.memoryLimit > 0 {
+		t.queueSize = clamp(int(t.memoryLimit/(256<<10)), 50, 5000)
+	}
+	if strconv.IntSize == 32 {
+		// 32-bit ARM and 386 boards have little address space to spare.
+		t.queueSize = min(t.queueSize, 500)
+	}
+
+	// Collect more eagerly when memory is tight.
+	t.gcPercent = 100
+	if t.memoryLimit > 0 && t.memoryLimit <= 256<<20 {
+		t.gcPercent = 50
+	}
+	if gogc, ok := os.LookupEnv("GOGC"); ok {
+		if gogc == "off" {
+			t.gcPercent = -1
+		} else if n, err := strconv.Atoi(gogc); err == nil {
+			t.gcPercent = n
+		}
+	}
+
+	// Like automaxprocs: one thread per whole CPU of the quota, so a
+	// fractional quota isn't spread over every core of the node and throttled.
+	t.maxProcs = max(1, int(math.Floor(t.cpus)))
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		t.maxProcs = runtime.GOMAXPROCS(0)
+	}
+
+	// Start collecting hard before the container is OOM-killed, keeping 10%
+	// of the limit for what the Go runtime doesn't account for.
+	if t.memoryLimit > 0 {
+		t.softMemoryLimit = t.memoryLimit / 10 * 9
+	}
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); ok {
+		t.softMemoryLimit = debug.SetMemoryLimit(-1)
+	}
+
+	if workers := conf.Int("resources.notificationWorkers", t.notificationWorkers); workers >= 1 {
+		t.notificationWorkers = workers
+	} else {
+		addConfigProblem("resources.notificationWorkers must be at least 1, got %d", workers)
+	}
+	// Half the workers per destination leaves the other half to the rest
+	// while one destination is slow.
+	t.destinationWorkers = conf.Int("resources.destinationWorkers", max(1, t.notificationWorkers/2))
+	if size := conf.Int("resources.queueSize", t.queueSize); size >= 1 {
+		t.queueSize = size
+	} else {
+		addConfigProblem("resources.queueSize must be at least 1, got %d", size)
+	}
+	t.gcPercent = conf.Int("resources.gcPercent", t.gcPercent)
+	t.maxProcs = conf.Int("resources.maxProcs", t.maxProcs)
+	if mb := conf.Int("resources.memoryLimitMB", -1); mb >= 0 {
+		t.softMemoryLimit = int64(mb) << 20
+	}
+	return t
+}
+
+// apply sets the runtime knobs and logs what was chosen.
+func (t resourceTuning) apply() {
+	debug.SetGCPercent(t.gcPercent)
+	runtime.GOMAXPROCS(t.maxProcs)
+	if t.softMemoryLimit > 0 {
+		debug.SetMemoryLimit(t.softMemoryLimit)
+	} else {
+		debug.SetMemoryLimit(math.MaxInt64)
+	}
+
+	memory := "unlimited"
+	if t.memoryLimit > 0 {
+		memory = strconv.FormatInt(t.memoryLimit>>20, 10) + "Mi"
+	}
+	gogc := "off"
+	if t.gcPercent >= 0 {
+		gogc = strconv.Itoa(t.gcPercent)
+	}
+	memLimit := "none"
+	if t.softMemoryLimit > 0 && t.softMemoryLimit < math.MaxInt64 {
+		memLimit = strconv.FormatInt(t.softMemoryLimit>>20, 10) + "MiB"
+	}
+	log.Printf("Resources (%s/%s): %.2f CPUs, %s memory; %d notification workers (%d per destination), queue size %d, GOMAXPROCS %d, GOGC %s, GOMEMLIMIT %s\n",
+		runtime.GOOS, runtime.GOARCH, t.cpus, memory, t.notificationWorkers, t.destinationWorkers, t.queueSize, t.maxProcs, gogc, memLimit)
+}
+
+// cgroupCPUQuota returns the CPU limit in cores, if one is set.
+func cgroupCPUQuota() (float64, bool) {
+	// cgroup v2: "<quota> <period>" or "max <period>"
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period, true
+			}
+		}
+		return 0, false
+	}
+
+	// cgroup v1: a quota of -1 means unlimited.
+	quota, err1 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, err2 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+		return float64(quota) / float64(period), true
+	}
+	return 0, false
+}
+
+// cgroupMemoryLimit returns the memory limit in bytes, or 0 when unlimited.
+func cgroupMemoryLimit() int64 {
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return limit
+	}
+
+	// cgroup v1 reports "unlimited" as a huge page-aligned number.
+	limit, err := readCgroupInt("/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	if err != nil || limit <= 0 || limit >= 1<<62 {
+		return 0
+	}
+	return limit
+}
+
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+var (
+	// maxResponseBytes caps how much of a Sysdig API response is read, so a
+	// pathological payload with millions of errors cannot exhaust memory.
+	maxResponseBytes = int64(conf.Int("http.maxResponseMB", 32)) << 20
+
+	// partialResponses processes the errors that fit in the limit instead of
+	// failing the poll when a response is too large.
+	partialResponses = conf.Bool("http.partialResponses", false)
+)
+
+var truncatedResponsesTotal = metrics.newCounter("sefi_truncated_responses_total",
+	"Sysdig API responses larger than http.maxResponseMB.")
+
+// readLimited reads at most maxResponseBytes from r. truncated reports that
+// the body was longer than that.
+func readLimited(r io.Reader) (body []byte, truncated bool, err error) {
+	body, err = io.ReadAll(io.LimitReader(r, maxResponseBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > maxResponseBytes {
+		return body[:maxResponseBytes], true, nil
+	}
+	return body, false, nil
+}
+
+// decodePartialPayload decodes a payload cut off at the size limit, keeping
+// every error entry that was received completely.
+func decodePartialPayload(body []byte) (*Payload, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("truncated response is not a JSON object")
+	}
+
+	var payload Payload
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+
+		var decodeErr error
+		switch key {
+		case "customerId":
+			decodeErr = dec.Decode(&payload.CustomerID)
+		case "integrationId":
+			decodeErr = dec.Decode(&payload.IntegrationID)
+		case "count":
+			decodeErr = dec.Decode(&payload.Count)
+		case "errors":
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return &payload, nil
+			}
+			for dec.More() {
+				var e ErrorLog
+				if err := dec.Decode(&e); err != nil {
+					return &payload, nil
+				}
+				payload.Errors = append(payload.Errors, e)
+			}
+			_, decodeErr = dec.Token()
+		default:
+			var skip json.RawMessage
+			decodeErr = dec.Decode(&skip)
+		}
+		if decodeErr != nil {
+			break
+		}
+	}
+	return &payload, nil
+}
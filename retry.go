@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// Transient poll failures (network errors and 5xx responses) are retried
+// within the same cycle with exponential backoff and full jitter, capped at
+// retry.maxBackoffSecs per wait.
+var (
+	retryMaxAttempts    = conf.Int("retry.maxAttempts", 4)
+	retryInitialBackoff = time.Duration(conf.Int("retry.initialBackoffSecs", 1)) * time.Second
+	retryMaxBackoff     = time.Duration(conf.Int("retry.maxBackoffSecs", 30)) * time.Second
+)
+
+// retryable reports whether a failed poll is worth retrying within the cycle.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500
+	}
+	var ae *authError
+	if errors.As(err, &ae) {
+		return false
+	}
+	var rl *rateLimitedError
+	if errors.As(err, &rl) {
+		return rl.RetryAfter <= retryMaxBackoff
+	}
+	return !errors.Is(err, errCircuitOpen)
+}
+
+// backoff returns the wait before retry number attempt (starting at 1).
+func backoff(attempt int) time.Duration {
+	limit := retryInitialBackoff << (attempt - 1)
+	if limit > retryMaxBackoff || limit <= 0 {
+		limit = retryMaxBackoff
+	}
+	return time.Duration(rand.Int64N(int64(limit) + 1))
+}
+
+func pollWithRetry(ctx context.Context, integrationID int) (*Payload, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if !sysdigBreaker.allow(time.Now()) {
+			return nil, errCircuitOpen
+		}
+
+		var payload *Payload
+		fetchCtx, span := startSpan(ctx, "fetch errors", spanKindClient)
+		span.set("integration.id", integrationID)
+		span.set("attempt", attempt)
+		payload, err = pollEndpoint(fetchCtx, integrationID, pollQuery(integrationID, time.Now().UTC()))
+		span.finish(err)
+
+		// Rate limiting says nothing about the API's health.
+		var rl *rateLimitedError
+		if ctx.Err() == nil && !errors.As(err, &rl) {
+			sysdigBreaker.record(err, time.Now())
+		} else {
+			sysdigBreaker.inconclusive(time.Now())
+		}
+
+		// A long Retry-After also holds back the following polls.
+		if rl != nil && !retryable(err) {
+			sysdigRateLimit.delay(rl.RetryAfter)
+		}
+
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt >= retryMaxAttempts {
+			return payload, err
+		}
+
+		wait := backoff(attempt)
+		if rl != nil {
+			wait = rl.RetryAfter
+		}
+		log.Printf("Poll attempt %d failed (%v), retrying in %s\n", attempt, err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
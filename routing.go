@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// routingFile names a YAML file of routing rules, kept out of config.yaml so
+// it can be owned and changed separately:
+//
+//	routes:
+//	  - when: 'category == "auth" && name.startsWith("prod-")'
+//	    slackChannel: "#security"
+//	    mentions: ["<!subteam^S123>"]
+//
+// The first route whose condition an error of the alert meets sends it to
+// its Slack channel and mentions, ahead of slackCategoryChannels,
+// slackChannelOverrides, owners and mentions; a route without one of them
+// leaves it to those. Conditions are those of alert conditions. The file is
+// reloaded with config.yaml and when it changes, see hotReload.
+var routingFile = conf.String("routingFile", "")
+
+type routingRule struct {
+	when         *condition
+	slackChannel string
+	mentions     []string
+}
+
+var (
+	routingMu    sync.RWMutex
+	routingRules = loadRoutingRules()
+)
+
+func loadRoutingRules() []routingRule {
+	rules, err := parseRoutingFile(routingFile)
+	if err == nil {
+		err = validateRoutingRules(rules)
+	}
+	if err != nil {
+		addConfigProblem("routingFile %s: %v", routingFile, err)
+		return nil
+	}
+	return rules
+}
+
+func currentRoutingRules() []routingRule {
+	routingMu.RLock()
+	defer routingMu.RUnlock()
+	return routingRules
+}
+
+func setRoutingRules(rules []routingRule) {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+	routingRules = rules
+}
+
+// parseRoutingFile reads the rules at path, none when path is empty.
+func parseRoutingFile(path string) ([]routingRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing rules: %v", err)
+	}
+	var doc struct {
+		Routes []struct {
+			When         string   `yaml:"when"`
+			SlackChannel string   `yaml:"slackChannel"`
+			Mentions     []string `yaml:"mentions"`
+		} `yaml:"routes"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse routing rules: %v", err)
+	}
+	rules := make([]routingRule, 0, len(doc.Routes))
+	for i, route := range doc.Routes {
+		when, err := parseCondition(route.When)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d].when: %v", i, err)
+		}
+		if route.SlackChannel == "" && len(route.Mentions) == 0 {
+			return nil, fmt.Errorf("routes[%d] must set slackChannel or mentions", i)
+		}
+		rules = append(rules, routingRule{when: when, slackChannel: route.SlackChannel, mentions: route.Mentions})
+	}
+	return rules, nil
+}
+
+// validateRoutingRules evaluates every rule against the errors of a sample
+// alert, so a rule comparing a string to a number is caught before it is
+// applied rather than on a real alert.
+func validateRoutingRules(rules []routingRule) error {
+	errors, payload := sampleAlert()
+	vars := conditionVars(payload, len(errors))
+	for i, rule := range rules {
+		for _, err := range errors {
+			vars["error"], vars["category"] = err.Error, err.Category
+			if _, evalErr := rule.when.eval(vars); evalErr != nil {
+				return fmt.Errorf("routes[%d].when fails on a sample alert: %v", i, evalErr)
+			}
+		}
+	}
+	return nil
+}
+
+// route returns the first rule an error of the alert meets.
+func route(errors []ErrorLog, payload *Payload) (routingRule, bool) {
+	rules := currentRoutingRules()
+	if len(rules) == 0 {
+		return routingRule{}, false
+	}
+	vars := conditionVars(payload, len(errors))
+	for i, rule := range rules {
+		for _, err := range errors {
+			vars["error"], vars["category"] = err.Error, err.Category
+			met, evalErr := rule.when.eval(vars)
+			if evalErr != nil {
+				log.Printf("Error evaluating routing rule %d: %v\n", i, evalErr)
+				break
+			}
+			if met {
+				return rule, true
+			}
+		}
+	}
+	return routingRule{}, false
+}
+
+// routedChannel is the Slack channel of an alert on errors.
+func routedChannel(errors []ErrorLog, payload *Payload) string {
+	if rule, ok := route(errors, payload); ok && rule.slackChannel != "" {
+		return rule.slackChannel
+	}
+	return alertChannel(payload.IntegrationID, dominantCategory(errors))
+}
+
+// routedMentions are the Slack mentions of an alert on errors.
+func routedMentions(errors []ErrorLog, payload *Payload) []string {
+	if rule, ok := route(errors, payload); ok && len(rule.mentions) > 0 {
+		return rule.mentions
+	}
+	return mentionsFor(payload.IntegrationID, alertSeverity(errors, payload))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prometheus alerting rules equivalent to the configured alarm, built on the
+// metrics we expose, so Alertmanager-based alerting can run side by side with
+// SEFI-Alarm from the same config.
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string         `yaml:"name"`
+	Rules []alertingRule `yaml:"rules"`
+}
+
+type alertingRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// promDuration renders d in Prometheus duration syntax, rounded up to a full
+// minute since rule windows shorter than that are rarely meaningful.
+func promDuration(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return strconv.Itoa(minutes) + "m"
+}
+
+func prometheusRules() ruleFile {
+	var integrationRules []alertingRule
+	if discoveryEnabled {
+		// The integrations are only known at run time, so one rule covers
+		// every integration not in digest mode, labelled with the one
+		// failing.
+		selector := ""
+		if len(digestIntegrations) > 0 {
+			selector = fmt.Sprintf("integration_id!~%q", strings.Join(digestIntegrations, "|"))
+		}
+		integrationRules = append(integrationRules, newErrorsRule(selector, "{{ $labels.integration_id }}"))
+		for _, id := range digestIntegrations {
+			integrationRules = append(integrationRules, digestRule(id))
+		}
+	} else if n, _ := strconv.Atoi(integrationID); digestMode(n) {
+		integrationRules = append(integrationRules, digestRule(integrationID))
+	} else {
+		integrationRules = append(integrationRules, newErrorsRule(fmt.Sprintf("integration_id=%q", integrationID), integrationID))
+	}
+
+	failedPolls := pollFailureAlertThreshold
+	selfRules := []alertingRule{
+		{
+			Alert:  "SefiPollingFailing",
+			Expr:   fmt.Sprintf(`increase(sefi_polls_total{result="failure"}[%s]) >= %d`, promDuration(time.Duration(failedPolls)*checkInterval), failedPolls),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary": "SEFI-Alarm cannot poll the Sysdig API",
+			},
+		},
+		{
+			Alert:  "SefiCircuitBreakerOpen",
+			Expr:   `sefi_circuit_breaker_state == 1`,
+			For:    "1m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary": "SEFI-Alarm stopped polling the Sysdig API after repeated failures",
+			},
+		},
+		{
+			Alert:  "SefiRateLimited",
+			Expr:   `increase(sefi_rate_limited_total[10m]) > 0`,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": "SEFI-Alarm is being rate limited by {{ $labels.target }}",
+			},
+		},
+	}
+
+	return ruleFile{Groups: []ruleGroup{
+		{Name: "sefi-alarm-integrations", Rules: integrationRules},
+		{Name: "sefi-alarm-self", Rules: selfRules},
+	}}
+}
+
+// newErrorsRule alerts on any new error of the integrations selector picks,
+// over a window that always spans a poll. id is how the summary names the
+// integration.
+func newErrorsRule(selector, id string) alertingRule {
+	window := promDuration(max(2*checkInterval, time.Minute))
+	return alertingRule{
+		Alert:  "SefiIntegrationErrors",
+		Expr:   fmt.Sprintf(`sum by (integration_id) (increase(sefi_integration_errors_total{%s}[%s])) > 0`, selector, window),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary":     fmt.Sprintf("Events forwarding errors on integration %s", id),
+			"description": fmt.Sprintf("{{ $value }} new errors in the last %s. %s%s", window, integrationURL, id),
+		},
+	}
+}
+
+// digestRule alerts on the errors of an integration in digest mode once per
+// digest interval.
+func digestRule(id string) alertingRule {
+	window := "1h"
+	if digestInterval == "daily" {
+		window = "1d"
+	}
+	return alertingRule{
+		Alert:  "SefiIntegrationErrorsDigest",
+		Expr:   fmt.Sprintf(`increase(sefi_integration_errors_total{integration_id=%q}[%s]) > 0`, id, window),
+		Labels: map[string]string{"severity": "info", "integration_id": id},
+		Annotations: map[string]string{
+			"summary":     fmt.Sprintf("Events forwarding errors on integration %s in the last %s", id, window),
+			"description": fmt.Sprintf("{{ $value }} new errors. %s%s", integrationURL, id),
+		},
+	}
+}
+
+func writePrometheusRules(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(prometheusRules()); err != nil {
+		return fmt.Errorf("failed to encode rules: %v", err)
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Integrations listed under sampling.integrations with a rate N keep 1 in N
+// of the new errors of each poll, always including the first and the last
+// of the burst, before anything else looks at them:
+//
+//	sampling:
+//	  integrations:
+//	    12345: 100
+//
+// Alerts on a sampled burst say so, with how many errors it held. Sampling
+// needs features.sampling.
+var samplingRates = loadSamplingRates()
+
+var sampledErrorsTotal = metrics.newCounter("sefi_sampled_errors_total",
+	"New errors dropped by sampling, per integration.", "integration_id")
+
+func loadSamplingRates() map[int]int {
+	rates := make(map[int]int)
+	if !featureEnabled("sampling") {
+		return rates
+	}
+	for key, value := range conf.StringMap("sampling.integrations") {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			addConfigProblem("sampling.integrations is keyed by integration ID, got %q", key)
+			continue
+		}
+		rate, err := strconv.Atoi(value)
+		if err != nil || rate < 1 {
+			addConfigProblem("sampling.integrations.%d must be a positive whole number, got %q", id, value)
+			continue
+		}
+		rates[id] = rate
+	}
+	return rates
+}
+
+// sample is what sampling made of the last burst of an integration.
+type sample struct {
+	Rate int
+	Seen int
+	Kept int
+}
+
+type samplingLog struct {
+	mu   sync.Mutex
+	last map[int]sample
+}
+
+var samples = &samplingLog{last: make(map[int]sample)}
+
+// keep samples the new errors of a poll of integrationID.
+func (s *samplingLog) keep(integrationID int, errs []ErrorLog) []ErrorLog {
+	rate := samplingRates[integrationID]
+	if rate <= 1 || len(errs) == 0 {
+		return errs
+	}
+
+	first, last := 0, 0
+	var firstAt, lastAt time.Time
+	for i, e := range errs {
+		t, err := e.Time()
+		if err != nil {
+			continue
+		}
+		if firstAt.IsZero() || t.Before(firstAt) {
+			first, firstAt = i, t
+		}
+		if lastAt.IsZero() || !t.Before(lastAt) {
+			last, lastAt = i, t
+		}
+	}
+	kept := make([]ErrorLog, 0, len(errs)/rate+2)
+	for i, e := range errs {
+		if i == first || i == last || i%rate == 0 {
+			kept = append(kept, e)
+		}
+	}
+
+	sampledErrorsTotal.add(float64(len(errs)-len(kept)), strconv.Itoa(integrationID))
+	s.mu.Lock()
+	s.last[integrationID] = sample{Rate: rate, Seen: len(errs), Kept: len(kept)}
+	s.mu.Unlock()
+	return kept
+}
+
+// of returns the sampling of the last burst of integrationID, if errors of
+// it were dropped.
+func (s *samplingLog) of(integrationID int) (sample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.last[integrationID]
+	return last, ok && last.Kept < last.Seen
+}
+
+// samplingNote describes the sampling of the last burst of integrationID for
+// alerts, e.g. "1 in 100, 12 of 1,043 errors kept", or is empty when nothing
+// was dropped.
+func samplingNote(integrationID int) string {
+	s, ok := samples.of(integrationID)
+	if !ok {
+		return ""
+	}
+	return "1 in " + formatCount(int64(s.Rate)) + ", " + formatCount(int64(s.Kept)) + " of " + formatCount(int64(s.Seen)) + " errors kept"
+}
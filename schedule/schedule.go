@@ -0,0 +1,71 @@
+// Package schedule runs work at calendar boundaries in UTC, such as every
+// hour or every Monday at midnight.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Period is how often work runs.
+type Period string
+
+const (
+	Hourly Period = "hourly"
+	Daily  Period = "daily"
+	// Weekly runs on Monday at midnight.
+	Weekly Period = "weekly"
+)
+
+// Parse reads a period from its name.
+func Parse(name string) (Period, error) {
+	switch p := Period(name); p {
+	case Hourly, Daily, Weekly:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown period %q, use hourly, daily or weekly", name)
+}
+
+// Length is the span between two boundaries.
+func (p Period) Length() time.Duration {
+	switch p {
+	case Hourly:
+		return time.Hour
+	case Daily:
+		return 24 * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// Next returns the first boundary after t.
+func (p Period) Next(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case Hourly:
+		return t.Truncate(time.Hour).Add(time.Hour)
+	case Daily:
+		return t.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	}
+	day := t.Truncate(24 * time.Hour)
+	days := (8 - int(day.Weekday())) % 7
+	if days == 0 {
+		days = 7
+	}
+	return day.AddDate(0, 0, days)
+}
+
+// Run calls fn with each boundary once it is reached, until ctx is done.
+func Run(ctx context.Context, p Period, fn func(boundary time.Time)) {
+	after := time.Now().UTC()
+	for {
+		next := p.Next(after)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		after = next
+		fn(next)
+	}
+}
@@ -0,0 +1,68 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{"hourly", "daily", "weekly"} {
+		if p, err := Parse(name); err != nil || string(p) != name {
+			t.Errorf("Parse(%q) = %q, %v", name, p, err)
+		}
+	}
+	for _, name := range []string{"", "Hourly", "monthly"} {
+		if _, err := Parse(name); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := map[Period]time.Duration{
+		Hourly: time.Hour,
+		Daily:  24 * time.Hour,
+		Weekly: 7 * 24 * time.Hour,
+	}
+	for p, want := range tests {
+		if got := p.Length(); got != want {
+			t.Errorf("%s.Length() = %s, want %s", p, got, want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2024-05-06 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 5, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		period Period
+		after  time.Time
+		want   time.Time
+	}{
+		{"hourly within the hour", Hourly, at(6, 10, 30), at(6, 11, 0)},
+		{"hourly on the boundary", Hourly, at(6, 10, 0), at(6, 11, 0)},
+		{"hourly across midnight", Hourly, at(6, 23, 59), at(7, 0, 0)},
+		{"daily within the day", Daily, at(6, 10, 30), at(7, 0, 0)},
+		{"daily on the boundary", Daily, at(6, 0, 0), at(7, 0, 0)},
+		{"daily across the month", Daily, time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"weekly on monday midnight", Weekly, at(6, 0, 0), at(13, 0, 0)},
+		{"weekly on monday", Weekly, at(6, 10, 0), at(13, 0, 0)},
+		{"weekly on sunday", Weekly, at(5, 23, 59), at(6, 0, 0)},
+		{"weekly midweek", Weekly, at(8, 12, 0), at(13, 0, 0)},
+		{"other zones are read as UTC", Daily, time.Date(2024, 5, 7, 1, 0, 0, 0, time.FixedZone("CEST", 2*3600)), at(7, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.period.Next(tt.after)
+			if !got.Equal(tt.want) {
+				t.Errorf("%s.Next(%v) = %v, want %v", tt.period, tt.after, got, tt.want)
+			}
+			if got.Location() != time.UTC {
+				t.Errorf("%s.Next(%v) is in %s, want UTC", tt.period, tt.after, got.Location())
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Self-alerts report problems with SEFI-Alarm itself rather than with an
+// integration. They go through the regular notification queue.
+var (
+	pollFailureAlertThreshold = conf.Int("retry.alertAfterFailedPolls", 5)
+	unreachableAlertAfter     = time.Duration(conf.Int("selfMonitor.unreachableAlertMins", 15)) * time.Minute
+)
+
+// pollWatchdog raises a single "cannot reach Sysdig" alert per outage, once
+// retry.alertAfterFailedPolls polls failed in a row or no poll succeeded for
+// selfMonitor.unreachableAlertMins (which also covers polls skipped by the
+// circuit breaker or rate limiting), plus a recovery notice afterwards.
+type pollWatchdog struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	consecutive int
+	lastErr     error
+	alerted     bool
+}
+
+var pollHealth = &pollWatchdog{lastSuccess: time.Now().UTC()}
+
+func (p *pollWatchdog) failed(err error, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.consecutive++
+	p.lastErr = err
+	p.checkLocked(at)
+}
+
+func (p *pollWatchdog) succeeded(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.alerted {
+		sendSelfAlert(at, reasonRecovered, "SEFI-Alarm can reach Sysdig again",
+			fmt.Sprintf("Polling the Sysdig API works again after %s without a successful poll (%d failed polls).",
+				at.Sub(p.lastSuccess).Round(time.Second), p.consecutive))
+	}
+	p.lastSuccess = at
+	p.consecutive = 0
+	p.lastErr = nil
+	p.alerted = false
+}
+
+// reset starts the watchdog over, for an instance that just took over polling.
+func (p *pollWatchdog) reset(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSuccess = at
+	p.consecutive = 0
+	p.lastErr = nil
+	p.alerted = false
+}
+
+// lastSucceeded returns when a poll last succeeded, or the instance took
+// over polling.
+func (p *pollWatchdog) lastSucceeded() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSuccess
+}
+
+func (p *pollWatchdog) check(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkLocked(at)
+}
+
+func (p *pollWatchdog) checkLocked(at time.Time) {
+	if p.alerted {
+		return
+	}
+	down := at.Sub(p.lastSuccess)
+	if p.consecutive < pollFailureAlertThreshold && down < unreachableAlertAfter {
+		return
+	}
+
+	p.alerted = true
+	reason := "no poll was attempted"
+	if p.lastErr != nil {
+		reason = apiErrorKind(p.lastErr) + " error, " + p.lastErr.Error()
+	}
+	sendSelfAlert(at, reasonFeedStale, "SEFI-Alarm cannot reach Sysdig",
+		fmt.Sprintf("No successful poll of the Sysdig API for %s (%s failed polls). Forwarding errors are not being detected, "+
+			"so silence does not mean the integrations are healthy. Check the bearer token, DNS and TLS certificates. Latest error: %s",
+			formatDuration(down), formatCount(int64(p.consecutive)), reason))
+}
+
+// selfMonitorLoop catches outages in which polls don't even fail, e.g. while
+// they are skipped or hang until their timeout.
+func selfMonitorLoop(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !role.isStandby() {
+				pollHealth.check(now.UTC())
+			}
+		}
+	}
+}
+
+// sendSelfAlert notifies about SEFI-Alarm itself, reason being one of the
+// reason codes.
+func sendSelfAlert(at time.Time, reason, title, text string) {
+	log.Printf("%s: %s\n", title, text)
+	blocks := []SlackBlock{
+		{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+		{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+	}
+	if footer, ok := podFooter(); ok {
+		blocks = append(blocks, footer)
+	}
+	notifications.enqueue(&Notification{
+		Message: SlackMessage{
+			Channel: slackChannel,
+			Text:    title + "\n" + text,
+			Blocks:  blocks,
+		},
+		Reason:   reason,
+		QueuedAt: at,
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Alerts carry a severity, decided by the most specific level that sets one:
+//
+//	severity:
+//	  default: warning           # every alert, critical if unset
+//	  tenants:                   # by tenant ID
+//	    "12345": critical
+//	  integrations:              # by integration ID
+//	    "678": info
+//	  categories:                # by the alert's error category
+//	    auth: critical
+//	  routes:                    # the first route whose condition an error meets
+//	    - when: 'error.contains("prod")'
+//	      severity: critical
+//
+// Routes use the expressions of alert conditions, so they can classify by
+// error pattern (error.matches) or count (count > 10). The explain-severity
+// command prints which level decided. "warn" is accepted for warning.
+//
+// Each severity can go to its own notifiers, slack, github and events (event
+// correlation), all of them when not listed:
+//
+//	severity:
+//	  notifiers:
+//	    info: [slack]
+//	    critical: [slack, events, github]
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// notifierSlack names the Slack notifier in config, where the others go by
+// their Notifier value.
+const notifierSlack = "slack"
+
+type severityRoute struct {
+	when     *condition
+	severity string
+}
+
+type severityConfig struct {
+	fallback     string
+	tenants      map[string]string
+	integrations map[string]string
+	categories   map[string]string
+	routes       []severityRoute
+	notifiers    map[string][]string
+}
+
+var severities = loadSeverities()
+
+func loadSeverities() severityConfig {
+	s, err := severitiesFrom(conf)
+	if err != nil {
+		addConfigProblem("severity: %v", err)
+	}
+	return s
+}
+
+func validSeverity(s string) bool {
+	return s == severityInfo || s == severityWarning || s == severityCritical
+}
+
+// normalizeSeverities rewrites the "warn" shorthand in values.
+func normalizeSeverities(values map[string]string) map[string]string {
+	for key, value := range values {
+		if value == "warn" {
+			values[key] = severityWarning
+		}
+	}
+	return values
+}
+
+func normalizeSeverity(s string) string {
+	if s == "warn" {
+		return severityWarning
+	}
+	return s
+}
+
+func severitiesFrom(c configMap) (severityConfig, error) {
+	s := severityConfig{
+		fallback:     normalizeSeverity(c.String("severity.default", severityCritical)),
+		tenants:      normalizeSeverities(c.StringMap("severity.tenants")),
+		integrations: normalizeSeverities(c.StringMap("severity.integrations")),
+		categories:   normalizeSeverities(c.StringMap("severity.categories")),
+		notifiers:    make(map[string][]string),
+	}
+	levels := map[string]map[string]string{"tenants": s.tenants, "integrations": s.integrations, "categories": s.categories}
+	if !validSeverity(s.fallback) {
+		return severityConfig{}, fmt.Errorf("default must be info, warning or critical, got %q", s.fallback)
+	}
+	for level, values := range levels {
+		for key, value := range values {
+			if !validSeverity(value) {
+				return severityConfig{}, fmt.Errorf("%s.%s must be info, warning or critical, got %q", level, key, value)
+			}
+		}
+	}
+
+	if v, ok := c.Lookup("severity.notifiers"); ok {
+		section, ok := asSection(v)
+		if !ok {
+			return severityConfig{}, fmt.Errorf("notifiers must map severities to lists of notifiers")
+		}
+		for severity, value := range section {
+			names := asStringList(value)
+			severity = normalizeSeverity(severity)
+			if !validSeverity(severity) {
+				return severityConfig{}, fmt.Errorf("notifiers: unknown severity %q", severity)
+			}
+			for _, name := range names {
+				if name != notifierSlack && name != notifierGitHub && name != notifierEvents {
+					return severityConfig{}, fmt.Errorf("notifiers.%s: unknown notifier %q, use slack, github or events", severity, name)
+				}
+			}
+			s.notifiers[severity] = names
+		}
+	}
+
+	v, ok := c.Lookup("severity.routes")
+	if !ok {
+		return s, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return severityConfig{}, fmt.Errorf("routes must be a list of when and severity")
+	}
+	for i, item := range list {
+		entry, ok := asSection(item)
+		if !ok {
+			return severityConfig{}, fmt.Errorf("routes[%d] must have when and severity", i)
+		}
+		when, err := parseCondition(configMap(entry).String("when", ""))
+		if err != nil {
+			return severityConfig{}, fmt.Errorf("routes[%d].when: %v", i, err)
+		}
+		severity := normalizeSeverity(configMap(entry).String("severity", ""))
+		if !validSeverity(severity) {
+			return severityConfig{}, fmt.Errorf("routes[%d].severity must be info, warning or critical, got %q", i, severity)
+		}
+		s.routes = append(s.routes, severityRoute{when: when, severity: severity})
+	}
+	return s, nil
+}
+
+// severityLevel is one step of the precedence chain.
+type severityLevel struct {
+	Level    string
+	Severity string // empty when the level doesn't set one
+}
+
+// chain returns every level, from the least to the most specific, for an
+// alert on the errors of payload.
+func (s severityConfig) chain(errors []ErrorLog, payload *Payload) []severityLevel {
+	id := strconv.Itoa(payload.IntegrationID)
+	category := dominantCategory(errors)
+	levels := []severityLevel{
+		{Level: "default", Severity: s.fallback},
+		{Level: "tenant " + tenantID, Severity: s.tenants[tenantID]},
+		{Level: "integration " + id, Severity: s.integrations[id]},
+		{Level: "category " + category, Severity: s.categories[category]},
+	}
+
+	route := severityLevel{Level: "route"}
+	vars := conditionVars(payload, len(errors))
+	for i, r := range s.routes {
+		for _, err := range errors {
+			vars["error"], vars["category"] = err.Error, err.Category
+			met, evalErr := r.when.eval(vars)
+			if evalErr != nil {
+				log.Printf("Error evaluating severity route %d: %v\n", i, evalErr)
+				continue
+			}
+			if met {
+				route = severityLevel{Level: fmt.Sprintf("route %d (%s)", i, r.when.text), Severity: r.severity}
+				break
+			}
+		}
+		if route.Severity != "" {
+			break
+		}
+	}
+	return append(levels, route)
+}
+
+// decide returns the severity of an alert on errors and the level that set it.
+func (s severityConfig) decide(errors []ErrorLog, payload *Payload) (severity, level string) {
+	for _, l := range s.chain(errors, payload) {
+		if l.Severity != "" {
+			severity, level = l.Severity, l.Level
+		}
+	}
+	return severity, level
+}
+
+// notifies reports whether alerts of severity go to notifier.
+func (s severityConfig) notifies(severity, notifier string) bool {
+	names, ok := s.notifiers[severity]
+	return !ok || containsString(names, notifier)
+}
+
+// alertSeverity is the severity of an alert on errors.
+func alertSeverity(errors []ErrorLog, payload *Payload) string {
+	severity, _ := severities.decide(errors, payload)
+	return severity
+}
+
+// explainSeverity prints the precedence chain for an alert on errors.
+func explainSeverity(w io.Writer, errors []ErrorLog, payload *Payload) {
+	severity, decidedBy := severities.decide(errors, payload)
+	for _, l := range severities.chain(errors, payload) {
+		value := l.Severity
+		if value == "" {
+			value = "not set"
+		}
+		marker := " "
+		if l.Level == decidedBy {
+			marker = ">"
+		}
+		fmt.Fprintf(w, "%s %-40s %s\n", marker, l.Level, value)
+	}
+	fmt.Fprintf(w, "Severity %s, decided by %s.\n", severity, decidedBy)
+	if names, ok := severities.notifiers[severity]; ok {
+		fmt.Fprintf(w, "Sent to %s.\n", strings.Join(names, ", "))
+	}
+}
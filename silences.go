@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const silencesFile = "silences.json"
+
+// Silence mutes alerts until it expires. It matches errors by integration,
+// tenant and a regular expression on the error message; each that is set must
+// match. Silenced errors are still counted, archived and recorded in history;
+// only the notifications are skipped.
+type Silence struct {
+	ID            string    `json:"id"`
+	IntegrationID int       `json:"integrationId,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	ErrorPattern  string    `json:"errorPattern,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	By            string    `json:"by,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Until         time.Time `json:"until"`
+
+	pattern *regexp.Regexp
+}
+
+// compile checks the silence has a matcher and prepares its pattern.
+func (s *Silence) compile() error {
+	if s.IntegrationID == 0 && s.Tenant == "" && s.ErrorPattern == "" {
+		return fmt.Errorf("a silence needs an integration, a tenant or an error pattern")
+	}
+	if s.ErrorPattern != "" {
+		pattern, err := regexp.Compile(s.ErrorPattern)
+		if err != nil {
+			return fmt.Errorf("invalid error pattern: %v", err)
+		}
+		s.pattern = pattern
+	}
+	return nil
+}
+
+// coversIntegration reports whether the silence applies to integrationID of
+// this instance's tenant, whatever the errors.
+func (s Silence) coversIntegration(integrationID int) bool {
+	return (s.IntegrationID == 0 || s.IntegrationID == integrationID) && (s.Tenant == "" || s.Tenant == tenantID)
+}
+
+// matches reports whether the silence mutes err on integrationID.
+func (s Silence) matches(integrationID int, err ErrorLog) bool {
+	return s.coversIntegration(integrationID) && (s.pattern == nil || s.pattern.MatchString(err.Error))
+}
+
+// Describe names what the silence matches, for logs and the dashboard.
+func (s Silence) Describe() string {
+	var parts []string
+	if s.IntegrationID != 0 {
+		parts = append(parts, "integration "+strconv.Itoa(s.IntegrationID))
+	}
+	if s.Tenant != "" {
+		parts = append(parts, "tenant "+s.Tenant)
+	}
+	if s.ErrorPattern != "" {
+		parts = append(parts, fmt.Sprintf("errors matching %q", s.ErrorPattern))
+	}
+	return strings.Join(parts, ", ")
+}
+
+type silenceStore struct {
+	mu       sync.Mutex
+	silences []Silence
+}
+
+var silences = loadSilences()
+
+func loadSilences() *silenceStore {
+	s := &silenceStore{}
+	if _, err := loadState(silencesFile, &s.silences); err != nil {
+		log.Printf("Error loading silences: %v\n", err)
+	}
+	s.silences = compileSilences(s.silences)
+	return s
+}
+
+// compileSilences prepares loaded silences, dropping any that no longer
+// compile.
+func compileSilences(loaded []Silence) []Silence {
+	kept := loaded[:0]
+	for _, silence := range loaded {
+		if err := silence.compile(); err != nil {
+			log.Printf("Dropping silence %s: %v\n", silence.ID, err)
+			continue
+		}
+		kept = append(kept, silence)
+	}
+	return kept
+}
+
+func (s *silenceStore) saveLocked() {
+	if err := saveState(silencesFile, s.silences); err != nil {
+		log.Printf("Error saving silences: %v\n", err)
+	}
+}
+
+// pruneLocked drops expired silences.
+func (s *silenceStore) pruneLocked(now time.Time) {
+	kept := s.silences[:0]
+	for _, silence := range s.silences {
+		if silence.Until.After(now) {
+			kept = append(kept, silence)
+		}
+	}
+	if len(kept) != len(s.silences) {
+		s.silences = kept
+		s.saveLocked()
+	}
+}
+
+func (s *silenceStore) add(silence Silence) Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id [4]byte
+	rand.Read(id[:])
+	silence.ID = hex.EncodeToString(id[:])
+	s.pruneLocked(silence.CreatedAt)
+	s.silences = append(s.silences, silence)
+	s.saveLocked()
+	return silence
+}
+
+// remove deletes the silence with id and reports whether it existed.
+func (s *silenceStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			s.silences = append(s.silences[:i], s.silences[i+1:]...)
+			s.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// active returns the silence muting every error of integrationID at now, if
+// any.
+func (s *silenceStore) active(integrationID int, now time.Time) (Silence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(now)
+	for _, silence := range s.silences {
+		if silence.pattern == nil && silence.coversIntegration(integrationID) {
+			return silence, true
+		}
+	}
+	return Silence{}, false
+}
+
+// filter splits errors of integrationID into those to notify and those a
+// silence active at now mutes.
+func (s *silenceStore) filter(integrationID int, errors []ErrorLog, now time.Time) (kept, muted []ErrorLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(now)
+	return filterSilenced(s.silences, integrationID, errors, func(Silence) bool { return true })
+}
+
+// filterSilenced splits errors by the silences for which applies is true.
+func filterSilenced(silences []Silence, integrationID int, errors []ErrorLog, applies func(Silence) bool) (kept, muted []ErrorLog) {
+	for _, err := range errors {
+		silenced := false
+		for _, silence := range silences {
+			if applies(silence) && silence.matches(integrationID, err) {
+				silenced = true
+				break
+			}
+		}
+		if silenced {
+			muted = append(muted, err)
+		} else {
+			kept = append(kept, err)
+		}
+	}
+	return kept, muted
+}
+
+func (s *silenceStore) list(now time.Time) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(now)
+	return append([]Silence{}, s.silences...)
+}
+
+// replaceDeclared swaps the silences whose ID starts with prefix for
+// declared, so the silences of Kubernetes resources follow them.
+func (s *silenceStore) replaceDeclared(prefix string, declared []Silence, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(now)
+	var previous, others, current []Silence
+	for _, silence := range s.silences {
+		if strings.HasPrefix(silence.ID, prefix) {
+			previous = append(previous, silence)
+		} else {
+			others = append(others, silence)
+		}
+	}
+	for _, silence := range declared {
+		if silence.Until.After(now) {
+			current = append(current, silence)
+		}
+	}
+	s.silences = append(others, current...)
+
+	before, _ := json.Marshal(previous)
+	after, _ := json.Marshal(current)
+	if string(before) != string(after) {
+		s.saveLocked()
+	}
+}
+
+func (s *silenceStore) reload() {
+	var loaded []Silence
+	if _, err := loadState(silencesFile, &loaded); err != nil {
+		log.Printf("Error reloading silences: %v\n", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences = compileSilences(loaded)
+}
+
+// silenceRequest is the body of POST /api/silences.
+type silenceRequest struct {
+	IntegrationID int    `json:"integrationId,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+	ErrorPattern  string `json:"errorPattern,omitempty"`
+	Duration      string `json:"duration"`
+	Reason        string `json:"reason"`
+	By            string `json:"by"`
+}
+
+func handleSilences(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, silences.list(now))
+	case http.MethodPost:
+		var req silenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, "duration must be a positive Go duration such as 2h or 30m", http.StatusBadRequest)
+			return
+		}
+		silence := Silence{
+			IntegrationID: req.IntegrationID,
+			Tenant:        req.Tenant,
+			ErrorPattern:  req.ErrorPattern,
+			Reason:        req.Reason,
+			By:            req.By,
+			CreatedAt:     now,
+			Until:         now.Add(duration),
+		}
+		if err := silence.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		silence = silences.add(silence)
+		log.Printf("Silenced %s until %s by %s: %s\n", silence.Describe(), silence.Until.Format(time.RFC3339), silence.By, silence.Reason)
+		writeJSON(w, http.StatusCreated, silence)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !silences.remove(id) {
+			http.Error(w, "no silence with id "+id, http.StatusNotFound)
+			return
+		}
+		log.Printf("Silence %s removed.\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/jcotoBan/SEFI-Alarm/notify"
+)
+
+// With a bot token, messages go through the Slack Web API instead of the
+// incoming webhook. That allows picking the channel per message, replying in
+// threads and editing messages that were already posted.
+var (
+	slackBotToken         = conf.String("slackBotToken", "")
+	slackChannel          = conf.String("slackChannel", "")
+	slackChannelOverrides = conf.StringMap("slackChannelOverrides")
+)
+
+type slackAPIResponse = notify.SlackResponse
+
+// slackClient posts to the webhook or, in bot-token mode, the Web API. A 429
+// becomes a rateLimitedError, so rate limited notifications are retried.
+var slackClient = &notify.Slack{
+	HTTPClient: httpClient,
+	WebhookURL: slackWebhookURL,
+	BotToken:   slackBotToken,
+	CheckResponse: func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return newRateLimitedError("slack", resp)
+		}
+		return nil
+	},
+}
+
+func slackBotMode() bool {
+	return slackBotToken != ""
+}
+
+// slackChannelFor returns the channel alerts for integrationID are posted to
+// in bot-token mode: its override, else its owner's channel.
+func slackChannelFor(integrationID int) string {
+	if channel, ok := slackChannelOverrides[strconv.Itoa(integrationID)]; ok {
+		return channel
+	}
+	if owner, ok := owners.get(integrationID); ok && owner.SlackChannel != "" {
+		return owner.SlackChannel
+	}
+	return slackChannel
+}
+
+func callSlackAPI(ctx context.Context, method string, body interface{}) (*slackAPIResponse, error) {
+	return slackClient.Call(ctx, method, body)
+}
+
+// postSlackMessage posts message with chat.postMessage. The returned channel
+// and ts identify the message for threaded replies and later updates.
+func postSlackMessage(ctx context.Context, message SlackMessage) (*slackAPIResponse, error) {
+	return slackClient.PostMessage(ctx, message)
+}
+
+// uploadSlackFile shares file in the thread of the message at ts.
+func uploadSlackFile(ctx context.Context, channel, ts string, file SlackFile) error {
+	return slackClient.UploadFile(ctx, channel, ts, file)
+}
+
+// updateSlackMessage replaces the content of a message posted earlier.
+func updateSlackMessage(ctx context.Context, channel, ts string, message SlackMessage) error {
+	return slackClient.UpdateMessage(ctx, channel, ts, message)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// withUmask runs create; there is no umask to set outside Unix.
+func withUmask(mode fs.FileMode, create func() error) error {
+	return create()
+}
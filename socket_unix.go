@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// withUmask runs create with a umask leaving no more than mode, so a socket
+// it creates is never reachable with wider permissions. The umask is
+// process-wide, the files other goroutines create meanwhile only come out
+// more restrictive.
+func withUmask(mode fs.FileMode, create func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(^mode & 0o777))
+	defer syscall.Umask(old)
+	return create()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A standby instance shares stateDir with the active one but neither polls nor
+// notifies. It keeps reloading the state the active instance writes, so a
+// promotion, through POST /api/promote or automatically once no active
+// instance has written a heartbeat for standby.leaderTimeoutSecs, resumes
+// with the same checkpoints, threads, digests and tickets.
+var (
+	standbyEnabled       = conf.Bool("standby.enabled", false)
+	standbyAutoPromote   = conf.Bool("standby.autoPromote", true)
+	standbyLeaderTimeout = time.Duration(conf.Int("standby.leaderTimeoutSecs", 90)) * time.Second
+)
+
+type haRole struct {
+	mu         sync.Mutex
+	standby    bool
+	promotedAt time.Time
+}
+
+var role = &haRole{standby: standbyEnabled || startedByUpgrade() || leaderElectionEnabled}
+
+func (r *haRole) isStandby() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.standby
+}
+
+func (r *haRole) name() string {
+	if r.isStandby() {
+		return "standby"
+	}
+	return "active"
+}
+
+// promote makes this instance the active one. It reports false if it already
+// was.
+func (r *haRole) promote(reason string) bool {
+	now, ok := r.takeOver(reason)
+	if ok {
+		sendSelfAlert(now, reasonPollerDegraded, "SEFI-Alarm standby promoted",
+			fmt.Sprintf("Instance %s took over polling and notifications: %s.", instanceID, reason))
+	}
+	return ok
+}
+
+// takeOver is promote without the self-alert, for handovers that are
+// expected.
+func (r *haRole) takeOver(reason string) (time.Time, bool) {
+	r.mu.Lock()
+	if !r.standby {
+		r.mu.Unlock()
+		return time.Time{}, false
+	}
+	now := time.Now().UTC()
+	r.standby = false
+	r.promotedAt = now
+	r.mu.Unlock()
+
+	log.Printf("Taking over polling and notifications: %s.\n", reason)
+	reloadState()
+	pollHealth.reset(now)
+	notifications.replayOutbox()
+	return now, true
+}
+
+// demote puts this instance back on standby, for a leader that lost its
+// lease. Notifications already queued are still delivered.
+func (r *haRole) demote(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.standby {
+		return
+	}
+	r.standby = true
+	log.Printf("Stopping polling and notifications: %s.\n", reason)
+}
+
+// reloadState reads the shared state written by the active instance.
+func reloadState() {
+	seen.reload()
+	threads.reload()
+	digests.reload()
+	tickets.reload()
+	acks.reload()
+	correlations.reload()
+	silences.reload()
+	budgets.reload()
+	alertStates.reload()
+	escalations.reload()
+	groups.reload()
+	ownerReports.reload()
+	redeliveries.reload()
+}
+
+// leaderWatch promotes a standby instance once no active instance claiming
+// the same integrations has written a heartbeat for standbyLeaderTimeout.
+type leaderWatch struct {
+	lastSeen time.Time
+}
+
+func (l *leaderWatch) check(peers []instanceRecord, now time.Time) {
+	for _, peer := range peers {
+		if !peer.Standby {
+			l.lastSeen = now
+			return
+		}
+	}
+	// With leader election the lease decides who polls.
+	if !standbyAutoPromote || leaderElectionEnabled || now.Sub(l.lastSeen) < standbyLeaderTimeout {
+		return
+	}
+	role.promote(fmt.Sprintf("no active instance heartbeat for %s", now.Sub(l.lastSeen).Round(time.Second)))
+}
+
+func logStandby() {
+	if leaderElectionEnabled {
+		return
+	}
+	if startedByUpgrade() {
+		log.Println("Started by an upgrade: not polling until the previous process exits.")
+		return
+	}
+	if !standbyEnabled {
+		return
+	}
+	if stateless {
+		log.Println("Starting on standby in stateless mode: state cannot be shared and automatic promotion is off, promote with POST /api/promote.")
+		return
+	}
+	log.Printf("Starting on standby: not polling until promoted through POST /api/promote or after %s without an active instance.\n", standbyLeaderTimeout)
+}
+
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	promoted := role.promote("promoted through the API")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"role":     role.name(),
+		"promoted": promoted,
+	})
+}
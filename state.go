@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	stateDir = conf.String("stateDir", "state")
+
+	// stateless disables every write to disk, for read-only filesystems. The
+	// dedup checkpoints then only live in memory, so a restart can repeat or
+	// miss alerts, and notifications still queued at shutdown are dropped.
+	// It is the memory storage backend.
+	stateless = storageBackend == storageMemory
+)
+
+func logStatelessTradeoffs() {
+	if !stateless {
+		return
+	}
+	log.Println("Running in stateless mode: nothing is persisted. Dedup checkpoints are kept in memory only " +
+		"(a restart may repeat or miss alerts) and undelivered notifications are lost on shutdown.")
+	if archiveEnabled {
+		log.Println("Payload archiving is configured but disabled by stateless mode.")
+	}
+}
+
+// checkStateDir verifies at startup that the state directory can be written,
+// so a read-only root filesystem is reported right away instead of on the
+// first save. On read-only containers stateDir should point at a writable
+// mount such as a tmpfs or emptyDir volume.
+func checkStateDir() error {
+	if stateless {
+		return nil
+	}
+
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return fmt.Errorf("state directory %q cannot be created: %v", stateDir, err)
+	}
+
+	probe, err := os.CreateTemp(stateDir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("state directory %q is not writable: %v", stateDir, err)
+	}
+	name := probe.Name()
+	probe.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("state directory %q does not allow removing files: %v", stateDir, err)
+	}
+	return nil
+}
+
+// saveState writes v as JSON to the document name of the store.
+func saveState(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", name, err)
+	}
+	if err := state.put(name, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// loadState reads the document name of the store into v. A missing document
+// is not an error; found reports whether anything was loaded.
+func loadState(name string, v interface{}) (found bool, err error) {
+	data, err := state.get(name)
+	if errors.Is(err, errStateNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return true, nil
+}
+
+func removeState(name string) error {
+	if err := state.remove(name); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", name, err)
+	}
+	return nil
+}
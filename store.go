@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps the named JSON documents SEFI-Alarm persists: the dedup
+// checkpoints, silences, outbox, threads, tickets and the rest of the state
+// read and written through loadState and saveState. storage.backend picks
+// one of:
+//
+//   - file (the default): one file per document under stateDir;
+//   - memory: nothing survives a restart, the same as stateless: true;
+//   - sqlite: a single database at storage.sqlite.path (stateDir/state.db by
+//     default), which also holds the error history;
+//   - remote: an HTTP key-value service at storage.remote.url, answering GET,
+//     PUT and DELETE on <url>/<name> (404 for a missing document) and GET on
+//     <url>/<dir>/ with the JSON array of names in dir, for hosts without a
+//     durable disk;
+//   - redis: a Redis server at storage.redis.address, shared by replicas
+//     that should not alert twice on the same error, see redis.go.
+//
+// The error history needs SQLite: it is kept under stateDir with the file
+// backend, in the sqlite database, only in memory with the remote and redis
+// backends and not at all with the memory backend. The payload archive and crash
+// reports are files under stateDir whatever the backend.
+type Store interface {
+	// get returns the document, or errStateNotFound.
+	get(name string) ([]byte, error)
+	put(name string, data []byte) error
+	remove(name string) error
+	// list returns the names of the documents in dir, such as the instance
+	// heartbeats.
+	list(dir string) ([]string, error)
+	// historyDSN is the SQLite database the error history is kept in, or ""
+	// when the backend keeps none.
+	historyDSN() string
+}
+
+var errStateNotFound = errors.New("not found")
+
+const (
+	storageFile   = "file"
+	storageMemory = "memory"
+	storageSQLite = "sqlite"
+	storageRemote = "remote"
+	storageRedis  = "redis"
+)
+
+var (
+	storageBackend      = storageBackendFrom(conf)
+	storageSQLitePath   = conf.String("storage.sqlite.path", "")
+	storageRemoteURL    = strings.TrimSuffix(conf.String("storage.remote.url", ""), "/")
+	storageRemoteToken  = conf.String("storage.remote.bearerToken", "")
+	storageRemoteHeader = conf.StringMap("storage.remote.headers")
+)
+
+// state is the store behind loadState and saveState.
+var state = openStore()
+
+// storageBackendFrom reads storage.backend, stateless: true standing for the
+// memory backend.
+func storageBackendFrom(c configMap) string {
+	backend := c.String("storage.backend", storageFile)
+	if c.Bool("stateless", false) {
+		if backend != storageFile && backend != storageMemory {
+			addConfigProblem("stateless: true cannot be combined with storage.backend: %s", backend)
+		}
+		return storageMemory
+	}
+	return backend
+}
+
+// openStore opens the configured backend. A misconfigured one is reported to
+// checkConfig, with a memory store standing in until it exits.
+func openStore() Store {
+	fallback := &memoryStore{documents: make(map[string][]byte)}
+	switch storageBackend {
+	case storageFile:
+		return &fileStore{dir: stateDir}
+	case storageMemory:
+		return &memoryStore{documents: make(map[string][]byte)}
+	case storageSQLite:
+		path := storageSQLitePath
+		if path == "" {
+			path = filepath.Join(stateDir, "state.db")
+		}
+		s, err := openSQLiteStore(path)
+		if err != nil {
+			addConfigProblem("storage.sqlite.path %s cannot be opened: %v", path, err)
+			return fallback
+		}
+		return s
+	case storageRemote:
+		if storageRemoteURL == "" {
+			addConfigProblem("storage.remote.url must be set for storage.backend: remote")
+			return fallback
+		}
+		return &remoteStore{url: storageRemoteURL, token: storageRemoteToken, headers: storageRemoteHeader}
+	case storageRedis:
+		if storageRedisAddress == "" {
+			addConfigProblem("storage.redis.address must be set for storage.backend: redis")
+			return fallback
+		}
+		return newRedisStore()
+	}
+	addConfigProblem("storage.backend must be file, memory, sqlite, remote or redis, got %q", storageBackend)
+	return fallback
+}
+
+// fileStore writes each document to its own file. Files are written to a
+// temporary path first and renamed so a crash never leaves a half-written
+// document behind.
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) get(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errStateNotFound
+	}
+	return data, err
+}
+
+func (s *fileStore) put(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(s.dir, name)), 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *fileStore) remove(name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, path.Join(dir, entry.Name()))
+		}
+	}
+	return names, nil
+}
+
+func (s *fileStore) historyDSN() string {
+	return "file:" + filepath.Join(s.dir, historyFile) + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	documents map[string][]byte
+}
+
+func (s *memoryStore) get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.documents[name]
+	if !ok {
+		return nil, errStateNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryStore) put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents[name] = data
+	return nil
+}
+
+func (s *memoryStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.documents, name)
+	return nil
+}
+
+func (s *memoryStore) list(dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.documents {
+		if path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStore) historyDSN() string { return "" }
+
+type sqliteStore struct {
+	db  *sql.DB
+	dsn string
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS documents (
+	name       TEXT PRIMARY KEY,
+	data       BLOB NOT NULL,
+	updated_at INTEGER NOT NULL
+)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, dsn: dsn}, nil
+}
+
+func (s *sqliteStore) get(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM documents WHERE name = ?`, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errStateNotFound
+	}
+	return data, err
+}
+
+func (s *sqliteStore) put(name string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO documents (name, data, updated_at) VALUES (?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		name, data, time.Now().Unix())
+	return err
+}
+
+func (s *sqliteStore) remove(name string) error {
+	_, err := s.db.Exec(`DELETE FROM documents WHERE name = ?`, name)
+	return err
+}
+
+func (s *sqliteStore) list(dir string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM documents WHERE name LIKE ? ESCAPE '\' ORDER BY name`,
+		strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(dir)+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+func (s *sqliteStore) historyDSN() string { return s.dsn }
+
+// remoteStore keeps the documents in an HTTP key-value service.
+type remoteStore struct {
+	url     string
+	token   string
+	headers map[string]string
+}
+
+const remoteStoreTimeout = 10 * time.Second
+
+func (s *remoteStore) do(method, name string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteStoreTimeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url+"/"+escapeStorePath(name), reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errStateNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(data) > 4096 {
+			data = data[:4096]
+		}
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", method, name, resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+func (s *remoteStore) get(name string) ([]byte, error) {
+	return s.do("GET", name, nil)
+}
+
+func (s *remoteStore) put(name string, data []byte) error {
+	_, err := s.do("PUT", name, data)
+	return err
+}
+
+func (s *remoteStore) remove(name string) error {
+	_, err := s.do("DELETE", name, nil)
+	if errors.Is(err, errStateNotFound) {
+		return nil
+	}
+	return err
+}
+
+// list asks for GET <url>/<dir>/, answered with a JSON array of the names in
+// dir, relative to it or not.
+func (s *remoteStore) list(dir string) ([]string, error) {
+	data, err := s.do("GET", dir+"/", nil)
+	if errors.Is(err, errStateNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var listed []string
+	if err := json.Unmarshal(data, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse the list of %s: %v", dir, err)
+	}
+	names := make([]string, 0, len(listed))
+	for _, name := range listed {
+		if !strings.HasPrefix(name, dir+"/") {
+			name = path.Join(dir, name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// historyDSN keeps the history of a remote-backed instance in memory, shared
+// by the connections of the pool.
+func (s *remoteStore) historyDSN() string {
+	return "file:sefi-history?mode=memory&cache=shared"
+}
+
+// escapeStorePath escapes each segment of name, keeping the slashes of the
+// <url>/<dir>/<name> layout.
+func escapeStorePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
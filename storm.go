@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// During an alert storm, once digest.storm.queueDepth notifications wait for
+// delivery, each Slack channel with messages still waiting switches to digest
+// mode: the new errors of integrations alerting there are buffered like those
+// of digest.integrations. Once the queue is down to digest.storm.clearDepth
+// (a quarter of queueDepth by default) they are sent as one summary per
+// integration and the channel is back to real-time alerts. Each switch is
+// announced once in the channel. Off unless queueDepth is set.
+var (
+	stormQueueDepth = conf.Int("digest.storm.queueDepth", 0)
+	stormClearDepth = conf.Int("digest.storm.clearDepth", stormQueueDepth/4)
+)
+
+var stormChannels = metrics.newGauge("sefi_storm_digest_channels",
+	"Slack channels switched to digest mode by a notification backlog.")
+
+// storm is a channel in digest mode.
+type storm struct {
+	since        time.Time
+	integrations []int
+}
+
+type stormTracker struct {
+	mu       sync.Mutex
+	channels map[string]*storm
+}
+
+var storms = &stormTracker{channels: make(map[string]*storm)}
+
+// buffering reports whether alerts of integrationID to channel go to its
+// digest, switching the channel to digest mode when the queue is backed up.
+func (s *stormTracker) buffering(channel string, integrationID int, now time.Time) bool {
+	if stormQueueDepth <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.channels[channel]
+	if !ok {
+		depth := notifications.depth()
+		if depth < stormQueueDepth || notifications.waiting(channel) == 0 {
+			return false
+		}
+		st = &storm{since: now}
+		s.channels[channel] = st
+		stormChannels.set(float64(len(s.channels)))
+		stormNotice(channel, now, "SEFI-Alarm switched to digest mode",
+			fmt.Sprintf("%s notifications are waiting for delivery, so new alerts for this channel are collected into digests until the backlog clears.", formatCount(int64(depth))))
+	}
+	st.integrations = appendUnique(st.integrations, integrationID)
+	return true
+}
+
+// clear flushes the digests of every channel in digest mode and returns them
+// to real-time alerts, once the queue is down to stormClearDepth.
+func (s *stormTracker) clear(now time.Time) {
+	if notifications.depth() > stormClearDepth {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]string, 0, len(s.channels))
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		st := s.channels[channel]
+		delete(s.channels, channel)
+		stormNotice(channel, now, "SEFI-Alarm is back to real-time alerts",
+			fmt.Sprintf("The notification backlog cleared after %s, digests of the alerts collected meanwhile follow.", now.Sub(st.since).Round(time.Second)))
+		digests.flushIntegrations(st.integrations, now)
+	}
+	stormChannels.set(float64(len(s.channels)))
+}
+
+func stormNotice(channel string, at time.Time, title, text string) {
+	log.Printf("%s for channel %q: %s\n", title, channel, text)
+	message := SlackMessage{
+		Channel: channel,
+		Text:    title + "\n" + text,
+		Blocks: []SlackBlock{
+			{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+			{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+		},
+	}
+	if templated, ok := templatedSummary(title, text, notifierSlack); ok {
+		message = SlackMessage{Channel: channel, Text: templated}
+	}
+	notifications.enqueue(&Notification{
+		Message:  message,
+		Reason:   reasonPollerDegraded,
+		QueuedAt: at,
+	})
+}
+
+func stormLoop(ctx context.Context) {
+	if stormQueueDepth <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			storms.clear(now.UTC())
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package sysdig is a client of the Sysdig Secure events forwarding API: it
+// fetches the delivery errors Sysdig records for a forwarding integration.
+//
+//	client := &sysdig.Client{APIBase: sysdig.Regions["eu1"].APIBase, Token: token, TenantID: 12345}
+//	payload, err := client.Errors(ctx, integrationID, sysdig.ErrorsQuery{From: time.Now().Add(-time.Hour)})
+//
+// Large error lists are fetched a page at a time and put back together.
+package sysdig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload is what the API returns for one integration.
+type Payload struct {
+	CustomerID    int        `json:"customerId"`
+	IntegrationID int        `json:"integrationId"`
+	Count         int        `json:"count"`
+	Errors        []ErrorLog `json:"errors"`
+}
+
+// ErrorLog is one delivery error, timestamped in RFC 3339 as a rule, see
+// ParseTimestamp.
+type ErrorLog struct {
+	Error     string `json:"error"`
+	Timestamp string `json:"timestamp"`
+	// Category is not sent by Sysdig, it is left for callers classifying
+	// errors.
+	Category string `json:"category,omitempty"`
+	// InvalidTimestamp is not sent by Sysdig either, it flags errors kept
+	// even though their timestamp doesn't parse.
+	InvalidTimestamp bool `json:"invalidTimestamp,omitempty"`
+}
+
+// timestampLayouts are the formats ParseTimestamp tries after RFC 3339.
+// Fractional seconds are accepted after the seconds of each, and a layout
+// without a zone is read as UTC.
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z0700",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// ParseTimestamp parses the timestamp of an error. Most come in RFC 3339,
+// but some have been seen with a space for the T, without a zone, or as
+// Unix seconds or milliseconds, which are all read too.
+func ParseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, layoutErr := time.Parse(layout, s); layoutErr == nil {
+			return t, nil
+		}
+	}
+	if t, ok := parseUnixTimestamp(s); ok {
+		return t, nil
+	}
+	return time.Time{}, err
+}
+
+// parseUnixTimestamp reads s as Unix seconds, possibly with a fraction, or
+// as milliseconds, microseconds or nanoseconds going by its digits.
+func parseUnixTimestamp(s string) (time.Time, bool) {
+	whole, fraction, hasFraction := strings.Cut(s, ".")
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, false
+	}
+	if hasFraction {
+		f, err := strconv.ParseFloat("0."+fraction, 64)
+		if err != nil || len(whole) > 10 {
+			return time.Time{}, false
+		}
+		return time.Unix(n, int64(f*1e9)).UTC(), true
+	}
+	switch {
+	case len(whole) <= 10:
+		return time.Unix(n, 0).UTC(), true
+	case len(whole) <= 13:
+		return time.UnixMilli(n).UTC(), true
+	case len(whole) <= 16:
+		return time.UnixMicro(n).UTC(), true
+	}
+	return time.Unix(0, n).UTC(), true
+}
+
+// Time parses the timestamp of e with ParseTimestamp.
+func (e ErrorLog) Time() (time.Time, error) {
+	return ParseTimestamp(e.Timestamp)
+}
+
+// Region holds the base URLs of a Sysdig SaaS region or install: where the
+// API is served and where the UI links point to.
+type Region struct {
+	APIBase string
+	UIBase  string
+}
+
+// Regions are the Sysdig SaaS regions.
+var Regions = map[string]Region{
+	"us1": {APIBase: "https://secure.sysdig.com", UIBase: "https://secure.sysdig.com"},
+	"us2": {APIBase: "https://us2.app.sysdig.com", UIBase: "https://us2.app.sysdig.com"},
+	"us4": {APIBase: "https://app.us4.sysdig.com", UIBase: "https://app.us4.sysdig.com"},
+	"eu1": {APIBase: "https://eu1.app.sysdig.com", UIBase: "https://eu1.app.sysdig.com"},
+	"au1": {APIBase: "https://app.au1.sysdig.com", UIBase: "https://app.au1.sysdig.com"},
+	"me2": {APIBase: "https://app.me2.sysdig.com", UIBase: "https://app.me2.sysdig.com"},
+	"in1": {APIBase: "https://app.in1.sysdig.com", UIBase: "https://app.in1.sysdig.com"},
+}
+
+// ErrorsPath is where the errors of the integrations are served under the
+// API base.
+const ErrorsPath = "/api/v1/eventsForwarding/errors/"
+
+// IntegrationPath is where the UI shows an integration, followed by its ID.
+const IntegrationPath = "/secure/#/settings/events-forwarding/"
+
+// IntegrationURL links to the settings of an integration in the UI.
+func (r Region) IntegrationURL(integrationID int) string {
+	return r.UIBase + IntegrationPath + strconv.Itoa(integrationID)
+}
+
+// Client fetches integration errors with an API token.
+type Client struct {
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// APIBase is the API base of the region, such as Regions["us1"].APIBase.
+	APIBase  string
+	Token    string
+	TenantID int
+	// PageSize is how many errors are asked for per request, DefaultPageSize
+	// when 0.
+	PageSize int
+	// MaxPages bounds the requests of one Errors call, DefaultMaxPages when
+	// 0. The errors of the pages fetched so far are returned with
+	// ErrTooManyPages.
+	MaxPages int
+	// MaxResponseBytes bounds each response read, unbounded when 0.
+	MaxResponseBytes int64
+	// FetchPage, when set, replaces how a page request is sent and its
+	// response decoded, for callers that archive or limit responses.
+	FetchPage func(req *http.Request) (*Payload, error)
+}
+
+const (
+	DefaultPageSize = 500
+	DefaultMaxPages = 20
+)
+
+// ErrTooManyPages is returned with the errors of the first MaxPages pages.
+var ErrTooManyPages = errors.New("more errors than MaxPages pages hold")
+
+// ErrorsQuery narrows the errors fetched. Zero fields are left out of the
+// request.
+type ErrorsQuery struct {
+	// From and To bound the error timestamps.
+	From time.Time
+	To   time.Time
+	// Limit caps the errors returned over all pages.
+	Limit int
+	// Offset skips the first errors.
+	Offset int
+}
+
+// APIError is returned for a response other than 200, with the start of its
+// body.
+type APIError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("the Sysdig API returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Unauthorized reports whether the token was rejected.
+func (e *APIError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// RateLimited reports whether the API asked to slow down, see RetryAfter.
+func (e *APIError) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary reports whether the request may succeed when retried.
+func (e *APIError) Temporary() bool {
+	return e.RateLimited() || e.StatusCode >= 500
+}
+
+// RetryAfter is the wait the Retry-After header asks for, 0 without one.
+func (e *APIError) RetryAfter() time.Duration {
+	value := e.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// maxErrorBodyBytes bounds how much of an error response is kept.
+const maxErrorBodyBytes = 16 << 10
+
+// ErrorsURL is the URL of the errors of an integration.
+func (c *Client) ErrorsURL(integrationID int) string {
+	return c.APIBase + ErrorsPath + strconv.Itoa(integrationID) + "/" + strconv.Itoa(c.TenantID)
+}
+
+// NewErrorsRequest builds the authenticated request for one page of the
+// errors of an integration.
+func (c *Client) NewErrorsRequest(ctx context.Context, integrationID int, query ErrorsQuery) (*http.Request, error) {
+	u := c.ErrorsURL(integrationID)
+	if params := query.values(); len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	return req, nil
+}
+
+func (q ErrorsQuery) values() url.Values {
+	params := url.Values{}
+	if !q.From.IsZero() {
+		params.Set("from", q.From.UTC().Format(time.RFC3339Nano))
+	}
+	if !q.To.IsZero() {
+		params.Set("to", q.To.UTC().Format(time.RFC3339Nano))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		params.Set("offset", strconv.Itoa(q.Offset))
+	}
+	return params
+}
+
+// Errors fetches the errors of an integration matching query, following the
+// pages until the count the API reports is reached, a page comes back short
+// or the query's Limit is met. A failed response is an *APIError.
+func (c *Client) Errors(ctx context.Context, integrationID int, query ErrorsQuery) (*Payload, error) {
+	pageSize := c.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	maxPages := c.MaxPages
+	if maxPages <= 0 {
+		maxPages = DefaultMaxPages
+	}
+
+	var all *Payload
+	for page := 0; ; page++ {
+		if page == maxPages {
+			return all, ErrTooManyPages
+		}
+		pageQuery := query
+		pageQuery.Offset = query.Offset + page*pageSize
+		pageQuery.Limit = pageSize
+		if query.Limit > 0 {
+			pageQuery.Limit = min(pageSize, query.Limit-page*pageSize)
+		}
+		p, err := c.page(ctx, integrationID, pageQuery)
+		if err != nil {
+			return nil, err
+		}
+		if all == nil {
+			all = p
+		} else {
+			all.Errors = append(all.Errors, p.Errors...)
+		}
+		// An API ignoring the paging parameters sends everything at once,
+		// which the count tells apart from a full page.
+		if len(p.Errors) < pageQuery.Limit || len(all.Errors) >= all.Count-query.Offset ||
+			(query.Limit > 0 && len(all.Errors) >= query.Limit) {
+			return all, nil
+		}
+	}
+}
+
+// page fetches a single page.
+func (c *Client) page(ctx context.Context, integrationID int, query ErrorsQuery) (*Payload, error) {
+	req, err := c.NewErrorsRequest(ctx, integrationID, query)
+	if err != nil {
+		return nil, err
+	}
+	if c.FetchPage != nil {
+		return c.FetchPage(req)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		return nil, &APIError{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	}
+
+	var r io.Reader = resp.Body
+	if c.MaxResponseBytes > 0 {
+		r = io.LimitReader(resp.Body, c.MaxResponseBytes)
+	}
+	var payload Payload
+	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+	return &payload, nil
+}
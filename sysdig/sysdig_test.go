@@ -0,0 +1,196 @@
+package sysdig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   string
+		want time.Time
+	}{
+		{"rfc3339", "2024-05-01T10:00:00Z", want},
+		{"rfc3339 offset", "2024-05-01T12:00:00+02:00", want},
+		{"rfc3339 fraction", "2024-05-01T10:00:00.25Z", want.Add(250 * time.Millisecond)},
+		{"offset without colon", "2024-05-01T12:00:00+0200", want},
+		{"space with offset", "2024-05-01 12:00:00+02:00", want},
+		{"space with offset without colon", "2024-05-01 12:00:00+0200", want},
+		{"space fraction", "2024-05-01 10:00:00.5Z", want.Add(500 * time.Millisecond)},
+		{"go time string", "2024-05-01 12:00:00 +0200 CEST", want},
+		{"no zone", "2024-05-01T10:00:00", want},
+		{"space no zone", "2024-05-01 10:00:00", want},
+		{"rfc1123z", "Wed, 01 May 2024 12:00:00 +0200", want},
+		{"rfc1123", "Wed, 01 May 2024 10:00:00 UTC", want},
+		{"unix seconds", "1714557600", want},
+		{"unix seconds fraction", "1714557600.5", want.Add(500 * time.Millisecond)},
+		{"unix milliseconds", "1714557600250", want.Add(250 * time.Millisecond)},
+		{"unix microseconds", "1714557600000250", want.Add(250 * time.Microsecond)},
+		{"unix nanoseconds", "1714557600000000250", want.Add(250)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTimestamp(tt.in)
+			if err != nil {
+				t.Fatalf("ParseTimestamp(%q): %v", tt.in, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimestampInvalid(t *testing.T) {
+	for _, in := range []string{"", "yesterday", "0", "-1714557600", "2024-05-01", "1714557600.x", "17145576000000.5"} {
+		if got, err := ParseTimestamp(in); err == nil {
+			t.Errorf("ParseTimestamp(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+// errorsServer serves total errors named e0, e1... honoring limit and offset
+// unless ignorePaging is set, and records the offset/limit of each request.
+func errorsServer(t *testing.T, total int, ignorePaging bool, requests *[]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if want := ErrorsPath + "42/7"; r.URL.Path != want {
+			t.Errorf("path = %q, want %q", r.URL.Path, want)
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		*requests = append(*requests, fmt.Sprintf("%d/%d", offset, limit))
+
+		start, end := offset, min(offset+limit, total)
+		if ignorePaging {
+			start, end = 0, total
+		}
+		payload := Payload{CustomerID: 7, IntegrationID: 42, Count: total, Errors: []ErrorLog{}}
+		for i := start; i < end; i++ {
+			payload.Errors = append(payload.Errors, ErrorLog{Error: "e" + strconv.Itoa(i)})
+		}
+		json.NewEncoder(w).Encode(payload)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestErrorsPaging(t *testing.T) {
+	tests := []struct {
+		name         string
+		total        int
+		ignorePaging bool
+		maxPages     int
+		query        ErrorsQuery
+		wantRequests []string
+		wantFirst    string
+		wantCount    int
+		wantErr      error
+	}{
+		{name: "empty", total: 0, wantRequests: []string{"0/2"}, wantCount: 0},
+		{name: "last page short", total: 5, wantRequests: []string{"0/2", "2/2", "4/2"}, wantFirst: "e0", wantCount: 5},
+		{name: "last page full", total: 4, wantRequests: []string{"0/2", "2/2"}, wantFirst: "e0", wantCount: 4},
+		{name: "limit within a page", total: 10, query: ErrorsQuery{Limit: 1}, wantRequests: []string{"0/1"}, wantFirst: "e0", wantCount: 1},
+		{name: "limit across pages", total: 10, query: ErrorsQuery{Limit: 3}, wantRequests: []string{"0/2", "2/1"}, wantFirst: "e0", wantCount: 3},
+		{name: "limit past the count", total: 3, query: ErrorsQuery{Limit: 10}, wantRequests: []string{"0/2", "2/2"}, wantFirst: "e0", wantCount: 3},
+		{name: "offset", total: 6, query: ErrorsQuery{Offset: 3}, wantRequests: []string{"3/2", "5/2"}, wantFirst: "e3", wantCount: 3},
+		{name: "offset and limit", total: 10, query: ErrorsQuery{Offset: 1, Limit: 2}, wantRequests: []string{"1/2"}, wantFirst: "e1", wantCount: 2},
+		{name: "offset past the count", total: 3, query: ErrorsQuery{Offset: 5}, wantRequests: []string{"5/2"}, wantCount: 0},
+		{name: "paging ignored", total: 5, ignorePaging: true, wantRequests: []string{"0/2"}, wantFirst: "e0", wantCount: 5},
+		{name: "too many pages", total: 10, maxPages: 2, wantRequests: []string{"0/2", "2/2"}, wantFirst: "e0", wantCount: 4, wantErr: ErrTooManyPages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			server := errorsServer(t, tt.total, tt.ignorePaging, &requests)
+			client := &Client{APIBase: server.URL, Token: "token", TenantID: 7, PageSize: 2, MaxPages: tt.maxPages}
+
+			payload, err := client.Errors(context.Background(), 42, tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Errors() error = %v, want %v", err, tt.wantErr)
+			}
+			if got, want := strings.Join(requests, " "), strings.Join(tt.wantRequests, " "); got != want {
+				t.Errorf("requests = %s, want %s", got, want)
+			}
+			if len(payload.Errors) != tt.wantCount {
+				t.Fatalf("got %d errors, want %d", len(payload.Errors), tt.wantCount)
+			}
+			if tt.wantCount > 0 && payload.Errors[0].Error != tt.wantFirst {
+				t.Errorf("first error = %q, want %q", payload.Errors[0].Error, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestErrorsQueryParameters(t *testing.T) {
+	from := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	to := from.Add(time.Minute)
+	req, err := (&Client{APIBase: "https://example.com", TenantID: 7}).NewErrorsRequest(context.Background(), 42, ErrorsQuery{From: from, To: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := req.URL.Query()
+	if got := query.Get("from"); got != "2024-05-01T10:00:00Z" {
+		t.Errorf("from = %q", got)
+	}
+	if got := query.Get("to"); got != "2024-05-01T10:01:00Z" {
+		t.Errorf("to = %q", got)
+	}
+	if query.Has("limit") || query.Has("offset") {
+		t.Errorf("zero limit and offset were sent: %s", req.URL.RawQuery)
+	}
+}
+
+func TestErrorsAPIError(t *testing.T) {
+	tests := []struct {
+		status       int
+		retryAfter   string
+		unauthorized bool
+		temporary    bool
+		wait         time.Duration
+	}{
+		{status: http.StatusUnauthorized, unauthorized: true},
+		{status: http.StatusForbidden, unauthorized: true},
+		{status: http.StatusNotFound},
+		{status: http.StatusTooManyRequests, retryAfter: "30", temporary: true, wait: 30 * time.Second},
+		{status: http.StatusBadGateway, temporary: true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				http.Error(w, "nope", tt.status)
+			}))
+			defer server.Close()
+
+			_, err := (&Client{APIBase: server.URL}).Errors(context.Background(), 42, ErrorsQuery{})
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Errors() error = %v, want an *APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Unauthorized() != tt.unauthorized ||
+				apiErr.Temporary() != tt.temporary || apiErr.RetryAfter() != tt.wait {
+				t.Errorf("got status %d, unauthorized %v, temporary %v, retry after %s",
+					apiErr.StatusCode, apiErr.Unauthorized(), apiErr.Temporary(), apiErr.RetryAfter())
+			}
+			if !strings.Contains(string(apiErr.Body), "nope") {
+				t.Errorf("body = %q", apiErr.Body)
+			}
+		})
+	}
+}
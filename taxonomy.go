@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+// Forwarder errors are tagged with a category from a built-in taxonomy. The
+// category is available to templates ({{.Category}} on an error, or
+// {{.Category}} on the alert for its most frequent one), labels
+// sefi_integration_errors_by_category_total and can route alerts to the
+// Slack channel set for it in slackCategoryChannels.
+const (
+	categoryAuth            = "auth"
+	categoryTLS             = "tls"
+	categoryDNS             = "dns"
+	categoryTimeout         = "timeout"
+	categoryThrottling      = "throttling"
+	categoryPayloadTooLarge = "payload_too_large"
+	categoryOther           = "other"
+)
+
+// errorCategories is checked in order; the first match wins, so the more
+// specific patterns come first.
+var errorCategories = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{categoryTLS, regexp.MustCompile(`(?i)x509|certificate|tls|ssl|handshake`)},
+	{categoryDNS, regexp.MustCompile(`(?i)no such host|dns|name resolution|resolve host|lookup .*: (server misbehaving|no such host)`)},
+	{categoryAuth, regexp.MustCompile(`(?i)\b(401|403)\b|unauthori[sz]ed|forbidden|authenticat|invalid (api )?(key|token)|access denied|permission denied`)},
+	{categoryThrottling, regexp.MustCompile(`(?i)\b429\b|too many requests|rate.?limit|throttl|quota`)},
+	{categoryPayloadTooLarge, regexp.MustCompile(`(?i)\b413\b|too large|entity too large|payload size|exceeds .*(size|limit)|message size`)},
+	{categoryTimeout, regexp.MustCompile(`(?i)timeout|timed out|deadline exceeded|i/o timeout`)},
+}
+
+var slackCategoryChannels = conf.StringMap("slackCategoryChannels")
+
+var integrationErrorsByCategory = metrics.newCounter("sefi_integration_errors_by_category_total",
+	"New forwarding errors detected per integration and error category.", "integration_id", "category")
+
+func classifyError(message string) string {
+	for _, c := range errorCategories {
+		if c.pattern.MatchString(message) {
+			return c.name
+		}
+	}
+	return categoryOther
+}
+
+// dominantCategory returns the most frequent category of errors, preferring
+// the one listed first in the taxonomy on ties.
+func dominantCategory(errors []ErrorLog) string {
+	counts := make(map[string]int)
+	for _, e := range errors {
+		counts[e.Category]++
+	}
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return categoryOther
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return categoryRank(names[i]) < categoryRank(names[j])
+	})
+	return names[0]
+}
+
+func categoryRank(name string) int {
+	for i, c := range errorCategories {
+		if c.name == name {
+			return i
+		}
+	}
+	return len(errorCategories)
+}
+
+// alertChannel returns the channel for an alert on integrationID whose errors
+// are mostly of category. A channel set for the category wins over the one
+// set for the integration.
+func alertChannel(integrationID int, category string) string {
+	if channel, ok := slackCategoryChannels[category]; ok {
+		return channel
+	}
+	return slackChannelFor(integrationID)
+}
+
+// defaultRemediationHints are appended to alerts by category. Each can be
+// replaced under remediationHints in config.yaml, or turned off with an
+// empty value.
+var defaultRemediationHints = map[string]string{
+	categoryAuth:            "Check that the credentials or token configured on the integration are still valid and have write access to the destination.",
+	categoryTLS:             "Check certificate expiry and the CA chain on the destination, and that it accepts the TLS version Sysdig offers.",
+	categoryDNS:             "Check that the destination hostname still resolves from the Sysdig region, and for typos in the integration's URL.",
+	categoryTimeout:         "Check that the destination is up and reachable from the Sysdig region, and whether it is overloaded or a firewall drops the traffic.",
+	categoryThrottling:      "The destination is rate limiting Sysdig. Raise its ingestion quota or reduce the events forwarded by this integration.",
+	categoryPayloadTooLarge: "The destination rejects the event size. Raise its maximum request size or forward fewer fields.",
+}
+
+var remediationHintOverrides = conf.StringMap("remediationHints")
+
+func remediationHint(category string) string {
+	if hint, ok := remediationHintOverrides[category]; ok {
+		return hint
+	}
+	return defaultRemediationHints[category]
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// alertTemplate, when configured through messageTemplate (inline) or
+// messageTemplateFile, replaces the built-in alert layout with whatever text
+// the template renders. See templateData for the available fields. It is
+// swapped by a config reload, so read it through currentAlertTemplate. The
+// template it replaced is kept, and swapped back in when the new one fails
+// on a real alert.
+var (
+	alertTemplateMu       sync.RWMutex
+	alertTemplate         = loadAlertTemplate()
+	previousAlertTemplate *template.Template
+)
+
+func currentAlertTemplate() *template.Template {
+	alertTemplateMu.RLock()
+	defer alertTemplateMu.RUnlock()
+	return alertTemplate
+}
+
+func setAlertTemplate(tmpl *template.Template) {
+	alertTemplateMu.Lock()
+	defer alertTemplateMu.Unlock()
+	if tmpl != alertTemplate {
+		previousAlertTemplate = alertTemplate
+	}
+	alertTemplate = tmpl
+}
+
+// rollbackAlertTemplate puts back the template failed replaced, returning
+// it, nil for the built-in layout. A template that failed since is not
+// rolled back twice.
+func rollbackAlertTemplate(failed *template.Template) *template.Template {
+	alertTemplateMu.Lock()
+	defer alertTemplateMu.Unlock()
+	if alertTemplate != failed {
+		return alertTemplate
+	}
+	alertTemplate, previousAlertTemplate = previousAlertTemplate, nil
+	hotReloads.inc("rollback")
+	return alertTemplate
+}
+
+// templateData is what message templates are executed against.
+type templateData struct {
+	IntegrationID  int
+	Integration    integrationInfo
+	TenantID       string
+	Region         string
+	IntegrationURL string
+	Count          int
+	RecentCount    int
+	Category       string
+	Hint           string
+	Pattern        string
+	Errors         []ErrorLog
+	Payload        *Payload
+	Mentions       string
+	Owner          string
+	Severity       string
+	// FailingFor is how long the integration's alert has been firing, or
+	// since the oldest of the new errors without alert states.
+	FailingFor time.Duration
+	// Sampled notes the sampling of a sampled burst, see
+	// sampling.integrations.
+	Sampled string
+}
+
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// Formatted for the configured locale.
+	"duration": templateDuration,
+	"number":   templateNumber,
+	"time":     templateTime,
+}
+
+func loadAlertTemplate() *template.Template {
+	tmpl, err := parseAlertTemplate(conf)
+	if err == nil {
+		err = validateAlertTemplate(tmpl)
+	}
+	if err != nil {
+		addConfigProblem("message template: %v", err)
+		return nil
+	}
+	return tmpl
+}
+
+// parseAlertTemplate returns the template configured in c, nil if none is.
+func parseAlertTemplate(c configMap) (*template.Template, error) {
+	text := c.String("messageTemplate", "")
+	if file := c.String("messageTemplateFile", ""); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read messageTemplateFile: %v", err)
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("alert").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// validateAlertTemplate renders tmpl against a sample alert, so a template
+// that parses but fails on real data, such as an index out of range, is
+// rejected before it replaces the running one.
+func validateAlertTemplate(tmpl *template.Template) error {
+	if tmpl == nil {
+		return nil
+	}
+	errors, payload := sampleAlert()
+	if _, err := renderTemplate(tmpl, newTemplateData(errors, payload, integrationURL)); err != nil {
+		return fmt.Errorf("the template fails on a sample alert: %v", err)
+	}
+	return nil
+}
+
+// sampleAlert is the alert templates and routing rules are tried on, the
+// errors of a test alert on the first monitored integration.
+func sampleAlert() ([]ErrorLog, *Payload) {
+	errors := testErrors(time.Now().UTC())
+	payload := &Payload{Count: len(errors), Errors: errors}
+	if ids := monitored.current(); len(ids) > 0 {
+		payload.IntegrationID = ids[0]
+	}
+	return errors, payload
+}
+
+func newTemplateData(errors []ErrorLog, payload *Payload, integrationUrl string) templateData {
+	integration, _ := integrationMeta.get(payload.IntegrationID)
+	integration.ID = payload.IntegrationID
+	return templateData{
+		IntegrationID:  payload.IntegrationID,
+		Integration:    integration,
+		TenantID:       tenantID,
+		Region:         region,
+		IntegrationURL: integrationUrl + fmt.Sprintf("%d", payload.IntegrationID),
+		Count:          payload.Count,
+		RecentCount:    len(errors),
+		Category:       dominantCategory(errors),
+		Hint:           remediationHint(dominantCategory(errors)),
+		Pattern:        failurePattern(payload.Errors),
+		Errors:         errors,
+		Payload:        payload,
+		Mentions:       mentionText(routedMentions(errors, payload)),
+		Owner:          ownerTeam(payload.IntegrationID),
+		Severity:       alertSeverity(errors, payload),
+		FailingFor:     failingFor(payload.IntegrationID, errors, time.Now().UTC()),
+		Sampled:        samplingNote(payload.IntegrationID),
+	}
+}
+
+func failingFor(integrationID int, errors []ErrorLog, now time.Time) time.Duration {
+	if since, ok := alertStates.firingSince(integrationID); ok {
+		return now.Sub(since)
+	}
+	var oldest time.Time
+	for _, e := range errors {
+		t, err := e.Time()
+		if err == nil && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
+}
+
+// The other notifiers take templates of their own under templates:, the
+// per-alert ones executed against templateData like messageTemplate:
+//
+//	templates:
+//	  github:
+//	    title: "{{.Severity | upper}}: {{.Integration.Name}} stopped forwarding"
+//	    body: "{{range .Errors}}{{.Error}}\n{{end}}"
+//	  events:
+//	    summary: "{{.Integration.Name}} has {{.RecentCount}} new errors"
+//	    description: "{{.Hint}}"
+//	  summary: "{{.Title}}\n\n{{.Text}}"
+//
+// Without a template of its own, a ticket body or an event description is
+// the rendered messageTemplate when one is set. templates.summary lays out
+// the notifications standing for several alerts, executed against
+// summaryData: batches, digests, rate-limit and storm notices, and the owner
+// report emails. Like messageTemplate, a templated Slack message is text only.
+type notifierTemplateSet struct {
+	ticketTitle      *template.Template
+	ticketBody       *template.Template
+	eventSummary     *template.Template
+	eventDescription *template.Template
+	summary          *template.Template
+}
+
+// summaryData is what templates.summary is executed against.
+type summaryData struct {
+	Title string
+	// Text is the built-in text of the notification, below its title.
+	Text string
+	// Notifier is slack, github, events or email.
+	Notifier string
+}
+
+var (
+	notifierTemplatesMu sync.RWMutex
+	notifierTemplates   = loadNotifierTemplates()
+)
+
+func currentNotifierTemplates() notifierTemplateSet {
+	notifierTemplatesMu.RLock()
+	defer notifierTemplatesMu.RUnlock()
+	return notifierTemplates
+}
+
+func setNotifierTemplates(set notifierTemplateSet) {
+	notifierTemplatesMu.Lock()
+	defer notifierTemplatesMu.Unlock()
+	notifierTemplates = set
+}
+
+func loadNotifierTemplates() notifierTemplateSet {
+	set, err := parseNotifierTemplates(conf)
+	if err == nil {
+		err = validateNotifierTemplates(set)
+	}
+	if err != nil {
+		addConfigProblem("templates: %v", err)
+		return notifierTemplateSet{}
+	}
+	return set
+}
+
+// parseNotifierTemplates returns the templates configured under templates:
+// in c.
+func parseNotifierTemplates(c configMap) (notifierTemplateSet, error) {
+	var set notifierTemplateSet
+	for _, part := range []struct {
+		key  string
+		tmpl **template.Template
+	}{
+		{"github.title", &set.ticketTitle},
+		{"github.body", &set.ticketBody},
+		{"events.summary", &set.eventSummary},
+		{"events.description", &set.eventDescription},
+		{"summary", &set.summary},
+	} {
+		text := c.String("templates."+part.key, "")
+		if text == "" {
+			continue
+		}
+		tmpl, err := template.New(part.key).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return notifierTemplateSet{}, fmt.Errorf("failed to parse %s: %v", part.key, err)
+		}
+		*part.tmpl = tmpl
+	}
+	return set, nil
+}
+
+// validateNotifierTemplates renders set against a sample alert and summary.
+func validateNotifierTemplates(set notifierTemplateSet) error {
+	errors, payload := sampleAlert()
+	data := newTemplateData(errors, payload, integrationURL)
+	for _, tmpl := range []*template.Template{set.ticketTitle, set.ticketBody, set.eventSummary, set.eventDescription} {
+		if tmpl == nil {
+			continue
+		}
+		if _, err := renderTemplate(tmpl, data); err != nil {
+			return fmt.Errorf("the template fails on a sample alert: %v", err)
+		}
+	}
+	if set.summary != nil {
+		sample := summaryData{Title: "Notifications held back by the rate limit", Text: "3 Slack notifications were not sent.", Notifier: notifierSlack}
+		if _, err := renderSummaryTemplate(set.summary, sample); err != nil {
+			return fmt.Errorf("the template fails on a sample summary: %v", err)
+		}
+	}
+	return nil
+}
+
+// renderNotifierTemplate renders tmpl for an alert, falling back to
+// messageTemplate when tmpl is nil and withAlertTemplate is set. It reports
+// false when there is no template, or it failed, and the built-in text
+// should be used.
+func renderNotifierTemplate(tmpl *template.Template, withAlertTemplate bool, data templateData) (string, bool) {
+	if tmpl == nil && withAlertTemplate {
+		tmpl = currentAlertTemplate()
+	}
+	if tmpl == nil {
+		return "", false
+	}
+	text, err := renderTemplate(tmpl, data)
+	if err != nil {
+		log.Printf("Error rendering %s template, using the default layout: %v\n", tmpl.Name(), err)
+		return "", false
+	}
+	return text, true
+}
+
+// templatedSummary lays out a summary notification with templates.summary,
+// reporting false when it isn't set or fails.
+func templatedSummary(title, text, notifier string) (string, bool) {
+	tmpl := currentNotifierTemplates().summary
+	if tmpl == nil {
+		return "", false
+	}
+	out, err := renderSummaryTemplate(tmpl, summaryData{Title: title, Text: text, Notifier: notifier})
+	if err != nil {
+		log.Printf("Error rendering the summary template, using the default layout: %v\n", err)
+		return "", false
+	}
+	return out, true
+}
+
+func renderSummaryTemplate(tmpl *template.Template, data summaryData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+func renderTemplate(tmpl *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
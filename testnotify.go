@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const testNotice = "This is a test alert sent by `sefi-alarm test-notify`, no action is needed."
+
+// testErrors are the synthetic errors of a test alert, one timeout and one
+// auth failure so the category, pattern and hint sections are rendered too.
+func testErrors(now time.Time) []ErrorLog {
+	errors := []ErrorLog{
+		{Error: "test-notify: context deadline exceeded (Client.Timeout exceeded while awaiting headers)", Timestamp: now.Add(-2 * time.Minute).Format(time.RFC3339)},
+		{Error: "test-notify: 401 Unauthorized", Timestamp: now.Add(-time.Minute).Format(time.RFC3339)},
+	}
+	for i := range errors {
+		errors[i].Category = classifyError(errors[i].Error)
+	}
+	return errors
+}
+
+// testResult is the outcome of sending the test alert to one notifier.
+type testResult struct {
+	Notifier string
+	Err      error
+}
+
+// testSend sends the test alert to one notifier.
+type testSend struct {
+	notifier string
+	kind     string // slack, github or events
+	send     func(ctx context.Context) error
+}
+
+// sendTestAlerts sends a synthetic alert for integrationID through every
+// configured notifier, formatted as a real one. The notifiers are sent to
+// concurrently, each within its notifierTimeoutSecs, and the results come
+// back in a fixed order. Nothing is recorded: no Slack thread is started, no
+// ticket is tracked and correlation events are resolved right away, so the
+// test doesn't affect later alerts.
+func sendTestAlerts(ctx context.Context, integrationID int) []testResult {
+	now := time.Now().UTC()
+	errors := testErrors(now)
+	payload := &Payload{IntegrationID: integrationID, Count: len(errors), Errors: errors}
+
+	message := createSlackMessage(errors, payload, integrationURL)
+	message.Text = testNotice + "\n" + message.Text
+	if len(message.Blocks) > 0 {
+		notice := SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: "_" + testNotice + "_"}}
+		message.Blocks = slices.Insert(message.Blocks, 1, notice)
+	}
+	slack := &Notification{
+		IntegrationID: integrationID,
+		Message:       message,
+		Variables:     workflowVariables(errors, payload, integrationURL),
+		Reason:        reasonThresholdExceeded,
+		QueuedAt:      now,
+	}
+	slack.Variables["text"] = message.Text
+
+	sends := []testSend{{
+		notifier: fmt.Sprintf("Slack (%s)", describeSlackDestination(message.Channel)),
+		kind:     notifierSlack,
+		send: func(ctx context.Context) error {
+			if err := slackRateLimit.wait(ctx); err != nil {
+				return err
+			}
+			if slackWorkflowMode() {
+				return sendSlackWorkflow(ctx, slack)
+			}
+			message := slack.Message
+			message.Metadata = slackMetadata(slack)
+			return sendSlackNotification(ctx, message)
+		},
+	}}
+
+	if githubEnabled() {
+		draft := createTicketDraft(errors, payload, integrationURL)
+		sends = append(sends, testSend{
+			notifier: "GitHub (" + githubRepo + ")",
+			kind:     notifierGitHub,
+			send: func(ctx context.Context) error {
+				request := map[string]interface{}{
+					"title": "[test] " + draft.Title,
+					"body":  testNotice + "\n\n" + draft.Body,
+				}
+				if len(githubLabels) > 0 {
+					request["labels"] = githubLabels
+				}
+				var issue githubIssue
+				if err := callGitHub(ctx, "POST", "/repos/"+githubRepo+"/issues", request, &issue); err != nil {
+					return err
+				}
+				// Close it straight away, it only shows the ticket would open.
+				return callGitHub(ctx, "PATCH", fmt.Sprintf("/repos/%s/issues/%d", githubRepo, issue.Number), map[string]interface{}{"state": "closed"}, &issue)
+			},
+		})
+	}
+
+	if correlationEnabled() {
+		tags := correlationEventTags(integrationID)
+		tags["category"] = dominantCategory(errors)
+		tags["test"] = "true"
+		event := &CorrelationEvent{
+			DedupKey:    correlationDedupKey(integrationID) + "/test",
+			Status:      "critical",
+			Reason:      reasonThresholdExceeded,
+			Summary:     "[test] Events forwarding errors on integration " + integrationLabel(integrationID),
+			Description: testNotice,
+			Tags:        tags,
+			At:          now,
+		}
+		sends = append(sends, testSend{
+			notifier: "event correlation (" + correlationFormat + ")",
+			kind:     notifierEvents,
+			send: func(ctx context.Context) error {
+				if err := sendCorrelationEvent(ctx, &Notification{Notifier: notifierEvents, IntegrationID: integrationID, Event: event, QueuedAt: now}); err != nil {
+					return err
+				}
+				resolved := *event
+				resolved.Status = "ok"
+				resolved.Reason = reasonRecovered
+				return sendCorrelationEvent(ctx, &Notification{Notifier: notifierEvents, IntegrationID: integrationID, Event: &resolved, QueuedAt: now})
+			},
+		})
+	}
+
+	results := make([]testResult, len(sends))
+	var wg sync.WaitGroup
+	for i, s := range sends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := ctx
+			if timeout := notifierTimeouts[s.kind]; timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			results[i] = testResult{Notifier: s.notifier, Err: s.send(ctx)}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// describeSlackDestination names where a Slack message goes.
+func describeSlackDestination(channel string) string {
+	switch {
+	case slackWorkflowMode():
+		return "workflow webhook"
+	case slackBotMode():
+		return "channel " + channel
+	default:
+		return "incoming webhook"
+	}
+}
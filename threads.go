@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const threadsFile = "threads.json"
+
+// In bot-token mode, repeated alerts for an integration are posted as replies
+// to the first alert of the incident. An incident ends once the integration
+// has been quiet for slackThreadQuietMins.
+var (
+	slackThreading       = conf.Bool("slackThreading", true)
+	slackThreadQuietTime = time.Duration(conf.Int("slackThreadQuietMins", 60)) * time.Minute
+)
+
+type incidentThread struct {
+	Channel   string    `json:"channel"`
+	TS        string    `json:"ts"`
+	StartedAt time.Time `json:"startedAt"`
+	LastAlert time.Time `json:"lastAlert"`
+}
+
+type incidentThreads struct {
+	mu      sync.Mutex
+	threads map[string]*incidentThread
+}
+
+var threads = loadIncidentThreads()
+
+func loadIncidentThreads() *incidentThreads {
+	t := &incidentThreads{threads: make(map[string]*incidentThread)}
+	if _, err := loadState(threadsFile, &t.threads); err != nil {
+		log.Printf("Error loading Slack threads, new alerts will start new threads: %v\n", err)
+	}
+	return t
+}
+
+func (t *incidentThreads) reload() {
+	threads := make(map[string]*incidentThread)
+	if _, err := loadState(threadsFile, &threads); err != nil {
+		log.Printf("Error reloading Slack threads: %v\n", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.threads = threads
+}
+
+// active returns the thread of the ongoing incident for integrationID, if the
+// previous alert is recent enough for at to belong to the same incident.
+func (t *incidentThreads) active(integrationID int, at time.Time) (*incidentThread, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	thread, ok := t.threads[strconv.Itoa(integrationID)]
+	if !ok || at.Sub(thread.LastAlert) > slackThreadQuietTime {
+		return nil, false
+	}
+	copied := *thread
+	return &copied, true
+}
+
+func (t *incidentThreads) record(integrationID int, thread incidentThread) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.threads[strconv.Itoa(integrationID)] = &thread
+	if err := saveState(threadsFile, t.threads); err != nil {
+		log.Printf("Error saving Slack threads: %v\n", err)
+	}
+}
+
+// sendThreaded sends n to Slack, threading it under the integration's ongoing
+// incident when the Web API is in use.
+func sendThreaded(ctx context.Context, n *Notification) error {
+	if webhook, ok := declaredWebhooks.get(n.IntegrationID); ok && n.IntegrationID != 0 {
+		return postDeclaredWebhook(ctx, webhook, n.Message)
+	}
+	if slackWorkflowMode() {
+		return sendSlackWorkflow(ctx, n)
+	}
+	message := n.Message
+	message.Metadata = slackMetadata(n)
+	if !slackBotMode() || !slackThreading || n.Unthreaded {
+		if n.Attachment == nil || !slackBotMode() {
+			return sendSlackNotification(ctx, message)
+		}
+		resp, err := postSlackMessage(ctx, message)
+		if err != nil {
+			return err
+		}
+		attachToMessage(ctx, n, resp.Channel, resp.TS)
+		return nil
+	}
+
+	thread, ongoing := threads.active(n.IntegrationID, n.QueuedAt)
+	if ongoing {
+		message.Channel = thread.Channel
+		message.ThreadTS = thread.TS
+	}
+
+	resp, err := postSlackMessage(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	if n.Attachment != nil {
+		ts := resp.TS
+		if ongoing {
+			ts = thread.TS
+		}
+		attachToMessage(ctx, n, resp.Channel, ts)
+	}
+	if ongoing {
+		thread.LastAlert = n.QueuedAt
+		threads.record(n.IntegrationID, *thread)
+	} else {
+		threads.record(n.IntegrationID, incidentThread{
+			Channel:   resp.Channel,
+			TS:        resp.TS,
+			StartedAt: n.QueuedAt,
+			LastAlert: n.QueuedAt,
+		})
+	}
+	return nil
+}
+
+// attachToMessage shares the attachment of n in the thread at ts, the alert
+// message or the incident thread it replied to. The alert itself
+// went out, so a failed upload is only logged rather than retried.
+func attachToMessage(ctx context.Context, n *Notification, channel, ts string) {
+	if err := uploadSlackFile(ctx, channel, ts, *n.Attachment); err != nil {
+		log.Printf("Error attaching %s to the alert for integration %d: %v\n", n.Attachment.Filename, n.IntegrationID, err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound notifications go through token buckets: one for every notifier
+// together, set by rateLimit.perMinute and rateLimit.burst, and one per
+// notifier under rateLimit.notifiers:
+//
+//	rateLimit:
+//	  perMinute: 60
+//	  notifiers:
+//	    slack:
+//	      perMinute: 20
+//	      burst: 10
+//
+// Burst defaults to perMinute. A notification finding a bucket empty is held
+// back, and the held back notifications of each destination are sent to it
+// as one summary once a token is free again, or when the queue drains on
+// shutdown. Off unless perMinute is set.
+var throttle = loadThrottle()
+
+// errThrottled is returned for a notification held back by the rate limit.
+var errThrottled = errors.New("held back by the rate limit")
+
+var throttledTotal = metrics.newCounter("sefi_notifications_throttled_total",
+	"Notifications held back by the outbound rate limit, by notifier.", "notifier")
+
+// tokenBucket refills rate tokens per second up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &tokenBucket{rate: float64(perMinute) / 60, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// overflow are the notifications held back for one destination: a notifier,
+// and for Slack a channel.
+type overflow struct {
+	kind         string
+	notifier     string
+	channel      string
+	since        time.Time
+	count        int
+	integrations map[int]int
+}
+
+type throttler struct {
+	mu        sync.Mutex
+	global    *tokenBucket
+	notifiers map[string]*tokenBucket
+	held      map[string]*overflow
+}
+
+func loadThrottle() *throttler {
+	t := &throttler{notifiers: make(map[string]*tokenBucket), held: make(map[string]*overflow)}
+	if perMinute := conf.Int("rateLimit.perMinute", 0); perMinute > 0 {
+		t.global = newTokenBucket(perMinute, conf.Int("rateLimit.burst", 0))
+	}
+	v, ok := conf.Lookup("rateLimit.notifiers")
+	if !ok {
+		return t
+	}
+	section, ok := asSection(v)
+	if !ok {
+		addConfigProblem("rateLimit.notifiers must map notifiers to perMinute and burst")
+		return t
+	}
+	for name, value := range section {
+		if name != notifierSlack && name != notifierGitHub && name != notifierEvents {
+			addConfigProblem("rateLimit.notifiers has an unknown notifier %q, use slack, github or events", name)
+			continue
+		}
+		entry, ok := asSection(value)
+		if !ok || configMap(entry).Int("perMinute", 0) <= 0 {
+			addConfigProblem("rateLimit.notifiers.%s must set a positive perMinute", name)
+			continue
+		}
+		t.notifiers[name] = newTokenBucket(configMap(entry).Int("perMinute", 0), configMap(entry).Int("burst", 0))
+	}
+	return t
+}
+
+func (t *throttler) enabled() bool {
+	return t.global != nil || len(t.notifiers) > 0
+}
+
+// bucketsLocked returns the buckets deliveries of notifier take from.
+func (t *throttler) bucketsLocked(notifier string) []*tokenBucket {
+	var buckets []*tokenBucket
+	if t.global != nil {
+		buckets = append(buckets, t.global)
+	}
+	if b, ok := t.notifiers[notifier]; ok {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// takeLocked takes a token from every bucket of notifier, or from none when
+// one of them is empty.
+func (t *throttler) takeLocked(notifier string, now time.Time) bool {
+	buckets := t.bucketsLocked(notifier)
+	for _, b := range buckets {
+		b.refill(now)
+		if b.tokens < 1 {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true
+}
+
+// allow reports whether n may be delivered now, holding it back for the
+// summary of its destination otherwise. Summaries themselves always go out.
+func (t *throttler) allow(n *Notification, now time.Time) bool {
+	if !t.enabled() || n.Reason == reasonRateLimited {
+		return true
+	}
+	notifier := notifierKind(n)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.takeLocked(notifier, now) {
+		return true
+	}
+
+	channel := ""
+	if notifier == notifierSlack {
+		channel = n.Message.Channel
+	}
+	key := notifier + " " + channel
+	o, ok := t.held[key]
+	if !ok {
+		o = &overflow{kind: notifier, notifier: notifierName(n), channel: channel, since: now, integrations: make(map[int]int)}
+		t.held[key] = o
+	}
+	o.count++
+	o.integrations[n.IntegrationID]++
+	throttledTotal.inc(notifier)
+	return false
+}
+
+// flush queues the summary of every destination whose notifier has a token
+// again.
+func (t *throttler) flush(now time.Time) {
+	for _, n := range t.summaries(now, false) {
+		notifications.enqueue(n)
+	}
+}
+
+// summaries takes the summaries of the held back notifications, only of the
+// destinations with a token again unless all is set.
+func (t *throttler) summaries(now time.Time, all bool) []*Notification {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make([]string, 0, len(t.held))
+	for key := range t.held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var out []*Notification
+	for _, key := range keys {
+		notifier, _, _ := strings.Cut(key, " ")
+		if !all && !t.takeLocked(notifier, now) {
+			continue
+		}
+		o := t.held[key]
+		delete(t.held, key)
+		out = append(out, o.summary(now))
+	}
+	return out
+}
+
+// summary is the notification standing for the held back notifications, for
+// the notifier they were held back from.
+func (o *overflow) summary(now time.Time) *Notification {
+	ids := make([]int, 0, len(o.integrations))
+	for id := range o.integrations {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		lines = append(lines, fmt.Sprintf("• %s: %s", integrationLabel(id), formatCount(int64(o.integrations[id]))))
+	}
+
+	title := "Notifications held back by the rate limit"
+	text := fmt.Sprintf("%s %s notifications were not sent in the last %s, by integration:\n%s",
+		formatCount(int64(o.count)), o.notifier, formatDuration(now.Sub(o.since)), strings.Join(lines, "\n"))
+	log.Printf("%s for %s: %d notifications\n", title, o.notifier, o.count)
+	templated, ok := templatedSummary(title, text, o.kind)
+	if ok {
+		text = templated
+	}
+	switch o.kind {
+	case notifierGitHub:
+		return &Notification{
+			Notifier: notifierGitHub,
+			Ticket:   &TicketDraft{Title: title, Body: text},
+			Reason:   reasonRateLimited,
+			QueuedAt: now,
+		}
+	case notifierEvents:
+		tags := correlationEventTags(0)
+		delete(tags, "integration_id")
+		tags["severity"] = severityWarning
+		return &Notification{
+			Notifier: notifierEvents,
+			Reason:   reasonRateLimited,
+			Event: &CorrelationEvent{
+				DedupKey:    fmt.Sprintf("sefi-alarm/%s/rate-limit", tenantID),
+				Status:      "warning",
+				Reason:      reasonRateLimited,
+				Summary:     title,
+				Description: text,
+				Tags:        tags,
+				At:          now,
+			},
+			QueuedAt: now,
+		}
+	}
+	message := SlackMessage{Channel: o.channel, Text: text}
+	if !ok {
+		message.Text = title + "\n" + text
+		message.Blocks = []SlackBlock{
+			{Type: "header", Text: &SlackText{Type: "plain_text", Text: title}},
+			{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: text}},
+		}
+	}
+	return &Notification{
+		Message:    message,
+		Reason:     reasonRateLimited,
+		Unthreaded: true,
+		QueuedAt:   now,
+	}
+}
+
+func throttleLoop(ctx context.Context) {
+	if !throttle.enabled() {
+		return
+	}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			throttle.flush(time.Now().UTC())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ticketsFile = "tickets.json"
+
+// TicketDraft is the content of a ticket a tracker notifier should open.
+type TicketDraft struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Ticket links an alert to the external artifact a notifier created for it.
+// Its status is refreshed periodically so the dashboard shows whether the
+// downstream ticket was resolved.
+type Ticket struct {
+	Notifier      string     `json:"notifier"`
+	ExternalID    string     `json:"externalId"`
+	URL           string     `json:"url"`
+	IntegrationID int        `json:"integrationId"`
+	Title         string     `json:"title"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	Status        string     `json:"status"`
+	ResolvedAt    *time.Time `json:"resolvedAt,omitempty"`
+	CheckedAt     time.Time  `json:"checkedAt"`
+}
+
+func (t *Ticket) resolved() bool {
+	return t.ResolvedAt != nil
+}
+
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets []*Ticket
+}
+
+var tickets = loadTickets()
+
+var ticketStatusInterval = time.Duration(conf.Int("tickets.statusPollMins", 10)) * time.Minute
+
+func loadTickets() *ticketStore {
+	t := &ticketStore{}
+	if _, err := loadState(ticketsFile, &t.tickets); err != nil {
+		log.Printf("Error loading tickets: %v\n", err)
+	}
+	return t
+}
+
+func (t *ticketStore) reload() {
+	var tickets []*Ticket
+	if _, err := loadState(ticketsFile, &tickets); err != nil {
+		log.Printf("Error reloading tickets: %v\n", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tickets = tickets
+}
+
+func (t *ticketStore) saveLocked() {
+	if err := saveState(ticketsFile, t.tickets); err != nil {
+		log.Printf("Error saving tickets: %v\n", err)
+	}
+}
+
+func (t *ticketStore) add(ticket *Ticket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tickets = append(t.tickets, ticket)
+	t.saveLocked()
+}
+
+// hasOpen reports whether notifier has an unresolved ticket for integrationID.
+func (t *ticketStore) hasOpen(notifier string, integrationID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ticket := range t.tickets {
+		if ticket.Notifier == notifier && ticket.IntegrationID == integrationID && !ticket.resolved() {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns copies of all tickets, newest first.
+func (t *ticketStore) list() []Ticket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Ticket, len(t.tickets))
+	for i, ticket := range t.tickets {
+		out[i] = *ticket
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (t *ticketStore) unresolved() []*Ticket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []*Ticket
+	for _, ticket := range t.tickets {
+		if !ticket.resolved() {
+			out = append(out, ticket)
+		}
+	}
+	return out
+}
+
+func (t *ticketStore) update(ticket *Ticket, status string, resolved bool, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if resolved && ticket.ResolvedAt == nil {
+		ticket.ResolvedAt = &at
+		log.Printf("%s ticket %s for integration %d was resolved.\n", ticket.Notifier, ticket.ExternalID, ticket.IntegrationID)
+	}
+	ticket.Status = status
+	ticket.CheckedAt = at
+	t.saveLocked()
+}
+
+// ticketStatusLoop backfills the status of unresolved tickets.
+func ticketStatusLoop(ctx context.Context) {
+	if !githubEnabled() {
+		return
+	}
+
+	ticker := time.NewTicker(ticketStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if role.isStandby() {
+			continue
+		}
+
+		for _, ticket := range tickets.unresolved() {
+			if ticket.Notifier != notifierGitHub {
+				continue
+			}
+			status, resolved, err := gitHubIssueStatus(ctx, ticket.ExternalID)
+			if err != nil {
+				log.Printf("Error checking %s ticket %s: %v\n", ticket.Notifier, ticket.ExternalID, err)
+				continue
+			}
+			tickets.update(ticket, status, resolved, time.Now().UTC())
+		}
+	}
+}
+
+func handleTickets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, tickets.list())
+}
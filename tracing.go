@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With tracing.endpoint set, polls and deliveries are traced with
+// OpenTelemetry spans sent to an OTLP/HTTP collector (<endpoint>/v1/traces,
+// JSON encoded): each poll is a trace with one span per integration, its
+// fetch attempts, filtering and notifying. Deliveries happen later on the
+// notification workers and are linked to the poll that queued them through
+// the traceparent kept with each notification.
+var (
+	tracingEndpoint    = strings.TrimSuffix(conf.String("tracing.endpoint", ""), "/")
+	tracingHeaders     = conf.StringMap("tracing.headers")
+	tracingServiceName = conf.String("tracing.serviceName", "sefi-alarm")
+	tracingInterval    = time.Duration(conf.Int("tracing.intervalSecs", 5)) * time.Second
+)
+
+// maxBufferedSpans bounds the spans kept while the collector is unreachable.
+const maxBufferedSpans = 4096
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+type traceSpan struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span, child of the one in ctx if any. It returns nil
+// when tracing is off; the methods of a nil span do nothing.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	if tracingEndpoint == "" {
+		return ctx, nil
+	}
+	s := &traceSpan{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanContextKey{}).(*traceSpan); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (s *traceSpan) set(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+// finish ends the span, failed if err is set, and queues it for export.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	spans.add(s)
+}
+
+// traceparent renders the span in ctx as a W3C traceparent header.
+func traceparent(ctx context.Context) string {
+	s, ok := ctx.Value(spanContextKey{}).(*traceSpan)
+	if !ok {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// withTraceparent continues the trace of a traceparent header in ctx.
+func withTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	s := &traceSpan{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+type spanBuffer struct {
+	mu      sync.Mutex
+	spans   []*traceSpan
+	dropped int
+}
+
+var spans = &spanBuffer{}
+
+func (b *spanBuffer) add(s *traceSpan) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.spans) >= maxBufferedSpans {
+		b.dropped++
+		return
+	}
+	b.spans = append(b.spans, s)
+}
+
+// flush exports the buffered spans. They are kept for the next flush when
+// the collector can't be reached.
+func (b *spanBuffer) flush(ctx context.Context) {
+	b.mu.Lock()
+	pending := b.spans
+	dropped := b.dropped
+	b.spans = nil
+	b.dropped = 0
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Dropped %d trace spans, the buffer was full.\n", dropped)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if err := exportSpans(ctx, pending); err != nil {
+		log.Printf("Error exporting %d trace spans: %v\n", len(pending), err)
+		b.mu.Lock()
+		b.spans = append(pending, b.spans...)
+		if len(b.spans) > maxBufferedSpans {
+			b.spans = b.spans[len(b.spans)-maxBufferedSpans:]
+		}
+		b.mu.Unlock()
+	}
+}
+
+func traceExportLoop(ctx context.Context) {
+	if tracingEndpoint == "" {
+		return
+	}
+
+	ticker := time.NewTicker(tracingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			spans.flush(ctx)
+		}
+	}
+}
+
+// flushTraces exports what is left on shutdown.
+func flushTraces() {
+	if tracingEndpoint == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	spans.flush(ctx)
+}
+
+func exportSpans(ctx context.Context, pending []*traceSpan) error {
+	return postOTLP(ctx, tracingEndpoint+"/v1/traces", tracingHeaders, encodeSpans(pending))
+}
+
+// postOTLP sends an OTLP/HTTP export request in its JSON encoding.
+func postOTLP(ctx context.Context, url string, headers map[string]string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("OTLP export failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// encodeSpans builds an OTLP ExportTraceServiceRequest in its JSON mapping,
+// where IDs are hex and 64-bit integers are strings.
+func encodeSpans(pending []*traceSpan) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(pending))
+	for _, s := range pending {
+		attributes := make([]map[string]interface{}, 0, len(s.attributes))
+		for key, value := range s.attributes {
+			attributes = append(attributes, otlpAttribute(key, value))
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            map[string]interface{}{"code": spanStatusOK},
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+		}
+		encoded = append(encoded, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": otlpResource(),
+			"scopeSpans": []map[string]interface{}{{
+				"scope": otlpScope(),
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+// otlpResource describes this instance to the collector.
+func otlpResource() map[string]interface{} {
+	attributes := []map[string]interface{}{
+		otlpAttribute("service.name", tracingServiceName),
+		otlpAttribute("service.version", version),
+		otlpAttribute("service.instance.id", instanceID),
+	}
+	if pod.detected() {
+		attributes = append(attributes, otlpAttribute("k8s.pod.name", pod.Name))
+	}
+	if pod.Namespace != "" {
+		attributes = append(attributes, otlpAttribute("k8s.namespace.name", pod.Namespace))
+	}
+	return map[string]interface{}{"attributes": attributes}
+}
+
+func otlpScope() map[string]interface{} {
+	return map[string]interface{}{"name": "sefi-alarm", "version": version}
+}
+
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+)
+
+// Errors whose timestamp doesn't parse, even in the fallback formats of
+// sysdig.ParseTimestamp, can't be placed in the poll window. Rather than
+// being dropped they are alerted on flagged, once: they are remembered by
+// timestamp and message, so the following polls returning them again don't
+// alert. The memory doesn't survive restarts.
+type unparsedErrors struct {
+	mu   sync.Mutex
+	seen map[int]map[string]bool
+}
+
+// maxUnparsedRemembered bounds the errors remembered per integration; past
+// it the memory starts over.
+const maxUnparsedRemembered = 1000
+
+var unparsed = &unparsedErrors{seen: make(map[int]map[string]bool)}
+
+var unparsableTimestamps = metrics.newCounter("sefi_unparsable_timestamps_total",
+	"Errors whose timestamp couldn't be parsed, alerted on flagged.", "integration_id")
+
+// fresh returns the errors of errs not returned before, flagged.
+func (u *unparsedErrors) fresh(integrationID int, errs []ErrorLog) []ErrorLog {
+	if len(errs) == 0 {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	seen := u.seen[integrationID]
+	if seen == nil || len(seen) >= maxUnparsedRemembered {
+		seen = make(map[string]bool)
+		u.seen[integrationID] = seen
+	}
+	var fresh []ErrorLog
+	for _, e := range errs {
+		key := e.Timestamp + "\x00" + e.Error
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		log.Printf("Error parsing timestamp %q of an error on integration %d, alerting on it flagged.\n", e.Timestamp, integrationID)
+		unparsableTimestamps.inc(strconv.Itoa(integrationID))
+		e.InvalidTimestamp = true
+		fresh = append(fresh, e)
+	}
+	return fresh
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const releasesURL = "https://api.github.com/repos/jcotoBan/SEFI-Alarm/releases/latest"
+
+// The update check only reports newer releases in the logs and the health
+// endpoint; it never downloads or installs anything.
+var (
+	updateCheckEnabled  = conf.Bool("updateCheck.enabled", false)
+	updateCheckInterval = time.Duration(conf.Int("updateCheck.intervalHours", 24)) * time.Hour
+)
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+}
+
+func updateCheckLoop(ctx context.Context) {
+	if !updateCheckEnabled {
+		return
+	}
+
+	for {
+		checkForUpdate(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(updateCheckInterval):
+		}
+	}
+}
+
+func checkForUpdate(ctx context.Context) {
+	release, err := fetchLatestRelease(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error checking for updates: %v\n", err)
+		}
+		return
+	}
+
+	if newerVersion(release.TagName, version) {
+		log.Printf("A newer version of SEFI-Alarm is available: %s (running %s). Release notes: %s\n", release.TagName, version, release.HTMLURL)
+		status.updateAvailable(release.TagName)
+	}
+}
+
+func fetchLatestRelease(ctx context.Context) (*githubRelease, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", releasesURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest release: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to parse release: %v", err)
+	}
+	return &release, nil
+}
+
+// newerVersion reports whether latest is a higher vMAJOR.MINOR.PATCH than
+// current. Development builds never report updates.
+func newerVersion(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	// Ignore pre-release and build suffixes such as "-rc1" or "+abc".
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
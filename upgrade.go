@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+// Sending SIGUSR2 upgrades the running binary in place, for hosts without an
+// orchestrator. The binary at the same path is started with the API listener
+// inherited and waits on standby while this process stops polling, drains
+// its notifications and exits. The new process then reloads the state left
+// behind and takes over; the one-minute lookback of each poll covers the
+// drain. If the new process does not come up, this one keeps running.
+const upgradeEnv = "SEFI_UPGRADE"
+
+// upgradeHandover is what a process started by an upgrade inherits from the
+// one it replaces.
+type upgradeHandover struct {
+	// active is whether the old process was polling, rather than on standby.
+	active bool
+	// ready is written to once the new process serves. parent reads EOF once
+	// the old process exited.
+	ready, parent *os.File
+	listener      net.Listener
+}
+
+// handover is set in a process started by an upgrade.
+var handover = inheritedHandover()
+
+// startedByUpgrade reports whether this process replaces one that was
+// polling, so it has to wait for it before polling too.
+func startedByUpgrade() bool {
+	return handover != nil && handover.active
+}
+
+// awaitParent tells the old process this one is ready and takes over once it
+// exited.
+func (h *upgradeHandover) awaitParent() {
+	if _, err := fmt.Fprintln(h.ready, "ready"); err != nil {
+		log.Printf("Error signalling the previous process: %v\n", err)
+	}
+	h.ready.Close()
+	go func() {
+		var buf [1]byte
+		for {
+			if _, err := h.parent.Read(buf[:]); err != nil {
+				break
+			}
+		}
+		h.parent.Close()
+		startDebugServer()
+		// With leader election the new process waits for the lease instead.
+		if h.active && !leaderElectionEnabled {
+			role.takeOver("the previous process exited after an upgrade")
+		}
+	}()
+}
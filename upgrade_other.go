@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// In-place upgrades need SIGUSR2 and inherited file descriptors, which only
+// Unix has.
+
+func upgradeSignals() <-chan os.Signal { return nil }
+
+func inheritedHandover() *upgradeHandover { return nil }
+
+func upgrade(listener net.Listener) error {
+	return fmt.Errorf("in-place upgrades are not supported on this platform")
+}
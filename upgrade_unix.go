@@ -0,0 +1,142 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	upgradeReadyTimeout = time.Minute
+	// upgradeListenerEnv is set to the address of the API listener when
+	// it is handed over.
+	upgradeListenerEnv = "SEFI_UPGRADE_LISTENER"
+)
+
+// File descriptors of the new process, after stdin, stdout and stderr.
+const (
+	upgradeReadyFD = 3 + iota
+	upgradeParentFD
+	upgradeListenerFD
+)
+
+func upgradeSignals() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	return c
+}
+
+func inheritedHandover() *upgradeHandover {
+	previous := os.Getenv(upgradeEnv)
+	if previous == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	h := &upgradeHandover{
+		active: previous == "active",
+		ready:  os.NewFile(upgradeReadyFD, "upgrade-ready"),
+		parent: os.NewFile(upgradeParentFD, "upgrade-parent"),
+	}
+	if address := os.Getenv(upgradeListenerEnv); address != "" {
+		os.Unsetenv(upgradeListenerEnv)
+		f := os.NewFile(upgradeListenerFD, "api-listener")
+		listener, err := net.FileListener(f)
+		f.Close()
+		switch {
+		case err != nil:
+			log.Printf("Error inheriting the API listener on %s: %v\n", address, err)
+		case address != apiListen:
+			// apiListen changed with the upgrade, listen there instead.
+			listener.Close()
+		default:
+			h.listener = listener
+		}
+	}
+	return h
+}
+
+// upgrade starts the binary again with listener and waits until it is ready.
+func upgrade(listener net.Listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the binary: %v", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	parentR, parentW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, readyW, parentR}
+	env := append(os.Environ(), upgradeEnv+"="+role.name())
+
+	if listener != nil {
+		var f *os.File
+		switch l := listener.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			// The old process must leave the socket file to the new one.
+			l.SetUnlinkOnClose(false)
+			f, err = l.File()
+		default:
+			err = fmt.Errorf("cannot hand over a %T", listener)
+		}
+		if err != nil {
+			readyW.Close()
+			parentR.Close()
+			parentW.Close()
+			return fmt.Errorf("failed to hand over the API listener: %v", err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		env = append(env, upgradeListenerEnv+"="+apiListen)
+	}
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	readyW.Close()
+	parentR.Close()
+	if err != nil {
+		parentW.Close()
+		return fmt.Errorf("failed to start %s: %v", executable, err)
+	}
+	log.Printf("Started %s as process %d, waiting for it to be ready.\n", executable, process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := bufio.NewReader(readyR).ReadString('\n')
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("not ready after %s", upgradeReadyTimeout)
+	}
+	if err != nil {
+		process.Kill()
+		process.Release()
+		parentW.Close()
+		return fmt.Errorf("new process failed to start: %v", err)
+	}
+	process.Release()
+
+	// parentW stays open until this process exits, which tells the new one
+	// to take over.
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// slackWebhookFormat "workflow" posts flat key/value variables instead of a
+// message, for webhooks created in Slack Workflow Builder. Workflow steps can
+// then use the variables to open tickets or page someone. Every variable is
+// always sent, empty when it doesn't apply, as workflows reject payloads that
+// miss a declared variable.
+var slackWebhookFormat = conf.String("slackWebhookFormat", "message")
+
+var workflowVariableNames = []string{
+	"title", "text", "integration_id", "integration_name", "integration_type", "tenant_id", "region",
+	"recent_errors", "total_errors", "errors", "category", "pattern", "hint", "integration_url", "mentions", "pod", "reason", "owner", "severity",
+}
+
+func slackWorkflowMode() bool {
+	return slackWebhookFormat == "workflow" && !slackBotMode()
+}
+
+func workflowVariables(errors []ErrorLog, payload *Payload, integrationUrl string) map[string]string {
+	lines := make([]string, len(errors))
+	for i, err := range errors {
+		lines[i] = err.Error
+	}
+	integration, _ := integrationMeta.get(payload.IntegrationID)
+	return map[string]string{
+		"title":            "Events forwarding errors on integration " + integrationLabel(payload.IntegrationID),
+		"integration_id":   fmt.Sprintf("%d", payload.IntegrationID),
+		"integration_name": integration.Name,
+		"integration_type": integration.Type,
+		"tenant_id":        tenantID,
+		"region":           region,
+		"recent_errors":    fmt.Sprintf("%d", len(errors)),
+		"total_errors":     fmt.Sprintf("%d", payload.Count),
+		"errors":           strings.Join(lines, "\n"),
+		"category":         dominantCategory(errors),
+		"pattern":          failurePattern(payload.Errors),
+		"hint":             remediationHint(dominantCategory(errors)),
+		"integration_url":  integrationUrl + fmt.Sprintf("%d", payload.IntegrationID),
+		"mentions":         mentionText(routedMentions(errors, payload)),
+		"owner":            ownerTeam(payload.IntegrationID),
+		"severity":         alertSeverity(errors, payload),
+	}
+}
+
+// sendSlackWorkflow posts the variables of n. Notifications without any, such
+// as digests and self-alerts, only fill in title and text.
+func sendSlackWorkflow(ctx context.Context, n *Notification) error {
+	vars := make(map[string]string, len(workflowVariableNames))
+	for _, name := range workflowVariableNames {
+		vars[name] = ""
+	}
+	title, _, _ := strings.Cut(n.Message.Text, "\n")
+	vars["title"] = title
+	vars["text"] = n.Message.Text
+	vars["reason"] = n.Reason
+	if pod.detected() {
+		vars["pod"] = pod.String()
+	}
+	for name, value := range n.Variables {
+		vars[name] = value
+	}
+	return postSlackWebhook(ctx, vars)
+}